@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	// maxRequestIDLength bounds the request ids taken from clients, longer
+	// ones are replaced.
+	maxRequestIDLength = 128
+)
+
+type requestIDKey struct{}
+
+func contextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFrom(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+// validRequestID accepts ids of printable ASCII, so they can not forge log
+// lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDHandler adds the request id of the context to the records it
+// passes to the wrapped handler, so logs of the datastore made on behalf of
+// a request tell which one.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := requestIDFrom(ctx); ok {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// accessLog logs a line per request of the routes of a mux.Router, it is to
+// be passed to Router.Use. Requests keep the id of the X-Request-ID header,
+// set by the API server or the balancer, or get a new one; the id is
+// answered in the same header and is in the context of the request. A nil
+// logger logs nothing, requests still get their ids. Lines of mutating
+// requests name the principal they are attributed to.
+func accessLog(logger *slog.Logger, ids *ulidGenerator) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			id := req.Header.Get(requestIDHeader)
+			if !validRequestID(id) {
+				var err error
+				if id, err = ids.New(); err != nil {
+					internalError(rw, err)
+					return
+				}
+			}
+			rw.Header().Set(requestIDHeader, id)
+			lrw := &loggingResponseWriter{ResponseWriter: rw}
+			var principal string
+			req = req.WithContext(withPrincipalSlot(contextWithRequestID(req.Context(), id), &principal))
+			next.ServeHTTP(lrw, req)
+			if logger == nil {
+				return
+			}
+
+			route := "unknown"
+			if r := mux.CurrentRoute(req); r != nil {
+				if tmpl, err := r.GetPathTemplate(); err == nil {
+					route = tmpl
+				}
+			}
+			if lrw.status == 0 {
+				lrw.status = http.StatusOK
+			}
+			attrs := []slog.Attr{
+				slog.String("request_id", id),
+				slog.String("method", req.Method),
+				slog.String("route", route),
+				slog.Int("status", lrw.status),
+				slog.Duration("latency", time.Since(start)),
+				slog.Int64("bytes", lrw.bytes),
+			}
+			if key, ok := mux.Vars(req)["key"]; ok {
+				attrs = append(attrs, slog.String("key", key))
+			}
+			if isWrite(req) {
+				if principal == "" {
+					principal = anonymousUser
+				}
+				attrs = append(attrs, slog.String("principal", principal))
+			}
+			logger.LogAttrs(req.Context(), slog.LevelInfo, "request", attrs...)
+		})
+	}
+}
+
+// loggingResponseWriter records the status and the body size of responses.
+// Streaming handlers find the Flusher of the wrapped writer, raw values its
+// io.ReaderFrom, and http.ResponseController the writer itself by Unwrap.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom copies r by the io.ReaderFrom of the wrapped writer if it has
+// one, so sendfile is not lost behind the log.
+func (w *loggingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, r)
+	}
+	w.bytes += n
+	return n, err
+}
+
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
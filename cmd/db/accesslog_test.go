@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessLog(t *testing.T) {
+	var out bytes.Buffer
+	var seen string
+	router := mux.NewRouter()
+	router.Use(accessLog(slog.New(slog.NewJSONHandler(&out, nil)), newUlidGenerator()))
+	router.HandleFunc("/db/{key}", func(rw http.ResponseWriter, req *http.Request) {
+		seen, _ = requestIDFrom(req.Context())
+		rw.WriteHeader(http.StatusCreated)
+		_, _ = rw.Write([]byte("value"))
+	})
+
+	type line struct {
+		Msg       string `json:"msg"`
+		RequestId string `json:"request_id"`
+		Method    string `json:"method"`
+		Route     string `json:"route"`
+		Key       string `json:"key"`
+		Status    int    `json:"status"`
+		Bytes     int64  `json:"bytes"`
+		Latency   int64  `json:"latency"`
+		Principal string `json:"principal"`
+	}
+	do := func(id string) (*httptest.ResponseRecorder, line) {
+		out.Reset()
+		req := httptest.NewRequest(http.MethodPost, "/db/key1", nil)
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var l line
+		assert.Nil(t, json.Unmarshal(out.Bytes(), &l), out.String())
+		return rec, l
+	}
+
+	rec, l := do("req-1")
+	assert.Equal(t, "req-1", rec.Header().Get(requestIDHeader))
+	assert.Equal(t, "req-1", seen)
+	assert.Equal(t, line{Msg: "request", RequestId: "req-1", Method: http.MethodPost, Route: "/db/{key}",
+		Key: "key1", Status: http.StatusCreated, Bytes: 5, Latency: l.Latency, Principal: anonymousUser}, l)
+
+	for _, id := range []string{"", "forged\nline"} {
+		rec, l = do(id)
+		generated := rec.Header().Get(requestIDHeader)
+		assert.Len(t, generated, 26, id)
+		assert.Equal(t, generated, l.RequestId, id)
+		assert.Equal(t, generated, seen, id)
+	}
+}
+
+func TestAccessLog_Principal(t *testing.T) {
+	var out bytes.Buffer
+	router := mux.NewRouter()
+	router.Use(accessLog(slog.New(slog.NewJSONHandler(&out, nil)), newUlidGenerator()))
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(rw, withPrincipal(req, keyID("writer")))
+		})
+	})
+	router.HandleFunc("/db/{key}", func(rw http.ResponseWriter, _ *http.Request) {})
+
+	logged := func(method string) map[string]interface{} {
+		out.Reset()
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/db/key1", nil))
+		var record map[string]interface{}
+		assert.Nil(t, json.Unmarshal(out.Bytes(), &record), out.String())
+		return record
+	}
+	assert.Equal(t, keyID("writer"), logged(http.MethodPut)["principal"])
+	assert.Equal(t, keyID("writer"), logged(http.MethodDelete)["principal"])
+	// Reads are not attributed.
+	assert.NotContains(t, logged(http.MethodGet), "principal")
+}
+
+func TestRequestIDHandler(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(requestIDHandler{slog.NewJSONHandler(&out, nil)}).With("component", "datastore")
+	logger.WarnContext(contextWithRequestID(context.Background(), "req-1"), "slow put")
+
+	var record map[string]interface{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &record))
+	assert.Equal(t, "req-1", record["request_id"])
+	assert.Equal(t, "datastore", record["component"])
+}
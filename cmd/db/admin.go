@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/Gopack-go-labs/labs4-5/datastore/replication"
+	"github.com/Gopack-go-labs/labs4-5/export"
+)
+
+type OptionsBody struct {
+	// MaxSegmentSize is in bytes.
+	MaxSegmentSize        int64 `json:"max_segment_size"`
+	SegmentMergeThreshold int   `json:"segment_merge_threshold"`
+	// CompactionRate is in bytes per second, zero for no limit.
+	CompactionRate int64 `json:"compaction_rate"`
+}
+
+func optionsBody(opts datastore.Options) OptionsBody {
+	return OptionsBody{
+		MaxSegmentSize:        opts.MaxSegmentSize.Bytes(),
+		SegmentMergeThreshold: opts.SegmentMergeThreshold,
+		CompactionRate:        opts.CompactionRate.Bytes(),
+	}
+}
+
+func optionsHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPut {
+			// Omitted fields keep their current values.
+			body := optionsBody(db.Options())
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				badRequest(rw, fmt.Errorf("malformed body: %w", err))
+				return
+			}
+
+			err := db.SetOptions(datastore.Options{
+				MaxSegmentSize:        datastore.FromBytes(body.MaxSegmentSize),
+				SegmentMergeThreshold: body.SegmentMergeThreshold,
+				CompactionRate:        datastore.FromBytes(body.CompactionRate),
+			})
+			if err != nil {
+				badRequest(rw, err)
+				return
+			}
+		}
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(optionsBody(db.Options()))
+	}
+}
+
+type StatusRes struct {
+	Version string          `json:"version"`
+	Role    string          `json:"role"`
+	Stats   datastore.Stats `json:"stats"`
+	Options OptionsBody     `json:"options"`
+	// ReadOnly is set for a db started with -read-only.
+	ReadOnly bool `json:"read_only,omitempty"`
+	// BackgroundError is the latest error of background compaction.
+	BackgroundError string `json:"background_error,omitempty"`
+}
+
+const (
+	roleLeader   = "leader"
+	roleFollower = "follower"
+)
+
+// following reports whether the db replicates a leader and rejects writes.
+// follower is nil unless the service was started with -follow.
+func following(follower *replication.Follower) bool {
+	return follower != nil && follower.Following()
+}
+
+func statusHandler(db *datastore.Db, follower *replication.Follower, readOnly bool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, _ *http.Request) {
+		role := roleLeader
+		if following(follower) {
+			role = roleFollower
+		}
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		res := StatusRes{
+			Version:  version,
+			Role:     role,
+			ReadOnly: readOnly,
+			Stats:    db.Stats(),
+			Options:  optionsBody(db.Options()),
+		}
+		if err := db.Err(); err != nil {
+			res.BackgroundError = err.Error()
+		}
+		_ = json.NewEncoder(rw).Encode(res)
+	}
+}
+
+// statsHandler serves the Stats of the db alone, lighter than /status.
+func statsHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(db.Stats())
+	}
+}
+
+// promoteHandler stops following the leader, the db accepts writes
+// afterwards. A db that does not follow responds with 409.
+func promoteHandler(follower *replication.Follower, usage *UsageTracker) http.HandlerFunc {
+	return func(rw http.ResponseWriter, _ *http.Request) {
+		if follower == nil || !follower.Promote() {
+			writeError(rw, http.StatusConflict, codeConflict, "the db does not follow a leader")
+			return
+		}
+		if err := usage.Reload(); err != nil {
+			log.Printf("Failed to reload usage: %s", err)
+		}
+		usage.SetReadOnly(false)
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// compactHandler merges sealed segments on demand. The merge is aborted when
+// the client goes away.
+func compactHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		stats, err := db.Compact(req.Context())
+		if err != nil {
+			internalError(rw, err)
+			return
+		}
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(stats)
+	}
+}
+
+// segmentsHandler lists the segment files with their sizes and key counts,
+// oldest first.
+func segmentsHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(db.SegmentStats())
+	}
+}
+
+// pauseCompactionHandler pauses or resumes merges, background ones
+// included, to give the disk to foreground traffic.
+func pauseCompactionHandler(db *datastore.Db, pause bool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, _ *http.Request) {
+		if pause {
+			db.PauseCompaction()
+		} else {
+			db.ResumeCompaction()
+		}
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// restoreHandler rolls the db back to the state right after the write with
+// the sequence number given by the seq query parameter.
+func restoreHandler(db *datastore.Db, follower *replication.Follower) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if following(follower) {
+			readOnly(rw)
+			return
+		}
+		seq, err := strconv.ParseUint(req.URL.Query().Get("seq"), 10, 64)
+		if err != nil {
+			badRequest(rw, fmt.Errorf("malformed seq"))
+			return
+		}
+
+		err = db.RestoreTo(seq)
+		switch {
+		case err == datastore.ErrSeqAhead:
+			badRequest(rw, err)
+			return
+		case err == datastore.ErrHistoryCompacted:
+			writeError(rw, http.StatusConflict, codeConflict, err.Error())
+			return
+		case err != nil:
+			internalError(rw, err)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// deleteRangeHandler deletes all the keys starting with the prefix query
+// parameter, which is required so the whole db is not wiped by mistake.
+func deleteRangeHandler(db *datastore.Db, follower *replication.Follower) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if following(follower) {
+			readOnly(rw)
+			return
+		}
+		prefix := req.URL.Query().Get("prefix")
+		if prefix == "" {
+			badRequest(rw, fmt.Errorf("prefix is required"))
+			return
+		}
+
+		if err := db.DeleteRange(prefix); err != nil {
+			writeFailed(rw, err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// exportHandler streams a snapshot of the db in the format given by the
+// format query parameter, csv by default.
+func exportHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		format := req.URL.Query().Get("format")
+		if format == "" {
+			format = export.CSV
+		}
+		if format != export.CSV && format != export.Parquet && format != export.NDJSON {
+			badRequest(rw, fmt.Errorf("unknown format %q", format))
+			return
+		}
+
+		snap := db.Snapshot()
+		defer snap.Release()
+
+		rw.Header().Set("content-type", export.ContentType(format))
+		rw.WriteHeader(http.StatusOK)
+		if err := export.Write(rw, format, snap); err != nil {
+			log.Printf("Export failed: %s", err)
+		}
+	}
+}
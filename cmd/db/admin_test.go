@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegments(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-segments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, err = s.db.PutString("key1", "value1")
+	assert.Nil(t, err)
+	_, err = s.db.PutString("key2", "value2")
+	assert.Nil(t, err)
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/segments", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var segments []datastore.SegmentStats
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&segments))
+	if assert.Len(t, segments, 1) {
+		assert.Equal(t, 2, segments[0].Keys)
+		assert.True(t, segments[0].Active)
+		assert.NotEmpty(t, segments[0].File)
+		assert.Greater(t, segments[0].Size, int64(0))
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-admin-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(keys string) { *adminKeys = keys }(*adminKeys)
+	*adminKeys = "operator,viewer:ro"
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	do := func(method, url, key string) int {
+		req := httptest.NewRequest(method, url, nil)
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/admin/segments", ""))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "/admin/compact", "intruder"))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/admin/compact", "viewer"))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/admin/segments", "viewer"))
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/admin/compact", "operator"))
+	assert.Equal(t, http.StatusAccepted, do(http.MethodPost, "/admin/verify", "operator"))
+	// Admin keys do not open /db, which stays open without -api-keys.
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/db/missing", ""))
+}
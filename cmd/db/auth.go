@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// readOnlySuffix marks keys of -api-keys which only read.
+	readOnlySuffix = ":ro"
+	// keyIDPrefix starts the ids of API keys.
+	keyIDPrefix = "sha256:"
+)
+
+// keyID returns the id of an API key, a prefix of its hash. Usage and
+// writes are attributed to the id, so keys are not stored, replicated or
+// answered by /admin/usage.
+func keyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return keyIDPrefix + hex.EncodeToString(sum[:8])
+}
+
+// Auth checks the API keys clients present in the X-API-Key header. The id
+// of a key is the principal of its requests, so usage stays attributed to
+// it.
+type Auth struct {
+	// keys maps the hashes of keys to whether they only read. Lookups of
+	// hashes take no time telling how much of a key matched.
+	keys map[[sha256.Size]byte]bool
+}
+
+// ParseAPIKeys parses a comma separated list of keys, those with the :ro
+// suffix only reading. An empty list disables authentication, nil is
+// returned then.
+func ParseAPIKeys(s string) (*Auth, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	a := &Auth{keys: make(map[[sha256.Size]byte]bool)}
+	for _, key := range strings.Split(s, ",") {
+		key = strings.TrimSpace(key)
+		readOnly := strings.HasSuffix(key, readOnlySuffix)
+		key = strings.TrimSuffix(key, readOnlySuffix)
+		if key == "" {
+			return nil, fmt.Errorf("empty API key")
+		}
+		a.keys[sha256.Sum256([]byte(key))] = readOnly
+	}
+	return a, nil
+}
+
+// check returns the status a request with the key is refused with, 0 if it
+// is allowed.
+func (a *Auth) check(key string, write bool) (int, string) {
+	if key == "" {
+		return http.StatusUnauthorized, "an API key is required"
+	}
+	readOnly, ok := a.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return http.StatusUnauthorized, "unknown API key"
+	}
+	if readOnly && write {
+		return http.StatusForbidden, "the API key only reads"
+	}
+	return 0, ""
+}
+
+// isWrite reports whether the request changes data or settings of the db.
+// Queries are posted, but only read.
+func isWrite(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return false
+	}
+	if route := mux.CurrentRoute(req); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl != "/db/_query" && tmpl != "/db/_mget"
+		}
+	}
+	return true
+}
+
+// Middleware answers requests without a known key with 401 and writes with
+// a read-only key with 403. A nil Auth lets every request through.
+func (a *Auth) Middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(apiKeyHeader)
+		if status, msg := a.check(key, isWrite(req)); status != 0 {
+			code := codeForbidden
+			if status == http.StatusUnauthorized {
+				rw.Header().Set("www-authenticate", `APIKey header="`+apiKeyHeader+`"`)
+				code = codeUnauthorized
+			}
+			writeError(rw, status, code, msg)
+			return
+		}
+		next.ServeHTTP(rw, withPrincipal(req, keyID(key)))
+	})
+}
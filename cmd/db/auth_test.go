@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Gopack-go-labs/labs4-5/api/dbpb"
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestParseAPIKeys(t *testing.T) {
+	auth, err := ParseAPIKeys("")
+	assert.Nil(t, err)
+	assert.Nil(t, auth)
+
+	auth, err = ParseAPIKeys("key1, key2:ro")
+	assert.Nil(t, err)
+	status, _ := auth.check("key1", true)
+	assert.Zero(t, status)
+	status, _ = auth.check("key2", false)
+	assert.Zero(t, status)
+	status, _ = auth.check("key2", true)
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = auth.check("key2:ro", false)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	for _, s := range []string{"key1,,key2", ":ro"} {
+		_, err := ParseAPIKeys(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(keys string) { *apiKeys = keys }(*apiKeys)
+	*apiKeys = "writer,reader:ro"
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	do := func(method, url, key, body string) int {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		if rec.Code == http.StatusUnauthorized {
+			assert.NotEmpty(t, rec.Header().Get("www-authenticate"))
+		}
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/db/key", "", ""))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "/db/key", "intruder", `{"value": "v"}`))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/db/key", "reader", `{"value": "v"}`))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodDelete, "/db/key", "reader", ""))
+	assert.False(t, s.db.Has("key"))
+
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/db/key", "writer", `{"value": "v"}`))
+	assert.Equal(t, int64(1), s.usage.get(keyID("writer")).KeysOwned)
+	// Writes are attributed to the key in the change feed, the owner
+	// records of usage are not of the caller.
+	changes, err := s.db.Changes(0)
+	assert.Nil(t, err)
+	nextChange := func() datastore.Change {
+		for c := range changes {
+			if c.Key == "key" {
+				return c
+			}
+		}
+		return datastore.Change{}
+	}
+	assert.Equal(t, keyID("writer"), nextChange().Principal)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/db/key", "reader", ""))
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/db/_mget", "reader", `["key"]`))
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/db/_query", "reader", `{}`))
+	// The change feed and the state of the db take the keys of /db too.
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/replication/changes", "", ""))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/stats", "", ""))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/status", "", ""))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/status", "reader", ""))
+
+	t.Run("gRPC", func(t *testing.T) {
+		lis := bufconn.Listen(1024 * 1024)
+		go s.grpc.Serve(lis)
+		defer s.grpc.Stop()
+		conn, err := grpc.NewClient("passthrough:///bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return lis.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		client := dbpb.NewDbClient(conn)
+		withKey := func(key string) context.Context {
+			return metadata.AppendToOutgoingContext(context.Background(), "x-api-key", key)
+		}
+
+		_, err = client.Get(context.Background(), &dbpb.GetRequest{Key: "key"})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+		_, err = client.Get(withKey("reader"), &dbpb.GetRequest{Key: "key"})
+		assert.Nil(t, err)
+		_, err = client.Delete(withKey("reader"), &dbpb.DeleteRequest{Key: "key"})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+		_, err = client.Delete(withKey("writer"), &dbpb.DeleteRequest{Key: "key"})
+		assert.Nil(t, err)
+		assert.Equal(t, keyID("writer"), nextChange().Principal)
+	})
+}
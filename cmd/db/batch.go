@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/Gopack-go-labs/labs4-5/datastore/replication"
+)
+
+// maxBatchSize bounds the writes of a /db/_batch and the keys of a /db/_mget
+// request.
+const maxBatchSize = 1000
+
+// BatchItem is a write of /db/_batch. The type is "string" or "int64" and is
+// inferred from the value when left out, see typedValue.
+type BatchItem struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+	Type  string      `json:"type"`
+}
+
+type BatchRes struct {
+	Written int `json:"written"`
+}
+
+type MgetRes struct {
+	Items []Res `json:"items"`
+}
+
+// checkBatchKey refuses keys /db/{key} could not address, so a batch
+// writes no keys of the service.
+func checkBatchKey(key string) error {
+	if key == "" || strings.Contains(key, "/") {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	return nil
+}
+
+// add adds the write of the item to the batch and returns the bytes
+// accounted for it.
+func (item BatchItem) add(b *datastore.Batch) (int64, error) {
+	v, err := typedValue(item.Value, item.Type)
+	if err != nil {
+		return 0, fmt.Errorf("value of %q: %w", item.Key, err)
+	}
+	if n, ok := v.(int64); ok {
+		b.PutInt64(item.Key, n)
+		return int64(len(item.Key) + 8), nil
+	}
+	s := v.(string)
+	b.PutString(item.Key, s)
+	return int64(len(item.Key) + len(s)), nil
+}
+
+// batchHandler writes the items of the request in order. Every item is
+// checked before anything is written; on a failure the number of items
+// written is set in the x-written header.
+func batchHandler(db *datastore.Db, usage *UsageTracker, follower *replication.Follower) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if following(follower) {
+			readOnly(rw)
+			return
+		}
+		var items []BatchItem
+		dec := json.NewDecoder(req.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&items); err != nil {
+			bodyError(rw, fmt.Errorf("malformed body: %w", err))
+			return
+		}
+		if len(items) > maxBatchSize {
+			badRequest(rw, fmt.Errorf("at most %d items are allowed", maxBatchSize))
+			return
+		}
+
+		var b datastore.Batch
+		keys := make([]string, len(items))
+		sizes := make([]int64, len(items))
+		for i, item := range items {
+			if err := checkBatchKey(item.Key); err != nil {
+				writeError(rw, http.StatusBadRequest, codeInvalidKey, err.Error())
+				return
+			}
+			size, err := item.add(&b)
+			if err != nil {
+				writeError(rw, http.StatusBadRequest, codeUnsupportedType, err.Error())
+				return
+			}
+			keys[i], sizes[i] = item.Key, size
+		}
+
+		n, err := usage.WriteBatch(clientKey(req), keys, sizes, func() (int, error) {
+			return db.WriteContext(req.Context(), &b)
+		})
+		if err != nil {
+			// The items before the failing one stay written.
+			rw.Header().Set("x-written", strconv.Itoa(n))
+		}
+		if err != nil {
+			writeFailed(rw, err)
+			return
+		}
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(BatchRes{Written: n})
+	}
+}
+
+// mgetHandler answers the values of a list of keys, in the order asked for.
+// Missing keys are left out.
+func mgetHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		var keys []string
+		if err := json.NewDecoder(req.Body).Decode(&keys); err != nil {
+			bodyError(rw, fmt.Errorf("malformed body: %w", err))
+			return
+		}
+		if len(keys) > maxBatchSize {
+			badRequest(rw, fmt.Errorf("at most %d keys are allowed", maxBatchSize))
+			return
+		}
+		for _, key := range keys {
+			if err := checkBatchKey(key); err != nil {
+				writeError(rw, http.StatusBadRequest, codeInvalidKey, err.Error())
+				return
+			}
+		}
+
+		values, err := db.GetMany(keys)
+		if err != nil {
+			internalError(rw, err)
+			return
+		}
+		res := MgetRes{Items: make([]Res, 0, len(values))}
+		for _, key := range keys {
+			switch v := values[key].(type) {
+			case string:
+				res.Items = append(res.Items, Res{Key: key, Value: v, Type: "string"})
+			case int64:
+				res.Items = append(res.Items, Res{Key: key, Value: strconv.FormatInt(v, 10), Type: "int64"})
+			}
+			// Keys asked for twice are answered once.
+			delete(values, key)
+		}
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(res)
+	}
+}
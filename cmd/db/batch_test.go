@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	do := func(url, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, url, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do("/db/_batch", `[
+		{"key": "a", "value": "value1"},
+		{"key": "b", "value": 2},
+		{"key": "c", "value": "3", "type": "int64"},
+		{"key": "a", "value": "value4", "type": "string"}
+	]`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res BatchRes
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, 4, res.Written)
+
+	s.usage.mu.Lock()
+	u := *s.usage.get(anonymousUser)
+	s.usage.mu.Unlock()
+	assert.Equal(t, int64(3), u.KeysOwned)
+	assert.Equal(t, int64(7+9+9+7), u.Daily.BytesWritten)
+
+	rec = do("/db/_mget", `["c", "missing", "a", "b", "a"]`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var mget MgetRes
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&mget))
+	assert.Equal(t, []Res{
+		{Key: "c", Value: "3", Type: "int64"},
+		{Key: "a", Value: "value4", Type: "string"},
+		{Key: "b", Value: "2", Type: "int64"},
+	}, mget.Items)
+
+	t.Run("Invalid items", func(t *testing.T) {
+		for _, body := range []string{
+			`{"key": "a"}`,
+			`[{"key": "", "value": "v"}]`,
+			`[{"key": "_sys/owner/a", "value": "v"}]`,
+			`[{"key": "d", "value": "v", "type": "int64"}]`,
+			`[{"key": "d", "value": 1, "type": "string"}]`,
+			`[{"key": "d", "value": true}]`,
+			`[{"key": "d", "value": "v"}, {"key": "e", "value": null}]`,
+		} {
+			assert.Equal(t, http.StatusBadRequest, do("/db/_batch", body).Code, body)
+		}
+		// Nothing of a refused batch is written.
+		assert.False(t, s.db.Has("d"))
+		assert.Equal(t, http.StatusBadRequest, do("/db/_mget", `["a/b"]`).Code)
+	})
+}
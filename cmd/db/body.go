@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// limitBody refuses bodies of more than limit bytes with 413, a body
+// declaring a larger content-length before it is read. Raw uploads and
+// imports are streamed to the store rather than held in memory, so they
+// are left to the storage quotas.
+func limitBody(limit int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.Body == nil || req.Body == http.NoBody || isRaw(req) || isImport(req) {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			if req.ContentLength > limit {
+				writeError(rw, http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Sprintf("body exceeds %d bytes", limit))
+				return
+			}
+			req.Body = http.MaxBytesReader(rw, req.Body, limit)
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+func isImport(req *http.Request) bool {
+	route := mux.CurrentRoute(req)
+	if route == nil {
+		return false
+	}
+	tmpl, err := route.GetPathTemplate()
+	return err == nil && tmpl == "/db/_import"
+}
+
+// bodyError answers a request whose body could not be read or decoded, with
+// 413 if the body exceeds the limit of limitBody.
+func bodyError(rw http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(rw, http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Sprintf("body exceeds %d bytes", tooLarge.Limit))
+		return
+	}
+	badRequest(rw, err)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Gopack-go-labs/labs4-5/api/dbpb"
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestBodyLimit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-body-limit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(size datastore.MemoryUnit) { maxBodySize = size }(maxBodySize)
+	maxBodySize = datastore.FromBytes(1024)
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	do := func(url, contentType string, body []byte, chunked bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("content-type", contentType)
+		}
+		if chunked {
+			// The size is only found out while reading.
+			req.ContentLength = -1
+		}
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		return rec
+	}
+	value := strings.Repeat("x", 2048)
+	large, _ := json.Marshal(Req{Value: value})
+	largeProto, _ := proto.Marshal(&dbpb.PutRequest{Value: &dbpb.Value{Kind: &dbpb.Value_StringValue{StringValue: value}}})
+
+	for _, chunked := range []bool{false, true} {
+		for _, tc := range []struct {
+			url, contentType string
+			body             []byte
+		}{
+			{"/db/key", "", large},
+			{"/db/key", protoContentType, largeProto},
+			{"/db/_batch", "", []byte(`[{"key": "key", "value": "` + value + `"}]`)},
+			{"/db/_mget", "", []byte(`["` + strings.Repeat("key", 500) + `"]`)},
+		} {
+			rec := do(tc.url, tc.contentType, tc.body, chunked)
+			assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, tc.url)
+			var res ErrorRes
+			assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+			assert.Equal(t, codeTooLarge, res.Code)
+		}
+	}
+	assert.False(t, s.db.Has("key"))
+
+	// Streamed bodies are not limited.
+	assert.Equal(t, http.StatusCreated, do("/db/raw", rawContentType, []byte(value), false).Code)
+	assert.Equal(t, http.StatusOK, do("/db/_import", "", []byte(`{"key": "imported", "value": "`+value+`"}`), true).Code)
+	assert.Equal(t, http.StatusCreated, do("/db/small", "", []byte(`{"value": "v"}`), false).Code)
+}
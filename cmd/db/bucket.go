@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/Gopack-go-labs/labs4-5/datastore/replication"
+	"github.com/gorilla/mux"
+)
+
+// bucketKey names a key of a bucket in usage accounting. Keys of /db/{key}
+// have no slash, so they never clash with keys of buckets.
+func bucketKey(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+// bucketHandler serves /db/{bucket}/{key}, the keys of a datastore bucket.
+// Values are JSON only; raw, protobuf and conditional writes are left to
+// /db/{key}, If-Match and If-None-Match are refused.
+func bucketHandler(db *datastore.Db, usage *UsageTracker, follower *replication.Follower) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		b, key := db.Bucket(vars["bucket"]).WithContext(req.Context()), vars["key"]
+
+		if (req.Method == http.MethodPost || req.Method == http.MethodDelete) && conditional(req) {
+			badRequest(rw, fmt.Errorf("keys of buckets can not be written conditionally"))
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			res := Res{Key: key, Type: "string"}
+			var err error
+			if req.URL.Query().Get("type") == "int64" {
+				var n int64
+				n, err = b.GetInt64(key)
+				res.Type, res.Value = "int64", strconv.FormatInt(n, 10)
+			} else {
+				res.Value, err = b.GetString(key)
+			}
+			// Values of the other type are not found either.
+			if errors.Is(err, datastore.ErrNotFound) || errors.Is(err, datastore.ErrNotString) || errors.Is(err, datastore.ErrNotInt64) {
+				notFound(rw)
+				return
+			}
+			if err != nil {
+				writeFailed(rw, err)
+				return
+			}
+			rw.Header().Set("content-type", "application/json")
+			rw.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(rw).Encode(res)
+
+		case http.MethodHead:
+			want := datastore.Str
+			if req.URL.Query().Get("type") == "int64" {
+				want = datastore.Int
+			}
+			serveHead(rw, b.Describe, key, want, false)
+
+		case http.MethodPost:
+			if following(follower) {
+				readOnly(rw)
+				return
+			}
+			var body Req
+			dec := json.NewDecoder(req.Body)
+			dec.UseNumber()
+			if err := dec.Decode(&body); err != nil {
+				bodyError(rw, fmt.Errorf("malformed body: %w", err))
+				return
+			}
+			ttl, err := writeTTL(req, body.TTL)
+			if err != nil {
+				badRequest(rw, err)
+				return
+			}
+			value, err := typedValue(body.Value, body.Type)
+			if err != nil {
+				writeError(rw, http.StatusBadRequest, codeUnsupportedType, err.Error())
+				return
+			}
+			client, name := clientKey(req), bucketKey(b.Name(), key)
+			var res Res
+			switch v := value.(type) {
+			case string:
+				res = Res{Key: key, Value: v, Type: "string"}
+				err = usage.Write(client, name, int64(len(name)+len(v)), func() error {
+					if ttl == 0 {
+						_, err := b.PutString(key, v)
+						return err
+					}
+					_, err := b.PutStringWithTTL(key, v, ttl)
+					return err
+				})
+			case int64:
+				res = Res{Key: key, Value: strconv.FormatInt(v, 10), Type: "int64"}
+				err = usage.Write(client, name, int64(len(name)+8), func() error {
+					if ttl == 0 {
+						_, err := b.PutInt64(key, v)
+						return err
+					}
+					_, err := b.PutInt64WithTTL(key, v, ttl)
+					return err
+				})
+			}
+			if err != nil {
+				writeFailed(rw, err)
+				return
+			}
+			rw.Header().Set("content-type", "application/json")
+			rw.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(rw).Encode(res)
+
+		case http.MethodDelete:
+			if following(follower) {
+				readOnly(rw)
+				return
+			}
+			if !b.Has(key) {
+				notFound(rw)
+				return
+			}
+			if err := usage.Delete(bucketKey(b.Name(), key), func() error { return b.Delete(key) }); err != nil {
+				writeFailed(rw, err)
+				return
+			}
+			rw.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// dropBucketHandler serves DELETE /db/{bucket}/, wiping all the keys of the
+// bucket. The trailing slash tells it from DELETE /db/{key}.
+func dropBucketHandler(db *datastore.Db, usage *UsageTracker, follower *replication.Follower) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if following(follower) {
+			readOnly(rw)
+			return
+		}
+		b := db.Bucket(mux.Vars(req)["bucket"])
+		if err := usage.DeletePrefix(bucketKey(b.Name(), ""), b.Drop); err != nil {
+			writeFailed(rw, err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
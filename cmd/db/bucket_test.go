@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuckets(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-buckets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return rec
+	}
+	get := func(url string) (int, Res) {
+		rec := do(http.MethodGet, url, "")
+		var res Res
+		if rec.Code == http.StatusOK {
+			assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+		}
+		return rec.Code, res
+	}
+	keysOwned := func() int64 {
+		s.usage.mu.Lock()
+		defer s.usage.mu.Unlock()
+		return s.usage.get(anonymousUser).KeysOwned
+	}
+
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/db/key", `{"value": "flat"}`).Code)
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/db/team1/key", `{"value": "one"}`).Code)
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/db/team1/count", `{"value": 2}`).Code)
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/db/team2/key", `{"value": "two", "ttl": "1h"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/db/team1/key", `{"value": 1.5}`).Code)
+	assert.Equal(t, int64(4), keysOwned())
+
+	// Teams do not collide with each other nor with the flat keyspace.
+	code, res := get("/db/key")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "flat", res.Value)
+	code, res = get("/db/team1/key")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, Res{Key: "key", Value: "one", Type: "string"}, res)
+	code, res = get("/db/team2/key")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "two", res.Value)
+	code, res = get("/db/team1/count?type=int64")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "2", res.Value)
+	code, _ = get("/db/team2/count?type=int64")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// Values of another type are not found, failed reads are no misses.
+	code, _ = get("/db/team1/count")
+	assert.Equal(t, http.StatusNotFound, code)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/db/team1/key", nil).WithContext(ctx))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// Conditional writes are refused rather than made unconditionally.
+	for _, header := range []string{"If-Match", "If-None-Match"} {
+		req := httptest.NewRequest(http.MethodPost, "/db/team1/key", strings.NewReader(`{"value": "new"}`))
+		req.Header.Set(header, "*")
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		req = httptest.NewRequest(http.MethodDelete, "/db/team2/key", nil)
+		req.Header.Set(header, `"1"`)
+		rec = httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+	_, res = get("/db/team1/key")
+	assert.Equal(t, "one", res.Value)
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/db/team2/key", "").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/db/team2/key", "").Code)
+	assert.Equal(t, int64(3), keysOwned())
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/db/team1/", "").Code)
+	code, _ = get("/db/team1/key")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Empty(t, s.db.Bucket("team1").Keys())
+	assert.Equal(t, int64(1), keysOwned())
+	code, _ = get("/db/key")
+	assert.Equal(t, http.StatusOK, code)
+}
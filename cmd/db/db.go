@@ -1,44 +1,479 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/http/pprof"
 	"net/url"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/Gopack-go-labs/labs4-5/datastore/metrics"
+	"github.com/Gopack-go-labs/labs4-5/datastore/replication"
 	"github.com/Gopack-go-labs/labs4-5/httptools"
 	"github.com/Gopack-go-labs/labs4-5/signal"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
 )
 
+// systemPrefix marks keys used by the service itself. Such keys can not be
+// addressed via /db/{key} since they contain a slash.
+const systemPrefix = "_sys/"
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+var (
+  quotaDailyRequests   = flag.Int64("quota-daily-requests", 0, "max requests per client per day, 0 for no limit")
+  quotaMonthlyRequests = flag.Int64("quota-monthly-requests", 0, "max requests per client per month, 0 for no limit")
+  quotaDailyBytes      = flag.Int64("quota-daily-bytes", 0, "max bytes written per client per day, 0 for no limit")
+  quotaMonthlyBytes    = flag.Int64("quota-monthly-bytes", 0, "max bytes written per client per month, 0 for no limit")
+  quotaKeys            = flag.Int64("quota-keys", 0, "max keys owned by a client, 0 for no limit")
+  port                 = flag.Int("port", 8083, "port of the HTTP API, also set by $DB_PORT")
+  grpcPort             = flag.Int("grpc-port", 8084, "port of the gRPC API, 0 to serve none, also set by $DB_GRPC_PORT")
+  reqTimeout           = flag.Duration("request-timeout", 5*time.Second, "time a request of /db gets for the datastore before it is answered with 503, 0 for no limit; watches and imports have none")
+  shutdownTimeout      = flag.Duration("shutdown-timeout", 15*time.Second, "time requests in flight get to finish on shutdown before the database is closed")
+  dataDir              = flag.String("dir", "/var/lib/db", "data directory, created if missing, empty for a temporary one, also set by $DB_DIR")
+  follow               = flag.String("follow", "", "address of the leader db to replicate, e.g. http://db:8083")
+  followKey            = flag.String("follow-key", "", "API key presented to the -follow leader, one of its -api-keys, also set by $DB_FOLLOW_KEY")
+  followCA             = flag.String("follow-ca", "", "PEM file of the CAs trusted to sign the certificate of an https -follow leader, the system ones by default")
+  tlsCert              = flag.String("tls-cert", "", "PEM certificate file to serve HTTPS and gRPC over TLS with, also presented to a -follow leader")
+  tlsKey               = flag.String("tls-key", "", "PEM key file of -tls-cert")
+  tlsClientCA          = flag.String("tls-client-ca", "", "PEM file of the CAs signing the certificates clients must present, none for no client verification")
+  maxClockSkew         = flag.Duration("max-clock-skew", 0, "clock skew from the leader beyond which TTL writes are flagged, 0 for no check")
+  refuseClockSkew      = flag.Bool("refuse-clock-skew", false, "refuse TTL writes instead of warning when -max-clock-skew is exceeded")
+  maxCompactionFails   = flag.Int("max-compaction-failures", 0, "background compactions failed in a row after which writes are refused, 0 for no limit")
+  verifyRate           = flag.Int64("verify-rate", 8*1024*1024, "bytes per second read by each verification job, 0 for no limit")
+  archiveDir           = flag.String("archive-dir", "", "directory of a mounted object storage bucket to archive cold segments to, none by default")
+  archiveAfter         = flag.Duration("archive-after", 24*time.Hour, "age of sealed segments moved to -archive-dir")
+  maxKeyLength         = flag.Int("max-key-length", 0, "max length of keys in bytes, 0 for no limit")
+  rateLimit            = flag.Float64("rate-limit", 0, "requests per second allowed to each client of /db, by API key or else IP, 0 for no limit")
+  rateBurst            = flag.Int("rate-burst", 20, "requests a client of /db may send at once beyond -rate-limit")
+  apiKeys              = flag.String("api-keys", "", "comma separated API keys clients of /db must present, those ending in :ro only read; none for open access, also set by $DB_API_KEYS")
+  adminKeys            = flag.String("admin-keys", "", "comma separated API keys operators of /admin must present, those ending in :ro only inspect; none for open access, also set by $DB_ADMIN_KEYS")
+  accessLogs           = flag.Bool("access-log", true, "log a JSON line per request to stdout")
+  debugMode            = flag.Bool("debug", false, "serve pprof profiles, expvar and runtime stats under /debug/, to the keys of -admin-keys")
+  readOnlyMode         = flag.Bool("read-only", false, "answer writes with 503 and serve reads only, for read replicas and maintenance windows")
+  mergeArchiveDir      = flag.String("merge-archive-dir", "", "directory segments replaced by merges are moved to instead of being removed, on the file system of -dir")
+)
+
+// checkKeyLength returns a key validator refusing keys longer than max
+// bytes, none for max 0. Keys of the service get their prefix on top of keys
+// of clients, so they are not limited.
+func checkKeyLength(max int) func(string) error {
+  return func(key string) error {
+    if max > 0 && len(key) > max && !strings.HasPrefix(key, systemPrefix) {
+      return fmt.Errorf("key is longer than %d bytes", max)
+    }
+    return nil
+  }
+}
+
 type Res struct {
   Key   string `json:"key"`
   Value string `json:"value"`
   Type  string `json:"type"`
+  // ExpiresAt is the RFC 3339 time a value written with a TTL expires at.
+  ExpiresAt string `json:"expires_at,omitempty"`
 }
 
 type Req struct {
   Value interface{} `json:"value"`
+  // Type is "string" or "int64", inferred from the value when left out;
+  // int64 values may be given as decimal strings.
+  Type string `json:"type"`
+  // TTL is a duration such as 30s after which the value expires, the ttl
+  // query parameter gives one as well.
+  TTL string `json:"ttl"`
 }
 
+var (
+  segmentSize    = 10 * datastore.Megabyte
+  maxDiskUsage   datastore.MemoryUnit
+  archiveCache   = 100 * datastore.Megabyte
+  compactionRate datastore.MemoryUnit
+  maxBodySize    datastore.MemoryUnit
+  gzipMinSize    = datastore.Kilobyte
+)
+
+func init() {
+  flag.Var(&segmentSize, "segment-size", "max size of a segment file, e.g. 10MB, also set by $DB_SEGMENT_SIZE")
+  flag.Var(&maxDiskUsage, "max-disk-usage", "max size of segment files, e.g. 20GB, writes beyond are refused, 0 for no limit")
+  flag.Var(&archiveCache, "archive-cache", "local cache size of archived segments, e.g. 1GB")
+  flag.Var(&compactionRate, "compaction-rate", "max bytes per second read and written by compaction, e.g. 20MB, 0 for no limit")
+  flag.Var(&gzipMinSize, "gzip-min-size", "min size of responses compressed with gzip for clients accepting it, e.g. 1KB, 0 for no compression")
+  flag.Var(&maxBodySize, "max-body-size", "max size of request bodies of /db other than raw uploads and imports, e.g. 1MB, 0 for the segment size")
+}
+
+// collector exports the metrics of the database on /metrics, gauges once it
+// is open; requestMetrics the ones of requests to the service.
+var (
+  collector      = metrics.NewCollector("datastore")
+  requestMetrics = newHTTPMetrics("db")
+)
+
+// logger is the logger of the datastore, its records tell the request they
+// are made on behalf of. accessLogger logs the requests themselves.
+var (
+  logger       = slog.New(requestIDHandler{slog.Default().Handler()})
+  accessLogger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+)
+
+const (
+  minInitRetry = 100 * time.Millisecond
+  maxInitRetry = 10 * time.Second
+)
+
 func main() {
-  httpHandler := mux.NewRouter()
+  if err := setFlagsFromEnv(flag.CommandLine, os.LookupEnv); err != nil {
+    log.Fatal(err)
+  }
+  flag.Parse()
+
+  gate := new(readyGate)
+  root := http.NewServeMux()
+  root.HandleFunc("/ready", gate.ServeReady)
+  root.HandleFunc("/healthz", serveHealthz)
+  root.HandleFunc("/readyz", gate.ServeReadyz)
+  prometheus.MustRegister(collector, requestMetrics)
+  root.Handle("/metrics", promhttp.Handler())
+  root.Handle("/", gate)
 
-  dir, err := ioutil.TempDir("", "temp-dir")
+  tlsConfig, err := serverTLS()
   if err != nil {
     log.Fatal(err)
   }
+  server := httptools.CreateTLSServer(*port, root, tlsConfig)
+  server.Start()
+
+  // The datastore is opened in the background, so a data dir that shows up
+  // late does not crash the service. Requests get 503 until it is open.
+  // Invalid flags can not be fixed by waiting, the service exits on them.
+  ctx, cancel := context.WithCancel(context.Background())
+  initDone := make(chan *service, 1)
+  go func() {
+    var svc *service
+    err := retry(ctx, minInitRetry, maxInitRetry, func() error {
+      var err error
+      svc, err = newService(*dataDir, datastore.WithRecoveryProgress(gate.recovering))
+      if err != nil {
+        log.Printf("Failed to initialize database: %v", err)
+      }
+      return err
+    })
+    if errors.As(err, &configError{}) {
+      log.Fatalf("Invalid configuration: %v", err)
+    }
+    if err == nil {
+      gate.open(svc.handler, svc.db.Writable)
+      if *grpcPort != 0 {
+        go serveGRPC(svc.grpc, *grpcPort)
+      }
+    }
+    initDone <- svc
+  }()
+
+  signal.WaitForTerminationSignal()
+  cancel()
+  // Requests in flight finish their writes before the database closes.
+  shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), *shutdownTimeout)
+  defer cancelShutdown()
+  if err := server.Shutdown(shutdownCtx); err != nil {
+    log.Printf("Failed to finish requests in flight: %s", err)
+  }
+  if svc := <-initDone; svc != nil {
+    stopGRPC(shutdownCtx, svc.grpc)
+    svc.Close()
+  }
+  log.Println("Database closed")
+}
+
+// service is the db with the HTTP and gRPC APIs on top of it.
+type service struct {
+  db      *datastore.Db
+  usage   *UsageTracker
+  verify  *VerifyJobs
+  handler http.Handler
+  grpc    *grpc.Server
+}
+
+func (s *service) Close() {
+  if err := s.verify.Close(); err != nil {
+    log.Printf("Failed to save verification jobs: %s", err)
+  }
+  if err := s.usage.Flush(); err != nil {
+    log.Printf("Failed to flush usage: %s", err)
+  }
+  if err := s.db.Close(); err != nil {
+    log.Printf("Failed to close database: %s", err)
+  }
+}
+
+// newService opens the db in dir with the options of the flags and extraOpts
+// on top of them.
+func newService(dir string, extraOpts ...datastore.Option) (*service, error) {
+  auth, err := ParseAPIKeys(*apiKeys)
+  if err != nil {
+    return nil, configError{fmt.Errorf("invalid -api-keys: %w", err)}
+  }
+  adminAuth, err := ParseAPIKeys(*adminKeys)
+  if err != nil {
+    return nil, configError{fmt.Errorf("invalid -admin-keys: %w", err)}
+  }
+  tlsConfig, err := serverTLS()
+  if err != nil {
+    return nil, configError{err}
+  }
+  if dir == "" {
+    dir, err = ioutil.TempDir("", "temp-dir")
+    if err != nil {
+      return nil, err
+    }
+  }
 
-  db, err := datastore.NewDb(dir, 10*datastore.Megabyte)
+  opts := []datastore.Option{
+    datastore.WithInstrumentation(datastore.NewExpvarInstrumentation("datastore")),
+    datastore.WithInstrumentation(collector),
+    datastore.WithMaxClockSkew(*maxClockSkew, *refuseClockSkew),
+    datastore.WithLogger(logger),
+    datastore.WithMaxCompactionFailures(*maxCompactionFails),
+    datastore.WithMaxDiskUsage(maxDiskUsage),
+    datastore.WithKeyValidator(checkKeyLength(*maxKeyLength)),
+    datastore.WithCompactionRate(compactionRate),
+  }
+  if *archiveDir != "" {
+    opts = append(opts, datastore.WithArchive(datastore.DirStore{Dir: *archiveDir}, *archiveAfter, archiveCache))
+  }
+  if *mergeArchiveDir != "" {
+    opts = append(opts, datastore.WithArchiveDir(*mergeArchiveDir))
+  }
+  opts = append(opts, extraOpts...)
+  db, err := datastore.NewDb(dir, segmentSize, opts...)
   if err != nil {
-    log.Fatalf("Failed to initialize database: %v", err)
+    return nil, err
+  }
+  collector.Watch(db)
+
+  usage, err := NewUsageTracker(db, Quota{
+    DailyRequests:   *quotaDailyRequests,
+    MonthlyRequests: *quotaMonthlyRequests,
+    DailyBytes:      *quotaDailyBytes,
+    MonthlyBytes:    *quotaMonthlyBytes,
+    Keys:            *quotaKeys,
+  })
+  if err != nil {
+    db.Close()
+    return nil, fmt.Errorf("failed to load usage: %w", err)
+  }
+  go usage.FlushEvery(10 * time.Second)
+
+  verify, err := NewVerifyJobs(db, dir, *verifyRate)
+  if err != nil {
+    db.Close()
+    return nil, fmt.Errorf("failed to load verification jobs: %w", err)
+  }
+
+  var follower *replication.Follower
+  if *follow != "" {
+    client, err := followClient()
+    if err != nil {
+      db.Close()
+      return nil, configError{err}
+    }
+    follower = replication.NewFollower(db, &replication.HTTPTransport{
+      URL:       *follow + "/replication/changes",
+      Client:    client,
+      Header:    followHeader(*followKey),
+      Heartbeat: replication.NewSkewMonitor(db).Observe,
+    })
+    usage.SetReadOnly(true)
+    follower.Start()
+  }
+
+  ids := newUlidGenerator()
+  var requestLogger *slog.Logger
+  if *accessLogs {
+    requestLogger = accessLogger
+  }
+
+  httpHandler := mux.NewRouter()
+  httpHandler.Use(accessLog(requestLogger, ids), requestMetrics.middleware, compress(gzipMinSize.Bytes()))
+  // The change feed carries every key and value, it takes the keys of /db.
+  httpHandler.Handle("/status", auth.Middleware(statusHandler(db, follower, *readOnlyMode))).Methods(http.MethodGet)
+  httpHandler.Handle("/stats", auth.Middleware(statsHandler(db))).Methods(http.MethodGet)
+  httpHandler.Handle("/replication/changes", auth.Middleware(replication.Handler(db))).Methods(http.MethodGet)
+  adminRouter := httpHandler.PathPrefix("/admin").Subrouter()
+  adminRouter.Use(adminAuth.Middleware)
+  adminRouter.HandleFunc("/promote", promoteHandler(follower, usage)).Methods(http.MethodPost)
+  adminRouter.Handle("/usage", usage).Methods(http.MethodGet)
+  adminRouter.HandleFunc("/options", optionsHandler(db)).Methods(http.MethodGet, http.MethodPut)
+  adminRouter.HandleFunc("/compact", compactHandler(db)).Methods(http.MethodPost)
+  adminRouter.HandleFunc("/segments", segmentsHandler(db)).Methods(http.MethodGet)
+  adminRouter.HandleFunc("/compaction/pause", pauseCompactionHandler(db, true)).Methods(http.MethodPost)
+  adminRouter.HandleFunc("/compaction/resume", pauseCompactionHandler(db, false)).Methods(http.MethodPost)
+  noWrites := refuseWrites(*readOnlyMode)
+  adminRouter.Handle("/restore", noWrites(restoreHandler(db, follower))).Methods(http.MethodPost)
+  adminRouter.HandleFunc("/export", exportHandler(db)).Methods(http.MethodGet)
+  adminRouter.Handle("/delete-range", noWrites(deleteRangeHandler(db, follower))).Methods(http.MethodPost)
+  adminRouter.HandleFunc("/verify", startVerifyHandler(verify)).Methods(http.MethodPost)
+  adminRouter.HandleFunc("/verify/{id}", verifyHandler(verify)).Methods(http.MethodGet)
+  if *debugMode {
+    debugRouter := httpHandler.PathPrefix("/debug").Subrouter()
+    debugRouter.Use(adminAuth.Middleware)
+    debugRouter.HandleFunc("/runtime", runtimeHandler(db)).Methods(http.MethodGet)
+    // The cmdline var holds the flags, -api-keys among them.
+    debugRouter.Handle("/vars", expvar.Handler()).Methods(http.MethodGet)
+    debugRouter.HandleFunc("/pprof/cmdline", pprof.Cmdline)
+    debugRouter.HandleFunc("/pprof/profile", pprof.Profile)
+    debugRouter.HandleFunc("/pprof/symbol", pprof.Symbol)
+    debugRouter.HandleFunc("/pprof/trace", pprof.Trace)
+    // The named profiles, such as goroutine and heap, and their index.
+    debugRouter.PathPrefix("/pprof/").HandlerFunc(pprof.Index)
+  }
+
+  dbRouter := httpHandler.PathPrefix("/db").Subrouter()
+  limiter := NewRateLimiter(*rateLimit, *rateBurst)
+  bodyLimit := maxBodySize
+  if bodyLimit == 0 {
+    bodyLimit = segmentSize
+  }
+  dbRouter.Use(auth.Middleware, limiter.Middleware, noWrites, usage.Middleware, limitBody(bodyLimit.Bytes()), requestTimeout(*reqTimeout))
+
+  // put stores the value from the request body under the key. On failure
+  // the error status is written and false is returned.
+  put := func(rw http.ResponseWriter, req *http.Request, key string) (Res, bool) {
+    if following(follower) {
+      readOnly(rw)
+      return Res{}, false
+    }
+
+    rev, err := writeRevision(req)
+    if err != nil {
+      badRequest(rw, err)
+      return Res{}, false
+    }
+
+    var body Req
+    var res Res
+
+    if isRaw(req) {
+      if req.ContentLength < 0 {
+        writeError(rw, http.StatusLengthRequired, codeLengthRequired, "raw values need a content-length")
+        return Res{}, false
+      }
+      if rev != datastore.AnyRevision {
+        // Streamed values are not written conditionally.
+        badRequest(rw, fmt.Errorf("raw values can not be written conditionally"))
+        return Res{}, false
+      }
+      if req.URL.Query().Get("ttl") != "" {
+        badRequest(rw, fmt.Errorf("raw values can not have a ttl"))
+        return Res{}, false
+      }
+      res = Res{Key: key, Type: "string"}
+      err = usage.Write(clientKey(req), key, int64(len(key))+req.ContentLength, func() error {
+        rev, err = db.PutReaderContext(req.Context(), key, req.Body, req.ContentLength)
+        return err
+      })
+    } else {
+      var ttl time.Duration
+      if isProto(req) {
+        if body.Value, ttl, err = decodeProtoPut(req); err != nil {
+          bodyError(rw, err)
+          return Res{}, false
+        }
+      } else {
+        dec := json.NewDecoder(req.Body)
+        dec.UseNumber()
+        if err = dec.Decode(&body); err != nil {
+          bodyError(rw, fmt.Errorf("malformed body: %w", err))
+          return Res{}, false
+        }
+        if ttl, err = writeTTL(req, body.TTL); err != nil {
+          badRequest(rw, err)
+          return Res{}, false
+        }
+      }
+      if body.Value, err = typedValue(body.Value, body.Type); err != nil {
+        writeError(rw, http.StatusBadRequest, codeUnsupportedType, err.Error())
+        return Res{}, false
+      }
+      switch v := body.Value.(type) {
+      case string:
+        res = Res{Key: key, Value: v, Type: "string"}
+        err = usage.Write(clientKey(req), key, int64(len(key)+len(v)), func() error {
+          rev, err = putString(req.Context(), db, key, v, rev, ttl)
+          return err
+        })
+      case int64:
+        res = Res{Key: key, Value: strconv.FormatInt(v, 10), Type: "int64"}
+        err = usage.Write(clientKey(req), key, int64(len(key)+8), func() error {
+          rev, err = putInt64(req.Context(), db, key, v, rev, ttl)
+          return err
+        })
+      }
+    }
+
+    if err != nil {
+      writeFailed(rw, err)
+      return Res{}, false
+    }
+    if rev != datastore.AnyRevision {
+      rw.Header().Set("etag", etag(rev))
+    }
+    return res, true
   }
-  defer db.Close()
+
+  dbRouter.HandleFunc("", func(rw http.ResponseWriter, req *http.Request) {
+    key, err := ids.New()
+    if err != nil {
+      internalError(rw, err)
+      return
+    }
+
+    res, ok := put(rw, req, key)
+    if !ok {
+      return
+    }
+
+    rw.Header().Set("location", "/db/"+key)
+    if isProto(req) || wantsProto(req) {
+      // Protobuf clients find the key in the location, its revision in the
+      // etag.
+      rw.WriteHeader(http.StatusCreated)
+      return
+    }
+    rw.Header().Set("content-type", "application/json")
+    rw.WriteHeader(http.StatusCreated)
+    _ = json.NewEncoder(rw).Encode(res)
+  }).Methods(http.MethodPost)
+  dbRouter.HandleFunc("", listHandler(db)).Methods(http.MethodGet)
+
+  dbRouter.HandleFunc("/_query", queryHandler(db)).Methods(http.MethodPost)
+  dbRouter.HandleFunc("/_batch", batchHandler(db, usage, follower)).Methods(http.MethodPost)
+  dbRouter.HandleFunc("/_mget", mgetHandler(db)).Methods(http.MethodPost)
+  dbRouter.HandleFunc("/_import", importHandler(db, usage, follower)).Methods(http.MethodPost)
+  dbRouter.HandleFunc("/{key}/incr", incrHandler(db, usage, follower)).Methods(http.MethodPost)
+  dbRouter.HandleFunc("/{key}/watch", watchHandler(db)).Methods(http.MethodGet)
+  // Keys of buckets named incr take no POST and those named watch no GET,
+  // /db/{key} routes go first.
+  dbRouter.HandleFunc("/{bucket}/", dropBucketHandler(db, usage, follower)).Methods(http.MethodDelete)
+  dbRouter.HandleFunc("/{bucket}/{key}", bucketHandler(db, usage, follower)).Methods(http.MethodGet, http.MethodHead, http.MethodPost, http.MethodDelete)
   
-  httpHandler.HandleFunc("/db/{key}", func(rw http.ResponseWriter, req *http.Request) {
+  dbRouter.HandleFunc("/{key}", func(rw http.ResponseWriter, req *http.Request) {
     urlStr := req.URL.String()
     myUrl, _ := url.Parse(urlStr)
     params, _ := url.ParseQuery(myUrl.RawQuery)
@@ -48,60 +483,113 @@ func main() {
   
     switch req.Method {
     case http.MethodGet:
+      if wantsRaw(req) && params.Get("type") != "int64" {
+        serveRawString(rw, db, key)
+        return
+      }
+      if wantsProto(req) {
+        serveProto(rw, db, key)
+        return
+      }
+
       var val string
-      var err error
       dataType := "string"
-  
+
+      data, meta, err := db.GetWithMetaContext(req.Context(), key)
+      if err != nil && req.Context().Err() != nil {
+        writeFailed(rw, err)
+        return
+      }
       if params.Get("type") == "int64" {
-        var data int64
-        data, err = db.GetInt64(key)
-        val = strconv.FormatInt(data, 10)
         dataType = "int64"
+        if n, ok := data.(int64); ok && err == nil {
+          val = strconv.FormatInt(n, 10)
+        } else {
+          err = datastore.ErrNotFound
+        }
+      } else if s, ok := data.(string); ok && err == nil {
+        val = s
       } else {
-        val, err = db.GetString(key)
+        err = datastore.ErrNotFound
       }
 
       if err != nil {
-        rw.WriteHeader(404)
+        notFound(rw)
         return
       }
       
       rw.Header().Set("content-type", "application/json")
+      rw.Header().Set("etag", etag(meta.Seq))
       rw.WriteHeader(http.StatusOK)
       _ = json.NewEncoder(rw).Encode(Res{
         Key: key,
         Value: val,
         Type: dataType,
+        ExpiresAt: expiresAt(meta),
       })
 
+    case http.MethodHead:
+      want := datastore.Str
+      if params.Get("type") == "int64" {
+        want = datastore.Int
+      }
+      serveHead(rw, db.Describe, key, want, wantsRaw(req))
+
     case http.MethodPost:
-      var body Req
+      res, ok := put(rw, req, key)
+      if !ok {
+        return
+      }
+      if isProto(req) || wantsProto(req) {
+        rw.WriteHeader(http.StatusCreated)
+        return
+      }
+      rw.Header().Set("content-type", "application/json")
+      rw.WriteHeader(http.StatusCreated)
+      _ = json.NewEncoder(rw).Encode(res)
 
-      err := json.NewDecoder(req.Body).Decode(&body)
+    case http.MethodDelete:
+      if following(follower) {
+        readOnly(rw)
+        return
+      }
+      if req.Header.Get("if-none-match") != "" {
+        badRequest(rw, fmt.Errorf("If-None-Match is not supported on DELETE"))
+        return
+      }
+      rev, err := writeRevision(req)
       if err != nil {
-        rw.WriteHeader(http.StatusBadRequest)
+        badRequest(rw, err)
         return
       }
-
-      switch v := body.Value.(type) {
-      case string:
-        err = db.PutString(key, v)
-      case float64:
-        err = db.PutInt64(key, int64(v))
+      if !db.Has(key) {
+        if rev != datastore.AnyRevision {
+          writeError(rw, http.StatusPreconditionFailed, codePrecondition, "key not found")
+          return
+        }
+        notFound(rw)
+        return
       }
-
+      err = usage.Delete(key, func() error {
+        return db.DeleteIfRevisionContext(req.Context(), key, rev)
+      })
       if err != nil {
-        rw.WriteHeader(http.StatusInternalServerError)
+        writeFailed(rw, err)
         return
       }
-      
-      rw.WriteHeader(http.StatusCreated)
+      rw.WriteHeader(http.StatusNoContent)
+
+    default:
+      rw.Header().Set("allow", "GET, HEAD, POST, DELETE")
+      writeError(rw, http.StatusMethodNotAllowed, codeMethodNotAllowed, req.Method+" is not allowed")
     }
   })
 
-  server := httptools.CreateServer(8083, httpHandler)
-
-  server.Start()
-
-  signal.WaitForTerminationSignal()
+  return &service{
+    db:      db,
+    usage:   usage,
+    verify:  verify,
+    handler: httpHandler,
+    grpc:    newGRPCServer(db, auth, limiter, usage, follower, *readOnlyMode, tlsConfig),
+  }, nil
 }
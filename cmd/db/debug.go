@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+)
+
+// RuntimeRes is the body of /debug/runtime, for profiling a db in situ
+// along with the profiles of /debug/pprof/.
+type RuntimeRes struct {
+	Goroutines int             `json:"goroutines"`
+	GoMaxProcs int             `json:"gomaxprocs"`
+	GC         GCStats         `json:"gc"`
+	Stats      datastore.Stats `json:"stats"`
+}
+
+type GCStats struct {
+	Cycles      uint32        `json:"cycles"`
+	PauseTotal  time.Duration `json:"pause_total_ns"`
+	LastPause   time.Duration `json:"last_pause_ns"`
+	LastGC      string        `json:"last_gc,omitempty"`
+	HeapAlloc   uint64        `json:"heap_alloc"`
+	HeapObjects uint64        `json:"heap_objects"`
+	NextGC      uint64        `json:"next_gc"`
+	Sys         uint64        `json:"sys"`
+}
+
+func gcStats() GCStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	stats := GCStats{
+		Cycles:      m.NumGC,
+		PauseTotal:  time.Duration(m.PauseTotalNs),
+		HeapAlloc:   m.HeapAlloc,
+		HeapObjects: m.HeapObjects,
+		NextGC:      m.NextGC,
+		Sys:         m.Sys,
+	}
+	if m.NumGC > 0 {
+		stats.LastPause = time.Duration(m.PauseNs[(m.NumGC+255)%256])
+		stats.LastGC = time.Unix(0, int64(m.LastGC)).UTC().Format(time.RFC3339Nano)
+	}
+	return stats
+}
+
+// runtimeHandler serves the goroutine count, the GC stats of the process
+// and the Stats of the db.
+func runtimeHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, _ *http.Request) {
+		res := RuntimeRes{
+			Goroutines: runtime.NumGoroutine(),
+			GoMaxProcs: runtime.GOMAXPROCS(0),
+			GC:         gcStats(),
+			Stats:      db.Stats(),
+		}
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(res)
+	}
+}
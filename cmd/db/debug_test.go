@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebug(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	get := func(s *service, url, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusNotFound, get(s, "/debug/runtime", "").Code)
+	assert.Equal(t, http.StatusNotFound, get(s, "/debug/pprof/", "").Code)
+	assert.Equal(t, http.StatusNotFound, get(s, "/debug/vars", "").Code)
+	s.Close()
+
+	defer func(debug bool, keys string) { *debugMode, *adminKeys = debug, keys }(*debugMode, *adminKeys)
+	*debugMode, *adminKeys = true, "ops"
+	s, err = newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, err = s.db.PutString("key", "value")
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusUnauthorized, get(s, "/debug/runtime", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, get(s, "/debug/vars", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, get(s, "/debug/pprof/", "").Code)
+	rec := get(s, "/debug/runtime", "ops")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res RuntimeRes
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Greater(t, res.Goroutines, 0)
+	assert.Greater(t, res.GC.HeapAlloc, uint64(0))
+	assert.Equal(t, s.db.Stats().Keys, res.Stats.Keys)
+
+	rec = get(s, "/debug/pprof/goroutine?debug=1", "ops")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "goroutine profile")
+	assert.Equal(t, http.StatusOK, get(s, "/debug/pprof/", "ops").Code)
+	assert.Equal(t, http.StatusOK, get(s, "/debug/pprof/cmdline", "ops").Code)
+	rec = get(s, "/debug/vars", "ops")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "cmdline")
+}
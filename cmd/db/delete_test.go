@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelete(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	do := func(method, url, body string) int {
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return rec.Code
+	}
+	keysOwned := func() int64 {
+		s.usage.mu.Lock()
+		defer s.usage.mu.Unlock()
+		return s.usage.get(anonymousUser).KeysOwned
+	}
+
+	body, _ := json.Marshal(Req{Value: "value1"})
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/db/key", string(body)))
+	assert.Equal(t, int64(1), keysOwned())
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/db/key", ""))
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/db/key", ""))
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/db/key", ""))
+	assert.Equal(t, int64(0), keysOwned())
+
+	// The key can be created again.
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/db/key", string(body)))
+	assert.Equal(t, int64(1), keysOwned())
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/db/key", strings.NewReader(string(body))))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "GET, HEAD, POST, DELETE", rec.Header().Get("allow"))
+}
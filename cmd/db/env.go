@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// envFlags are the flags an environment variable sets, for deployments
+// configured through the environment. Flags given on the command line take
+// precedence.
+var envFlags = map[string]string{
+	"port":         "DB_PORT",
+	"grpc-port":    "DB_GRPC_PORT",
+	"dir":          "DB_DIR",
+	"segment-size": "DB_SEGMENT_SIZE",
+	"api-keys":     "DB_API_KEYS",
+	"admin-keys":   "DB_ADMIN_KEYS",
+	"follow-key":   "DB_FOLLOW_KEY",
+}
+
+// setFlagsFromEnv sets the flags of envFlags from the variables lookup
+// finds, before the command line is parsed.
+func setFlagsFromEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	for name, env := range envFlags {
+		if val, ok := lookup(env); ok {
+			if err := fs.Set(name, val); err != nil {
+				return fmt.Errorf("invalid %s: %w", env, err)
+			}
+		}
+	}
+	return nil
+}
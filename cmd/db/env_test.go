@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	newFlags := func() (*flag.FlagSet, *int, *string, *datastore.MemoryUnit) {
+		fs := flag.NewFlagSet("db", flag.ContinueOnError)
+		port := fs.Int("port", 8083, "")
+		dir := fs.String("dir", "data", "")
+		size := 10 * datastore.Megabyte
+		fs.Var(&size, "segment-size", "")
+		return fs, port, dir, &size
+	}
+	env := map[string]string{"DB_PORT": "9000", "DB_DIR": "/var/lib/db", "DB_SEGMENT_SIZE": "64MB"}
+	lookup := func(name string) (string, bool) {
+		val, ok := env[name]
+		return val, ok
+	}
+
+	fs, port, dir, size := newFlags()
+	assert.Nil(t, setFlagsFromEnv(fs, lookup))
+	assert.Nil(t, fs.Parse([]string{"-port", "9001"}))
+	// The command line wins over the environment.
+	assert.Equal(t, 9001, *port)
+	assert.Equal(t, "/var/lib/db", *dir)
+	assert.Equal(t, 64*datastore.Megabyte, *size)
+
+	env["DB_SEGMENT_SIZE"] = "big"
+	fs, _, _, _ = newFlags()
+	assert.ErrorContains(t, setFlagsFromEnv(fs, lookup), "DB_SEGMENT_SIZE")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+)
+
+// Codes of ErrorRes, stable for clients to branch on unlike messages.
+const (
+	codeBadRequest       = "bad_request"
+	codeInvalidKey       = "invalid_key"
+	codeUnsupportedType  = "unsupported_type"
+	codeNotFound         = "not_found"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeReadOnly         = "read_only"
+	codeConflict         = "conflict"
+	codePrecondition     = "precondition_failed"
+	codeTooLarge         = "too_large"
+	codeLengthRequired   = "length_required"
+	codeQuotaExceeded    = "quota_exceeded"
+	codeTooManyRequests  = "too_many_requests"
+	codeUnavailable      = "unavailable"
+	codeInternal         = "internal"
+)
+
+// ErrorRes is the body of error responses.
+type ErrorRes struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeError(rw http.ResponseWriter, status int, code, message string) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(ErrorRes{Code: code, Message: message})
+}
+
+func badRequest(rw http.ResponseWriter, err error) {
+	writeError(rw, http.StatusBadRequest, codeBadRequest, err.Error())
+}
+
+func notFound(rw http.ResponseWriter) {
+	writeError(rw, http.StatusNotFound, codeNotFound, "key not found")
+}
+
+// readOnly answers writes to a follower, which only takes the writes of its
+// leader.
+func readOnly(rw http.ResponseWriter) {
+	writeError(rw, http.StatusForbidden, codeReadOnly, "the db follows a leader and takes no writes")
+}
+
+func internalError(rw http.ResponseWriter, err error) {
+	writeError(rw, http.StatusInternalServerError, codeInternal, err.Error())
+}
+
+// writeFailed answers a failed write with the status of its error.
+func writeFailed(rw http.ResponseWriter, err error) {
+	status, code := failedStatus(err)
+	writeError(rw, status, code, err.Error())
+}
+
+// failedStatus returns the status and code of a failed write.
+func failedStatus(err error) (int, string) {
+	switch {
+	case err == errStorageQuota || errors.Is(err, datastore.ErrDiskQuotaExceeded):
+		return http.StatusInsufficientStorage, codeQuotaExceeded
+	case errors.Is(err, datastore.ErrCompactionFailing), errors.Is(err, datastore.ErrClockSkew),
+		errors.Is(err, datastore.ErrClosed), errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable, codeUnavailable
+	case errors.Is(err, datastore.ErrInvalidKey), errors.Is(err, datastore.ErrReservedKey),
+		errors.Is(err, datastore.ErrInvalidBucket), errors.Is(err, datastore.ErrReservedBucket):
+		return http.StatusBadRequest, codeInvalidKey
+	case errors.Is(err, datastore.ErrNotInt64):
+		return http.StatusConflict, codeConflict
+	case errors.Is(err, datastore.ErrOverflow), errors.Is(err, datastore.ErrNegativeSize):
+		return http.StatusBadRequest, codeBadRequest
+	case errors.Is(err, datastore.ErrConflict):
+		return http.StatusPreconditionFailed, codePrecondition
+	case errors.Is(err, datastore.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge, codeTooLarge
+	default:
+		return http.StatusInternalServerError, codeInternal
+	}
+}
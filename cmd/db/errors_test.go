@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrors(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	do := func(method, url, body string) (int, ErrorRes) {
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, httptest.NewRequest(method, url, strings.NewReader(body)))
+		var res ErrorRes
+		if rec.Code >= 400 {
+			assert.Equal(t, "application/json", rec.Header().Get("content-type"))
+			assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+			assert.NotEmpty(t, res.Message)
+		}
+		return rec.Code, res
+	}
+
+	for _, body := range []string{`{"value": true}`, `{"value": {"a": 1}}`, `{"value": null}`, `{}`, `{"value": 1.5}`} {
+		code, res := do(http.MethodPost, "/db/key", body)
+		assert.Equal(t, http.StatusBadRequest, code, body)
+		assert.Equal(t, codeUnsupportedType, res.Code, body)
+	}
+	_, err = s.db.GetString("key")
+	assert.Equal(t, datastore.ErrNotFound, err)
+
+	code, res := do(http.MethodPost, "/db/key", `{"value": `)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, codeBadRequest, res.Code)
+
+	code, res = do(http.MethodGet, "/db/key", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, codeNotFound, res.Code)
+
+	code, res = do(http.MethodPut, "/db/key", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	assert.Equal(t, codeMethodNotAllowed, res.Code)
+
+	code, res = do(http.MethodPost, "/admin/promote", "")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, codeConflict, res.Code)
+
+	code, res = do(http.MethodPost, "/db/key", `{"value": 42}`)
+	assert.Equal(t, http.StatusCreated, code)
+}
+
+func TestWriteFailed(t *testing.T) {
+	for err, want := range map[error]struct {
+		status int
+		code   string
+	}{
+		errStorageQuota:                                     {http.StatusInsufficientStorage, codeQuotaExceeded},
+		datastore.ErrDiskQuotaExceeded:                      {http.StatusInsufficientStorage, codeQuotaExceeded},
+		datastore.ErrCompactionFailing:                      {http.StatusServiceUnavailable, codeUnavailable},
+		datastore.ErrClockSkew:                              {http.StatusServiceUnavailable, codeUnavailable},
+		datastore.ErrClosed:                                 {http.StatusServiceUnavailable, codeUnavailable},
+		datastore.ErrInvalidKey:                             {http.StatusBadRequest, codeInvalidKey},
+		datastore.ErrConflict:                               {http.StatusPreconditionFailed, codePrecondition},
+		datastore.ErrNotInt64:                               {http.StatusConflict, codeConflict},
+		datastore.ErrOverflow:                               {http.StatusBadRequest, codeBadRequest},
+		datastore.ErrTooLarge:                               {http.StatusRequestEntityTooLarge, codeTooLarge},
+		fmt.Errorf("disk on fire"):                          {http.StatusInternalServerError, codeInternal},
+		fmt.Errorf("%w: too long", datastore.ErrInvalidKey): {http.StatusBadRequest, codeInvalidKey},
+	} {
+		rec := httptest.NewRecorder()
+		writeFailed(rec, err)
+		assert.Equal(t, want.status, rec.Code, err.Error())
+		var res ErrorRes
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+		assert.Equal(t, ErrorRes{Code: want.code, Message: err.Error()}, res)
+	}
+}
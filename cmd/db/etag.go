@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+)
+
+// etag is the entity tag of a key at the revision.
+func etag(rev uint64) string {
+	return `"` + strconv.FormatUint(rev, 10) + `"`
+}
+
+// conditional reports whether the request has an If-Match or If-None-Match
+// header.
+func conditional(req *http.Request) bool {
+	return req.Header.Get("if-match") != "" || req.Header.Get("if-none-match") != ""
+}
+
+// writeRevision returns the revision a write or a delete is conditioned on
+// by the If-Match or If-None-Match header of the request,
+// datastore.AnyRevision if there is none. If-None-Match: * only creates the
+// key, If-Match takes the tag of a single revision.
+func writeRevision(req *http.Request) (uint64, error) {
+	if match := req.Header.Get("if-none-match"); match != "" {
+		if match != "*" {
+			return 0, fmt.Errorf("unsupported If-None-Match %q", match)
+		}
+		return 0, nil
+	}
+	match := req.Header.Get("if-match")
+	if match == "" {
+		return datastore.AnyRevision, nil
+	}
+	tag := strings.TrimPrefix(strings.TrimSpace(match), "W/")
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, fmt.Errorf("malformed If-Match %q", match)
+	}
+	rev, err := strconv.ParseUint(tag[1:len(tag)-1], 10, 64)
+	if err != nil || rev == datastore.AnyRevision {
+		return 0, fmt.Errorf("malformed If-Match %q", match)
+	}
+	return rev, nil
+}
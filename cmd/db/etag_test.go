@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteRevision(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/db/key", nil)
+	rev, err := writeRevision(req)
+	assert.Nil(t, err)
+	assert.Equal(t, datastore.AnyRevision, rev)
+
+	req.Header.Set("if-match", `"42"`)
+	rev, err = writeRevision(req)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(42), rev)
+
+	req.Header.Set("if-match", "42")
+	_, err = writeRevision(req)
+	assert.NotNil(t, err)
+
+	req.Header.Set("if-none-match", "*")
+	rev, err = writeRevision(req)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), rev)
+}
+
+func TestConditionalWrites(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-etag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	server := httptest.NewServer(s.handler)
+	defer server.Close()
+
+	post := func(header, tag, value string) *http.Response {
+		body, _ := json.Marshal(Req{Value: value})
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/db/key", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != "" {
+			req.Header.Set(header, tag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := post("if-none-match", "*", "v1")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	created := resp.Header.Get("etag")
+	assert.NotEmpty(t, created)
+	resp = post("if-none-match", "*", "v1")
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/db/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, created, resp.Header.Get("etag"))
+
+	resp = post("if-match", created, "v2")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	updated := resp.Header.Get("etag")
+	assert.NotEqual(t, created, updated)
+
+	// The first tag is stale now.
+	resp = post("if-match", created, "v3")
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	val, err := s.db.GetString("key")
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", val)
+
+	resp = post("if-match", "bad", "v3")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	del := func(header, tag string) int {
+		req, err := http.NewRequest(http.MethodDelete, server.URL+"/db/key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != "" {
+			req.Header.Set(header, tag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusPreconditionFailed, del("if-match", created))
+	assert.Equal(t, http.StatusBadRequest, del("if-none-match", "*"))
+	assert.True(t, s.db.Has("key"))
+	assert.Equal(t, http.StatusNoContent, del("if-match", updated))
+	assert.False(t, s.db.Has("key"))
+	assert.Equal(t, http.StatusPreconditionFailed, del("if-match", updated))
+	assert.Equal(t, http.StatusNotFound, del("", ""))
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Gopack-go-labs/labs4-5/api/dbpb"
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/Gopack-go-labs/labs4-5/datastore/replication"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer serves the gRPC API of api/dbpb with the semantics of the
+// routes of /db: the same keys, quotas and revisions.
+type grpcServer struct {
+	dbpb.UnimplementedDbServer
+	db       *datastore.Db
+	usage    *UsageTracker
+	follower *replication.Follower
+	readOnly bool
+}
+
+// newGRPCServer returns a grpc.Server serving the API. Clients present their
+// API key in the x-api-key metadata, it is checked by auth, limited by
+// limiter and requests are counted against its quotas as HTTP ones are. With
+// readOnly, writes are refused as Unavailable. With tlsConfig set, calls are
+// served over TLS.
+func newGRPCServer(db *datastore.Db, auth *Auth, limiter *RateLimiter, usage *UsageTracker, follower *replication.Follower, readOnly bool, tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := auth.checkGRPC(ctx, info.FullMethod != dbpb.Db_Get_FullMethodName)
+			if err != nil {
+				return nil, err
+			}
+			if err := limiter.checkGRPC(ctx); err != nil {
+				return nil, err
+			}
+			if ctx, err = usage.countGRPC(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		// Watch is the only stream, it reads.
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := auth.checkGRPC(stream.Context(), false)
+			if err != nil {
+				return err
+			}
+			if err := limiter.checkGRPC(ctx); err != nil {
+				return err
+			}
+			if ctx, err = usage.countGRPC(ctx); err != nil {
+				return err
+			}
+			return handler(srv, principalStream{stream, ctx})
+		}),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(opts...)
+	dbpb.RegisterDbServer(server, &grpcServer{db: db, usage: usage, follower: follower, readOnly: readOnly})
+	return server
+}
+
+func grpcAPIKey(ctx context.Context) string {
+	if keys := metadata.ValueFromIncomingContext(ctx, strings.ToLower(apiKeyHeader)); len(keys) > 0 {
+		return keys[0]
+	}
+	return ""
+}
+
+// checkGRPC is Auth.Middleware for gRPC calls, it returns the context with
+// the principal of the call.
+func (a *Auth) checkGRPC(ctx context.Context, write bool) (context.Context, error) {
+	if a == nil {
+		return ctx, nil
+	}
+	key := grpcAPIKey(ctx)
+	switch httpStatus, msg := a.check(key, write); httpStatus {
+	case http.StatusUnauthorized:
+		return nil, status.Error(codes.Unauthenticated, msg)
+	case http.StatusForbidden:
+		return nil, status.Error(codes.PermissionDenied, msg)
+	}
+	return contextWithPrincipal(ctx, keyID(key)), nil
+}
+
+// countGRPC counts a call as Middleware counts a request and attaches the
+// client to the context.
+func (t *UsageTracker) countGRPC(ctx context.Context) (context.Context, error) {
+	client := grpcClient(ctx)
+	if !t.countRequest(client) {
+		return nil, status.Error(codes.ResourceExhausted, "request quota exceeded")
+	}
+	return contextWithPrincipal(ctx, client), nil
+}
+
+type principalStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s principalStream) Context() context.Context {
+	return s.ctx
+}
+
+func grpcClient(ctx context.Context) string {
+	if principal, ok := principalFrom(ctx); ok {
+		return principal
+	}
+	return anonymousUser
+}
+
+// grpcError is writeFailed for gRPC, the status of a failed call.
+func grpcError(err error) error {
+	switch {
+	case err == errStorageQuota || errors.Is(err, datastore.ErrDiskQuotaExceeded):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, datastore.ErrCompactionFailing), errors.Is(err, datastore.ErrClockSkew), errors.Is(err, datastore.ErrClosed):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, datastore.ErrInvalidKey), errors.Is(err, datastore.ErrReservedKey),
+		errors.Is(err, datastore.ErrOverflow), errors.Is(err, datastore.ErrTooLarge):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, datastore.ErrConflict), errors.Is(err, datastore.ErrNotInt64):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case err == datastore.ErrNotFound:
+		return status.Error(codes.NotFound, "key not found")
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return status.FromContextError(err).Err()
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// checkWrite refuses writes to a follower or a -read-only db and keys
+// /db/{key} could not address.
+func (s *grpcServer) checkWrite(key string) error {
+	if s.readOnly {
+		return status.Error(codes.Unavailable, readOnlyMessage)
+	}
+	if following(s.follower) {
+		return status.Error(codes.PermissionDenied, "the db follows a leader and takes no writes")
+	}
+	if err := checkBatchKey(key); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return nil
+}
+
+func toValue(v interface{}) *dbpb.Value {
+	switch v := v.(type) {
+	case string:
+		return &dbpb.Value{Kind: &dbpb.Value_StringValue{StringValue: v}}
+	case int64:
+		return &dbpb.Value{Kind: &dbpb.Value_Int64Value{Int64Value: v}}
+	}
+	return nil
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func (s *grpcServer) Get(ctx context.Context, req *dbpb.GetRequest) (*dbpb.GetResponse, error) {
+	if err := checkBatchKey(req.Key); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	val, meta, err := s.db.GetWithMetaContext(ctx, req.Key)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	value := toValue(val)
+	if value == nil {
+		return nil, status.Error(codes.NotFound, "key not found")
+	}
+	return &dbpb.GetResponse{Key: req.Key, Value: value, Revision: meta.Seq, ExpiresAt: unixNano(meta.ExpiresAt)}, nil
+}
+
+func (s *grpcServer) Put(ctx context.Context, req *dbpb.PutRequest) (*dbpb.PutResponse, error) {
+	if err := s.checkWrite(req.Key); err != nil {
+		return nil, err
+	}
+	if req.TtlMillis < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl_millis must not be negative")
+	}
+	ttl := time.Duration(req.TtlMillis) * time.Millisecond
+	rev := datastore.AnyRevision
+	if req.IfRevision != nil {
+		rev = *req.IfRevision
+	}
+
+	var err error
+	switch v := req.GetValue().GetKind().(type) {
+	case *dbpb.Value_StringValue:
+		err = s.usage.Write(grpcClient(ctx), req.Key, int64(len(req.Key)+len(v.StringValue)), func() error {
+			rev, err = putString(ctx, s.db, req.Key, v.StringValue, rev, ttl)
+			return err
+		})
+	case *dbpb.Value_Int64Value:
+		err = s.usage.Write(grpcClient(ctx), req.Key, int64(len(req.Key)+8), func() error {
+			rev, err = putInt64(ctx, s.db, req.Key, v.Int64Value, rev, ttl)
+			return err
+		})
+	default:
+		return nil, status.Error(codes.InvalidArgument, "a value is required")
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &dbpb.PutResponse{Revision: rev}, nil
+}
+
+func (s *grpcServer) Delete(ctx context.Context, req *dbpb.DeleteRequest) (*dbpb.DeleteResponse, error) {
+	if err := s.checkWrite(req.Key); err != nil {
+		return nil, err
+	}
+	rev := datastore.AnyRevision
+	if req.IfRevision != nil {
+		rev = *req.IfRevision
+	}
+	if !s.db.Has(req.Key) {
+		if rev != datastore.AnyRevision {
+			return nil, status.Error(codes.FailedPrecondition, "key not found")
+		}
+		return nil, status.Error(codes.NotFound, "key not found")
+	}
+	err := s.usage.Delete(req.Key, func() error {
+		return s.db.DeleteIfRevisionContext(ctx, req.Key, rev)
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &dbpb.DeleteResponse{}, nil
+}
+
+// Batch is /db/_batch: every write is checked before any is applied, on a
+// failure the writes applied are in the written trailer.
+func (s *grpcServer) Batch(ctx context.Context, req *dbpb.BatchRequest) (*dbpb.BatchResponse, error) {
+	if s.readOnly {
+		return nil, status.Error(codes.Unavailable, readOnlyMessage)
+	}
+	if following(s.follower) {
+		return nil, status.Error(codes.PermissionDenied, "the db follows a leader and takes no writes")
+	}
+	if len(req.Writes) > maxBatchSize {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d writes are allowed", maxBatchSize)
+	}
+
+	var b datastore.Batch
+	keys := make([]string, len(req.Writes))
+	sizes := make([]int64, len(req.Writes))
+	for i, w := range req.Writes {
+		if err := checkBatchKey(w.Key); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		switch v := w.GetValue().GetKind().(type) {
+		case *dbpb.Value_StringValue:
+			b.PutString(w.Key, v.StringValue)
+			sizes[i] = int64(len(w.Key) + len(v.StringValue))
+		case *dbpb.Value_Int64Value:
+			b.PutInt64(w.Key, v.Int64Value)
+			sizes[i] = int64(len(w.Key) + 8)
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "write of %q has no value", w.Key)
+		}
+		keys[i] = w.Key
+	}
+
+	n, err := s.usage.WriteBatch(grpcClient(ctx), keys, sizes, func() (int, error) {
+		return s.db.WriteContext(ctx, &b)
+	})
+	if err != nil {
+		_ = grpc.SetTrailer(ctx, metadata.Pairs("x-written", fmt.Sprint(n)))
+		return nil, grpcError(err)
+	}
+	return &dbpb.BatchResponse{Written: int32(n)}, nil
+}
+
+// Watch streams the change feed of the Db. Keys of the service and of
+// buckets are left out. The stream fails with ABORTED when the watcher lags
+// too far behind; it may resume from the last seq it got.
+func (s *grpcServer) Watch(req *dbpb.WatchRequest, stream dbpb.Db_WatchServer) error {
+	ctx := stream.Context()
+	changes, err := s.db.Watch(ctx, req.Prefix, req.SinceSeq)
+	if err != nil {
+		return grpcError(err)
+	}
+	for c := range changes {
+		if internalKey(c.Key) {
+			continue
+		}
+		// Deletes and writes expired meanwhile come without a value.
+		event := &dbpb.WatchEvent{Seq: c.Seq, Key: c.Key, ExpiresAt: unixNano(c.ExpiresAt)}
+		if c.ExpiresAt.IsZero() || c.ExpiresAt.After(time.Now()) {
+			event.Value = toValue(c.Value)
+		}
+		if err := stream.Send(event); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	return status.Error(codes.Aborted, "the watcher fell behind the change feed")
+}
+
+// serveGRPC serves the gRPC API on the port until stopGRPC.
+func serveGRPC(server *grpc.Server, port int) {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Printf("Failed to listen for gRPC: %s", err)
+		return
+	}
+	log.Printf("Serving gRPC on %s", lis.Addr())
+	if err := server.Serve(lis); err != nil {
+		log.Printf("Failed to serve gRPC: %s", err)
+	}
+}
+
+// stopGRPC lets calls in flight finish until ctx is done. Watch streams only
+// end with their clients, so they are cut then.
+func stopGRPC(ctx context.Context, server *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		server.Stop()
+	}
+}
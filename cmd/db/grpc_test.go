@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/Gopack-go-labs/labs4-5/api/dbpb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPC(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	lis := bufconn.Listen(1024 * 1024)
+	go s.grpc.Serve(lis)
+	defer s.grpc.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := dbpb.NewDbClient(conn)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "alice")
+
+	code := func(err error) codes.Code {
+		return status.Code(err)
+	}
+	str := func(s string) *dbpb.Value {
+		return &dbpb.Value{Kind: &dbpb.Value_StringValue{StringValue: s}}
+	}
+
+	put, err := client.Put(ctx, &dbpb.PutRequest{Key: "key1", Value: str("value1")})
+	assert.Nil(t, err)
+	got, err := client.Get(ctx, &dbpb.GetRequest{Key: "key1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "value1", got.Value.GetStringValue())
+	assert.Equal(t, put.Revision, got.Revision)
+	assert.Zero(t, got.ExpiresAt)
+	assert.Equal(t, int64(1), s.usage.get(anonymousUser).KeysOwned)
+
+	t.Run("Revisions", func(t *testing.T) {
+		stale := put.Revision - 1
+		_, err := client.Put(ctx, &dbpb.PutRequest{Key: "key1", Value: str("value2"), IfRevision: &stale})
+		assert.Equal(t, codes.FailedPrecondition, code(err))
+		_, err = client.Delete(ctx, &dbpb.DeleteRequest{Key: "key1", IfRevision: &stale})
+		assert.Equal(t, codes.FailedPrecondition, code(err))
+		_, err = client.Delete(ctx, &dbpb.DeleteRequest{Key: "key1", IfRevision: &put.Revision})
+		assert.Nil(t, err)
+		_, err = client.Get(ctx, &dbpb.GetRequest{Key: "key1"})
+		assert.Equal(t, codes.NotFound, code(err))
+		_, err = client.Delete(ctx, &dbpb.DeleteRequest{Key: "key1"})
+		assert.Equal(t, codes.NotFound, code(err))
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		_, err := client.Put(ctx, &dbpb.PutRequest{Key: "ttl", Value: str("value"), TtlMillis: 60000})
+		assert.Nil(t, err)
+		got, err := client.Get(ctx, &dbpb.GetRequest{Key: "ttl"})
+		assert.Nil(t, err)
+		assert.NotZero(t, got.ExpiresAt)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := client.Get(ctx, &dbpb.GetRequest{Key: systemPrefix + "usage"})
+		assert.Equal(t, codes.InvalidArgument, code(err))
+		_, err = client.Put(ctx, &dbpb.PutRequest{Key: "key"})
+		assert.Equal(t, codes.InvalidArgument, code(err))
+		_, err = client.Put(ctx, &dbpb.PutRequest{Key: "", Value: str("value")})
+		assert.Equal(t, codes.InvalidArgument, code(err))
+		_, err = client.Batch(ctx, &dbpb.BatchRequest{Writes: []*dbpb.BatchWrite{{Key: "a", Value: str("1")}, {Key: "b"}}})
+		assert.Equal(t, codes.InvalidArgument, code(err))
+		assert.False(t, s.db.Has("a"))
+	})
+
+	t.Run("BatchAndWatch", func(t *testing.T) {
+		before, err := client.Put(ctx, &dbpb.PutRequest{Key: "before", Value: str("value")})
+		assert.Nil(t, err)
+		res, err := client.Batch(ctx, &dbpb.BatchRequest{Writes: []*dbpb.BatchWrite{
+			{Key: "batch:a", Value: str("a")},
+			{Key: "other", Value: str("b")},
+			{Key: "batch:c", Value: &dbpb.Value{Kind: &dbpb.Value_Int64Value{Int64Value: 3}}},
+		}})
+		assert.Nil(t, err)
+		assert.Equal(t, int32(3), res.Written)
+
+		watchCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stream, err := client.Watch(watchCtx, &dbpb.WatchRequest{Prefix: "batch:", SinceSeq: before.Revision})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recv := func() *dbpb.WatchEvent {
+			event, err := stream.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return event
+		}
+
+		event := recv()
+		assert.Equal(t, "batch:a", event.Key)
+		assert.Equal(t, "a", event.Value.GetStringValue())
+		event = recv()
+		assert.Equal(t, "batch:c", event.Key)
+		assert.Equal(t, int64(3), event.Value.GetInt64Value())
+
+		_, err = client.Delete(ctx, &dbpb.DeleteRequest{Key: "batch:a"})
+		assert.Nil(t, err)
+		deleted := recv()
+		assert.Equal(t, "batch:a", deleted.Key)
+		assert.Nil(t, deleted.Value)
+		assert.Less(t, event.Seq, deleted.Seq)
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// compress gzips responses of at least minSize bytes for clients sending
+// Accept-Encoding: gzip, smaller ones are not worth it. Responses flushed
+// before they reach minSize, as streams are, go uncompressed, and so do
+// responses whose handler set a content-length or the octet-stream content
+// type, raw values whose size is promised and which are sent by sendfile.
+// It is to be passed to Router.Use, a minSize of 0 compresses nothing.
+func compress(minSize int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if minSize <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Add("vary", "Accept-Encoding")
+			if req.Method == http.MethodHead || !acceptsGzip(req) {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			gw := &gzipResponseWriter{ResponseWriter: rw, minSize: minSize}
+			defer gw.Close()
+			next.ServeHTTP(gw, req)
+		})
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of the request
+// lists gzip with a non-zero quality.
+func acceptsGzip(req *http.Request) bool {
+	for _, enc := range strings.Split(req.Header.Get("accept-encoding"), ",") {
+		name, params, _ := strings.Cut(enc, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		quality, err := strconv.ParseFloat(q, 64)
+		return err == nil && quality > 0
+	}
+	return false
+}
+
+// gzipResponseWriter holds the status and the first bytes of a response
+// until minSize bytes are written, when it starts to compress, or the
+// response is flushed or done, when it sends them as they are.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int64
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	plain   bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		if w.uncompressible() {
+			_ = w.start(false)
+		}
+	}
+}
+
+// uncompressible reports whether the headers set by the handler rule out
+// compressing the response.
+func (w *gzipResponseWriter) uncompressible() bool {
+	h := w.Header()
+	return h.Get("content-length") != "" || h.Get("content-encoding") != "" ||
+		strings.HasPrefix(h.Get("content-type"), rawContentType)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.plain {
+		return w.ResponseWriter.Write(p)
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if int64(len(w.buf)) >= w.minSize {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// start sends the status and the bytes held, compressed if compressed is
+// set and the handler did not encode the response itself.
+func (w *gzipResponseWriter) start(compressed bool) error {
+	h := w.Header()
+	if w.uncompressible() {
+		compressed = false
+	}
+	buf := w.buf
+	w.buf = nil
+	if !compressed {
+		w.plain = true
+		if w.status != 0 {
+			w.ResponseWriter.WriteHeader(w.status)
+		}
+		if len(buf) == 0 {
+			return nil
+		}
+		_, err := w.ResponseWriter.Write(buf)
+		return err
+	}
+
+	// The compressed bytes would be sniffed otherwise.
+	if h.Get("content-type") == "" {
+		h.Set("content-type", http.DetectContentType(buf))
+	}
+	h.Del("content-length")
+	h.Set("content-encoding", "gzip")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.gz = gzipWriters.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+	_, err := w.gz.Write(buf)
+	return err
+}
+
+// ReadFrom passes uncompressed responses to the io.ReaderFrom of the wrapped
+// writer, so io.Copy gets to use sendfile through the middleware.
+func (w *gzipResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok && w.plain {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(writerOnly{w}, r)
+}
+
+// writerOnly hides the ReadFrom of a writer from io.Copy.
+type writerOnly struct {
+	io.Writer
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	} else if !w.plain {
+		_ = w.start(false)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close ends the compressed stream, or sends a response too small to
+// compress.
+func (w *gzipResponseWriter) Close() {
+	if w.gz != nil {
+		_ = w.gz.Close()
+		gzipWriters.Put(w.gz)
+		w.gz = nil
+		return
+	}
+	if !w.plain {
+		_ = w.start(false)
+	}
+}
+
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat(`{"key": "value"}`, 100)
+	handler := compress(1024)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		body := large
+		if req.URL.Query().Get("small") != "" {
+			body = "{}"
+		}
+		// Written in parts, across the min size.
+		_, _ = io.WriteString(rw, body[:len(body)/2])
+		_, _ = io.WriteString(rw, body[len(body)/2:])
+	}))
+	do := func(url, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("accept-encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("/", "deflate, gzip")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("content-encoding"))
+	assert.Equal(t, "application/json", rec.Header().Get("content-type"))
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("vary"))
+	r, err := gzip.NewReader(rec.Body)
+	assert.Nil(t, err)
+	body, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, large, string(body))
+
+	for _, c := range []struct{ url, acceptEncoding, body string }{
+		{"/", "", large},
+		{"/", "gzip;q=0", large},
+		{"/", "br", large},
+		{"/?small=1", "gzip", "{}"},
+	} {
+		rec := do(c.url, c.acceptEncoding)
+		assert.Equal(t, http.StatusCreated, rec.Code, c)
+		assert.Empty(t, rec.Header().Get("content-encoding"), c)
+		assert.Equal(t, c.body, rec.Body.String(), c)
+	}
+}
+
+func TestCompress_Flush(t *testing.T) {
+	handler := compress(1024)(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		rw.(http.Flusher).Flush()
+		_, _ = io.WriteString(rw, strings.Repeat("event\n", 1000))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("accept-encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.True(t, rec.Flushed)
+	assert.Empty(t, rec.Header().Get("content-encoding"))
+	assert.Equal(t, strings.Repeat("event\n", 1000), rec.Body.String())
+}
+
+// readerFromRecorder is a recorder whose ReadFrom is told apart from Write,
+// as that of the writers of net/http which use sendfile is.
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom int64
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(r.ResponseRecorder, src)
+	r.readFrom += n
+	return n, err
+}
+
+func TestCompress_Uncompressible(t *testing.T) {
+	large := strings.Repeat("value", 1000)
+	for _, header := range []struct{ name, value string }{
+		{"content-length", strconv.Itoa(len(large))},
+		{"content-type", rawContentType},
+	} {
+		handler := compress(1024)(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			rw.Header().Set(header.name, header.value)
+			rw.WriteHeader(http.StatusOK)
+			// As serveRawString copies, with no WriterTo to the source.
+			_, _ = io.Copy(rw, io.LimitReader(strings.NewReader(large), int64(len(large))))
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("accept-encoding", "gzip")
+		rec := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+		handler.ServeHTTP(rec, req)
+		assert.Empty(t, rec.Header().Get("content-encoding"), header.name)
+		assert.Equal(t, large, rec.Body.String(), header.name)
+		assert.Equal(t, int64(len(large)), rec.readFrom, header.name)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+)
+
+// serveHead answers a HEAD request for the key with the headers a GET of
+// the value would have, along with its type and size, without reading the
+// value. Values of another type than asked for are missing as for GET. raw
+// is set for GETs which would get the raw string.
+func serveHead(rw http.ResponseWriter, describe func(key string) (datastore.ValueInfo, error), key string, want datastore.ValueType, raw bool) {
+	info, err := describe(key)
+	if err != nil || info.Type != want {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	h := rw.Header()
+	h.Set("etag", etag(info.Seq))
+	h.Set("x-value-type", info.Type.String())
+	h.Set("x-value-size", strconv.FormatInt(info.Size, 10))
+	if !info.UpdatedAt.IsZero() {
+		h.Set("last-modified", info.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+	if raw && want == datastore.Str {
+		h.Set("content-type", rawContentType)
+		h.Set("content-length", strconv.FormatInt(info.Size, 10))
+	} else {
+		h.Set("content-type", "application/json")
+	}
+	rw.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHead(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-head")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	body, _ := json.Marshal(Req{Value: "value1"})
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/key", strings.NewReader(string(body))))
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	head := func(url, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodHead, url, nil)
+		if accept != "" {
+			req.Header.Set("accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec = head("/db/key", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "string", rec.Header().Get("x-value-type"))
+	assert.Equal(t, "6", rec.Header().Get("x-value-size"))
+	assert.NotEmpty(t, rec.Header().Get("etag"))
+	assert.NotEmpty(t, rec.Header().Get("last-modified"))
+	assert.Equal(t, 0, rec.Body.Len())
+
+	get := httptest.NewRecorder()
+	s.handler.ServeHTTP(get, httptest.NewRequest(http.MethodGet, "/db/key", nil))
+	assert.Equal(t, get.Header().Get("etag"), rec.Header().Get("etag"))
+
+	rec = head("/db/key", rawContentType)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "6", rec.Header().Get("content-length"))
+
+	assert.Equal(t, http.StatusNotFound, head("/db/key?type=int64", "").Code)
+	assert.Equal(t, http.StatusNotFound, head("/db/missing", "").Code)
+
+	t.Run("buckets", func(t *testing.T) {
+		_, err = s.db.Bucket("team").PutInt64("count", 3)
+		assert.Nil(t, err)
+		rec := head("/db/team/count?type=int64", "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "int64", rec.Header().Get("x-value-type"))
+		assert.Equal(t, 0, rec.Body.Len())
+		assert.Equal(t, http.StatusNotFound, head("/db/team/count", "").Code)
+		assert.Equal(t, http.StatusNotFound, head("/db/team/key", "").Code)
+	})
+}
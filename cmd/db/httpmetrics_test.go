@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPMetrics(t *testing.T) {
+	m := newHTTPMetrics("db")
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(m)
+
+	router := mux.NewRouter()
+	router.Use(m.middleware)
+	router.HandleFunc("/db/{key}", func(rw http.ResponseWriter, req *http.Request) {
+		if mux.Vars(req)["key"] == "missing" {
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	})
+	for _, url := range []string{"/db/a", "/db/b", "/db/missing", "/unknown"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, url, nil))
+	}
+
+	expected := `
+# HELP db_http_requests_total Requests by route, method and response code.
+# TYPE db_http_requests_total counter
+db_http_requests_total{code="200",method="get",route="/db/{key}"} 2
+db_http_requests_total{code="404",method="get",route="/db/{key}"} 1
+`
+	assert.Nil(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "db_http_requests_total"))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.duration))
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.inFlight))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/Gopack-go-labs/labs4-5/datastore/replication"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// ImportProgress is a line of the response of /db/_import, written after
+// every batch of items loaded. The last line is done or carries the error
+// the import stopped at; items imported before stay written.
+type ImportProgress struct {
+	Imported int       `json:"imported"`
+	Skipped  int       `json:"skipped"`
+	Done     bool      `json:"done,omitempty"`
+	Error    *ErrorRes `json:"error,omitempty"`
+}
+
+// internalKey reports whether the key belongs to the service or to a
+// bucket, whose keys start with a NUL byte. Clients do not address such
+// keys, though keys of the service are part of exports.
+func internalKey(key string) bool {
+	return strings.HasPrefix(key, systemPrefix) || strings.HasPrefix(key, "\x00")
+}
+
+// importHandler loads a stream of BatchItem values separated by newlines, as
+// written by /admin/export?format=ndjson, in batches of maxBatchSize items.
+// Internal keys of exports are skipped. Failures before the first batch is
+// written are answered with their status, later ones in the last progress
+// line.
+func importHandler(db *datastore.Db, usage *UsageTracker, follower *replication.Follower) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if following(follower) {
+			readOnly(rw)
+			return
+		}
+
+		var progress ImportProgress
+		started := false
+		report := func() {
+			if !started {
+				rw.Header().Set("content-type", ndjsonContentType)
+				rw.WriteHeader(http.StatusOK)
+				started = true
+			}
+			_ = json.NewEncoder(rw).Encode(progress)
+			if f, ok := rw.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+		fail := func(status int, code string, err error) {
+			if !started {
+				writeError(rw, status, code, err.Error())
+				return
+			}
+			progress.Error = &ErrorRes{Code: code, Message: err.Error()}
+			report()
+		}
+
+		var b datastore.Batch
+		var keys []string
+		var sizes []int64
+		flush := func() error {
+			n, err := usage.WriteBatch(clientKey(req), keys, sizes, func() (int, error) {
+				return db.WriteContext(req.Context(), &b)
+			})
+			progress.Imported += n
+			b, keys, sizes = datastore.Batch{}, keys[:0], sizes[:0]
+			return err
+		}
+
+		dec := json.NewDecoder(req.Body)
+		dec.UseNumber()
+		for line := 1; ; line++ {
+			var item BatchItem
+			err := dec.Decode(&item)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				fail(http.StatusBadRequest, codeBadRequest, fmt.Errorf("malformed item %d: %w", line, err))
+				return
+			}
+			if internalKey(item.Key) {
+				progress.Skipped++
+				continue
+			}
+			if err := checkBatchKey(item.Key); err != nil {
+				fail(http.StatusBadRequest, codeInvalidKey, fmt.Errorf("item %d: %w", line, err))
+				return
+			}
+			size, err := item.add(&b)
+			if err != nil {
+				fail(http.StatusBadRequest, codeUnsupportedType, fmt.Errorf("item %d: %w", line, err))
+				return
+			}
+			keys, sizes = append(keys, item.Key), append(sizes, size)
+
+			if b.Len() == maxBatchSize {
+				if err := flush(); err != nil {
+					status, code := failedStatus(err)
+					fail(status, code, err)
+					return
+				}
+				report()
+			}
+		}
+		if err := flush(); err != nil {
+			status, code := failedStatus(err)
+			fail(status, code, err)
+			return
+		}
+		progress.Done = true
+		report()
+	}
+}
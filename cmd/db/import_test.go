@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImport(t *testing.T) {
+	newTestService := func() *service {
+		dir, err := os.MkdirTemp("", "test-import")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		s, err := newService(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(s.Close)
+		return s
+	}
+	load := func(s *service, body string) (int, []ImportProgress) {
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/_import", strings.NewReader(body)))
+		var lines []ImportProgress
+		if rec.Code == http.StatusOK {
+			assert.Equal(t, ndjsonContentType, rec.Header().Get("content-type"))
+			dec := json.NewDecoder(rec.Body)
+			for dec.More() {
+				var line ImportProgress
+				assert.Nil(t, dec.Decode(&line))
+				lines = append(lines, line)
+			}
+		}
+		return rec.Code, lines
+	}
+
+	t.Run("Export", func(t *testing.T) {
+		src := newTestService()
+		_, err := src.db.PutString("name", "gopack")
+		assert.Nil(t, err)
+		_, err = src.db.PutInt64("counter", 1<<60+1)
+		assert.Nil(t, err)
+		_, err = src.db.PutString(systemPrefix+"hidden", "value")
+		assert.Nil(t, err)
+		rec := httptest.NewRecorder()
+		src.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/export?format=ndjson", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		dst := newTestService()
+		code, lines := load(dst, rec.Body.String())
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []ImportProgress{{Imported: 2, Skipped: 1, Done: true}}, lines)
+		name, err := dst.db.GetString("name")
+		assert.Nil(t, err)
+		assert.Equal(t, "gopack", name)
+		counter, err := dst.db.GetInt64("counter")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1<<60+1), counter)
+		assert.False(t, dst.db.Has(systemPrefix+"hidden"))
+	})
+
+	t.Run("Progress", func(t *testing.T) {
+		s := newTestService()
+		var body strings.Builder
+		for i := 0; i < 2500; i++ {
+			fmt.Fprintf(&body, "{\"key\": \"key%d\", \"value\": %d}\n", i, i)
+		}
+		code, lines := load(s, body.String())
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []ImportProgress{{Imported: 1000}, {Imported: 2000}, {Imported: 2500, Done: true}}, lines)
+		assert.Equal(t, int64(2500), s.usage.get(anonymousUser).KeysOwned)
+
+		// A failure after the first batch ends the stream with the error.
+		body.WriteString(`{"key": "a/b", "value": "v"}`)
+		code, lines = load(s, body.String())
+		assert.Equal(t, http.StatusOK, code)
+		last := lines[len(lines)-1]
+		assert.Equal(t, 2000, last.Imported)
+		assert.False(t, last.Done)
+		assert.Equal(t, codeInvalidKey, last.Error.Code)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		s := newTestService()
+		for _, body := range []string{
+			`{"key": "a", "value": "v"} {"key":`,
+			`{"key": "", "value": "v"}`,
+			`{"key": "a", "value": true}`,
+		} {
+			code, _ := load(s, body)
+			assert.Equal(t, http.StatusBadRequest, code, body)
+		}
+		assert.False(t, s.db.Has("a"))
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/Gopack-go-labs/labs4-5/datastore/replication"
+	"github.com/gorilla/mux"
+)
+
+type IncrReq struct {
+	// Delta is added to the counter, 1 if left out.
+	Delta *json.Number `json:"delta"`
+}
+
+// incrHandler adds the delta of the body to the int64 value of the key and
+// answers the sum. Keys which do not exist count from zero, an empty body
+// adds 1.
+func incrHandler(db *datastore.Db, usage *UsageTracker, follower *replication.Follower) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if following(follower) {
+			readOnly(rw)
+			return
+		}
+		var body IncrReq
+		dec := json.NewDecoder(req.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&body); err != nil && err != io.EOF {
+			bodyError(rw, fmt.Errorf("malformed body: %w", err))
+			return
+		}
+		delta := int64(1)
+		if body.Delta != nil {
+			var err error
+			if delta, err = body.Delta.Int64(); err != nil {
+				writeError(rw, http.StatusBadRequest, codeUnsupportedType, "delta must be an int64 integer")
+				return
+			}
+		}
+
+		key := mux.Vars(req)["key"]
+		var sum int64
+		err := usage.Write(clientKey(req), key, int64(len(key)+8), func() error {
+			var err error
+			sum, err = db.IncrementContext(req.Context(), key, delta)
+			return err
+		})
+		if err != nil {
+			writeFailed(rw, err)
+			return
+		}
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(Res{Key: key, Value: strconv.FormatInt(sum, 10), Type: "int64"})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIncr(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-incr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	incr := func(key, body string) (int, Res) {
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/db/"+key+"/incr", strings.NewReader(body)))
+		var res Res
+		if rec.Code == http.StatusOK {
+			assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+		}
+		return rec.Code, res
+	}
+
+	code, res := incr("counter", `{"delta": 5}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, Res{Key: "counter", Value: "5", Type: "int64"}, res)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, _ := incr("counter", "")
+			assert.Equal(t, http.StatusOK, code)
+		}()
+	}
+	wg.Wait()
+	n, err := s.db.GetInt64("counter")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(15), n)
+
+	code, res = incr("counter", `{"delta": -20}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "-5", res.Value)
+
+	_, err = s.db.PutString("name", "value1")
+	assert.Nil(t, err)
+	code, _ = incr("name", `{"delta": 1}`)
+	assert.Equal(t, http.StatusConflict, code)
+	for _, body := range []string{`{"delta": 1.5}`, `{"delta": "one"}`, `{"delta": 9223372036854775808}`, `{`} {
+		code, _ = incr("counter", body)
+		assert.Equal(t, http.StatusBadRequest, code, body)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+)
+
+// ListItem is a key listed by GET /db, with its value and type if asked for.
+type ListItem struct {
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+	Type  string  `json:"type,omitempty"`
+}
+
+type ListRes struct {
+	Items  []ListItem `json:"items"`
+	Cursor string     `json:"cursor,omitempty"`
+}
+
+// listKeys returns a page of up to limit keys starting with prefix in
+// lexical order, after the key of the cursor. Keys of the service are left
+// out. Values are only read if asked for.
+func listKeys(db *datastore.Db, prefix string, limit int, cursor string, values bool) (ListRes, error) {
+	if limit < 0 || limit > maxQueryLimit {
+		return ListRes{}, fmt.Errorf("limit must be between 0 and %d", maxQueryLimit)
+	}
+	if limit == 0 {
+		limit = defaultQueryLimit
+	}
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return ListRes{}, err
+	}
+
+	it := db.Iterate(prefix)
+	defer it.Close()
+	if cursor != "" {
+		it.Seek(after)
+	}
+
+	res := ListRes{Items: make([]ListItem, 0)}
+	for it.Next() {
+		key := it.Key()
+		if cursor != "" && key <= after || strings.HasPrefix(key, systemPrefix) {
+			continue
+		}
+		if len(res.Items) == limit {
+			res.Cursor = encodeCursor(res.Items[limit-1].Key)
+			break
+		}
+
+		item := ListItem{Key: key}
+		if values {
+			val, err := it.Value()
+			if err != nil {
+				// The key was deleted or expired meanwhile.
+				continue
+			}
+			var s string
+			switch v := val.(type) {
+			case string:
+				s, item.Type = v, "string"
+			case int64:
+				s, item.Type = strconv.FormatInt(v, 10), "int64"
+			}
+			item.Value = &s
+		}
+		res.Items = append(res.Items, item)
+	}
+	return res, nil
+}
+
+// listHandler serves GET /db?prefix=&limit=&cursor=&values=true, a page of
+// listKeys. The cursor of the response, if any, fetches the next page.
+func listHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		params := req.URL.Query()
+		limit := 0
+		if s := params.Get("limit"); s != "" {
+			var err error
+			if limit, err = strconv.Atoi(s); err != nil {
+				badRequest(rw, fmt.Errorf("malformed limit"))
+				return
+			}
+		}
+		values := false
+		if s := params.Get("values"); s != "" {
+			var err error
+			if values, err = strconv.ParseBool(s); err != nil {
+				badRequest(rw, fmt.Errorf("malformed values"))
+				return
+			}
+		}
+
+		res, err := listKeys(db, params.Get("prefix"), limit, params.Get("cursor"), values)
+		if err != nil {
+			badRequest(rw, err)
+			return
+		}
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(res)
+	}
+}
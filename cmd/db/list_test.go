@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestList(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_, err = s.db.PutString("user:a", "alice")
+	assert.Nil(t, err)
+	_, err = s.db.PutInt64("user:b", 2)
+	assert.Nil(t, err)
+	_, err = s.db.PutString("user:c", "")
+	assert.Nil(t, err)
+	_, err = s.db.PutString("other", "value")
+	assert.Nil(t, err)
+	_, err = s.db.PutString(systemPrefix+"hidden", "value")
+	assert.Nil(t, err)
+
+	list := func(query url.Values) (int, ListRes) {
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/db?"+query.Encode(), nil))
+		var res ListRes
+		if rec.Code == http.StatusOK {
+			assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+		}
+		return rec.Code, res
+	}
+
+	code, res := list(url.Values{})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []ListItem{{Key: "other"}, {Key: "user:a"}, {Key: "user:b"}, {Key: "user:c"}}, res.Items)
+	assert.Empty(t, res.Cursor)
+
+	t.Run("Values", func(t *testing.T) {
+		code, res := list(url.Values{"prefix": {"user:"}, "values": {"true"}})
+		assert.Equal(t, http.StatusOK, code)
+		str := func(s string) *string { return &s }
+		assert.Equal(t, []ListItem{
+			{Key: "user:a", Value: str("alice"), Type: "string"},
+			{Key: "user:b", Value: str("2"), Type: "int64"},
+			{Key: "user:c", Value: str(""), Type: "string"},
+		}, res.Items)
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		var keys []string
+		query := url.Values{"prefix": {"user:"}, "limit": {"2"}}
+		for pages := 0; pages < 3; pages++ {
+			code, res := list(query)
+			assert.Equal(t, http.StatusOK, code)
+			for _, item := range res.Items {
+				keys = append(keys, item.Key)
+			}
+			if res.Cursor == "" {
+				break
+			}
+			query.Set("cursor", res.Cursor)
+		}
+		assert.Equal(t, []string{"user:a", "user:b", "user:c"}, keys)
+	})
+
+	t.Run("Deleted", func(t *testing.T) {
+		_, err = s.db.PutString("gone:a", "value")
+		assert.Nil(t, err)
+		_, err = s.db.PutStringWithTTL("gone:b", "value", time.Millisecond)
+		assert.Nil(t, err)
+		assert.Nil(t, s.db.Delete("gone:a"))
+		time.Sleep(5 * time.Millisecond)
+
+		for _, values := range []string{"false", "true"} {
+			code, res := list(url.Values{"prefix": {"gone:"}, "values": {values}})
+			assert.Equal(t, http.StatusOK, code)
+			assert.Empty(t, res.Items, values)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, query := range []url.Values{
+			{"limit": {"many"}},
+			{"limit": {"-1"}},
+			{"limit": {"1001"}},
+			{"values": {"maybe"}},
+			{"cursor": {"%%%"}},
+		} {
+			code, _ := list(query)
+			assert.Equal(t, http.StatusBadRequest, code, query.Encode())
+		}
+	})
+}
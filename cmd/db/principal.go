@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+)
+
+type principalKey struct{}
+
+// principalSlotKey holds the *string the principal is recorded into for
+// middlewares running before the principal is known, as the access log does.
+type principalSlotKey struct{}
+
+// withPrincipal attaches the caller the request is attributed to. Components
+// recording mutations read it with clientKey instead of parsing headers, so
+// they keep working when authentication decides who the caller is.
+func withPrincipal(req *http.Request, principal string) *http.Request {
+	return req.WithContext(contextWithPrincipal(req.Context(), principal))
+}
+
+// contextWithPrincipal attaches the principal to ctx. Writes made with the
+// context are attributed to it by the datastore, but those of anonymous
+// callers, which would only take room in every entry.
+func contextWithPrincipal(ctx context.Context, principal string) context.Context {
+	if slot, ok := ctx.Value(principalSlotKey{}).(*string); ok {
+		*slot = principal
+	}
+	if principal != anonymousUser {
+		ctx = datastore.WithPrincipal(ctx, principal)
+	}
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+func principalFrom(ctx context.Context) (string, bool) {
+	principal, ok := ctx.Value(principalKey{}).(string)
+	return principal, ok
+}
+
+// withPrincipalSlot returns a copy of ctx in which the principal attached
+// further down the handler chain is recorded into slot.
+func withPrincipalSlot(ctx context.Context, slot *string) context.Context {
+	return context.WithValue(ctx, principalSlotKey{}, slot)
+}
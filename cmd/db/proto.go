@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Gopack-go-labs/labs4-5/api/dbpb"
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"google.golang.org/protobuf/proto"
+)
+
+// protoContentType marks bodies of /db/{key} encoded as the messages of
+// api/dbpb, which spare large values the escaping of JSON. Errors are JSON
+// either way.
+const protoContentType = "application/x-protobuf"
+
+// wantsProto reports whether the client asked for a dbpb.GetResponse
+// instead of the JSON envelope.
+func wantsProto(req *http.Request) bool {
+	return req.Header.Get("accept") == protoContentType
+}
+
+// isProto reports whether the request body is a dbpb.PutRequest.
+func isProto(req *http.Request) bool {
+	return req.Header.Get("content-type") == protoContentType
+}
+
+// decodeProtoPut returns the value and TTL of a dbpb.PutRequest body, the
+// ttl query parameter giving the TTL when ttl_millis is 0. The key comes
+// from the URL and the revision from If-Match, so the body must not set
+// them.
+func decodeProtoPut(req *http.Request) (interface{}, time.Duration, error) {
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	var body dbpb.PutRequest
+	if err := proto.Unmarshal(data, &body); err != nil {
+		return nil, 0, fmt.Errorf("malformed body: %w", err)
+	}
+	if body.Key != "" || body.IfRevision != nil {
+		return nil, 0, fmt.Errorf("key and if_revision are given by the URL and If-Match")
+	}
+	if body.TtlMillis < 0 {
+		return nil, 0, fmt.Errorf("ttl_millis must not be negative")
+	}
+	ttl := time.Duration(body.TtlMillis) * time.Millisecond
+	if ttl == 0 {
+		if ttl, err = writeTTL(req, ""); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	switch v := body.GetValue().GetKind().(type) {
+	case *dbpb.Value_StringValue:
+		return v.StringValue, ttl, nil
+	case *dbpb.Value_Int64Value:
+		return v.Int64Value, ttl, nil
+	}
+	return nil, ttl, nil
+}
+
+func writeProto(rw http.ResponseWriter, status int, msg proto.Message) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		internalError(rw, err)
+		return
+	}
+	rw.Header().Set("content-type", protoContentType)
+	rw.WriteHeader(status)
+	_, _ = rw.Write(data)
+}
+
+// serveProto answers the value of the key as a dbpb.GetResponse, which
+// carries the type of the value so no type parameter is needed.
+func serveProto(rw http.ResponseWriter, db *datastore.Db, key string) {
+	val, meta, err := db.GetWithMeta(key)
+	value := toValue(val)
+	if err != nil || value == nil {
+		notFound(rw)
+		return
+	}
+	rw.Header().Set("etag", etag(meta.Seq))
+	writeProto(rw, http.StatusOK, &dbpb.GetResponse{
+		Key:       key,
+		Value:     value,
+		Revision:  meta.Seq,
+		ExpiresAt: unixNano(meta.ExpiresAt),
+	})
+}
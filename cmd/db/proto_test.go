@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Gopack-go-labs/labs4-5/api/dbpb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestProtoContentType(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	post := func(url string, body *dbpb.PutRequest) *httptest.ResponseRecorder {
+		data, err := proto.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+		req.Header.Set("content-type", protoContentType)
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		return rec
+	}
+	get := func(key string) (*httptest.ResponseRecorder, *dbpb.GetResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/db/"+key, nil)
+		req.Header.Set("accept", protoContentType)
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		var res dbpb.GetResponse
+		if rec.Code == http.StatusOK {
+			assert.Equal(t, protoContentType, rec.Header().Get("content-type"))
+			assert.Nil(t, proto.Unmarshal(rec.Body.Bytes(), &res))
+		}
+		return rec, &res
+	}
+
+	blob := strings.Repeat("0123456789", 10*1024)
+	rec := post("/db/blob", &dbpb.PutRequest{Value: &dbpb.Value{Kind: &dbpb.Value_StringValue{StringValue: blob}}, TtlMillis: 60000})
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	rec, res := get("blob")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, blob, res.Value.GetStringValue())
+	assert.NotZero(t, res.ExpiresAt)
+	assert.Equal(t, etag(res.Revision), rec.Header().Get("etag"))
+
+	rec = post("/db", &dbpb.PutRequest{Value: &dbpb.Value{Kind: &dbpb.Value_Int64Value{Int64Value: -7}}})
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Empty(t, rec.Body.String())
+	key := strings.TrimPrefix(rec.Header().Get("location"), "/db/")
+	n, err := s.db.GetInt64(key)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-7), n)
+	_, res = get(key)
+	assert.Equal(t, int64(-7), res.Value.GetInt64Value())
+	assert.Equal(t, etag(res.Revision), rec.Header().Get("etag"))
+
+	// JSON stays the default.
+	rec = httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/db/blob", nil))
+	assert.Equal(t, "application/json", rec.Header().Get("content-type"))
+
+	rec, _ = get("missing")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rev := uint64(1)
+	for _, body := range []*dbpb.PutRequest{
+		{},
+		{Key: "other", Value: &dbpb.Value{Kind: &dbpb.Value_StringValue{StringValue: "value"}}},
+		{IfRevision: &rev, Value: &dbpb.Value{Kind: &dbpb.Value_StringValue{StringValue: "value"}}},
+		{TtlMillis: -1, Value: &dbpb.Value{Kind: &dbpb.Value_StringValue{StringValue: "value"}}},
+	} {
+		assert.Equal(t, http.StatusBadRequest, post("/db/key", body).Code, body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/db/key", strings.NewReader("not protobuf"))
+	req.Header.Set("content-type", protoContentType)
+	rec = httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.False(t, s.db.Has("key"))
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+type QueryFilter struct {
+	Op    string `json:"op"`
+	Value int64  `json:"value"`
+}
+
+// QueryReq is the body of POST /db/_query. Type restricts the values to
+// one type, looked up in the type index rather than by reading every value.
+type QueryReq struct {
+	Prefix string        `json:"prefix"`
+	Type   string        `json:"type"`
+	Where  []QueryFilter `json:"where"`
+	Limit  int           `json:"limit"`
+	Cursor string        `json:"cursor"`
+}
+
+type QueryRes struct {
+	Items  []Res  `json:"items"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+func (f QueryFilter) Match(v int64) bool {
+	switch f.Op {
+	case "eq":
+		return v == f.Value
+	case "ne":
+		return v != f.Value
+	case "lt":
+		return v < f.Value
+	case "lte":
+		return v <= f.Value
+	case "gt":
+		return v > f.Value
+	case "gte":
+		return v >= f.Value
+	}
+	return false
+}
+
+// valueTypes names the types of the type index.
+var valueTypes = map[string]datastore.ValueType{"string": datastore.Str, "int64": datastore.Int}
+
+func (q *QueryReq) validate() error {
+	if _, ok := valueTypes[q.Type]; !ok && q.Type != "" {
+		return fmt.Errorf("unknown type %q", q.Type)
+	}
+	if len(q.Where) > 0 && q.Type == "string" {
+		return fmt.Errorf("numeric filters require int64 values")
+	}
+	for _, f := range q.Where {
+		switch f.Op {
+		case "eq", "ne", "lt", "lte", "gt", "gte":
+		default:
+			return fmt.Errorf("unknown filter operator %q", f.Op)
+		}
+	}
+	if q.Limit < 0 || q.Limit > maxQueryLimit {
+		return fmt.Errorf("limit must be between 0 and %d", maxQueryLimit)
+	}
+	return nil
+}
+
+func (q *QueryReq) match(val interface{}) (Res, bool) {
+	switch v := val.(type) {
+	case string:
+		if q.Type == "int64" || len(q.Where) > 0 {
+			return Res{}, false
+		}
+		return Res{Value: v, Type: "string"}, true
+	case int64:
+		if q.Type == "string" {
+			return Res{}, false
+		}
+		for _, f := range q.Where {
+			if !f.Match(v) {
+				return Res{}, false
+			}
+		}
+		return Res{Value: strconv.FormatInt(v, 10), Type: "int64"}, true
+	}
+	return Res{}, false
+}
+
+// indexedKeys returns the sorted keys with the prefix and the type from the
+// type index.
+func indexedKeys(db *datastore.Db, prefix string, t datastore.ValueType) []string {
+	var keys []string
+	for _, key := range db.KeysByType(t) {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func runQuery(db *datastore.Db, q QueryReq) (QueryRes, error) {
+	if err := q.validate(); err != nil {
+		return QueryRes{}, err
+	}
+	limit := q.Limit
+	if limit == 0 {
+		limit = defaultQueryLimit
+	}
+	after, err := decodeCursor(q.Cursor)
+	if err != nil {
+		return QueryRes{}, err
+	}
+
+	// Queries of a type walk the keys of the type index, the others iterate
+	// over every key.
+	var next func() (string, interface{}, bool, error)
+	if t, ok := valueTypes[q.Type]; ok {
+		keys := indexedKeys(db, q.Prefix, t)
+		pos := sort.SearchStrings(keys, after)
+		next = func() (string, interface{}, bool, error) {
+			if pos == len(keys) {
+				return "", nil, false, nil
+			}
+			key := keys[pos]
+			pos++
+			var val interface{}
+			var err error
+			if t == datastore.Int {
+				val, err = db.GetInt64(key)
+			} else {
+				val, err = db.GetString(key)
+			}
+			return key, val, true, err
+		}
+	} else {
+		it := db.Iterate(q.Prefix)
+		defer it.Close()
+		if q.Cursor != "" {
+			it.Seek(after)
+		}
+		next = func() (string, interface{}, bool, error) {
+			if !it.Next() {
+				return "", nil, false, nil
+			}
+			val, err := it.Value()
+			return it.Key(), val, true, err
+		}
+	}
+
+	res := QueryRes{Items: make([]Res, 0)}
+	for {
+		key, val, ok, err := next()
+		if !ok {
+			break
+		}
+		if q.Cursor != "" && key == after || strings.HasPrefix(key, systemPrefix) {
+			continue
+		}
+		if len(res.Items) == limit {
+			res.Cursor = encodeCursor(res.Items[limit-1].Key)
+			break
+		}
+		if err != nil {
+			continue
+		}
+		item, ok := q.match(val)
+		if !ok {
+			continue
+		}
+		item.Key = key
+		res.Items = append(res.Items, item)
+	}
+
+	return res, nil
+}
+
+// encodeCursor returns the opaque cursor of a page ending with the key.
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// decodeCursor returns the key a page was ended with, none for an empty
+// cursor.
+func decodeCursor(cursor string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("malformed cursor")
+	}
+	return string(raw), nil
+}
+
+func queryHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		var q QueryReq
+		if err := json.NewDecoder(req.Body).Decode(&q); err != nil {
+			bodyError(rw, fmt.Errorf("malformed body: %w", err))
+			return
+		}
+
+		res, err := runQuery(db, q)
+		if err != nil {
+			badRequest(rw, err)
+			return
+		}
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(res)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunQuery(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := datastore.NewDb(dir, 10*datastore.Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.PutInt64("counter:a", 1)
+	assert.Nil(t, err)
+	_, err = db.PutInt64("counter:b", 5)
+	assert.Nil(t, err)
+	_, err = db.PutInt64("counter:c", 10)
+	assert.Nil(t, err)
+	_, err = db.PutString("counter:d", "not a number")
+	assert.Nil(t, err)
+	_, err = db.PutString("name", "gopack")
+	assert.Nil(t, err)
+
+	t.Run("prefix", func(t *testing.T) {
+		res, err := runQuery(db, QueryReq{Prefix: "counter:"})
+		assert.Nil(t, err)
+		assert.Len(t, res.Items, 4)
+		assert.Empty(t, res.Cursor)
+	})
+
+	t.Run("type", func(t *testing.T) {
+		res, err := runQuery(db, QueryReq{Type: "string"})
+		assert.Nil(t, err)
+		assert.Equal(t, []Res{
+			{Key: "counter:d", Value: "not a number", Type: "string"},
+			{Key: "name", Value: "gopack", Type: "string"},
+		}, res.Items)
+	})
+
+	t.Run("type pagination", func(t *testing.T) {
+		res, err := runQuery(db, QueryReq{Prefix: "counter:", Type: "int64", Limit: 2})
+		assert.Nil(t, err)
+		assert.Len(t, res.Items, 2)
+		res, err = runQuery(db, QueryReq{Prefix: "counter:", Type: "int64", Where: []QueryFilter{{Op: "gte", Value: 5}}, Cursor: res.Cursor})
+		assert.Nil(t, err)
+		assert.Equal(t, []Res{{Key: "counter:c", Value: "10", Type: "int64"}}, res.Items)
+	})
+
+	t.Run("numeric filters", func(t *testing.T) {
+		res, err := runQuery(db, QueryReq{Where: []QueryFilter{{Op: "gt", Value: 1}, {Op: "lte", Value: 10}}})
+		assert.Nil(t, err)
+		assert.Equal(t, []Res{
+			{Key: "counter:b", Value: "5", Type: "int64"},
+			{Key: "counter:c", Value: "10", Type: "int64"},
+		}, res.Items)
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		var keys []string
+		q := QueryReq{Prefix: "counter:", Limit: 3}
+		for {
+			res, err := runQuery(db, q)
+			assert.Nil(t, err)
+			for _, item := range res.Items {
+				keys = append(keys, item.Key)
+			}
+			if res.Cursor == "" {
+				break
+			}
+			q.Cursor = res.Cursor
+		}
+		assert.Equal(t, []string{"counter:a", "counter:b", "counter:c", "counter:d"}, keys)
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		_, err := runQuery(db, QueryReq{Type: "team"})
+		assert.Error(t, err)
+		_, err = runQuery(db, QueryReq{Where: []QueryFilter{{Op: "like"}}})
+		assert.Error(t, err)
+		_, err = runQuery(db, QueryReq{Cursor: "%%%"})
+		assert.Error(t, err)
+	})
+}
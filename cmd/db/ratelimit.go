@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// rateLimitSweep is how often buckets refilled to their burst are
+	// dropped, so clients seen once do not stay in memory.
+	rateLimitSweep = time.Minute
+	// maxRateLimitBuckets is the number of buckets beyond which they are
+	// swept every second rather than every rateLimitSweep.
+	maxRateLimitBuckets = 1 << 16
+)
+
+// RateLimiter limits the requests of every client to a rate per second with
+// bursts of up to burst requests, by token buckets keyed by the principal
+// Auth verified or, for clients without one, by IP.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	// at is the time tokens were counted at.
+	at time.Time
+}
+
+// NewRateLimiter returns nil for rate 0, which limits no requests. A burst
+// below 1 is raised to 1.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   math.Max(float64(burst), 1),
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token of the client, returning false and the time until
+// the next token otherwise.
+func (l *RateLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b, ok := l.buckets[client]
+	if since := now.Sub(l.lastSweep); since >= rateLimitSweep || !ok && len(l.buckets) >= maxRateLimitBuckets && since >= time.Second {
+		l.sweep(now)
+		b, ok = l.buckets[client]
+	}
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, at: now}
+		l.buckets[client] = b
+	}
+	if l.refill(b, now) < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets of clients idle long enough to have refilled them,
+// they start full anyway. Must be called with l.mu held.
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// refill adds the tokens earned since the bucket was last counted.
+func (l *RateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.at).Seconds()*l.rate)
+	b.at = now
+	return b.tokens
+}
+
+// rateLimitKey names the bucket of a request, the principal Auth verified
+// or else the IP it comes from. Keys no one verified are not trusted: a
+// client changing them on every request would get a fresh burst each time.
+func rateLimitKey(req *http.Request) string {
+	if key, ok := verifiedKey(req.Context()); ok {
+		return key
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// verifiedKey returns the bucket of the principal of the context, if one
+// was verified.
+func verifiedKey(ctx context.Context) (string, bool) {
+	if principal, ok := principalFrom(ctx); ok && principal != anonymousUser {
+		return "key:" + principal, true
+	}
+	return "", false
+}
+
+// Middleware answers requests beyond the rate of their client with 429 and
+// the seconds until the next one is allowed in Retry-After. A nil
+// RateLimiter lets every request through.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if ok, wait := l.allow(rateLimitKey(req)); !ok {
+			rw.Header().Set("retry-after", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(rw, http.StatusTooManyRequests, codeTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// checkGRPC is Middleware for gRPC calls.
+func (l *RateLimiter) checkGRPC(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	key, ok := verifiedKey(ctx)
+	if !ok {
+		key = "ip:"
+		if p, ok := peer.FromContext(ctx); ok {
+			if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+				key += host
+			}
+		}
+	}
+	if ok, wait := l.allow(key); !ok {
+		return status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry in %s", wait.Round(time.Millisecond))
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	assert.Nil(t, NewRateLimiter(0, 10))
+
+	now := time.Unix(1700000000, 0)
+	l := NewRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("a")
+		assert.True(t, ok, i)
+	}
+	ok, wait := l.allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	// Buckets are kept by client.
+	ok, _ = l.allow("b")
+	assert.True(t, ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.allow("a")
+	assert.True(t, ok)
+	ok, _ = l.allow("a")
+	assert.False(t, ok)
+
+	// Refilled buckets are dropped.
+	now = now.Add(rateLimitSweep)
+	ok, _ = l.allow("c")
+	assert.True(t, ok)
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestRateLimit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-rate-limit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(rate float64, burst int) { *rateLimit, *rateBurst = rate, burst }(*rateLimit, *rateBurst)
+	*rateLimit, *rateBurst = 0.1, 2
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	get := func(key, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/db/missing", nil)
+		req.RemoteAddr = remote
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusNotFound, get("", "10.0.0.1:1000").Code)
+	assert.Equal(t, http.StatusNotFound, get("", "10.0.0.1:1001").Code)
+	rec := get("", "10.0.0.1:1002")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "10", rec.Header().Get("retry-after"))
+
+	assert.Equal(t, http.StatusNotFound, get("", "10.0.0.2:1000").Code)
+	// Without -api-keys no one verifies keys, changing them gets no burst.
+	assert.Equal(t, http.StatusTooManyRequests, get("alice", "10.0.0.1:1003").Code)
+	assert.Equal(t, http.StatusTooManyRequests, get("bob", "10.0.0.1:1004").Code)
+
+	t.Run("verified keys", func(t *testing.T) {
+		defer func(keys string) { *apiKeys = keys }(*apiKeys)
+		*apiKeys = "alice,bob"
+		s, err := newService(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		get := func(key, remote string) int {
+			req := httptest.NewRequest(http.MethodGet, "/db/missing", nil)
+			req.RemoteAddr = remote
+			req.Header.Set(apiKeyHeader, key)
+			rec := httptest.NewRecorder()
+			s.handler.ServeHTTP(rec, req)
+			return rec.Code
+		}
+		assert.Equal(t, http.StatusNotFound, get("alice", "10.0.0.1:1000"))
+		assert.Equal(t, http.StatusNotFound, get("alice", "10.0.0.1:1001"))
+		assert.Equal(t, http.StatusTooManyRequests, get("alice", "10.0.0.1:1002"))
+		assert.Equal(t, http.StatusNotFound, get("bob", "10.0.0.1:1003"))
+		// Refused keys take no bucket.
+		assert.Equal(t, http.StatusUnauthorized, get("mallory", "10.0.0.1:1004"))
+	})
+}
+
+func TestRateLimiter_MaxBuckets(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := NewRateLimiter(1, 1)
+	l.now = func() time.Time { return now }
+	l.lastSweep = now
+	for i := 0; i < maxRateLimitBuckets; i++ {
+		// Every other client has been idle for a second, refilling its bucket.
+		l.buckets[strconv.Itoa(i)] = &tokenBucket{at: now.Add(time.Duration(i%2) * time.Second)}
+	}
+
+	// Idle buckets go once a second while the limiter is full.
+	now = now.Add(time.Second)
+	ok, _ := l.allow("new")
+	assert.True(t, ok)
+	assert.Len(t, l.buckets, maxRateLimitBuckets/2+1)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+)
+
+const rawContentType = "application/octet-stream"
+
+// wantsRaw reports whether the client asked for the bare value instead of
+// the JSON envelope.
+func wantsRaw(req *http.Request) bool {
+	return req.Header.Get("accept") == rawContentType
+}
+
+// isRaw reports whether the request body is the bare value to store. Such
+// bodies are streamed to the store as they arrive.
+func isRaw(req *http.Request) bool {
+	return req.Header.Get("content-type") == rawContentType
+}
+
+// serveRawString writes the string value of the key as the response body.
+// The value is copied from the segment file to the connection as is, so the
+// runtime can use sendfile and large values never pass through user-space
+// buffers.
+func serveRawString(rw http.ResponseWriter, db *datastore.Db, key string) {
+	// The value is opened after its revision is read, so a write in between
+	// makes the tag stale rather than newer than the body.
+	info, err := db.Describe(key)
+	if err != nil {
+		notFound(rw)
+		return
+	}
+	f, size, err := db.OpenString(key)
+	if err != nil {
+		notFound(rw)
+		return
+	}
+	defer f.Close()
+
+	rw.Header().Set("etag", etag(info.Seq))
+	rw.Header().Set("content-type", rawContentType)
+	rw.Header().Set("content-length", strconv.FormatInt(size, 10))
+	rw.WriteHeader(http.StatusOK)
+	_, _ = io.Copy(rw, io.LimitReader(f, size))
+}
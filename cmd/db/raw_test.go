@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeRawString(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := datastore.NewDb(dir, 10*datastore.Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	blob := strings.Repeat("0123456789", 100*1024)
+	_, err = db.PutString("before", "x")
+	assert.Nil(t, err)
+	_, err = db.PutString("blob", blob)
+	assert.Nil(t, err)
+	_, err = db.PutString("after", "y")
+	assert.Nil(t, err)
+	_, err = db.PutInt64("counter", 1)
+	assert.Nil(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		serveRawString(rw, db, strings.TrimPrefix(req.URL.Path, "/"))
+	}))
+	defer server.Close()
+
+	get := func(key string) (*http.Response, string) {
+		resp, err := http.Get(server.URL + "/" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+
+	resp, body := get("blob")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, rawContentType, resp.Header.Get("content-type"))
+	assert.Equal(t, int64(len(blob)), resp.ContentLength)
+	assert.Equal(t, blob, body)
+	info, err := db.Describe("blob")
+	assert.Nil(t, err)
+	assert.Equal(t, etag(info.Seq), resp.Header.Get("etag"))
+
+	_, body = get("after")
+	assert.Equal(t, "y", body)
+
+	resp, _ = get("counter")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = get("missing")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServeRawString_Middleware(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Raw writes answer the revision of the key as others do.
+	blob := strings.Repeat("0123456789", 100*1024)
+	req := httptest.NewRequest(http.MethodPost, "/db/blob", strings.NewReader(blob))
+	req.Header.Set("content-type", rawContentType)
+	put := httptest.NewRecorder()
+	s.handler.ServeHTTP(put, req)
+	assert.Equal(t, http.StatusCreated, put.Code)
+	info, err := s.db.Describe("blob")
+	assert.Nil(t, err)
+	assert.Equal(t, etag(info.Seq), put.Header().Get("etag"))
+
+	// The value reaches the ReaderFrom of the connection through the access
+	// log, the metrics and compression.
+	req = httptest.NewRequest(http.MethodGet, "/db/blob", nil)
+	req.Header.Set("accept", rawContentType)
+	req.Header.Set("accept-encoding", "gzip")
+	rec := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	s.handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("content-encoding"))
+	assert.Equal(t, blob, rec.Body.String())
+	assert.Equal(t, int64(len(blob)), rec.readFrom)
+}
+
+func TestIsRaw(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/db/key", strings.NewReader("value"))
+	assert.False(t, isRaw(req))
+	req.Header.Set("content-type", rawContentType)
+	assert.True(t, isRaw(req))
+}
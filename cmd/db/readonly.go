@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// readOnlyMessage is the error answered to writes of a -read-only db.
+const readOnlyMessage = "the db is read-only and takes no writes"
+
+// refuseWrites answers writes with 503 when on, for a db serving as a read
+// replica or kept unchanged during maintenance; reads are served as usual.
+// It is to be passed to Router.Use.
+func refuseWrites(on bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if !on {
+			return next
+		}
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if isWrite(req) {
+				writeError(rw, http.StatusServiceUnavailable, codeReadOnly, readOnlyMessage)
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
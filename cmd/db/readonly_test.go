@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Gopack-go-labs/labs4-5/api/dbpb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReadOnlyMode(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-read-only")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(v bool) { *readOnlyMode = v }(*readOnlyMode)
+	*readOnlyMode = true
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, err = s.db.PutString("key", "value")
+	assert.Nil(t, err)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return rec
+	}
+
+	for _, w := range []struct{ method, url, body string }{
+		{http.MethodPost, "/db/other", `{"value": "v"}`},
+		{http.MethodDelete, "/db/key", ""},
+		{http.MethodPost, "/db/_batch", `[{"key": "other", "value": "v"}]`},
+		{http.MethodPost, "/admin/delete-range", `{"start": "a", "end": "z"}`},
+	} {
+		rec := do(w.method, w.url, w.body)
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code, w.url)
+		assert.Contains(t, rec.Body.String(), codeReadOnly, w.url)
+	}
+	assert.False(t, s.db.Has("other"))
+
+	rec := do(http.MethodGet, "/db/key", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "value")
+
+	var res StatusRes
+	assert.Nil(t, json.NewDecoder(do(http.MethodGet, "/status", "").Body).Decode(&res))
+	assert.True(t, res.ReadOnly)
+
+	grpcServer := &grpcServer{db: s.db, usage: s.usage, readOnly: true}
+	_, err = grpcServer.Put(context.Background(), &dbpb.PutRequest{Key: "other", Value: &dbpb.Value{Kind: &dbpb.Value_StringValue{StringValue: "v"}}})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	get, err := grpcServer.Get(context.Background(), &dbpb.GetRequest{Key: "key"})
+	assert.Nil(t, err)
+	assert.Equal(t, "value", get.GetValue().GetStringValue())
+}
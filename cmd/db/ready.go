@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// readyGate answers 503 to all requests until the service handler is set.
+type readyGate struct {
+	handler atomic.Value
+	// check returns why the open service is degraded, if it is.
+	check atomic.Value
+	// recovered and total count the segments of the datastore recovery
+	// reported by recovering.
+	recovered atomic.Int64
+	total     atomic.Int64
+}
+
+// StartingRes is the body of /readyz while the datastore is recovered.
+type StartingRes struct {
+	Status            string `json:"status"`
+	SegmentsRecovered int64  `json:"segments_recovered"`
+	SegmentsTotal     int64  `json:"segments_total"`
+}
+
+// recovering records the progress of the datastore recovery for
+// ServeReadyz, it is to be passed to datastore.WithRecoveryProgress.
+func (g *readyGate) recovering(recovered, total int) {
+	g.total.Store(int64(total))
+	g.recovered.Store(int64(recovered))
+}
+
+// open passes requests to h from now on. check, if not nil, tells whether
+// the service is degraded for ServeReadyz.
+func (g *readyGate) open(h http.Handler, check func() error) {
+	if check != nil {
+		g.check.Store(check)
+	}
+	g.handler.Store(h)
+}
+
+func (g *readyGate) ready() bool {
+	return g.handler.Load() != nil
+}
+
+func (g *readyGate) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h, ok := g.handler.Load().(http.Handler)
+	if !ok {
+		rw.Header().Set("Retry-After", "1")
+		writeError(rw, http.StatusServiceUnavailable, codeUnavailable, "the database is starting")
+		return
+	}
+	h.ServeHTTP(rw, req)
+}
+
+// ServeReady reports whether the datastore is open.
+func (g *readyGate) ServeReady(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("content-type", "text/plain")
+	if !g.ready() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = rw.Write([]byte("NOT READY"))
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write([]byte("OK"))
+}
+
+// ServeReadyz tells the service apart starting, healthy and degraded,
+// degraded being open but unable to take writes. A starting service answers
+// the progress of the datastore recovery in a StartingRes.
+func (g *readyGate) ServeReadyz(rw http.ResponseWriter, _ *http.Request) {
+	if !g.ready() {
+		rw.Header().Set("content-type", "application/json")
+		rw.Header().Set("Retry-After", "1")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(rw).Encode(StartingRes{
+			Status:            "starting",
+			SegmentsRecovered: g.recovered.Load(),
+			SegmentsTotal:     g.total.Load(),
+		})
+		return
+	}
+	rw.Header().Set("content-type", "text/plain")
+	if check, ok := g.check.Load().(func() error); ok {
+		if err := check(); err != nil {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = rw.Write([]byte("DEGRADED: " + err.Error()))
+			return
+		}
+	}
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write([]byte("OK"))
+}
+
+// serveHealthz reports the process is up, whatever the state of the
+// datastore.
+func serveHealthz(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("content-type", "text/plain")
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write([]byte("OK"))
+}
+
+// configError is an error of the flags of the service. No attempt of retry
+// can succeed before the service is started with other flags.
+type configError struct {
+	err error
+}
+
+func (e configError) Error() string {
+	return e.err.Error()
+}
+
+func (e configError) Unwrap() error {
+	return e.err
+}
+
+// retry calls fn until it succeeds, doubling the pause between attempts from
+// min up to max. It gives up once ctx is done, or on a configError.
+func retry(ctx context.Context, min, max time.Duration, fn func() error) error {
+	wait := min
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if errors.As(err, &configError{}) {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if wait *= 2; wait > max {
+			wait = max
+		}
+	}
+}
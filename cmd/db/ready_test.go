@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadyGate(t *testing.T) {
+	gate := new(readyGate)
+
+	rec := httptest.NewRecorder()
+	gate.ServeReady(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	rec = httptest.NewRecorder()
+	gate.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/db/key", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+	gate.open(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusTeapot)
+	}), nil)
+	rec = httptest.NewRecorder()
+	gate.ServeReady(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = httptest.NewRecorder()
+	gate.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/db/key", nil))
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+}
+
+func TestReadyGate_Readyz(t *testing.T) {
+	gate := new(readyGate)
+	readyz := func() (int, string) {
+		rec := httptest.NewRecorder()
+		gate.ServeReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.JSONEq(t, `{"status": "starting", "segments_recovered": 0, "segments_total": 0}`, body)
+
+	gate.recovering(3, 10)
+	code, body = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.JSONEq(t, `{"status": "starting", "segments_recovered": 3, "segments_total": 10}`, body)
+
+	var degraded error
+	gate.open(http.NotFoundHandler(), func() error { return degraded })
+	code, body = readyz()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "OK", body)
+
+	degraded = fmt.Errorf("disk quota exceeded")
+	code, body = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "DEGRADED: disk quota exceeded", body)
+
+	rec := httptest.NewRecorder()
+	serveHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestRetry(t *testing.T) {
+	attempts := 0
+	err := retry(context.Background(), time.Millisecond, 2*time.Millisecond, func() error {
+		if attempts++; attempts < 3 {
+			return fmt.Errorf("not yet")
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = retry(ctx, time.Millisecond, time.Millisecond, func() error { return fmt.Errorf("never") })
+	assert.Equal(t, context.Canceled, err)
+
+	// Configuration errors are not retried.
+	attempts = 0
+	invalid := configError{fmt.Errorf("invalid -api-keys")}
+	err = retry(context.Background(), time.Millisecond, time.Millisecond, func() error {
+		attempts++
+		return fmt.Errorf("failed: %w", invalid)
+	})
+	assert.ErrorIs(t, err, invalid)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestNewService_InvalidConfig(t *testing.T) {
+	defer func(keys string) { *apiKeys = keys }(*apiKeys)
+	*apiKeys = "writer,,reader"
+
+	_, err := newService(t.TempDir())
+	assert.ErrorAs(t, err, &configError{})
+}
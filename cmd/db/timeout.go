@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// requestTimeout bounds the time requests spend on the datastore, none for
+// timeout 0. Context-aware datastore calls give up once it passes and the
+// request is answered with 503, rather than a slow compaction or a stuck
+// write loop piling connections up. Watches and imports stream for as long
+// as the client wants, so they are left alone.
+func requestTimeout(timeout time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if timeout == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if isImport(req) || isWatch(req) {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			ctx, cancel := context.WithTimeout(req.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(rw, req.WithContext(ctx))
+		})
+	}
+}
+
+func isWatch(req *http.Request) bool {
+	route := mux.CurrentRoute(req)
+	if route == nil {
+		return false
+	}
+	tmpl, err := route.GetPathTemplate()
+	return err == nil && tmpl == "/db/{key}/watch"
+}
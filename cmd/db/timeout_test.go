@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	var hasDeadline bool
+	handler := func(_ http.ResponseWriter, req *http.Request) {
+		_, hasDeadline = req.Context().Deadline()
+	}
+	router := mux.NewRouter()
+	dbRouter := router.PathPrefix("/db").Subrouter()
+	dbRouter.Use(requestTimeout(time.Minute))
+	dbRouter.HandleFunc("/{key}/watch", handler)
+	dbRouter.HandleFunc("/{key}", handler)
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/db/key", nil))
+	assert.True(t, hasDeadline)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/db/key/watch", nil))
+	assert.False(t, hasDeadline)
+}
+
+func TestRequestContext(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-request-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, err = s.db.PutString("key", "value")
+	assert.Nil(t, err)
+
+	// Requests whose time is up by the time they reach the datastore.
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	do := func(method, url, body string) int {
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, httptest.NewRequest(method, url, strings.NewReader(body)).WithContext(ctx))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, do(http.MethodGet, "/db/key", ""))
+	assert.Equal(t, http.StatusServiceUnavailable, do(http.MethodPost, "/db/other", `{"value": "v"}`))
+	assert.Equal(t, http.StatusServiceUnavailable, do(http.MethodDelete, "/db/key", ""))
+	assert.Equal(t, http.StatusServiceUnavailable, do(http.MethodPost, "/db/_batch", `[{"key": "other", "value": "v"}]`))
+	assert.False(t, s.db.Has("other"))
+	assert.True(t, s.db.Has("key"))
+}
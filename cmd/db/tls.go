@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/Gopack-go-labs/labs4-5/httptools"
+)
+
+// serverTLS returns the config of the HTTP and gRPC APIs from -tls-cert,
+// -tls-key and -tls-client-ca, nil to serve them unencrypted.
+func serverTLS() (*tls.Config, error) {
+	if *tlsCert == "" && *tlsKey == "" {
+		if *tlsClientCA != "" {
+			return nil, fmt.Errorf("-tls-client-ca needs -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+	if *tlsCert == "" || *tlsKey == "" {
+		return nil, fmt.Errorf("-tls-cert and -tls-key are set together")
+	}
+	return httptools.ServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+}
+
+// followClient returns the client of the change feed of the leader, which
+// trusts -follow-ca and presents the certificate of the db to leaders
+// verifying clients.
+func followClient() (*http.Client, error) {
+	if *followCA == "" && *tlsCert == "" {
+		return http.DefaultClient, nil
+	}
+	cfg, err := httptools.ClientTLSConfig(*followCA, *tlsCert, *tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}, nil
+}
+
+// followHeader returns the header of the requests to the -follow leader,
+// presenting the key if one is set.
+func followHeader(key string) http.Header {
+	if key == "" {
+		return nil
+	}
+	h := make(http.Header)
+	h.Set(apiKeyHeader, key)
+	return h
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Gopack-go-labs/labs4-5/httptools"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA signs certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{cert: cert, key: key, dir: dir}
+	writePEM(t, ca.file("ca.pem"), "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) file(name string) string {
+	return filepath.Join(ca.dir, name)
+}
+
+// issue writes a certificate for localhost and its key as name.pem and
+// name-key.pem.
+func (ca *testCA) issue(t *testing.T, name string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := ca.file(name+".pem"), ca.file(name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, file, typ string, der []byte) {
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir)
+	serverCert, serverKey := ca.issue(t, "db", 2)
+	clientCert, clientKey := ca.issue(t, "server", 3)
+
+	defer func(cert, key, clientCA string) {
+		*tlsCert, *tlsKey, *tlsClientCA = cert, key, clientCA
+	}(*tlsCert, *tlsKey, *tlsClientCA)
+
+	*tlsCert, *tlsKey, *tlsClientCA = "", "", ""
+	cfg, err := serverTLS()
+	assert.Nil(t, err)
+	assert.Nil(t, cfg)
+
+	*tlsClientCA = ca.file("ca.pem")
+	_, err = serverTLS()
+	assert.NotNil(t, err)
+	*tlsCert = serverCert
+	_, err = serverTLS()
+	assert.NotNil(t, err)
+
+	*tlsKey = serverKey
+	cfg, err = serverTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(serveHealthz))
+	server.TLS = cfg
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(caFile, certFile, keyFile string) (*http.Response, error) {
+		cfg, err := httptools.ClientTLSConfig(caFile, certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		return client.Get(server.URL + "/healthz")
+	}
+
+	resp, err := get(ca.file("ca.pem"), clientCert, clientKey)
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+	// Clients without a certificate of the CA are refused.
+	_, err = get(ca.file("ca.pem"), "", "")
+	assert.NotNil(t, err)
+	// So are clients not trusting the db.
+	_, err = get("", clientCert, clientKey)
+	assert.NotNil(t, err)
+}
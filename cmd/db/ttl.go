@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+)
+
+// writeTTL returns the TTL of a write, given by the ttl field of the body or
+// else the ttl query parameter as a duration such as 30s; zero for none.
+func writeTTL(req *http.Request, field string) (time.Duration, error) {
+	s := field
+	if s == "" {
+		s = req.URL.Query().Get("ttl")
+	}
+	if s == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("malformed ttl %q, a positive duration such as 30s is expected", s)
+	}
+	return ttl, nil
+}
+
+func putString(ctx context.Context, db *datastore.Db, key, value string, rev uint64, ttl time.Duration) (uint64, error) {
+	if ttl == 0 {
+		return db.PutIfRevisionContext(ctx, key, value, rev)
+	}
+	return db.PutIfRevisionWithTTLContext(ctx, key, value, rev, ttl)
+}
+
+func putInt64(ctx context.Context, db *datastore.Db, key string, value int64, rev uint64, ttl time.Duration) (uint64, error) {
+	if ttl == 0 {
+		return db.PutInt64IfRevisionContext(ctx, key, value, rev)
+	}
+	return db.PutInt64IfRevisionWithTTLContext(ctx, key, value, rev, ttl)
+}
+
+// expiresAt formats the expiration time of a value for Res, none for values
+// without TTL.
+func expiresAt(meta datastore.Meta) string {
+	if meta.ExpiresAt.IsZero() {
+		return ""
+	}
+	return meta.ExpiresAt.UTC().Format(time.RFC3339Nano)
+}
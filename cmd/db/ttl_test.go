@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTTL(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return rec
+	}
+	get := func(url string) Res {
+		rec := do(http.MethodGet, url, "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var res Res
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+		return res
+	}
+
+	start := time.Now()
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/db/a", `{"value": "value1", "ttl": "1h"}`).Code)
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/db/b?ttl=30m", `{"value": 2}`).Code)
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/db/c", `{"value": "value3"}`).Code)
+
+	expires, err := time.Parse(time.RFC3339Nano, get("/db/a").ExpiresAt)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, start.Add(time.Hour), expires, time.Minute)
+	expires, err = time.Parse(time.RFC3339Nano, get("/db/b?type=int64").ExpiresAt)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, start.Add(30*time.Minute), expires, time.Minute)
+	assert.Empty(t, get("/db/c").ExpiresAt)
+
+	// Expired values are gone.
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/db/d", `{"value": "value4", "ttl": "1ms"}`).Code)
+	time.Sleep(2 * time.Millisecond)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/db/d", "").Code)
+
+	for _, url := range []string{"/db/e?ttl=soon", "/db/e?ttl=-1s"} {
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, url, `{"value": "value5"}`).Code, url)
+	}
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/db/e", `{"value": "value5", "ttl": "0s"}`).Code)
+}
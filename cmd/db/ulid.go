@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidGenerator produces ULIDs: 48 bits of a millisecond timestamp followed
+// by 80 random bits, encoded in Crockford's base32. Ids generated within the
+// same millisecond increment the random part, so they are strictly sorted.
+type ulidGenerator struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	lastMs  uint64
+	entropy [10]byte
+}
+
+func newUlidGenerator() *ulidGenerator {
+	return &ulidGenerator{now: time.Now}
+}
+
+func (g *ulidGenerator) New() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(g.now().UnixMilli())
+	if ms <= g.lastMs {
+		// Same millisecond or the clock went backwards.
+		ms = g.lastMs
+		if !incrementEntropy(g.entropy[:]) {
+			return "", fmt.Errorf("ulid entropy exhausted within a millisecond")
+		}
+	} else {
+		if _, err := rand.Read(g.entropy[:]); err != nil {
+			return "", err
+		}
+		g.lastMs = ms
+	}
+
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> (40 - 8*i))
+	}
+	copy(id[6:], g.entropy[:])
+	return encodeUlid(id), nil
+}
+
+func incrementEntropy(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeUlid encodes 128 bits as 26 base32 characters, most significant
+// bits first with the first character carrying only 3 bits.
+func encodeUlid(id [16]byte) string {
+	res := make([]byte, 26)
+	for i := 0; i < 26; i++ {
+		// Bit position of the character in the 130-bit padded value.
+		bit := i*5 - 2
+		var v int
+		for j := 0; j < 5; j++ {
+			pos := bit + j
+			v <<= 1
+			if pos >= 0 && id[pos/8]&(0x80>>(pos%8)) != 0 {
+				v |= 1
+			}
+		}
+		res[i] = crockfordAlphabet[v]
+	}
+	return string(res)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUlidGenerator(t *testing.T) {
+	t.Run("encoding", func(t *testing.T) {
+		var id [16]byte
+		assert.Equal(t, "00000000000000000000000000", encodeUlid(id))
+		for i := range id {
+			id[i] = 0xff
+		}
+		assert.Equal(t, "7ZZZZZZZZZZZZZZZZZZZZZZZZZ", encodeUlid(id))
+	})
+
+	t.Run("sortable", func(t *testing.T) {
+		now := time.UnixMilli(1700000000000)
+		g := newUlidGenerator()
+		g.now = func() time.Time { return now }
+
+		ids := make([]string, 0, 1000)
+		for i := 0; i < 1000; i++ {
+			if i%100 == 0 {
+				now = now.Add(time.Millisecond)
+			}
+			id, err := g.New()
+			assert.Nil(t, err)
+			assert.Len(t, id, 26)
+			ids = append(ids, id)
+		}
+		assert.True(t, sort.StringsAreSorted(ids))
+
+		unique := make(map[string]bool)
+		for _, id := range ids {
+			unique[id] = true
+		}
+		assert.Len(t, unique, len(ids))
+	})
+
+	t.Run("clock going backwards", func(t *testing.T) {
+		now := time.UnixMilli(1700000000000)
+		g := newUlidGenerator()
+		g.now = func() time.Time { return now }
+
+		first, err := g.New()
+		assert.Nil(t, err)
+		now = now.Add(-time.Second)
+		second, err := g.New()
+		assert.Nil(t, err)
+		assert.Less(t, first, second)
+	})
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+)
+
+const (
+	usagePrefix   = systemPrefix + "usage/"
+	ownerPrefix   = systemPrefix + "owner/"
+	apiKeyHeader  = "X-API-Key"
+	anonymousUser = "anonymous"
+)
+
+var errStorageQuota = fmt.Errorf("storage quota exceeded")
+
+// Quota limits the usage of a single client. Zero values mean no limit.
+type Quota struct {
+	DailyRequests   int64
+	MonthlyRequests int64
+	DailyBytes      int64
+	MonthlyBytes    int64
+	Keys            int64
+}
+
+type Counters struct {
+	Requests     int64 `json:"requests"`
+	BytesWritten int64 `json:"bytes_written"`
+}
+
+type Usage struct {
+	Day       string   `json:"day"`
+	Month     string   `json:"month"`
+	Daily     Counters `json:"daily"`
+	Monthly   Counters `json:"monthly"`
+	KeysOwned int64    `json:"keys_owned"`
+}
+
+// UsageTracker accounts requests and written bytes per principal, the id of
+// the API key Auth verified, and keeps the counters in the system bucket of
+// the db, so they survive restarts. Without authentication every client is
+// the anonymous one, so clients make up no new principals.
+type UsageTracker struct {
+	db    *datastore.Db
+	quota Quota
+	now   func() time.Time
+
+	mu    sync.Mutex
+	usage map[string]*Usage
+	dirty map[string]bool
+
+	// readOnly holds flushes back while the db follows a leader.
+	readOnly atomic.Bool
+}
+
+func NewUsageTracker(db *datastore.Db, quota Quota) (*UsageTracker, error) {
+	t := &UsageTracker{
+		db:    db,
+		quota: quota,
+		now:   time.Now,
+		dirty: make(map[string]bool),
+	}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload replaces the counters with the ones persisted in the db, such as
+// the counters a follower replicated from its leader.
+func (t *UsageTracker) Reload() error {
+	usage := make(map[string]*Usage)
+	it := t.db.Iterate(usagePrefix)
+	defer it.Close()
+	for it.Next() {
+		val, err := it.Value()
+		if err != nil {
+			return err
+		}
+		raw, ok := val.(string)
+		if !ok {
+			continue
+		}
+		var u Usage
+		if err := json.Unmarshal([]byte(raw), &u); err != nil {
+			return fmt.Errorf("cannot decode usage of %s: %w", it.Key(), err)
+		}
+		usage[strings.TrimPrefix(it.Key(), usagePrefix)] = &u
+	}
+
+	t.mu.Lock()
+	t.usage = usage
+	t.dirty = make(map[string]bool)
+	t.mu.Unlock()
+	return nil
+}
+
+// clientKey returns the principal attached to the request or, without one,
+// the anonymous one. The API key header is not read: a key Auth did not
+// verify names no one.
+func clientKey(req *http.Request) string {
+	if principal, ok := principalFrom(req.Context()); ok {
+		return principal
+	}
+	return anonymousUser
+}
+
+// get returns the usage of the client with the counters of finished periods
+// reset. Must be called with t.mu held.
+func (t *UsageTracker) get(client string) *Usage {
+	u, ok := t.usage[client]
+	if !ok {
+		u = &Usage{}
+		t.usage[client] = u
+	}
+
+	now := t.now().UTC()
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day = day
+		u.Daily = Counters{}
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month = month
+		u.Monthly = Counters{}
+	}
+	return u
+}
+
+func exceeds(limit, val int64) bool {
+	return limit > 0 && val > limit
+}
+
+// Middleware counts every request of a client and rejects it with 429 when
+// one of the request quotas is exhausted.
+func (t *UsageTracker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		client := clientKey(req)
+		if !t.countRequest(client) {
+			writeError(rw, http.StatusTooManyRequests, codeTooManyRequests, "request quota exceeded")
+			return
+		}
+		next.ServeHTTP(rw, withPrincipal(req, client))
+	})
+}
+
+// countRequest counts a request of the client, false if one of the request
+// quotas is exhausted and the request is to be rejected.
+func (t *UsageTracker) countRequest(client string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.get(client)
+	if exceeds(t.quota.DailyRequests, u.Daily.Requests+1) || exceeds(t.quota.MonthlyRequests, u.Monthly.Requests+1) {
+		return false
+	}
+	u.Daily.Requests++
+	u.Monthly.Requests++
+	t.dirty[client] = true
+	return true
+}
+
+// Write checks the storage quotas of the client, performs put and accounts
+// the written bytes. A key is owned by the client that created it. The bytes
+// and the key are reserved while put runs, so a long put such as a
+// streamed upload does not block other clients.
+func (t *UsageTracker) Write(client, key string, size int64, put func() error) error {
+	t.mu.Lock()
+	u := t.get(client)
+	if exceeds(t.quota.DailyBytes, u.Daily.BytesWritten+size) || exceeds(t.quota.MonthlyBytes, u.Monthly.BytesWritten+size) {
+		t.mu.Unlock()
+		return errStorageQuota
+	}
+
+	_, err := t.db.Describe(ownerPrefix + key)
+	isNew := err == datastore.ErrNotFound
+	if isNew && exceeds(t.quota.Keys, u.KeysOwned+1) {
+		t.mu.Unlock()
+		return errStorageQuota
+	}
+	u.Daily.BytesWritten += size
+	u.Monthly.BytesWritten += size
+	if isNew {
+		u.KeysOwned++
+	}
+	t.dirty[client] = true
+	t.mu.Unlock()
+
+	err = put()
+	if err == nil && isNew {
+		_, err = t.db.PutString(ownerPrefix+key, client)
+	}
+	if err != nil {
+		t.mu.Lock()
+		u.Daily.BytesWritten -= size
+		u.Monthly.BytesWritten -= size
+		if isNew {
+			u.KeysOwned--
+		}
+		t.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// WriteBatch is Write for the writes of a batch, sizes holding the bytes
+// of every key. write returns how many of the writes it applied in order;
+// only those are accounted and only their keys are owned.
+func (t *UsageTracker) WriteBatch(client string, keys []string, sizes []int64, write func() (int, error)) (int, error) {
+	var size int64
+	for _, s := range sizes {
+		size += s
+	}
+
+	t.mu.Lock()
+	u := t.get(client)
+	if exceeds(t.quota.DailyBytes, u.Daily.BytesWritten+size) || exceeds(t.quota.MonthlyBytes, u.Monthly.BytesWritten+size) {
+		t.mu.Unlock()
+		return 0, errStorageQuota
+	}
+
+	// created maps new keys to the index of their first write.
+	created := make(map[string]int)
+	for i, key := range keys {
+		if _, ok := created[key]; ok {
+			continue
+		}
+		if _, err := t.db.Describe(ownerPrefix + key); err == datastore.ErrNotFound {
+			created[key] = i
+		}
+	}
+	if exceeds(t.quota.Keys, u.KeysOwned+int64(len(created))) {
+		t.mu.Unlock()
+		return 0, errStorageQuota
+	}
+	u.Daily.BytesWritten += size
+	u.Monthly.BytesWritten += size
+	u.KeysOwned += int64(len(created))
+	t.dirty[client] = true
+	t.mu.Unlock()
+
+	n, err := write()
+	var owners datastore.Batch
+	for key, i := range created {
+		if i < n {
+			owners.PutString(ownerPrefix+key, client)
+			delete(created, key)
+		}
+	}
+	if _, ownErr := t.db.Write(&owners); err == nil {
+		err = ownErr
+	}
+
+	var refund int64
+	for _, s := range sizes[n:] {
+		refund += s
+	}
+	t.mu.Lock()
+	u.Daily.BytesWritten -= refund
+	u.Monthly.BytesWritten -= refund
+	u.KeysOwned -= int64(len(created))
+	t.mu.Unlock()
+	return n, err
+}
+
+// Delete performs del and releases the key from the client owning it, so
+// it no longer counts against the key quota of the owner.
+func (t *UsageTracker) Delete(key string, del func() error) error {
+	if err := del(); err != nil {
+		return err
+	}
+	owner, err := t.db.GetString(ownerPrefix + key)
+	if err == datastore.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := t.db.Delete(ownerPrefix + key); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.get(owner)
+	if u.KeysOwned > 0 {
+		u.KeysOwned--
+	}
+	t.dirty[owner] = true
+	return nil
+}
+
+// DeletePrefix performs del, which deletes the keys starting with prefix,
+// and releases those keys from the clients owning them.
+func (t *UsageTracker) DeletePrefix(prefix string, del func() error) error {
+	if err := del(); err != nil {
+		return err
+	}
+	released := make(map[string]int64)
+	it := t.db.Iterate(ownerPrefix + prefix)
+	defer it.Close()
+	for it.Next() {
+		// Owners of keys deleted meanwhile are gone already.
+		if owner, err := it.Value(); err == nil {
+			if owner, ok := owner.(string); ok {
+				released[owner]++
+			}
+		}
+	}
+	if err := t.db.DeleteRange(ownerPrefix + prefix); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for owner, n := range released {
+		u := t.get(owner)
+		u.KeysOwned = max(u.KeysOwned-n, 0)
+		t.dirty[owner] = true
+	}
+	return nil
+}
+
+// SetReadOnly stops or resumes persisting the counters. A follower db only
+// takes writes from its leader, so counters change in memory only.
+func (t *UsageTracker) SetReadOnly(readOnly bool) {
+	t.readOnly.Store(readOnly)
+}
+
+func (t *UsageTracker) Flush() error {
+	if t.readOnly.Load() {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for client := range t.dirty {
+		data, err := json.Marshal(t.usage[client])
+		if err != nil {
+			return err
+		}
+		if _, err := t.db.PutString(usagePrefix+client, string(data)); err != nil {
+			return err
+		}
+		delete(t.dirty, client)
+	}
+	return nil
+}
+
+func (t *UsageTracker) FlushEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := t.Flush(); err != nil {
+			log.Printf("Failed to flush usage: %s", err)
+		}
+	}
+}
+
+func (t *UsageTracker) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	t.mu.Lock()
+	res := make(map[string]Usage, len(t.usage))
+	for client := range t.usage {
+		res[client] = *t.get(client)
+	}
+	t.mu.Unlock()
+
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(res)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageTracker(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := datastore.NewDb(dir, 10*datastore.Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tracker, err := NewUsageTracker(db, Quota{DailyRequests: 2, DailyBytes: 10, Keys: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func() error { return nil }
+	teamA, teamB := keyID("team-a"), keyID("team-b")
+
+	t.Run("request quota", func(t *testing.T) {
+		handler := tracker.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+		}))
+		codes := make([]int, 0, 3)
+		for i := 0; i < 3; i++ {
+			req := withPrincipal(httptest.NewRequest(http.MethodGet, "/db/key", nil), teamA)
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			codes = append(codes, rw.Code)
+		}
+		assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, codes)
+	})
+
+	t.Run("storage quota", func(t *testing.T) {
+		assert.Nil(t, tracker.Write(teamA, "k1", 6, put))
+		assert.Nil(t, tracker.Write(teamA, "k1", 4, put))
+		assert.Equal(t, errStorageQuota, tracker.Write(teamA, "k1", 1, put))
+		assert.Nil(t, tracker.Write(teamB, "k2", 1, put))
+		assert.Equal(t, errStorageQuota, tracker.Write(teamB, "k3", 1, put))
+	})
+
+	t.Run("persistence", func(t *testing.T) {
+		assert.Nil(t, tracker.Flush())
+		reloaded, err := NewUsageTracker(db, Quota{})
+		assert.Nil(t, err)
+		u := reloaded.usage[teamA]
+		if assert.NotNil(t, u) {
+			assert.Equal(t, int64(2), u.Daily.Requests)
+			assert.Equal(t, int64(10), u.Daily.BytesWritten)
+			assert.Equal(t, int64(1), u.KeysOwned)
+		}
+	})
+}
+
+func TestClientKey(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/db/key", nil)
+	assert.Equal(t, anonymousUser, clientKey(req))
+
+	// Keys Auth did not verify name no one.
+	req.Header.Set(apiKeyHeader, "team-a")
+	assert.Equal(t, anonymousUser, clientKey(req))
+
+	assert.Equal(t, "team-b", clientKey(withPrincipal(req, "team-b")))
+}
+
+func TestUsageTracker_KeyIDs(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-usage-key-ids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(keys string) { *apiKeys = keys }(*apiKeys)
+	*apiKeys = "secret-key"
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	do := func(method, url, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set(apiKeyHeader, key)
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		return rec
+	}
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/db/key", "secret-key", `{"value": "v"}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/db/key", "made-up", "").Code)
+	assert.Nil(t, s.usage.Flush())
+
+	// Neither the counters nor the owners name the key.
+	id := keyID("secret-key")
+	owner, err := s.db.GetString(ownerPrefix + "key")
+	assert.Nil(t, err)
+	assert.Equal(t, id, owner)
+	assert.True(t, s.db.Has(usagePrefix+id))
+	assert.False(t, s.db.Has(usagePrefix+"secret-key"))
+	assert.False(t, s.db.Has(usagePrefix+"made-up"))
+	var res map[string]Usage
+	assert.Nil(t, json.NewDecoder(do(http.MethodGet, "/admin/usage", "", "").Body).Decode(&res))
+	assert.Contains(t, res, id)
+	assert.NotContains(t, res, "secret-key")
+}
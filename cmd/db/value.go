@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// typedValue converts a value decoded with json.Decoder.UseNumber, so large
+// numbers keep their precision, to a string or an int64 as typ asks. An
+// empty typ is inferred from the value: strings stay strings and numbers
+// are int64. int64 values may be given as decimal strings as well.
+func typedValue(v interface{}, typ string) (interface{}, error) {
+	switch typ {
+	case "", "string", "int64":
+	default:
+		return nil, fmt.Errorf("unknown type %q, string or int64 is expected", typ)
+	}
+
+	switch v := v.(type) {
+	case string:
+		if typ != "int64" {
+			return v, nil
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("value %q is not an int64", v)
+		}
+		return n, nil
+	case json.Number:
+		if typ == "string" {
+			return nil, fmt.Errorf("value %s is not a string", v)
+		}
+		n, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("numbers must be int64 integers, got %s", v)
+		}
+		return n, nil
+	case int64:
+		if typ == "string" {
+			return nil, fmt.Errorf("value %d is not a string", v)
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("values must be strings or int64 numbers")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypedValue(t *testing.T) {
+	for _, c := range []struct {
+		value interface{}
+		typ   string
+		want  interface{}
+	}{
+		{"v", "", "v"},
+		{"v", "string", "v"},
+		{"42", "string", "42"},
+		{"42", "int64", int64(42)},
+		{json.Number("9007199254740993"), "", int64(9007199254740993)},
+		{json.Number("-7"), "int64", int64(-7)},
+		{int64(3), "", int64(3)},
+	} {
+		v, err := typedValue(c.value, c.typ)
+		assert.Nil(t, err, c)
+		assert.Equal(t, c.want, v, c)
+	}
+
+	for _, c := range []struct {
+		value interface{}
+		typ   string
+	}{
+		{"v", "int64"},
+		{"v", "bool"},
+		{json.Number("1.5"), ""},
+		{json.Number("9223372036854775808"), "int64"},
+		{json.Number("42"), "string"},
+		{true, ""},
+		{nil, "string"},
+	} {
+		_, err := typedValue(c.value, c.typ)
+		assert.NotNil(t, err, c)
+	}
+}
+
+func TestPostType(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-post-type")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	post := func(url, body string) (int, Res) {
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, url, strings.NewReader(body)))
+		var res Res
+		if rec.Code == http.StatusCreated {
+			assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+		}
+		return rec.Code, res
+	}
+
+	// Numbers beyond float64 precision are kept.
+	code, res := post("/db/big", `{"value": 9223372036854775807}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, Res{Key: "big", Value: "9223372036854775807", Type: "int64"}, res)
+	n, err := s.db.GetInt64("big")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(math.MaxInt64), n)
+
+	code, res = post("/db/count", `{"value": "12", "type": "int64"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "int64", res.Type)
+	n, err = s.db.GetInt64("count")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), n)
+
+	code, res = post("/db/code", `{"value": "12", "type": "string"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "string", res.Type)
+	code, res = post("/db/team/code", `{"value": "7", "type": "int64"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, Res{Key: "code", Value: "7", Type: "int64"}, res)
+
+	for _, body := range []string{`{"value": 12, "type": "string"}`, `{"value": "v", "type": "int64"}`, `{"value": "v", "type": "bool"}`} {
+		code, _ := post("/db/key", body)
+		assert.Equal(t, http.StatusBadRequest, code, body)
+	}
+	assert.False(t, s.db.Has("key"))
+}
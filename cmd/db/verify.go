@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/gorilla/mux"
+)
+
+const (
+	verifyFileName = "verify.json"
+
+	verifyRunning = "running"
+	verifyDone    = "done"
+	verifyFailed  = "failed"
+
+	// verifySaveInterval bounds how often progress of a job is persisted,
+	// a resumed job repeats at most that much work.
+	verifySaveInterval = time.Second
+	// minVerifyPage is the least number of bytes verified between pauses.
+	minVerifyPage      = 64 * 1024
+	defaultFindingPage = 100
+)
+
+// VerifyJob is a verification of the whole db.
+type VerifyJob struct {
+	Id            string                    `json:"id"`
+	Status        string                    `json:"status"`
+	Error         string                    `json:"error,omitempty"`
+	Cursor        datastore.VerifyCursor    `json:"cursor"`
+	BytesVerified int64                     `json:"bytes_verified"`
+	StartedAt     time.Time                 `json:"started_at"`
+	UpdatedAt     time.Time                 `json:"updated_at"`
+	Findings      []datastore.VerifyFinding `json:"findings"`
+}
+
+// VerifyJobRes is a job with a page of its findings.
+type VerifyJobRes struct {
+	VerifyJob
+	TotalFindings int `json:"total_findings"`
+	// NextOffset is the offset query parameter of the next page of
+	// findings, zero for the last page.
+	NextOffset int `json:"next_offset,omitempty"`
+}
+
+// VerifyJobs runs verification jobs in the background. Jobs are kept in a
+// file of the data directory, so running ones resume after a restart. The
+// IO of each job is limited to rate bytes per second, unless rate is zero.
+type VerifyJobs struct {
+	db   *datastore.Db
+	path string
+	rate int64
+	ids  *ulidGenerator
+
+	mu   sync.Mutex
+	jobs map[string]*VerifyJob
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewVerifyJobs(db *datastore.Db, dir string, rate int64) (*VerifyJobs, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	v := &VerifyJobs{
+		db:     db,
+		path:   filepath.Join(dir, verifyFileName),
+		rate:   rate,
+		ids:    newUlidGenerator(),
+		jobs:   make(map[string]*VerifyJob),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	data, err := os.ReadFile(v.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var jobs []*VerifyJob
+		if err := json.Unmarshal(data, &jobs); err != nil {
+			return nil, err
+		}
+		for _, job := range jobs {
+			v.jobs[job.Id] = job
+			if job.Status == verifyRunning {
+				v.run(job)
+			}
+		}
+	}
+	return v, nil
+}
+
+// Start creates a job and runs it.
+func (v *VerifyJobs) Start() (VerifyJob, error) {
+	id, err := v.ids.New()
+	if err != nil {
+		return VerifyJob{}, err
+	}
+	now := time.Now()
+	job := &VerifyJob{Id: id, Status: verifyRunning, StartedAt: now, UpdatedAt: now}
+
+	v.mu.Lock()
+	v.jobs[id] = job
+	res := *job
+	v.mu.Unlock()
+
+	if err := v.save(); err != nil {
+		return VerifyJob{}, err
+	}
+	v.run(job)
+	return res, nil
+}
+
+// Get returns a copy of the job.
+func (v *VerifyJobs) Get(id string) (VerifyJob, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	job, ok := v.jobs[id]
+	if !ok {
+		return VerifyJob{}, false
+	}
+	res := *job
+	res.Findings = append([]datastore.VerifyFinding(nil), job.Findings...)
+	return res, true
+}
+
+// Close stops running jobs and persists their progress, they resume with
+// the next NewVerifyJobs.
+func (v *VerifyJobs) Close() error {
+	v.cancel()
+	v.wg.Wait()
+	return v.save()
+}
+
+func (v *VerifyJobs) run(job *VerifyJob) {
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		v.mu.Lock()
+		cursor := job.Cursor
+		v.mu.Unlock()
+
+		pageSize := v.rate / 10
+		if pageSize < minVerifyPage {
+			pageSize = minVerifyPage
+		}
+		saved := time.Now()
+		for {
+			start := time.Now()
+			page, err := v.db.Verify(cursor, pageSize)
+
+			v.mu.Lock()
+			job.Cursor = page.Next
+			job.BytesVerified += page.Bytes
+			job.Findings = append(job.Findings, page.Findings...)
+			job.UpdatedAt = time.Now()
+			if err != nil {
+				job.Status = verifyFailed
+				job.Error = err.Error()
+			} else if page.Done {
+				job.Status = verifyDone
+			}
+			finished := job.Status != verifyRunning
+			v.mu.Unlock()
+			cursor = page.Next
+
+			if finished || time.Since(saved) >= verifySaveInterval {
+				if err := v.save(); err != nil {
+					log.Printf("Failed to save verification jobs: %s", err)
+				}
+				saved = time.Now()
+			}
+			if finished {
+				return
+			}
+
+			// Pause for as long as reading the page should take at the rate.
+			var pause time.Duration
+			if v.rate > 0 {
+				pause = time.Duration(page.Bytes)*time.Second/time.Duration(v.rate) - time.Since(start)
+			}
+			select {
+			case <-v.ctx.Done():
+				return
+			case <-time.After(pause):
+			}
+		}
+	}()
+}
+
+func (v *VerifyJobs) save() error {
+	v.mu.Lock()
+	jobs := make([]*VerifyJob, 0, len(v.jobs))
+	for _, job := range v.jobs {
+		jobs = append(jobs, job)
+	}
+	data, err := json.Marshal(jobs)
+	v.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(v.path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(v.path+".tmp", v.path)
+}
+
+// startVerifyHandler starts a verification job, the status of which is
+// served at the returned location.
+func startVerifyHandler(jobs *VerifyJobs) http.HandlerFunc {
+	return func(rw http.ResponseWriter, _ *http.Request) {
+		job, err := jobs.Start()
+		if err != nil {
+			internalError(rw, err)
+			return
+		}
+
+		rw.Header().Set("content-type", "application/json")
+		rw.Header().Set("location", "/admin/verify/"+job.Id)
+		rw.WriteHeader(http.StatusAccepted)
+		job.Findings = []datastore.VerifyFinding{}
+		_ = json.NewEncoder(rw).Encode(VerifyJobRes{VerifyJob: job})
+	}
+}
+
+// verifyHandler reports the progress of a job with a page of its findings
+// selected by the offset and limit query parameters.
+func verifyHandler(jobs *VerifyJobs) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		job, ok := jobs.Get(mux.Vars(req)["id"])
+		if !ok {
+			writeError(rw, http.StatusNotFound, codeNotFound, "verification job not found")
+			return
+		}
+
+		offset, limit := 0, defaultFindingPage
+		var err error
+		if s := req.URL.Query().Get("offset"); s != "" {
+			if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+				badRequest(rw, fmt.Errorf("malformed offset"))
+				return
+			}
+		}
+		if s := req.URL.Query().Get("limit"); s != "" {
+			if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+				badRequest(rw, fmt.Errorf("malformed limit"))
+				return
+			}
+		}
+
+		res := VerifyJobRes{VerifyJob: job, TotalFindings: len(job.Findings)}
+		if offset > len(job.Findings) {
+			offset = len(job.Findings)
+		}
+		end := offset + limit
+		if end < len(job.Findings) {
+			res.NextOffset = end
+		} else {
+			end = len(job.Findings)
+		}
+		res.Findings = job.Findings[offset:end]
+		if res.Findings == nil {
+			res.Findings = []datastore.VerifyFinding{}
+		}
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(res)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyJobs(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := datastore.NewDb(dir, 10*datastore.Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"key1", "key2", "key3"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+
+	jobs, err := NewVerifyJobs(db, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/verify", startVerifyHandler(jobs)).Methods(http.MethodPost)
+	router.HandleFunc("/admin/verify/{id}", verifyHandler(jobs)).Methods(http.MethodGet)
+
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/admin/verify", nil))
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	var started VerifyJobRes
+	assert.Nil(t, json.NewDecoder(rw.Body).Decode(&started))
+	assert.Equal(t, verifyRunning, started.Status)
+	assert.Equal(t, "/admin/verify/"+started.Id, rw.Header().Get("location"))
+
+	get := func(url string) (int, VerifyJobRes) {
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, url, nil))
+		var res VerifyJobRes
+		_ = json.NewDecoder(rw.Body).Decode(&res)
+		return rw.Code, res
+	}
+	code, _ := get("/admin/verify/unknown")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get("/admin/verify/" + started.Id + "?limit=0")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	wait := func(id string) VerifyJobRes {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			code, res := get("/admin/verify/" + id)
+			assert.Equal(t, http.StatusOK, code)
+			if res.Status != verifyRunning {
+				return res
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("The job did not finish")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	res := wait(started.Id)
+	assert.Equal(t, verifyDone, res.Status)
+	assert.Equal(t, int64(3*40), res.BytesVerified)
+	assert.Equal(t, 0, res.TotalFindings)
+	assert.Equal(t, []datastore.VerifyFinding{}, res.Findings)
+	assert.Nil(t, jobs.Close())
+
+	// A job interrupted by a restart resumes from its cursor.
+	interrupted := []VerifyJob{{
+		Id:            "interrupted",
+		Status:        verifyRunning,
+		Cursor:        datastore.VerifyCursor{Segment: 0, Offset: 40},
+		BytesVerified: 40,
+	}}
+	data, err := json.Marshal(interrupted)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, verifyFileName), data, 0o600))
+
+	jobs, err = NewVerifyJobs(db, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jobs.Close()
+	router = mux.NewRouter()
+	router.HandleFunc("/admin/verify/{id}", verifyHandler(jobs)).Methods(http.MethodGet)
+
+	res = wait("interrupted")
+	assert.Equal(t, verifyDone, res.Status)
+	assert.Equal(t, int64(3*40), res.BytesVerified)
+	assert.Equal(t, datastore.VerifyCursor{Segment: 1}, res.Cursor)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/gorilla/mux"
+)
+
+// watchHeartbeat is the interval of comments keeping idle watch streams
+// open through proxies.
+var watchHeartbeat = 15 * time.Second
+
+// ChangeRes is the data of an event of /db/{key}/watch. Deletes come
+// without value and type.
+type ChangeRes struct {
+	Seq       uint64  `json:"seq"`
+	Key       string  `json:"key"`
+	Value     *string `json:"value,omitempty"`
+	Type      string  `json:"type,omitempty"`
+	ExpiresAt string  `json:"expires_at,omitempty"`
+}
+
+func changeRes(c datastore.Change) ChangeRes {
+	res := ChangeRes{Seq: c.Seq, Key: c.Key}
+	if c.Deleted() {
+		return res
+	}
+	var s string
+	switch v := c.Value.(type) {
+	case string:
+		s, res.Type = v, "string"
+	case int64:
+		s, res.Type = strconv.FormatInt(v, 10), "int64"
+	}
+	res.Value = &s
+	res.ExpiresAt = expiresAt(datastore.Meta{ExpiresAt: c.ExpiresAt})
+	return res
+}
+
+// watchHandler streams the writes of the key, or of the keys it prefixes
+// with prefix=true, as Server-Sent Events: put and delete events with the
+// sequence number of the write as their id and a ChangeRes as data. The
+// stream starts after the since parameter, or the Last-Event-ID a
+// reconnecting EventSource sends, and from the next write without either.
+// It ends when the client falls too far behind; EventSource then resumes
+// from the last event.
+func watchHandler(db *datastore.Db) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		key := mux.Vars(req)["key"]
+		params := req.URL.Query()
+		prefix := false
+		if s := params.Get("prefix"); s != "" {
+			var err error
+			if prefix, err = strconv.ParseBool(s); err != nil {
+				badRequest(rw, fmt.Errorf("malformed prefix"))
+				return
+			}
+		}
+		since := db.LastSeq()
+		for _, s := range []string{params.Get("since"), req.Header.Get("last-event-id")} {
+			if s == "" {
+				continue
+			}
+			var err error
+			if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+				badRequest(rw, fmt.Errorf("malformed sequence number %q", s))
+				return
+			}
+		}
+
+		changes, err := db.Watch(req.Context(), key, since)
+		if err != nil {
+			writeError(rw, http.StatusServiceUnavailable, codeUnavailable, err.Error())
+			return
+		}
+		// The stream outlives the write timeout of the server.
+		_ = http.NewResponseController(rw).SetWriteDeadline(time.Time{})
+		flusher, _ := rw.(http.Flusher)
+		flush := func() {
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		rw.Header().Set("content-type", "text/event-stream")
+		rw.Header().Set("cache-control", "no-cache")
+		rw.WriteHeader(http.StatusOK)
+		flush()
+
+		heartbeat := time.NewTicker(watchHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case c, ok := <-changes:
+				if !ok {
+					return
+				}
+				if internalKey(c.Key) || !prefix && c.Key != key {
+					continue
+				}
+				event := "put"
+				if c.Deleted() {
+					event = "delete"
+				}
+				data, err := json.Marshal(changeRes(c))
+				if err != nil {
+					return
+				}
+				if _, err := fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", c.Seq, event, data); err != nil {
+					return
+				}
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(rw, ": heartbeat\n\n"); err != nil {
+					return
+				}
+			}
+			flush()
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sseEvent is an event of a text/event-stream body.
+type sseEvent struct {
+	id, event string
+	data      ChangeRes
+}
+
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && ev.event != "":
+			return ev
+		case strings.HasPrefix(line, "id: "):
+			ev.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.data))
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	defer func(d time.Duration) { watchHeartbeat = d }(watchHeartbeat)
+	watchHeartbeat = 10 * time.Millisecond
+
+	server := httptest.NewUnstartedServer(s.handler)
+	// Streams outlive the write timeout.
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	watch := func(t *testing.T, url string, header http.Header) *bufio.Reader {
+		req, err := http.NewRequest(http.MethodGet, server.URL+url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/event-stream", resp.Header.Get("content-type"))
+		return bufio.NewReader(resp.Body)
+	}
+
+	t.Run("Key", func(t *testing.T) {
+		events := watch(t, "/db/key1/watch", nil)
+		// Past the write timeout.
+		time.Sleep(200 * time.Millisecond)
+		_, err = s.db.PutString("key10", "other")
+		assert.Nil(t, err)
+		_, err = s.db.PutString("key1", "value1")
+		assert.Nil(t, err)
+		assert.Nil(t, s.db.Delete("key1"))
+
+		ev := readEvent(t, events)
+		assert.Equal(t, "put", ev.event)
+		assert.Equal(t, "key1", ev.data.Key)
+		assert.Equal(t, "value1", *ev.data.Value)
+		assert.Equal(t, "string", ev.data.Type)
+		ev = readEvent(t, events)
+		assert.Equal(t, "delete", ev.event)
+		assert.Equal(t, ChangeRes{Seq: ev.data.Seq, Key: "key1"}, ev.data)
+	})
+
+	t.Run("Prefix", func(t *testing.T) {
+		_, err = s.db.PutString("user:a", "alice")
+		assert.Nil(t, err)
+		seq := s.db.LastSeq()
+		_, err = s.db.PutInt64("user:b", 2)
+		assert.Nil(t, err)
+		_, err = s.db.PutString("user:c", "carol")
+		assert.Nil(t, err)
+
+		// A reconnecting EventSource resumes after its last event.
+		events := watch(t, "/db/user:/watch?prefix=true", http.Header{"Last-Event-Id": {strconv.FormatUint(seq, 10)}})
+		ev := readEvent(t, events)
+		assert.Equal(t, "user:b", ev.data.Key)
+		assert.Equal(t, strconv.FormatUint(ev.data.Seq, 10), ev.id)
+		assert.Equal(t, "2", *ev.data.Value)
+		assert.Equal(t, "int64", ev.data.Type)
+		assert.Equal(t, "user:c", readEvent(t, events).data.Key)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, url := range []string{"/db/key/watch?prefix=maybe", "/db/key/watch?since=first"} {
+			rec := httptest.NewRecorder()
+			s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+			assert.Equal(t, http.StatusBadRequest, rec.Code, url)
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dbctl export [-addr url] [-key key] [-format csv|parquet|ndjson] [-out file]")
+	fmt.Fprintln(os.Stderr, "       dbctl fsck -dir path [-json] [-repair]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "export":
+		exportCmd(os.Args[2:])
+	case "fsck":
+		fsckCmd(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+// exportCmd downloads a snapshot of the db service contents.
+func exportCmd(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	addr := flags.String("addr", "http://localhost:8083", "db service address")
+	format := flags.String("format", "csv", "export format, csv, parquet or ndjson")
+	key := flags.String("key", os.Getenv("DB_ADMIN_KEY"), "admin API key of the db service, also set by $DB_ADMIN_KEY")
+	out := flags.String("out", "", "output file, stdout by default")
+	_ = flags.Parse(args)
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/admin/export?format=%s", *addr, url.QueryEscape(*format)), nil)
+	if err != nil {
+		log.Fatalf("Export failed: %s", err)
+	}
+	if *key != "" {
+		req.Header.Set("X-API-Key", *key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("Export failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("Export failed: db responded with %d", resp.StatusCode)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Fatalf("Export failed: %s", err)
+	}
+}
+
+// fsckCmd verifies the data directory of a db which is not running and exits
+// with 1 if any problem is found, unless it is repaired.
+func fsckCmd(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	dir := flags.String("dir", "", "data directory")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	repair := flags.Bool("repair", false, "salvage damaged segments and quarantine corrupt files")
+	_ = flags.Parse(args)
+	if *dir == "" {
+		usage()
+	}
+
+	report, err := datastore.Verify(*dir)
+	if err != nil {
+		log.Fatalf("Verification failed: %s", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		for _, seg := range report.Segments {
+			fmt.Printf("%s: %d entries, %d bytes\n", seg.Path, seg.Entries, seg.Bytes)
+			for _, f := range seg.Findings {
+				problem := f.Problem
+				if f.Key != "" {
+					problem = f.Key + ": " + problem
+				}
+				fmt.Printf("  offset %d: %s\n", f.Offset, problem)
+			}
+		}
+		for _, problem := range report.Problems {
+			fmt.Println(problem)
+		}
+	}
+	if report.OK() {
+		return
+	}
+	if !*repair {
+		os.Exit(1)
+	}
+
+	repaired, err := datastore.Repair(*dir)
+	if err != nil {
+		log.Fatalf("Repair failed: %s", err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(repaired)
+		return
+	}
+	fmt.Printf("salvaged %d entries, dropped %d\n", repaired.Salvaged, repaired.Dropped)
+	for _, path := range repaired.Repaired {
+		fmt.Printf("repaired %s\n", path)
+	}
+	for _, path := range repaired.Quarantined {
+		fmt.Printf("quarantined %s\n", path)
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"github.com/roman-mazur/architecture-practice-4-template/httptools"
+	"github.com/Gopack-go-labs/labs4-5/httptools"
 	"github.com/roman-mazur/architecture-practice-4-template/signal"
 	"io"
 	"log"
@@ -16,18 +16,27 @@ import (
 
 var (
 	port       = flag.Int("port", 8090, "load balancer port")
+	adminPort  = flag.Int("admin-port", 8091, "port of /drain and /stack-status, to be kept off the public network")
 	timeoutSec = flag.Int("timeout-sec", 3, "request timeout time in seconds")
 	https      = flag.Bool("https", false, "whether backends support HTTPs")
+	dbAddr     = flag.String("db", "db:8083", "address of the db tier reported by /stack-status")
+	drainWait  = flag.Duration("drain-timeout", 30*time.Second, "max time to wait for in-flight requests of a draining backend")
 
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
 )
 
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
 type Server struct {
 	addr    string
 	alive   bool
 	load    atomic.Int32
 	timeout time.Duration
 	secured bool
+	// draining servers get no new requests until they fail a health check,
+	// i.e. until the process shuts down.
+	draining atomic.Bool
 }
 
 func (s *Server) Scheme() string {
@@ -38,16 +47,21 @@ func (s *Server) Scheme() string {
 }
 
 func (s *Server) CheckHealth() {
-	ctx, _ := context.WithTimeout(context.Background(), s.timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
 	req, _ := http.NewRequestWithContext(ctx, "GET",
 		fmt.Sprintf("%s://%s/health", s.Scheme(), s.addr), nil)
 	resp, err := http.DefaultClient.Do(req)
 
 	if err != nil || resp.StatusCode != http.StatusOK {
 		s.alive = false
+		s.draining.Store(false)
 	} else {
 		s.alive = true
 	}
+	if err == nil {
+		resp.Body.Close()
+	}
 }
 
 type LoadBalancer struct {
@@ -56,6 +70,8 @@ type LoadBalancer struct {
 	heartbeat      time.Duration
 	timeout        time.Duration
 	pickMethod     func([]*Server) *Server
+	dbAddr         string
+	drainTimeout   time.Duration
 }
 
 func LoadBalancerInit(servers []string, heartbeat time.Duration, timeout time.Duration) *LoadBalancer {
@@ -64,10 +80,12 @@ func LoadBalancerInit(servers []string, heartbeat time.Duration, timeout time.Du
 		srvs = append(srvs, &Server{addr: s, timeout: timeout, secured: *https})
 	}
 	return &LoadBalancer{
-		servers:    srvs,
-		heartbeat:  heartbeat,
-		timeout:    timeout,
-		pickMethod: leastConnections,
+		servers:      srvs,
+		heartbeat:    heartbeat,
+		timeout:      timeout,
+		pickMethod:   leastConnections,
+		dbAddr:       *dbAddr,
+		drainTimeout: *drainWait,
 	}
 }
 
@@ -75,20 +93,22 @@ func (lb *LoadBalancer) syncPickServer() *Server {
 	lb.pickServerLock.Lock()
 	defer lb.pickServerLock.Unlock()
 	server := lb.pickMethod(lb.aliveServers())
-	server.load.Add(1)
+	if server != nil {
+		server.load.Add(1)
+	}
 	return server
 }
 
 func (lb *LoadBalancer) forward(rw http.ResponseWriter, r *http.Request) error {
 	dst := lb.syncPickServer()
-	defer dst.load.Add(-1)
-
 	if dst == nil {
 		rw.WriteHeader(http.StatusServiceUnavailable)
 		return fmt.Errorf("no alive servers")
 	}
+	defer dst.load.Add(-1)
 
-	ctx, _ := context.WithTimeout(r.Context(), lb.timeout)
+	ctx, cancel := context.WithTimeout(r.Context(), lb.timeout)
+	defer cancel()
 	fwdRequest := r.Clone(ctx)
 	fwdRequest.RequestURI = ""
 	fwdRequest.URL.Host = dst.addr
@@ -123,7 +143,7 @@ func (lb *LoadBalancer) forward(rw http.ResponseWriter, r *http.Request) error {
 func (lb *LoadBalancer) aliveServers() []*Server {
 	var alive []*Server
 	for _, s := range lb.servers {
-		if s.alive {
+		if s.alive && !s.draining.Load() {
 			alive = append(alive, s)
 		}
 	}
@@ -169,10 +189,14 @@ func main() {
 
 	go lb.Heartbeat()
 
+	// Every path of the frontend is forwarded to the backends, the balancer
+	// itself is operated through the admin port.
 	frontend := httptools.CreateServer(*port, http.HandlerFunc(lb.Serve))
+	admin := httptools.CreateServerWithWriteTimeout(*adminPort, lb.adminHandler(), adminWriteTimeout(lb.drainTimeout))
 
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
 	frontend.Start()
+	admin.Start()
 	signal.WaitForTerminationSignal()
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const drainPollInterval = 50 * time.Millisecond
+
+// drainResponseMargin is the time a drain response gets to be written past
+// the drain timeout.
+const drainResponseMargin = 5 * time.Second
+
+// adminHandler serves the endpoints of the admin port.
+func (lb *LoadBalancer) adminHandler() http.Handler {
+	h := http.NewServeMux()
+	h.HandleFunc("/stack-status", lb.ServeStackStatus)
+	h.HandleFunc("/drain", lb.ServeDrain)
+	return h
+}
+
+// adminWriteTimeout returns the write timeout of the admin port, drains
+// waiting up to drainTimeout must still get their response.
+func adminWriteTimeout(drainTimeout time.Duration) time.Duration {
+	return drainTimeout + drainResponseMargin
+}
+
+func (lb *LoadBalancer) server(addr string) *Server {
+	for _, s := range lb.servers {
+		if s.addr == addr {
+			return s
+		}
+	}
+	return nil
+}
+
+// ServeDrain lets a backend coordinate its shutdown. POST /drain?server=addr
+// stops sending new requests to the backend and responds once its in-flight
+// requests are done, 504 if they do not finish within the drain timeout.
+// DELETE /drain?server=addr brings a restarted backend back.
+func (lb *LoadBalancer) ServeDrain(rw http.ResponseWriter, r *http.Request) {
+	s := lb.server(r.URL.Query().Get("server"))
+	if s == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		// Taking the pick lock guarantees that no request is forwarded to the
+		// server once the flag is set, so load only goes down.
+		lb.pickServerLock.Lock()
+		s.draining.Store(true)
+		lb.pickServerLock.Unlock()
+
+		if !lb.waitIdle(r, s) {
+			rw.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		s.draining.Store(false)
+		rw.WriteHeader(http.StatusOK)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (lb *LoadBalancer) waitIdle(r *http.Request, s *Server) bool {
+	timeout := time.NewTimer(lb.drainTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for s.load.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-timeout.C:
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrain(t *testing.T) {
+	lb := LoadBalancerInit([]string{"server1:8080", "server2:8080"}, time.Second, time.Second)
+	lb.drainTimeout = time.Second
+	for _, s := range lb.servers {
+		s.alive = true
+	}
+	server1 := lb.servers[0]
+
+	drain := func(method string) int {
+		req := httptest.NewRequest(method, "/drain?server=server1:8080", nil)
+		w := httptest.NewRecorder()
+		lb.ServeDrain(w, req)
+		return w.Code
+	}
+
+	t.Run("waits for in-flight requests", func(t *testing.T) {
+		server1.load.Add(1)
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			server1.load.Add(-1)
+		}()
+
+		start := time.Now()
+		assert.Equal(t, http.StatusOK, drain(http.MethodPost))
+		assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+		assert.Equal(t, []*Server{lb.servers[1]}, lb.aliveServers())
+	})
+
+	t.Run("undrain", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, drain(http.MethodDelete))
+		assert.Len(t, lb.aliveServers(), 2)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		lb.drainTimeout = 100 * time.Millisecond
+		server1.load.Add(1)
+		defer server1.load.Add(-1)
+		assert.Equal(t, http.StatusGatewayTimeout, drain(http.MethodPost))
+	})
+
+	t.Run("unknown server", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/drain?server=unknown:8080", nil)
+		w := httptest.NewRecorder()
+		lb.ServeDrain(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestAdminHandler(t *testing.T) {
+	lb := LoadBalancerInit([]string{"server1:8080"}, time.Second, time.Second)
+	lb.servers[0].alive = true
+
+	req := httptest.NewRequest(http.MethodDelete, "/drain?server=server1:8080", nil)
+	w := httptest.NewRecorder()
+	lb.adminHandler().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Drains waiting for the whole timeout still get their response.
+	assert.Greater(t, adminWriteTimeout(30*time.Second), 30*time.Second)
+}
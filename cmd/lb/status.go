@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	statusOk       = "ok"
+	statusDegraded = "degraded"
+	statusDown     = "down"
+)
+
+type ComponentStatus struct {
+	Addr    string          `json:"addr"`
+	Healthy bool            `json:"healthy"`
+	Version string          `json:"version,omitempty"`
+	Details json.RawMessage `json:"details,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+type StackStatus struct {
+	Status   string            `json:"status"`
+	Version  string            `json:"version"`
+	Backends []ComponentStatus `json:"backends"`
+	Db       ComponentStatus   `json:"db"`
+}
+
+// fetchStatus reads the /status document of a stack component. Components
+// report their health in the "healthy" field, the db tier is healthy as long
+// as it responds.
+func (lb *LoadBalancer) fetchStatus(ctx context.Context, scheme, addr string) ComponentStatus {
+	res := ComponentStatus{Addr: addr}
+
+	ctx, cancel := context.WithTimeout(ctx, lb.timeout)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/status", scheme, addr), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		res.Error = fmt.Sprintf("status endpoint responded with %d", resp.StatusCode)
+		return res
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res.Details); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	var common struct {
+		Version string `json:"version"`
+		Healthy *bool  `json:"healthy"`
+	}
+	_ = json.Unmarshal(res.Details, &common)
+	res.Version = common.Version
+	res.Healthy = common.Healthy == nil || *common.Healthy
+	return res
+}
+
+func (lb *LoadBalancer) StackStatus(ctx context.Context) StackStatus {
+	res := StackStatus{
+		Version:  version,
+		Backends: make([]ComponentStatus, len(lb.servers)),
+	}
+
+	var wg sync.WaitGroup
+	for i, s := range lb.servers {
+		wg.Add(1)
+		go func(i int, s *Server) {
+			defer wg.Done()
+			res.Backends[i] = lb.fetchStatus(ctx, s.Scheme(), s.addr)
+		}(i, s)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		res.Db = lb.fetchStatus(ctx, "http", lb.dbAddr)
+	}()
+	wg.Wait()
+
+	healthy := 0
+	for _, b := range res.Backends {
+		if b.Healthy {
+			healthy++
+		}
+	}
+	switch {
+	case !res.Db.Healthy || healthy == 0:
+		res.Status = statusDown
+	case healthy < len(res.Backends):
+		res.Status = statusDegraded
+	default:
+		res.Status = statusOk
+	}
+	return res
+}
+
+func (lb *LoadBalancer) ServeStackStatus(rw http.ResponseWriter, r *http.Request) {
+	res := lb.StackStatus(r.Context())
+
+	rw.Header().Set("content-type", "application/json")
+	if res.Status == statusDown {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		rw.WriteHeader(http.StatusOK)
+	}
+	_ = json.NewEncoder(rw).Encode(res)
+}
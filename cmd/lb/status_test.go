@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func statusServer(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(body))
+	}))
+}
+
+func TestStackStatus(t *testing.T) {
+	healthy := statusServer(`{"version":"v1","healthy":true}`)
+	defer healthy.Close()
+	failing := statusServer(`{"version":"v1","healthy":false}`)
+	defer failing.Close()
+	db := statusServer(`{"version":"v2","stats":{"segments":1}}`)
+	defer db.Close()
+
+	host := func(s *httptest.Server) string {
+		u, _ := url.Parse(s.URL)
+		return u.Host
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		lb := LoadBalancerInit([]string{host(healthy)}, time.Second, time.Second)
+		lb.dbAddr = host(db)
+
+		req := httptest.NewRequest(http.MethodGet, "/stack-status", nil)
+		w := httptest.NewRecorder()
+		lb.ServeStackStatus(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		res := lb.StackStatus(req.Context())
+		assert.Equal(t, statusOk, res.Status)
+		assert.Equal(t, "v1", res.Backends[0].Version)
+		assert.Equal(t, "v2", res.Db.Version)
+		assert.True(t, res.Db.Healthy)
+	})
+
+	t.Run("degraded", func(t *testing.T) {
+		lb := LoadBalancerInit([]string{host(healthy), host(failing)}, time.Second, time.Second)
+		lb.dbAddr = host(db)
+
+		res := lb.StackStatus(httptest.NewRequest(http.MethodGet, "/", nil).Context())
+		assert.Equal(t, statusDegraded, res.Status)
+		assert.False(t, res.Backends[1].Healthy)
+	})
+
+	t.Run("db down", func(t *testing.T) {
+		lb := LoadBalancerInit([]string{host(healthy)}, time.Second, 100*time.Millisecond)
+		lb.dbAddr = "127.0.0.1:1"
+
+		req := httptest.NewRequest(http.MethodGet, "/stack-status", nil)
+		w := httptest.NewRecorder()
+		lb.ServeStackStatus(w, req)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+}
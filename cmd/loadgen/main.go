@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	modeBalancer = "balancer"
+	modeDb       = "db"
+
+	distUniform = "uniform"
+	distZipf    = "zipf"
+)
+
+type Config struct {
+	Target      string        `json:"target"`
+	Mode        string        `json:"mode"`
+	Concurrency int           `json:"concurrency"`
+	Duration    time.Duration `json:"duration_ns"`
+	WriteRatio  float64       `json:"write_ratio"`
+	Keys        int           `json:"keys"`
+	Dist        string        `json:"dist"`
+	ZipfS       float64       `json:"zipf_s"`
+	ValueSize   int           `json:"value_size"`
+	Timeout     time.Duration `json:"timeout_ns"`
+}
+
+func (c Config) validate() error {
+	if c.Mode != modeBalancer && c.Mode != modeDb {
+		return fmt.Errorf("unknown mode %q", c.Mode)
+	}
+	if c.Mode == modeBalancer && c.WriteRatio > 0 {
+		return fmt.Errorf("the balancer serves reads only, use -mode=db for writes")
+	}
+	if c.WriteRatio < 0 || c.WriteRatio > 1 {
+		return fmt.Errorf("write ratio must be within [0, 1]")
+	}
+	if c.Dist != distUniform && c.Dist != distZipf {
+		return fmt.Errorf("unknown key distribution %q", c.Dist)
+	}
+	if c.Dist == distZipf && c.ZipfS <= 1 {
+		return fmt.Errorf("zipf exponent must be greater than 1")
+	}
+	if c.Concurrency < 1 || c.Keys < 1 {
+		return fmt.Errorf("concurrency and keys must be positive")
+	}
+	return nil
+}
+
+// keyPicker returns key indexes of the configured distribution. It is not
+// safe for concurrent use.
+func keyPicker(c Config, seed int64) func() int {
+	rnd := rand.New(rand.NewSource(seed))
+	if c.Dist == distZipf {
+		zipf := rand.NewZipf(rnd, c.ZipfS, 1, uint64(c.Keys-1))
+		return func() int { return int(zipf.Uint64()) }
+	}
+	return func() int { return rnd.Intn(c.Keys) }
+}
+
+// run generates load until the duration passes or ctx is done.
+func run(ctx context.Context, c Config) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.Duration)
+	defer cancel()
+
+	client := &http.Client{Timeout: c.Timeout}
+	reads, writes := newRecorder(), newRecorder()
+	body, _ := json.Marshal(map[string]string{"value": strings.Repeat("x", c.ValueSize)})
+
+	do := func(req *http.Request, rec *recorder) {
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() == nil {
+				rec.record(time.Since(start), 0)
+			}
+			return
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		rec.record(time.Since(start), resp.StatusCode)
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < c.Concurrency; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			pick := keyPicker(c, seed)
+			rnd := rand.New(rand.NewSource(seed))
+			for ctx.Err() == nil {
+				key := fmt.Sprintf("key-%d", pick())
+				if rnd.Float64() < c.WriteRatio {
+					req, _ := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/db/%s", c.Target, key), bytes.NewReader(body))
+					req.Header.Set("content-type", "application/json")
+					do(req, writes)
+					continue
+				}
+
+				url := fmt.Sprintf("%s/db/%s", c.Target, key)
+				if c.Mode == modeBalancer {
+					url = fmt.Sprintf("%s/api/v1/some-data?key=%s", c.Target, key)
+				}
+				req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+				do(req, reads)
+			}
+		}(time.Now().UnixNano() + int64(w))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	res := Result{
+		Config:     c,
+		ElapsedSec: elapsed.Seconds(),
+		Reads:      reads.stats(),
+		Writes:     writes.stats(),
+	}
+	var total int64
+	for _, s := range []*OpStats{res.Reads, res.Writes} {
+		if s != nil {
+			total += s.Requests
+		}
+	}
+	res.Throughput = float64(total) / elapsed.Seconds()
+	return res
+}
+
+func printResult(res Result) {
+	fmt.Printf("%d workers for %.1fs: %.1f req/s\n", res.Config.Concurrency, res.ElapsedSec, res.Throughput)
+	for _, op := range []struct {
+		name  string
+		stats *OpStats
+	}{{"reads", res.Reads}, {"writes", res.Writes}} {
+		if op.stats == nil {
+			continue
+		}
+		s := op.stats
+		fmt.Printf("%-6s %8d requests, %.2f%% errors, p50 %.2fms p90 %.2fms p95 %.2fms p99 %.2fms max %.2fms\n",
+			op.name, s.Requests, s.ErrorRate*100, s.P50Ms, s.P90Ms, s.P95Ms, s.P99Ms, s.MaxMs)
+	}
+}
+
+func main() {
+	var c Config
+	flag.StringVar(&c.Target, "target", "http://localhost:8090", "balancer or db address")
+	flag.StringVar(&c.Mode, "mode", modeBalancer, "balancer to read via /api/v1/some-data, db to read and write /db/{key}")
+	flag.IntVar(&c.Concurrency, "concurrency", 10, "number of concurrent workers")
+	flag.DurationVar(&c.Duration, "duration", 10*time.Second, "test duration")
+	flag.Float64Var(&c.WriteRatio, "writes", 0, "share of write requests, db mode only")
+	flag.IntVar(&c.Keys, "keys", 1000, "number of distinct keys")
+	flag.StringVar(&c.Dist, "dist", distUniform, "key distribution, uniform or zipf")
+	flag.Float64Var(&c.ZipfS, "zipf-s", 1.1, "zipf distribution exponent, greater than 1")
+	flag.IntVar(&c.ValueSize, "value-size", 100, "size of written values in bytes")
+	flag.DurationVar(&c.Timeout, "timeout", 3*time.Second, "request timeout")
+	out := flag.String("json", "", "file to write results as JSON to, - for stdout")
+	flag.Parse()
+
+	if err := c.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	res := run(context.Background(), c)
+	printResult(res)
+
+	if *out == "" {
+		return
+	}
+	w := os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	rec := newRecorder()
+	for i := 1; i <= 100; i++ {
+		rec.record(time.Duration(i)*time.Millisecond, http.StatusOK)
+	}
+	rec.record(time.Millisecond, http.StatusServiceUnavailable)
+	rec.record(time.Millisecond, 0)
+
+	s := rec.stats()
+	assert.Equal(t, int64(102), s.Requests)
+	assert.Equal(t, int64(2), s.Errors)
+	assert.Equal(t, map[int]int{http.StatusOK: 100, http.StatusServiceUnavailable: 1}, s.Statuses)
+	assert.Equal(t, 100.0, s.MaxMs)
+	assert.InDelta(t, 50, s.P50Ms, 2)
+	assert.InDelta(t, 99, s.P99Ms, 2)
+}
+
+func TestKeyPicker(t *testing.T) {
+	c := Config{Keys: 100, Dist: distZipf, ZipfS: 1.5}
+	pick := keyPicker(c, 1)
+	hits := make([]int, c.Keys)
+	for i := 0; i < 10000; i++ {
+		hits[pick()]++
+	}
+	// The hottest key takes a big share with zipf.
+	assert.Greater(t, hits[0], 2000)
+}
+
+func TestRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			rw.WriteHeader(http.StatusCreated)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "-0") {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	c := Config{
+		Target:      server.URL,
+		Mode:        modeDb,
+		Concurrency: 4,
+		Duration:    200 * time.Millisecond,
+		WriteRatio:  0.5,
+		Keys:        10,
+		Dist:        distUniform,
+		ValueSize:   10,
+		Timeout:     time.Second,
+	}
+	assert.Nil(t, c.validate())
+
+	res := run(context.Background(), c)
+	assert.NotNil(t, res.Reads)
+	assert.NotNil(t, res.Writes)
+	assert.Greater(t, res.Reads.Errors, int64(0))
+	assert.Equal(t, int64(0), res.Writes.Errors)
+	assert.Greater(t, res.Throughput, 0.0)
+
+	c.Mode = modeBalancer
+	assert.Error(t, c.validate())
+}
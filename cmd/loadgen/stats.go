@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// OpStats summarizes requests of one kind. Latencies are in milliseconds.
+type OpStats struct {
+	Requests  int64       `json:"requests"`
+	Errors    int64       `json:"errors"`
+	ErrorRate float64     `json:"error_rate"`
+	Statuses  map[int]int `json:"statuses"`
+	P50Ms     float64     `json:"p50_ms"`
+	P90Ms     float64     `json:"p90_ms"`
+	P95Ms     float64     `json:"p95_ms"`
+	P99Ms     float64     `json:"p99_ms"`
+	MaxMs     float64     `json:"max_ms"`
+}
+
+type Result struct {
+	Config     Config   `json:"config"`
+	ElapsedSec float64  `json:"elapsed_sec"`
+	Throughput float64  `json:"throughput_rps"`
+	Reads      *OpStats `json:"reads,omitempty"`
+	Writes     *OpStats `json:"writes,omitempty"`
+}
+
+// recorder collects outcomes of requests of one kind.
+type recorder struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    int64
+	statuses  map[int]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{statuses: make(map[int]int)}
+}
+
+// record accounts a request that got the status, zero when it failed
+// before a response. Statuses of 5xx are errors.
+func (r *recorder) record(latency time.Duration, status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.latencies = append(r.latencies, latency)
+	if status != 0 {
+		r.statuses[status]++
+	}
+	if status == 0 || status >= 500 {
+		r.errors++
+	}
+}
+
+func toMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (r *recorder) stats() *OpStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := len(r.latencies)
+	if n == 0 {
+		return nil
+	}
+	sorted := append([]time.Duration(nil), r.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p float64) float64 {
+		return toMs(sorted[int(float64(n-1)*p)])
+	}
+
+	statuses := make(map[int]int, len(r.statuses))
+	for status, count := range r.statuses {
+		statuses[status] = count
+	}
+	return &OpStats{
+		Requests:  int64(n),
+		Errors:    r.errors,
+		ErrorRate: float64(r.errors) / float64(n),
+		Statuses:  statuses,
+		P50Ms:     percentile(0.5),
+		P90Ms:     percentile(0.9),
+		P95Ms:     percentile(0.95),
+		P99Ms:     percentile(0.99),
+		MaxMs:     toMs(sorted[n-1]),
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	latencyWindowLen = 128
+	// minHedgeSamples is the amount of observed latencies required before
+	// p95 is trusted enough to hedge reads.
+	minHedgeSamples = 20
+	// retryCost is the price of a single retry in budget milli-tokens.
+	retryCost      = 1000
+	maxRetryTokens = 10 * retryCost
+)
+
+// requestIDHeader carries the id of a request from the balancer to the db,
+// so their logs can be correlated.
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// withRequestID makes the requests to the db done with the context carry
+// the id, none for an empty one.
+func withRequestID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+type DbResponse struct {
+	StatusCode int
+	Body       []byte
+}
+
+// retryBudget allows retrying at most ratio of all the requests. Every
+// request deposits ratio of a token, every retry or hedge withdraws one.
+type retryBudget struct {
+	deposit int64
+	tokens  atomic.Int64
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{deposit: int64(ratio * retryCost)}
+}
+
+func (b *retryBudget) onRequest() {
+	if b.tokens.Add(b.deposit) > maxRetryTokens {
+		b.tokens.Store(maxRetryTokens)
+	}
+}
+
+func (b *retryBudget) tryWithdraw() bool {
+	for {
+		cur := b.tokens.Load()
+		if cur < retryCost {
+			return false
+		}
+		if b.tokens.CompareAndSwap(cur, cur-retryCost) {
+			return true
+		}
+	}
+}
+
+// latencyWindow keeps the latest request latencies.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [latencyWindowLen]time.Duration
+	n       int
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.n%latencyWindowLen] = d
+	w.n++
+}
+
+// percentile returns the p-th percentile of the window and false if there
+// are not enough samples yet.
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	w.mu.Lock()
+	n := w.n
+	if n > latencyWindowLen {
+		n = latencyWindowLen
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, w.samples[:n])
+	w.mu.Unlock()
+
+	if n < minHedgeSamples {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(float64(n-1)*p)], true
+}
+
+type DbClientStats struct {
+	Requests      int64   `json:"requests"`
+	Retries       int64   `json:"retries"`
+	RetriesDenied int64   `json:"retries_denied"`
+	Hedges        int64   `json:"hedges"`
+	HedgeWins     int64   `json:"hedge_wins"`
+	DeadlineSkips int64   `json:"deadline_skips"`
+	P50Ms         float64 `json:"p50_ms"`
+	P95Ms         float64 `json:"p95_ms"`
+	P99Ms         float64 `json:"p99_ms"`
+}
+
+// DbClient talks to replicas of the db service. Failed requests are retried
+// on another replica within the retry budget, reads slower than p95 are
+// hedged with a second request to another replica.
+type DbClient struct {
+	replicas []string
+	client   *http.Client
+	budget   *retryBudget
+	latency  latencyWindow
+	next     atomic.Uint32
+
+	requests, retries, retriesDenied atomic.Int64
+	hedges, hedgeWins, deadlineSkips atomic.Int64
+}
+
+func NewDbClient(replicas []string, retryRatio float64) *DbClient {
+	return &DbClient{
+		replicas: replicas,
+		client:   http.DefaultClient,
+		budget:   newRetryBudget(retryRatio),
+	}
+}
+
+func (c *DbClient) replica(attempt int, start uint32) string {
+	return c.replicas[(int(start)+attempt)%len(c.replicas)]
+}
+
+// fitsDeadline reports whether another attempt is likely to complete before
+// the context deadline.
+func (c *DbClient) fitsDeadline(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return true
+	}
+	expected, ok := c.latency.percentile(0.95)
+	if !ok {
+		return time.Until(deadline) > 0
+	}
+	if time.Until(deadline) < expected {
+		c.deadlineSkips.Add(1)
+		return false
+	}
+	return true
+}
+
+func (c *DbClient) do(ctx context.Context, method, url, contentType string, body []byte) (*DbResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("content-type", contentType)
+	}
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		req.Header.Set(requestIDHeader, id)
+	}
+
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.latency.add(time.Since(start))
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("db replica responded with %d", resp.StatusCode)
+	}
+	return &DbResponse{StatusCode: resp.StatusCode, Body: data}, nil
+}
+
+// withRetries runs attempt against consecutive replicas until it succeeds,
+// the retry budget is exhausted or the deadline is too close.
+func (c *DbClient) withRetries(ctx context.Context, attempt func(ctx context.Context, n int, start uint32) (*DbResponse, error)) (*DbResponse, error) {
+	c.requests.Add(1)
+	c.budget.onRequest()
+	start := c.next.Add(1)
+
+	var lastErr error
+	for n := 0; ; n++ {
+		if n > 0 {
+			if !c.fitsDeadline(ctx) {
+				break
+			}
+			if !c.budget.tryWithdraw() {
+				c.retriesDenied.Add(1)
+				break
+			}
+			c.retries.Add(1)
+		}
+
+		resp, err := attempt(ctx, n, start)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+func (c *DbClient) Get(ctx context.Context, key string) (*DbResponse, error) {
+	return c.withRetries(ctx, func(ctx context.Context, n int, start uint32) (*DbResponse, error) {
+		return c.hedgedGet(ctx, key, n, start)
+	})
+}
+
+func (c *DbClient) Post(ctx context.Context, key string, body interface{}) (*DbResponse, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return c.withRetries(ctx, func(ctx context.Context, n int, start uint32) (*DbResponse, error) {
+		url := fmt.Sprintf("%s/%s", c.replica(n, start), key)
+		return c.do(ctx, http.MethodPost, url, "application/json", data)
+	})
+}
+
+type hedgeResult struct {
+	resp   *DbResponse
+	err    error
+	hedged bool
+}
+
+// hedgedGet reads from a replica and, if no response arrives within p95,
+// issues the same read to the next replica. The first success wins.
+func (c *DbClient) hedgedGet(ctx context.Context, key string, n int, start uint32) (*DbResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult, 2)
+	get := func(replica string, hedged bool) {
+		resp, err := c.do(ctx, http.MethodGet, fmt.Sprintf("%s/%s", replica, key), "", nil)
+		results <- hedgeResult{resp: resp, err: err, hedged: hedged}
+	}
+	go get(c.replica(n, start), false)
+
+	pending := 1
+	var hedgeTimer <-chan time.Time
+	if delay, ok := c.latency.percentile(0.95); ok && len(c.replicas) > 1 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		hedgeTimer = timer.C
+	}
+
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-hedgeTimer:
+			hedgeTimer = nil
+			if !c.fitsDeadline(ctx) || !c.budget.tryWithdraw() {
+				continue
+			}
+			c.hedges.Add(1)
+			pending++
+			go get(c.replica(n+1, start), true)
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if res.hedged {
+					c.hedgeWins.Add(1)
+				}
+				return res.resp, nil
+			}
+			lastErr = res.err
+		}
+	}
+	return nil, lastErr
+}
+
+func toMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (c *DbClient) Stats() DbClientStats {
+	stats := DbClientStats{
+		Requests:      c.requests.Load(),
+		Retries:       c.retries.Load(),
+		RetriesDenied: c.retriesDenied.Load(),
+		Hedges:        c.hedges.Load(),
+		HedgeWins:     c.hedgeWins.Load(),
+		DeadlineSkips: c.deadlineSkips.Load(),
+	}
+	if p, ok := c.latency.percentile(0.5); ok {
+		stats.P50Ms = toMs(p)
+	}
+	if p, ok := c.latency.percentile(0.95); ok {
+		stats.P95Ms = toMs(p)
+	}
+	if p, ok := c.latency.percentile(0.99); ok {
+		stats.P99Ms = toMs(p)
+	}
+	return stats
+}
+
+func (c *DbClient) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(c.Stats())
+}
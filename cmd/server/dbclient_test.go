@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func backend(delay time.Duration, status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		rw.WriteHeader(status)
+		_, _ = rw.Write([]byte(`{"key":"k","value":"v","type":"string"}`))
+	}))
+}
+
+func TestDbClient_HedgedReads(t *testing.T) {
+	slow := backend(500*time.Millisecond, http.StatusOK)
+	defer slow.Close()
+	fast := backend(0, http.StatusOK)
+	defer fast.Close()
+
+	client := NewDbClient([]string{slow.URL, fast.URL}, 1)
+	for i := 0; i < minHedgeSamples; i++ {
+		client.latency.add(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get(context.Background(), "k")
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected response %v: %s", resp, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Hedged reads took %s", elapsed)
+	}
+
+	stats := client.Stats()
+	if stats.HedgeWins < 2 {
+		t.Errorf("Expected reads from the slow replica to be hedged: %+v", stats)
+	}
+	if stats.P99Ms > 400 {
+		t.Errorf("Tail latency was not reduced: %+v", stats)
+	}
+}
+
+func TestDbClient_RetryBudget(t *testing.T) {
+	broken := backend(0, http.StatusInternalServerError)
+	defer broken.Close()
+
+	client := NewDbClient([]string{broken.URL}, 0.25)
+	for i := 0; i < 20; i++ {
+		if _, err := client.Post(context.Background(), "k", Req{Value: "v"}); err == nil {
+			t.Fatal("Expected an error from a broken replica")
+		}
+	}
+
+	stats := client.Stats()
+	if stats.Retries != 5 {
+		t.Errorf("Expected 5 retries within the budget, got %+v", stats)
+	}
+	if stats.RetriesDenied != 20 {
+		t.Errorf("Expected every request to end with a denied retry, got %+v", stats)
+	}
+}
+
+func TestDbClient_DeadlineAware(t *testing.T) {
+	broken := backend(20*time.Millisecond, http.StatusInternalServerError)
+	defer broken.Close()
+
+	client := NewDbClient([]string{broken.URL}, 1)
+	for i := 0; i < minHedgeSamples; i++ {
+		client.latency.add(time.Second)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := client.Get(ctx, "k"); err == nil {
+		t.Fatal("Expected an error from a broken replica")
+	}
+	if stats := client.Stats(); stats.Retries != 0 || stats.DeadlineSkips == 0 {
+		t.Errorf("Expected retry to be skipped due to deadline: %+v", stats)
+	}
+}
+
+func TestDbClient_RequestID(t *testing.T) {
+	var got string
+	db := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(requestIDHeader)
+		_, _ = rw.Write([]byte(`{"key":"k","value":"v","type":"string"}`))
+	}))
+	defer db.Close()
+
+	client := NewDbClient([]string{db.URL}, 1)
+	if _, err := client.Get(withRequestID(context.Background(), "req-1"), "k"); err != nil {
+		t.Fatal(err)
+	}
+	if got != "req-1" {
+		t.Errorf("Expected the request id to reach the db, got %q", got)
+	}
+	if _, err := client.Get(withRequestID(context.Background(), ""), "k"); err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("Expected no request id, got %q", got)
+	}
+}
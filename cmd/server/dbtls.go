@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// dbTLSConfig returns the config of requests to https db replicas, trusting
+// the CAs of caFile, the system ones if empty, and presenting the
+// certificate of certFile and keyFile to replicas verifying clients.
+func dbTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// SetTLSConfig makes the client talk to https replicas with cfg.
+func (c *DbClient) SetTLSConfig(cfg *tls.Config) {
+	c.client = &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// callDrain asks the balancer to drain (POST) or to bring back (DELETE) the
+// server known to it by addr. A drain request returns once the balancer has
+// no requests in flight to the server.
+func callDrain(ctx context.Context, drainUrl, method, addr string) error {
+	u, err := url.Parse(drainUrl)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("server", addr)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("balancer responded with %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/roman-mazur/architecture-practice-4-template/httptools"
@@ -25,20 +27,53 @@ type Req struct {
   Type  string `json:"type"`
 }
 
-var port = flag.Int("port", 8080, "server port")
+var (
+  port        = flag.Int("port", 8080, "server port")
+  dbUrls      = flag.String("db", "http://db:8083/db", "comma separated list of db replica URLs")
+  retryRatio  = flag.Float64("retry-budget", 0.1, "max ratio of db requests that may be retried")
+  dbTimeout   = flag.Duration("db-timeout", 2*time.Second, "deadline of a db request including retries")
+  lbDrain     = flag.String("lb-drain", "", "drain endpoint of the balancer called on shutdown, e.g. http://balancer:8091/drain")
+  advertise   = flag.String("advertise", "", "address the balancer knows this server by, hostname:port by default")
+  drainWait   = flag.Duration("drain-timeout", 35*time.Second, "max time to wait for the balancer to drain this server")
+  maxStale    = flag.Duration("max-stale", 5*time.Minute, "max age of cached values served while the db is unavailable, 0 disables")
+  staleSize   = flag.Int("stale-cache-size", 10000, "number of keys whose last values are cached for db outages")
+  dbCA        = flag.String("db-ca", "", "PEM file of the CAs trusted to sign the certificates of https db replicas, the system ones by default")
+  dbCert      = flag.String("db-cert", "", "PEM certificate file presented to db replicas verifying clients")
+  dbKey       = flag.String("db-key", "", "PEM key file of -db-cert")
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
 
 const teamName = "gopack"
-const dbUrl = "http://db:8083/db"
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
 
+type Status struct {
+  Version  string        `json:"version"`
+  Healthy  bool          `json:"healthy"`
+  DbClient DbClientStats `json:"db_client"`
+}
+
+func healthy() bool {
+  return os.Getenv(confHealthFailure) != "true"
+}
+
 func main() {
-  client := http.DefaultClient
+  flag.Parse()
+  client := NewDbClient(strings.Split(*dbUrls, ","), *retryRatio)
+  if *dbCA != "" || *dbCert != "" {
+    cfg, err := dbTLSConfig(*dbCA, *dbCert, *dbKey)
+    if err != nil {
+      log.Fatalf("Failed to load db TLS config: %s", err)
+    }
+    client.SetTLSConfig(cfg)
+  }
   h := new(http.ServeMux)
   
   h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
     rw.Header().Set("content-type", "text/plain")
-    if failConfig := os.Getenv(confHealthFailure); failConfig == "true" {
+    if !healthy() {
       rw.WriteHeader(http.StatusInternalServerError)
       _, _ = rw.Write([]byte("FAILURE"))
     } else {
@@ -48,6 +83,7 @@ func main() {
   })
 
   report := make(Report)
+  cache := newStaleCache(*maxStale, *staleSize)
 
   h.HandleFunc("/api/v1/some-data", func(rw http.ResponseWriter, r *http.Request) {
     respDelayString := os.Getenv(confResponseDelaySec)
@@ -67,23 +103,39 @@ func main() {
 		return
 	}
 
-	resp, err := client.Get(fmt.Sprintf("%s/%s", dbUrl, key))
+	ctx, cancel := context.WithTimeout(withRequestID(r.Context(), r.Header.Get(requestIDHeader)), *dbTimeout)
+	defer cancel()
+	resp, err := client.Get(ctx, key)
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		// Keep serving reads during short db outages.
+		if res, age, ok := cache.get(key); ok {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Header().Set("X-Stale", "true")
+			rw.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+			rw.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(rw).Encode(res)
+			return
+		}
+	}
 	if err != nil {
 		rw.WriteHeader(http.StatusNotFound)
 		return
 	}
-	defer resp.Body.Close()
 
 	var body Res
 	if resp.StatusCode == http.StatusNotFound {
+		cache.remove(key)
 		rw.WriteHeader(http.StatusNotFound)
 		return
 	}
 	
-	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if resp.StatusCode == http.StatusOK {
+		cache.put(key, body)
+	}
 
 	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(http.StatusOK)
@@ -91,23 +143,47 @@ func main() {
   })
 
   h.Handle("/report", report)
+  h.Handle("/db-client-stats", client)
+  h.HandleFunc("/status", func(rw http.ResponseWriter, r *http.Request) {
+    rw.Header().Set("content-type", "application/json")
+    rw.WriteHeader(http.StatusOK)
+    _ = json.NewEncoder(rw).Encode(Status{
+      Version:  version,
+      Healthy:  healthy(),
+      DbClient: client.Stats(),
+    })
+  })
 
   server := httptools.CreateServer(*port, h)
   server.Start()
 
-  buffer := new(bytes.Buffer)
   body := Req{Value: time.Now().Format(time.RFC3339), Type: "string"}
-  if err := json.NewEncoder(buffer).Encode(body); err != nil {
-    fmt.Println("Failed to encode request body:", err)
+  ctx, cancel := context.WithTimeout(context.Background(), *dbTimeout)
+  defer cancel()
+  if _, err := client.Post(ctx, teamName, body); err != nil {
+    fmt.Println("Failed to send POST request:", err)
     return
   }
 
-  res, err := client.Post(fmt.Sprintf("%s/%s", dbUrl, teamName), "application/json", buffer)
-  if err != nil {
-    fmt.Println("Failed to send POST request:", err)
-    return
+  addr := *advertise
+  if addr == "" {
+    hostname, _ := os.Hostname()
+    addr = fmt.Sprintf("%s:%d", hostname, *port)
+  }
+  if *lbDrain != "" {
+    // A server restarted quickly may still be marked as draining.
+    if err := callDrain(context.Background(), *lbDrain, http.MethodDelete, addr); err != nil {
+      log.Printf("Failed to register with the balancer: %s", err)
+    }
   }
-  defer res.Body.Close()
 
   signal.WaitForTerminationSignal()
+
+  if *lbDrain != "" {
+    ctx, cancel := context.WithTimeout(context.Background(), *drainWait)
+    defer cancel()
+    if err := callDrain(ctx, *lbDrain, http.MethodPost, addr); err != nil {
+      log.Printf("Failed to drain: %s", err)
+    }
+  }
 }
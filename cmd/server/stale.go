@@ -0,0 +1,86 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// staleCache keeps the last known values of recently read keys, so reads can
+// be served while the db is unavailable. At most capacity keys are kept, the
+// least recently updated ones are evicted first.
+type staleCache struct {
+	maxAge   time.Duration
+	capacity int
+	now      func() time.Time
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	order *list.List
+}
+
+type cachedValue struct {
+	key string
+	res Res
+	at  time.Time
+}
+
+func newStaleCache(maxAge time.Duration, capacity int) *staleCache {
+	return &staleCache{
+		maxAge:   maxAge,
+		capacity: capacity,
+		now:      time.Now,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *staleCache) enabled() bool {
+	return c.maxAge > 0 && c.capacity > 0
+}
+
+func (c *staleCache) put(key string, res Res) {
+	if !c.enabled() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.order.Remove(el)
+	}
+	c.items[key] = c.order.PushFront(&cachedValue{key: key, res: res, at: c.now()})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cachedValue).key)
+	}
+}
+
+// remove forgets the key, used once the db reports it does not exist.
+func (c *staleCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.order.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+// get returns the cached value and its age if it is not older than maxAge.
+func (c *staleCache) get(key string) (Res, time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return Res{}, 0, false
+	}
+	v := el.Value.(*cachedValue)
+	age := c.now().Sub(v.at)
+	if age > c.maxAge {
+		return Res{}, 0, false
+	}
+	return v.res, age, true
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStaleCache(t *testing.T) {
+	now := time.Now()
+	c := newStaleCache(time.Minute, 2)
+	c.now = func() time.Time { return now }
+
+	c.put("a", Res{Key: "a", Value: "1"})
+	c.put("b", Res{Key: "b", Value: "2"})
+	c.put("a", Res{Key: "a", Value: "3"})
+	c.put("c", Res{Key: "c", Value: "4"})
+
+	if _, _, ok := c.get("b"); ok {
+		t.Error("Least recently updated key is not evicted")
+	}
+	if res, _, ok := c.get("a"); !ok || res.Value != "3" {
+		t.Errorf("Expected the latest value of a, got %v", res)
+	}
+
+	now = now.Add(30 * time.Second)
+	if _, age, ok := c.get("c"); !ok || age != 30*time.Second {
+		t.Errorf("Expected c aged 30s, got %v", age)
+	}
+	c.remove("c")
+	if _, _, ok := c.get("c"); ok {
+		t.Error("Removed key is served")
+	}
+
+	now = now.Add(time.Minute)
+	if _, _, ok := c.get("a"); ok {
+		t.Error("Value older than max age is served")
+	}
+}
@@ -0,0 +1,600 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// archiveManifestName is the file listing archived segments.
+	archiveManifestName = "archive.json"
+	// archiveCacheDirName is the directory of archived segments fetched for
+	// reading, it is cleared when the Db is opened.
+	archiveCacheDirName = "archive-cache"
+)
+
+// ObjectStore is an object storage, such as S3, keeping archived segments.
+// Objects are written once under keys which are never reused.
+type ObjectStore interface {
+	Put(key string, r io.Reader, size int64) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// DirStore is an ObjectStore keeping objects as files of Dir, for instance a
+// mounted bucket or a network share.
+type DirStore struct {
+	Dir string
+}
+
+func (s DirStore) Put(key string, r io.Reader, size int64) error {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(s.Dir, key)
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(f, r, size)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s DirStore) Get(key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.Dir, key))
+}
+
+func (s DirStore) Delete(key string) error {
+	return os.Remove(filepath.Join(s.Dir, key))
+}
+
+// WithArchive moves sealed segments last written more than after ago to the
+// store, keeping only hot segments on the local backend. Archived segments
+// are fetched into a local cache of cacheSize bytes as they are read, so
+// recovery, merges and reads of cold keys download them. The check runs
+// with the expiration sweep.
+func WithArchive(store ObjectStore, after time.Duration, cacheSize MemoryUnit) Option {
+	return func(db *Db) {
+		db.archive = &archiveBackend{store: store, cacheSize: cacheSize.Bytes()}
+		db.archiveAfter = after
+	}
+}
+
+// archivedFile is a manifest record of an archived segment.
+type archivedFile struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// archiveObject is an archived file along with its readers and the cached
+// copy, if fetched.
+type archiveObject struct {
+	archivedFile
+	cachePath string
+	lastUsed  atomic.Int64
+	readers   map[*archivedReader]bool
+	// removed is set once the file is removed or replaced, the object is
+	// deleted after the last reader is closed.
+	removed bool
+}
+
+// archiveBackend puts files archived to an object store in place of local
+// files of the wrapped backend. Archived files are read only.
+type archiveBackend struct {
+	Backend
+	store     ObjectStore
+	cacheSize int64
+	dir       string
+
+	mu sync.Mutex
+	// files are the archived files by path.
+	files map[string]*archiveObject
+	// objects also include removed objects which are still read.
+	objects   map[*archiveObject]bool
+	cacheUsed int64
+
+	// fetchMu serializes downloads.
+	fetchMu sync.Mutex
+}
+
+// init loads the manifest of the archive kept in dir of the local backend.
+func (b *archiveBackend) init(local Backend, dir string) error {
+	b.Backend = local
+	b.dir = dir
+	b.files = make(map[string]*archiveObject)
+	b.objects = make(map[*archiveObject]bool)
+
+	if err := removeAll(local, filepath.Join(dir, archiveCacheDirName)); err != nil {
+		return err
+	}
+	data, err := readFile(local, filepath.Join(dir, archiveManifestName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var manifest map[string]archivedFile
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return err
+	}
+	for name, file := range manifest {
+		path := filepath.Join(dir, name)
+		// A crash may leave the local copy of a file already archived.
+		if err := removeAll(local, path); err != nil {
+			return err
+		}
+		obj := &archiveObject{archivedFile: file, readers: make(map[*archivedReader]bool)}
+		b.files[path] = obj
+		b.objects[obj] = true
+	}
+	return nil
+}
+
+// saveManifest persists the archived files, mu must be held.
+func (b *archiveBackend) saveManifest() error {
+	manifest := make(map[string]archivedFile, len(b.files))
+	for path, obj := range b.files {
+		name, err := filepath.Rel(b.dir, path)
+		if err != nil {
+			return err
+		}
+		manifest[name] = obj.archivedFile
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(b.dir, archiveManifestName)
+	if err := writeFile(b.Backend, path+".tmp", data); err != nil {
+		return err
+	}
+	return b.Backend.Rename(path+".tmp", path)
+}
+
+func (b *archiveBackend) archived(path string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.files[filepath.Clean(path)]
+	return ok
+}
+
+// archive uploads the local file to the store and removes it. The file must
+// not be written anymore.
+func (b *archiveBackend) archive(path string) error {
+	path = filepath.Clean(path)
+	if b.archived(path) {
+		return nil
+	}
+	info, err := stat(b.Backend, path)
+	if err != nil {
+		return err
+	}
+	f, err := b.Backend.Open(path)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s-%d", filepath.Base(path), time.Now().UnixNano())
+	err = b.store.Put(key, io.NewSectionReader(f, 0, info.Size()), info.Size())
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	obj := &archiveObject{
+		archivedFile: archivedFile{Key: key, Size: info.Size(), ModTime: info.ModTime()},
+		readers:      make(map[*archivedReader]bool),
+	}
+	b.files[path] = obj
+	b.objects[obj] = true
+	err = b.saveManifest()
+	if err != nil {
+		delete(b.files, path)
+		delete(b.objects, obj)
+	}
+	b.mu.Unlock()
+	if err != nil {
+		b.store.Delete(key)
+		return err
+	}
+	return b.Backend.Remove(path)
+}
+
+func (b *archiveBackend) Open(name string) (File, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	obj, ok := b.files[filepath.Clean(name)]
+	if !ok {
+		return b.Backend.Open(name)
+	}
+	r := &archivedReader{b: b, obj: obj}
+	obj.readers[r] = true
+	return r, nil
+}
+
+func (b *archiveBackend) Create(name string) (File, error) {
+	if b.archived(name) {
+		return nil, fmt.Errorf("%s is archived", name)
+	}
+	return b.Backend.Create(name)
+}
+
+func (b *archiveBackend) Remove(name string) error {
+	name = filepath.Clean(name)
+	b.mu.Lock()
+	var dropped []*archiveObject
+	prefix := name + string(filepath.Separator)
+	for path := range b.files {
+		if path == name || strings.HasPrefix(path, prefix) {
+			dropped = append(dropped, b.drop(path)...)
+		}
+	}
+	var err error
+	if len(dropped) > 0 {
+		err = b.saveManifest()
+	}
+	b.mu.Unlock()
+	b.deleteObjects(dropped)
+	if err != nil {
+		return err
+	}
+
+	err = b.Backend.Remove(name)
+	if os.IsNotExist(err) && len(dropped) > 0 {
+		return nil
+	}
+	return err
+}
+
+func (b *archiveBackend) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	b.mu.Lock()
+	var dropped []*archiveObject
+	if _, ok := b.files[newpath]; ok {
+		dropped = b.drop(newpath)
+	}
+	obj, ok := b.files[oldpath]
+	if ok {
+		delete(b.files, oldpath)
+		b.files[newpath] = obj
+	}
+	var err error
+	if ok || len(dropped) > 0 {
+		err = b.saveManifest()
+	}
+	b.mu.Unlock()
+	b.deleteObjects(dropped)
+	if err != nil || ok {
+		return err
+	}
+	return b.Backend.Rename(oldpath, newpath)
+}
+
+// drop forgets the archived file and returns its object if it can be
+// deleted right away, mu must be held.
+func (b *archiveBackend) drop(path string) []*archiveObject {
+	obj := b.files[path]
+	delete(b.files, path)
+	obj.removed = true
+	if len(obj.readers) > 0 {
+		return nil
+	}
+	delete(b.objects, obj)
+	return []*archiveObject{obj}
+}
+
+// deleteObjects deletes dropped objects from the store and the cache.
+func (b *archiveBackend) deleteObjects(objs []*archiveObject) {
+	for _, obj := range objs {
+		b.store.Delete(obj.Key)
+		b.mu.Lock()
+		cachePath := obj.cachePath
+		if cachePath != "" {
+			obj.cachePath = ""
+			b.cacheUsed -= obj.Size
+		}
+		b.mu.Unlock()
+		if cachePath != "" {
+			removeAll(b.Backend, cachePath)
+		}
+	}
+}
+
+func (b *archiveBackend) List(dir string) ([]os.FileInfo, error) {
+	infos, err := b.Backend.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Clean(dir)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for path, obj := range b.files {
+		if filepath.Dir(path) == dir {
+			infos = append(infos, memInfo{name: filepath.Base(path), size: obj.Size, modTime: obj.ModTime})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (b *archiveBackend) Chtimes(name string, atime, mtime time.Time) error {
+	b.mu.Lock()
+	obj, ok := b.files[filepath.Clean(name)]
+	if ok {
+		obj.ModTime = mtime
+		err := b.saveManifest()
+		b.mu.Unlock()
+		return err
+	}
+	b.mu.Unlock()
+	if c, ok := b.Backend.(chtimesBackend); ok {
+		return c.Chtimes(name, atime, mtime)
+	}
+	return nil
+}
+
+// fetch opens the cached copy of the object, downloading it if needed. It
+// returns objects to evict from the cache to make room.
+func (b *archiveBackend) fetch(obj *archiveObject) (File, []*archiveObject, error) {
+	b.mu.Lock()
+	if obj.cachePath != "" {
+		f, err := b.Backend.Open(obj.cachePath)
+		b.mu.Unlock()
+		return f, nil, err
+	}
+	b.mu.Unlock()
+
+	b.fetchMu.Lock()
+	defer b.fetchMu.Unlock()
+
+	path := filepath.Join(b.dir, archiveCacheDirName, obj.Key)
+	if err := b.download(obj.Key, path); err != nil {
+		return nil, nil, err
+	}
+	f, err := b.Backend.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if obj.cachePath != "" {
+		// Another reader fetched it meanwhile, both share the same file.
+		return f, nil, nil
+	}
+	obj.cachePath = path
+	b.cacheUsed += obj.Size
+	obj.lastUsed.Store(time.Now().UnixNano())
+
+	// Least recently used copies make room, the one just fetched stays even
+	// if it does not fit alone.
+	var cached []*archiveObject
+	for o := range b.objects {
+		if o.cachePath != "" && o != obj {
+			cached = append(cached, o)
+		}
+	}
+	sort.Slice(cached, func(i, j int) bool { return cached[i].lastUsed.Load() < cached[j].lastUsed.Load() })
+	var victims []*archiveObject
+	for _, o := range cached {
+		if b.cacheUsed <= b.cacheSize {
+			break
+		}
+		victims = append(victims, o)
+		b.cacheUsed -= o.Size
+	}
+	return f, victims, nil
+}
+
+func (b *archiveBackend) download(key, path string) error {
+	r, err := b.store.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp := path + ".tmp"
+	if err := removeAll(b.Backend, tmp); err != nil {
+		return err
+	}
+	f, err := b.Backend.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		removeAll(b.Backend, tmp)
+		return err
+	}
+	return b.Backend.Rename(tmp, path)
+}
+
+// evict drops the cached copies of the objects. Readers fetch them again
+// when needed.
+func (b *archiveBackend) evict(victims []*archiveObject) {
+	for _, obj := range victims {
+		b.mu.Lock()
+		path := obj.cachePath
+		obj.cachePath = ""
+		readers := make([]*archivedReader, 0, len(obj.readers))
+		for r := range obj.readers {
+			readers = append(readers, r)
+		}
+		b.mu.Unlock()
+
+		for _, r := range readers {
+			r.drop()
+		}
+		if path != "" {
+			removeAll(b.Backend, path)
+		}
+	}
+}
+
+// release is called when a reader of the object is closed.
+func (b *archiveBackend) release(r *archivedReader) {
+	b.mu.Lock()
+	obj := r.obj
+	delete(obj.readers, r)
+	var dropped []*archiveObject
+	if obj.removed && len(obj.readers) == 0 && b.objects[obj] {
+		delete(b.objects, obj)
+		dropped = append(dropped, obj)
+	}
+	b.mu.Unlock()
+	b.deleteObjects(dropped)
+}
+
+// archiveSegments archives sealed segments last written before the
+// threshold. Merges are not run meanwhile, archiving is skipped if one is.
+func (db *Db) archiveSegments() {
+	if db.archive == nil || !db.mergeMu.TryLock() {
+		return
+	}
+	defer db.mergeMu.Unlock()
+
+	segments := db.segmentSet()
+	for _, seg := range segments[:len(segments)-1] {
+		if db.archive.archived(seg.path) {
+			continue
+		}
+		modTime, err := seg.ModTime()
+		if err != nil || time.Since(modTime) < db.archiveAfter {
+			continue
+		}
+		if err := db.archiveSegment(seg); err != nil {
+			db.logger.Error("failed to archive segment", "segment", seg.id, "err", err)
+			db.background.fail(err, false)
+			return
+		}
+		db.logger.Info("segment archived", "segment", seg.id, "bytes", seg.Size())
+	}
+}
+
+// archiveSegment archives the file of the segment and switches its reader
+// over to the archived one, so the local file is released.
+func (db *Db) archiveSegment(seg *Segment) error {
+	if err := db.archive.archive(seg.path); err != nil {
+		return err
+	}
+	reader, err := db.backend.Open(seg.path)
+	if err != nil {
+		return err
+	}
+
+	db.segmentsMu.Lock()
+	seg.mu.Lock()
+	old := seg.reader
+	seg.reader = reader
+	// Iterators keep reading the local file until the segment is released.
+	if seg.pins > 0 {
+		seg.retired = append(seg.retired, old)
+		old = nil
+	}
+	seg.mu.Unlock()
+	db.segmentsMu.Unlock()
+	if old == nil {
+		return nil
+	}
+	return old.Close()
+}
+
+// archivedReader reads an archived file from its cached copy.
+type archivedReader struct {
+	b   *archiveBackend
+	obj *archiveObject
+
+	mu     sync.RWMutex
+	f      File
+	closed bool
+}
+
+func (r *archivedReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.RLock()
+	if r.f != nil {
+		n, err := r.f.ReadAt(p, off)
+		r.obj.lastUsed.Store(time.Now().UnixNano())
+		r.mu.RUnlock()
+		return n, err
+	}
+	r.mu.RUnlock()
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return 0, os.ErrClosed
+	}
+	var victims []*archiveObject
+	if r.f == nil {
+		f, evict, err := r.b.fetch(r.obj)
+		if err != nil {
+			r.mu.Unlock()
+			return 0, err
+		}
+		r.f, victims = f, evict
+	}
+	n, err := r.f.ReadAt(p, off)
+	r.mu.Unlock()
+
+	r.b.evict(victims)
+	return n, err
+}
+
+// drop closes the cached copy, it is fetched again by the next read.
+func (r *archivedReader) drop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+}
+
+func (r *archivedReader) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("archived files are read only")
+}
+
+func (r *archivedReader) Sync() error {
+	return nil
+}
+
+func (r *archivedReader) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return os.ErrClosed
+	}
+	r.closed = true
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+	r.mu.Unlock()
+
+	r.b.release(r)
+	return nil
+}
@@ -0,0 +1,51 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// archiveDirTimeFormat names the directory of a merge within the archive
+// directory, names sort by time.
+const archiveDirTimeFormat = "20060102T150405.000000000Z"
+
+// WithArchiveDir makes merges move the segment files they replace, and the
+// blob files only those referenced, to a directory of dir named after the
+// time of the merge instead of removing them, so an operator can bring the
+// state before a merge back by hand. The files are renamed, dir has to be
+// on the file system of the Db. Nothing removes archived files, operators
+// clean dir up once the undo window is over.
+//
+// Unlike WithArchive, which moves live sealed segments to an object store,
+// files archived here are no longer part of the Db.
+func WithArchiveDir(dir string) Option {
+	return func(db *Db) {
+		db.mergeArchiveDir = dir
+	}
+}
+
+// mergeArchive returns the directory the merge starting now archives the
+// files it replaces to, none if archiving is off.
+func (db *Db) mergeArchive() string {
+	if db.mergeArchiveDir == "" {
+		return ""
+	}
+	return filepath.Join(db.mergeArchiveDir, time.Now().UTC().Format(archiveDirTimeFormat))
+}
+
+// archiveFile moves the file into the archive directory of a merge, if
+// archive is not empty, and removes it otherwise. A missing file is not an
+// error, the merge may be finished on recovery.
+func (db *Db) archiveFile(path, archive string) error {
+	var err error
+	if archive == "" {
+		err = db.backend.Remove(path)
+	} else {
+		err = db.backend.Rename(path, filepath.Join(archive, filepath.Base(path)))
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
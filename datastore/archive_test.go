@@ -0,0 +1,104 @@
+package datastore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDb_Archive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storeDir, err := ioutil.TempDir("", "test-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+
+	store := DirStore{Dir: storeDir}
+	opts := []Option{WithArchive(store, 0, 40*2*Byte)}
+	db, err := NewDb(dir, 40*2*Byte, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"key1", "key2", "key3", "key4", "key5"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 3, len(db.segments))
+
+	// Archiving skips a turn while a background merge planned on the rolls
+	// holds the merge lock.
+	assert.Eventually(t, func() bool {
+		db.archiveSegments()
+		return db.Stats().ArchivedSegments == 2
+	}, time.Second, time.Millisecond)
+	stats := db.Stats()
+	assert.Equal(t, 2, stats.ArchivedSegments)
+	assert.Equal(t, int64(40), stats.DiskBytes)
+	for _, seg := range db.segments[:2] {
+		_, err := os.Stat(seg.FilePath())
+		assert.True(t, os.IsNotExist(err))
+	}
+	objects, err := ioutil.ReadDir(storeDir)
+	assert.Nil(t, err)
+	assert.Len(t, objects, 2)
+
+	cacheDir := filepath.Join(dir, archiveCacheDirName)
+	t.Run("read", func(t *testing.T) {
+		for _, key := range []string{"key1", "key3", "key2", "key5"} {
+			val, err := db.GetString(key)
+			assert.Nil(t, err)
+			assert.Equal(t, "value1", val)
+
+			// The cache only has room for one segment.
+			cached, err := ioutil.ReadDir(cacheDir)
+			assert.Nil(t, err)
+			assert.True(t, len(cached) <= 1)
+		}
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, 40*2*Byte, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 2, db.Stats().ArchivedSegments)
+
+		val, err := db.GetString("key4")
+		assert.Nil(t, err)
+		assert.Equal(t, "value1", val)
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		_, err = db.PutString("key1", "value2")
+		assert.Nil(t, err)
+		_, err := db.Compact(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, 0, db.Stats().ArchivedSegments)
+
+		// Merged segments are written locally, their objects are deleted.
+		objects, err := ioutil.ReadDir(storeDir)
+		assert.Nil(t, err)
+		assert.Empty(t, objects)
+		val, err := db.GetString("key1")
+		assert.Nil(t, err)
+		assert.Equal(t, "value2", val)
+		val, err = db.GetString("key3")
+		assert.Nil(t, err)
+		assert.Equal(t, "value1", val)
+	})
+}
@@ -0,0 +1,357 @@
+package datastore
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend stores the files of a Db: segments, blobs and the bookkeeping
+// files next to them. Names are paths within the data directory given to
+// NewDb. Directories need not be created, a backend creates them as files
+// are created in them, and removes them with their files.
+//
+// A backend may also implement Chtimes(name string, atime, mtime time.Time)
+// error, as the os file system does. Merge uses it to keep modification
+// times of merged segments, which retention and compaction by time rely on.
+type Backend interface {
+	// Open opens the file for reading. An open file stays readable when it
+	// is renamed or removed.
+	Open(name string) (File, error)
+	// Create opens the file for appending, creating it if missing.
+	Create(name string) (File, error)
+	// Remove removes the file, or the directory with all it contains.
+	// Removing what does not exist fails with an error satisfying
+	// os.IsNotExist, which backends without directories may return for
+	// directories left with no files.
+	Remove(name string) error
+	// List describes the files and directories within dir, nothing if dir
+	// does not exist.
+	List(dir string) ([]os.FileInfo, error)
+	// Rename moves the file, replacing the one at newpath if any. The
+	// directory of newpath is created if missing.
+	Rename(oldpath, newpath string) error
+}
+
+// File is an open file of a Backend.
+type File interface {
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	// Sync commits the written data to the storage.
+	Sync() error
+}
+
+// OSBackend keeps files in the os file system, it is the Backend of a Db
+// unless changed with WithBackend.
+type OSBackend struct{}
+
+func (OSBackend) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OSBackend) Create(name string) (File, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OSBackend) Remove(name string) error {
+	if _, err := os.Lstat(name); err != nil {
+		return err
+	}
+	return os.RemoveAll(name)
+}
+
+func (OSBackend) List(dir string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (OSBackend) Rename(oldpath, newpath string) error {
+	if err := os.MkdirAll(filepath.Dir(newpath), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSBackend) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// chtimesBackend is a Backend able to change modification times.
+type chtimesBackend interface {
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// stat describes the file of the backend.
+func stat(b Backend, name string) (os.FileInfo, error) {
+	infos, err := b.List(filepath.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Name() == filepath.Base(name) {
+			return info, nil
+		}
+	}
+	return nil, notExist("stat", name)
+}
+
+func readFile(b Backend, name string) ([]byte, error) {
+	f, err := b.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.NewSectionReader(f, 0, maxSectionSize))
+}
+
+// writeFile replaces the content of the file.
+func writeFile(b Backend, name string, data []byte) error {
+	if err := removeAll(b, name); err != nil {
+		return err
+	}
+	f, err := b.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// removeAll removes the file or the directory if it exists.
+func removeAll(b Backend, name string) error {
+	if err := b.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// memBackend keeps files in memory.
+type memBackend struct {
+	mu    sync.Mutex
+	files map[string]*memData
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{files: make(map[string]*memData)}
+}
+
+// memData is the content of a file of a memBackend.
+type memData struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func (m *memBackend) Open(name string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	return &memFile{name: name, d: d}, nil
+}
+
+func (m *memBackend) Create(name string) (File, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.files[name]
+	if !ok {
+		d = &memData{modTime: time.Now()}
+		m.files[name] = d
+	}
+	return &memFile{name: name, d: d, writable: true}, nil
+}
+
+func (m *memBackend) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	found := false
+	prefix := name + string(filepath.Separator)
+	for path := range m.files {
+		if path == name || strings.HasPrefix(path, prefix) {
+			delete(m.files, path)
+			found = true
+		}
+	}
+	if !found {
+		return notExist("remove", name)
+	}
+	return nil
+}
+
+func (m *memBackend) List(dir string) ([]os.FileInfo, error) {
+	dir = filepath.Clean(dir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var infos []os.FileInfo
+	dirs := make(map[string]bool)
+	prefix := dir + string(filepath.Separator)
+	for path, d := range m.files {
+		if filepath.Dir(path) == dir {
+			infos = append(infos, d.info(path))
+		} else if rest, ok := strings.CutPrefix(path, prefix); ok {
+			dirs[strings.SplitN(rest, string(filepath.Separator), 2)[0]] = true
+		}
+	}
+	for name := range dirs {
+		infos = append(infos, memInfo{name: name, dir: true})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (m *memBackend) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.files[filepath.Clean(oldpath)]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	delete(m.files, filepath.Clean(oldpath))
+	m.files[filepath.Clean(newpath)] = d
+	return nil
+}
+
+func (m *memBackend) Chtimes(name string, _, mtime time.Time) error {
+	m.mu.Lock()
+	d, ok := m.files[filepath.Clean(name)]
+	m.mu.Unlock()
+	if !ok {
+		return notExist("chtimes", name)
+	}
+	d.mu.Lock()
+	d.modTime = mtime
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *memData) info(path string) memInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return memInfo{name: filepath.Base(path), size: int64(len(d.data)), modTime: d.modTime}
+}
+
+// memFile is an open file of a memBackend.
+type memFile struct {
+	name     string
+	d        *memData
+	writable bool
+	closed   atomic.Bool
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed.Load() {
+		return 0, fs.ErrClosed
+	}
+	f.d.mu.RLock()
+	defer f.d.mu.RUnlock()
+
+	if off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed.Load() {
+		return 0, fs.ErrClosed
+	}
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	f.d.data = append(f.d.data, p...)
+	f.d.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed.Swap(true) {
+		return fs.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+// memInfo describes a file or a directory of a memBackend.
+type memInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.dir }
+func (i memInfo) Sys() interface{}   { return nil }
+
+func (i memInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0o755
+	}
+	return 0o600
+}
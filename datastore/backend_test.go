@@ -0,0 +1,76 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("os", func(t *testing.T) { testBackend(t, OSBackend{}, filepath.Join(dir, "db")) })
+	t.Run("memory", func(t *testing.T) { testBackend(t, newMemBackend(), "db") })
+}
+
+func testBackend(t *testing.T, b Backend, dir string) {
+	infos, err := b.List(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, infos)
+	_, err = b.Open(filepath.Join(dir, "missing"))
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, os.IsNotExist(b.Remove(filepath.Join(dir, "missing"))))
+
+	shadow := filepath.Join(dir, "shadow", "a")
+	w, err := b.Create(shadow)
+	assert.Nil(t, err)
+	_, err = w.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Sync())
+
+	r, err := b.Open(shadow)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Rename(shadow, filepath.Join(dir, "a")))
+	assert.Nil(t, removeAll(b, filepath.Join(dir, "shadow")))
+	_, err = w.Write([]byte(" world"))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+
+	// Open files keep their data across renames and removals.
+	buf := make([]byte, 11)
+	n, err := r.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(buf[:n]))
+
+	infos, err = b.List(dir)
+	assert.Nil(t, err)
+	if assert.Len(t, infos, 1) {
+		assert.Equal(t, "a", infos[0].Name())
+		assert.Equal(t, int64(11), infos[0].Size())
+		assert.False(t, infos[0].IsDir())
+	}
+
+	assert.Nil(t, b.Remove(filepath.Join(dir, "a")))
+	_, err = stat(b, filepath.Join(dir, "a"))
+	assert.True(t, os.IsNotExist(err))
+	n, err = r.ReadAt(buf[:5], 6)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(buf[:n]))
+	assert.Nil(t, r.Close())
+
+	stats := filepath.Join(dir, "stats")
+	assert.Nil(t, writeFile(b, stats, []byte("{\"a\": 1}")))
+	assert.Nil(t, writeFile(b, stats, []byte("{}")))
+	data, err := readFile(b, stats)
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", string(data))
+	assert.Nil(t, removeAll(b, dir))
+	assert.Nil(t, removeAll(b, dir))
+}
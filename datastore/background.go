@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrCompactionFailing wraps the latest compaction error when writes are
+// refused after compaction failed too many times in a row, see
+// WithMaxCompactionFailures.
+var ErrCompactionFailing = fmt.Errorf("compaction keeps failing")
+
+// WithErrorHandler makes fn be called with every error of background work,
+// such as merges started on segment rolls. fn must not block.
+func WithErrorHandler(fn func(error)) Option {
+	return func(db *Db) {
+		db.background.handler = fn
+	}
+}
+
+// WithMaxCompactionFailures makes writes fail with ErrCompactionFailing
+// after n background compactions fail in a row, so a disk that is full does
+// not keep growing segments nobody can merge. Writes go on once a
+// compaction succeeds. Zero, the default, never fails writes.
+func WithMaxCompactionFailures(n int) Option {
+	return func(db *Db) {
+		db.background.maxFailures = n
+	}
+}
+
+// background tracks errors of work nobody waits for.
+type background struct {
+	handler     func(error)
+	maxFailures int
+	observers   []ErrorInstrumentation
+
+	mu sync.Mutex
+	// err is the latest error.
+	err error
+	// failures counts compactions failed in a row.
+	failures int
+}
+
+func (b *background) fail(err error, compaction bool) {
+	b.mu.Lock()
+	b.err = err
+	if compaction {
+		b.failures++
+	}
+	b.mu.Unlock()
+
+	if b.handler != nil {
+		b.handler(err)
+	}
+	for _, o := range b.observers {
+		o.OnBackgroundError(err, compaction)
+	}
+}
+
+func (b *background) compacted() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = nil
+	b.failures = 0
+}
+
+// writeErr returns the error writes have to fail with.
+func (b *background) writeErr() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.maxFailures > 0 && b.failures >= b.maxFailures {
+		return fmt.Errorf("%w: %v", ErrCompactionFailing, b.err)
+	}
+	return nil
+}
+
+// Err returns the latest error of background work, nil if there is none or
+// a compaction succeeded since.
+func (db *Db) Err() error {
+	db.background.mu.Lock()
+	defer db.background.mu.Unlock()
+	return db.background.err
+}
+
+// compactInBackground runs compact without anyone waiting for the outcome,
+// so a failure is logged and recorded for Err.
+func (db *Db) compactInBackground() {
+	go func() {
+		err := db.compact()
+		if errors.Is(err, ErrClosed) {
+			return
+		}
+		if err != nil {
+			db.logger.Error("background compaction failed", "err", err)
+			db.background.fail(err, true)
+			return
+		}
+		db.background.compacted()
+	}()
+}
@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingBackend fails renames while failing is set.
+type failingBackend struct {
+	Backend
+	failing atomic.Bool
+}
+
+func (b *failingBackend) Rename(oldpath, newpath string) error {
+	if b.failing.Load() {
+		return errors.New("backend failure")
+	}
+	return b.Backend.Rename(oldpath, newpath)
+}
+
+// mergeAll plans a merge of all sealed segments.
+type mergeAll struct{}
+
+func (mergeAll) Plan(segments []SegmentInfo, _ Options) (int, int, bool) {
+	return 0, len(segments), true
+}
+
+func TestDb_BackgroundErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	errs := make(chan error, 10)
+	backend := &failingBackend{Backend: OSBackend{}}
+	db, err := NewDb(dir, 40*2*Byte,
+		WithBackend(backend),
+		WithCompactionPolicy(mergeAll{}),
+		WithMaxCompactionFailures(1),
+		WithErrorHandler(func(err error) { errs <- err }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	assert.Nil(t, db.Err())
+
+	// Merge persists stats first, which fails while files can not be
+	// renamed. Memtable flushes fail too, the logs stay segments then.
+	backend.failing.Store(true)
+
+	for _, key := range []string{"key1", "key2", "key3"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	select {
+	case err := <-errs:
+		assert.Error(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Background work did not fail")
+	}
+	assert.Error(t, db.Err())
+	assert.Eventually(t, func() bool { return db.background.writeErr() != nil }, 2*time.Second, 10*time.Millisecond)
+	_, err = db.PutString("key4", "value1")
+	assert.True(t, errors.Is(err, ErrCompactionFailing))
+
+	backend.failing.Store(false)
+	_, err = db.Compact(context.Background())
+	assert.Nil(t, err)
+	assert.Nil(t, db.Err())
+	_, err = db.PutString("key4", "value1")
+	assert.Nil(t, err)
+}
@@ -0,0 +1,56 @@
+package datastore
+
+import "sync"
+
+// Barrier returns once every write started before the call is taken, or
+// failed. Writes go through the write loop while reads look up segments
+// directly, so a Get racing a Put from another goroutine may miss it even
+// though the Put started first. A Get after Barrier sees every such write,
+// which gives read-your-writes to callers which hand the writes off, as
+// servers passing writes of a client to a pool of workers. A Get following
+// a Put that returned always sees it, without any barrier.
+func (db *Db) Barrier() {
+	db.inflight.wait()
+}
+
+// inflightWrites tracks writes between their start and their result for
+// Barrier.
+type inflightWrites struct {
+	mu   sync.Mutex
+	next uint64
+	// writes holds a channel closed once the write is done by ticket.
+	writes map[uint64]chan struct{}
+}
+
+func (w *inflightWrites) begin() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.writes == nil {
+		w.writes = make(map[uint64]chan struct{})
+	}
+	ticket := w.next
+	w.next++
+	w.writes[ticket] = make(chan struct{})
+	return ticket
+}
+
+func (w *inflightWrites) end(ticket uint64) {
+	w.mu.Lock()
+	done := w.writes[ticket]
+	delete(w.writes, ticket)
+	w.mu.Unlock()
+	close(done)
+}
+
+// wait returns once the writes in flight are done.
+func (w *inflightWrites) wait() {
+	w.mu.Lock()
+	pending := make([]chan struct{}, 0, len(w.writes))
+	for _, done := range w.writes {
+		pending = append(pending, done)
+	}
+	w.mu.Unlock()
+	for _, done := range pending {
+		<-done
+	}
+}
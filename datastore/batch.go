@@ -0,0 +1,77 @@
+package datastore
+
+import "context"
+
+// Batch collects writes to be passed to the write loop at once by Db.Write.
+// The zero value is an empty batch.
+type Batch struct {
+	entries []*entry
+}
+
+func (b *Batch) PutString(key, value string) {
+	b.entries = append(b.entries, &entry{key: key, value: value, valueType: Str})
+}
+
+func (b *Batch) PutInt64(key string, value int64) {
+	b.entries = append(b.entries, &entry{key: key, value: value, valueType: Int})
+}
+
+// Delete removes the key as Db.Delete does.
+func (b *Batch) Delete(key string) {
+	b.entries = append(b.entries, &entry{key: key, value: "", valueType: Str, expiresAt: tombstoneExpiry})
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.entries)
+}
+
+// Write applies the writes of the batch in order, without writes of other
+// callers in between. Keys are checked before anything is written. A
+// failure leaves the writes before the failing one applied; Write returns
+// how many were applied, all of them unless the error is not nil.
+func (db *Db) Write(b *Batch) (int, error) {
+	return db.WriteContext(context.Background(), b)
+}
+
+// WriteContext is Write given up as PutIfRevisionContext is once ctx is
+// done, no entry of the batch is written then.
+func (db *Db) WriteContext(ctx context.Context, b *Batch) (int, error) {
+	for _, e := range b.entries {
+		var err error
+		if e.expiresAt == tombstoneExpiry {
+			if isBucketKey(e.key) {
+				err = ErrReservedKey
+			}
+		} else {
+			err = db.checkKey(e.key)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(b.entries) == 0 {
+		return 0, nil
+	}
+	var written int
+	err := db.put(PutRequest{ctx: ctx, batch: b.entries, written: &written})
+	return written, err
+}
+
+// GetMany returns the values of the keys found, strings and int64s as Get
+// would return them. Missing keys are left out; any other failure is
+// returned.
+func (db *Db) GetMany(keys []string) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		val, err := db.getUnknown(context.Background(), key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[key] = val
+	}
+	return values, nil
+}
@@ -0,0 +1,148 @@
+package datastore
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Workloads of the Db benchmarks, e.g.
+//
+//	go test -run - -bench Db_ ./datastore -bench.values 100,10000 -bench.keys 1000
+var (
+	benchValues = flag.String("bench.values", "64,1024,16384", "comma separated value sizes in bytes of the Db benchmarks")
+	benchKeys   = flag.Int("bench.keys", 10000, "number of distinct keys of the Db benchmarks")
+	benchReads  = flag.Float64("bench.reads", 0.8, "share of reads in BenchmarkDb_Mixed, the rest are puts")
+)
+
+// benchmarkValues runs fn as a sub-benchmark for every value size of
+// -bench.values, with the keys of -bench.keys.
+func benchmarkValues(b *testing.B, fn func(b *testing.B, value string, keys []string)) {
+	keys := benchmarkKeys(*benchKeys)
+	for _, s := range strings.Split(*benchValues, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || size <= 0 {
+			b.Fatalf("invalid value size %q", s)
+		}
+		b.Run(fmt.Sprintf("value=%d/keys=%d", size, len(keys)), func(b *testing.B) {
+			fn(b, strings.Repeat("v", size), keys)
+		})
+	}
+}
+
+func benchmarkKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%08d", i)
+	}
+	return keys
+}
+
+// benchmarkDb opens a Db in a temporary directory, closed when the benchmark
+// ends.
+func benchmarkDb(b *testing.B, segmentSize MemoryUnit, opts ...Option) *Db {
+	db, err := NewDb(b.TempDir(), segmentSize, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+	return db
+}
+
+func benchmarkPut(b *testing.B, db *Db, keys []string, value string) {
+	for _, key := range keys {
+		if _, err := db.PutString(key, value); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDb_Put(b *testing.B) {
+	benchmarkValues(b, func(b *testing.B, value string, keys []string) {
+		db := benchmarkDb(b, 4*Megabyte)
+		b.SetBytes(int64(len(value)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := db.PutString(keys[i%len(keys)], value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkDb_GetHot reads keys of the active segment, served by its
+// memtable.
+func BenchmarkDb_GetHot(b *testing.B) {
+	benchmarkValues(b, func(b *testing.B, value string, keys []string) {
+		size := FromBytes(int64(2 * len(keys) * (len(value) + 64)))
+		db := benchmarkDb(b, size, WithCompactionPolicy(manualOnly{}))
+		benchmarkPut(b, db, keys, value)
+		if len(db.segments) != 1 {
+			b.Fatalf("keys written to %d segments", len(db.segments))
+		}
+		benchmarkGet(b, db, keys, value)
+	})
+}
+
+// BenchmarkDb_GetCold reads keys of sealed segments only, served by their
+// files.
+func BenchmarkDb_GetCold(b *testing.B) {
+	benchmarkValues(b, func(b *testing.B, value string, keys []string) {
+		db := benchmarkDb(b, 4*Megabyte, WithCompactionPolicy(manualOnly{}))
+		benchmarkPut(b, db, keys, value)
+		// Seal the segment of the latest keys.
+		for n, i := len(db.segments), 0; len(db.segments) == n; i++ {
+			if _, err := db.PutString(fmt.Sprintf("filler%08d", i), value); err != nil {
+				b.Fatal(err)
+			}
+		}
+		benchmarkGet(b, db, keys, value)
+		b.ReportMetric(float64(len(db.segments)), "segments")
+	})
+}
+
+func benchmarkGet(b *testing.B, db *Db, keys []string, value string) {
+	b.SetBytes(int64(len(value)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.GetString(keys[i%len(keys)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDb_Mixed reads and overwrites random keys from parallel
+// goroutines, -bench.reads of the operations being reads. Compaction runs
+// in the background as it would in production.
+func BenchmarkDb_Mixed(b *testing.B) {
+	benchmarkValues(b, func(b *testing.B, value string, keys []string) {
+		db := benchmarkDb(b, 4*Megabyte)
+		benchmarkPut(b, db, keys, value)
+		var seed atomic.Int64
+		b.SetBytes(int64(len(value)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			rnd := rand.New(rand.NewSource(seed.Add(1)))
+			for pb.Next() {
+				key := keys[rnd.Intn(len(keys))]
+				var err error
+				if rnd.Float64() < *benchReads {
+					_, err = db.GetString(key)
+				} else {
+					_, err = db.PutString(key, value)
+				}
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
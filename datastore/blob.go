@@ -0,0 +1,125 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// blobFlag is set in the type byte of string entries whose value is stored
+// in a blob file. The value of such entry is a blobRef.
+const blobFlag = 0x40
+
+const blobRefSize = 24
+
+// blobRef points to a value spilled over to a blob file.
+type blobRef struct {
+	id, offset, length int64
+}
+
+func (r *blobRef) encode(dst []byte) {
+	binary.LittleEndian.PutUint64(dst, uint64(r.id))
+	binary.LittleEndian.PutUint64(dst[8:], uint64(r.offset))
+	binary.LittleEndian.PutUint64(dst[16:], uint64(r.length))
+}
+
+func decodeBlobRef(src []byte) *blobRef {
+	return &blobRef{
+		id:     int64(binary.LittleEndian.Uint64(src)),
+		offset: int64(binary.LittleEndian.Uint64(src[8:])),
+		length: int64(binary.LittleEndian.Uint64(src[16:])),
+	}
+}
+
+func blobPath(dir string, id int64) string {
+	return filepath.Join(dir, fmt.Sprintf("blob-%d", id))
+}
+
+// writeBlob stores size bytes read from r in a new blob file.
+func (db *Db) writeBlob(r io.Reader, size int64) (*blobRef, error) {
+	id := db.lastBlobId.Add(1)
+	path := blobPath(db.outDir, id)
+	f, err := db.backend.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.CopyN(f, r, size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		db.backend.Remove(path)
+		return nil, err
+	}
+	return &blobRef{id: id, length: size}, nil
+}
+
+func (db *Db) openBlob(ref *blobRef) (File, error) {
+	return db.backend.Open(blobPath(db.outDir, ref.id))
+}
+
+func (db *Db) readBlob(ref *blobRef) (string, error) {
+	f, err := db.openBlob(ref)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data := make([]byte, ref.length)
+	if _, err := f.ReadAt(data, ref.offset); err != nil && !(err == io.EOF && ref.length == 0) {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// resolve replaces a blob reference read from a segment with the value.
+func (db *Db) resolve(val interface{}) (interface{}, error) {
+	if ref, ok := val.(*blobRef); ok {
+		return db.readBlob(ref)
+	}
+	return val, nil
+}
+
+func (db *Db) removeBlobs(ids map[int64]bool) {
+	db.archiveBlobs(ids, "")
+}
+
+// archiveBlobs moves the blob files to the archive directory of a merge, or
+// removes them if archive is empty.
+func (db *Db) archiveBlobs(ids map[int64]bool, archive string) {
+	for id := range ids {
+		db.archiveFile(blobPath(db.outDir, id), archive)
+	}
+}
+
+// recoverBlobs removes blob files not referenced by any entry, which are
+// left by a crash between writing a blob and its entry or in the middle of a
+// merge.
+func (db *Db) recoverBlobs(referenced map[int64]bool) error {
+	files, err := db.backend.List(db.outDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), "blob-") {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(file.Name(), "blob-"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if id > db.lastBlobId.Load() {
+			db.lastBlobId.Store(id)
+		}
+		if !referenced[id] {
+			if err := db.backend.Remove(filepath.Join(db.outDir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bucketMark starts the keys of bucket entries, which are stored as the mark,
+// the bucket name, the mark again and the key. Keys of the Db itself can
+// not start with the mark, so they never clash with keys of buckets.
+const bucketMark = "\x00"
+
+// systemBucket holds the entries of the Db itself, such as its lifetime
+// counters. Callers can not open it, and its entries are not part of
+// Changes.
+const systemBucket = "_sys"
+
+var (
+	ErrReservedKey    = fmt.Errorf("keys starting with NUL are reserved for buckets")
+	ErrInvalidBucket  = fmt.Errorf("bucket names must be nonempty and have no NUL")
+	ErrReservedBucket = fmt.Errorf("the %s bucket is reserved for the db", systemBucket)
+)
+
+// Bucket is a namespace of keys within the Db. Keys of a bucket are isolated
+// from keys of the Db and of other buckets: they are not listed by
+// KeysByType, Iterate or Snapshot of the Db, nor of other buckets. Changes
+// and replication cover buckets too.
+type Bucket struct {
+	db     *Db
+	name   string
+	prefix string
+	// ctx is the context of the operations, nil for context.Background.
+	ctx context.Context
+}
+
+// Bucket returns a handle of the named bucket. Buckets need not be created,
+// a bucket with no keys is the same as one which does not exist. Operations
+// of a bucket with an invalid name fail with ErrInvalidBucket, those of the
+// system bucket with ErrReservedBucket.
+func (db *Db) Bucket(name string) *Bucket {
+	return &Bucket{db: db, name: name, prefix: bucketMark + name + bucketMark}
+}
+
+// WithContext returns a copy of the bucket whose writes are traced as
+// children of the span of ctx, given up once ctx is done and attributed to
+// the principal of ctx, as those of PutStringContext are. Its reads are
+// those of GetStringContext.
+func (b *Bucket) WithContext(ctx context.Context) *Bucket {
+	c := *b
+	c.ctx = ctx
+	return &c
+}
+
+// context returns the context of the operations of the bucket.
+func (b *Bucket) context() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+func (b *Bucket) check() error {
+	if b.name == "" || strings.Contains(b.name, bucketMark) {
+		return ErrInvalidBucket
+	}
+	if b.name == systemBucket {
+		return ErrReservedBucket
+	}
+	return nil
+}
+
+// put writes the entry and returns its sequence number, as Db.PutString
+// does.
+func (b *Bucket) put(e *entry) (uint64, error) {
+	if err := b.check(); err != nil {
+		return 0, err
+	}
+	if err := b.db.keyRules.check(e.key); err != nil {
+		return 0, err
+	}
+	e.key = b.prefix + e.key
+	return b.db.putEntry(b.ctx, e)
+}
+
+func (b *Bucket) PutString(key, value string) (uint64, error) {
+	return b.put(&entry{key: key, value: value, valueType: Str})
+}
+
+func (b *Bucket) PutInt64(key string, value int64) (uint64, error) {
+	return b.put(&entry{key: key, value: value, valueType: Int})
+}
+
+func (b *Bucket) PutStringWithTTL(key, value string, ttl time.Duration) (uint64, error) {
+	if err := b.db.checkClockSkew(); err != nil {
+		return 0, err
+	}
+	return b.put(&entry{key: key, value: value, valueType: Str, expiresAt: expiresAt(ttl)})
+}
+
+func (b *Bucket) PutInt64WithTTL(key string, value int64, ttl time.Duration) (uint64, error) {
+	if err := b.db.checkClockSkew(); err != nil {
+		return 0, err
+	}
+	return b.put(&entry{key: key, value: value, valueType: Int, expiresAt: expiresAt(ttl)})
+}
+
+func (b *Bucket) GetString(key string) (string, error) {
+	if err := b.check(); err != nil {
+		return "", err
+	}
+	return b.db.GetStringContext(b.context(), b.prefix+key)
+}
+
+func (b *Bucket) GetInt64(key string) (int64, error) {
+	if err := b.check(); err != nil {
+		return 0, err
+	}
+	return b.db.GetInt64Context(b.context(), b.prefix+key)
+}
+
+// Has reports whether the bucket holds a live value of the key.
+func (b *Bucket) Has(key string) bool {
+	return b.check() == nil && b.db.Has(b.prefix+key)
+}
+
+// Describe is Db.Describe for the key of the bucket.
+func (b *Bucket) Describe(key string) (ValueInfo, error) {
+	if err := b.check(); err != nil {
+		return ValueInfo{}, err
+	}
+	return b.db.Describe(b.prefix + key)
+}
+
+// Delete removes the key from the bucket. Deleting a key which does not
+// exist is not an error.
+func (b *Bucket) Delete(key string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.db.put(PutRequest{ctx: b.ctx, entry: &entry{key: b.prefix + key, value: "", valueType: Str, expiresAt: tombstoneExpiry}})
+}
+
+// Keys returns the live keys of the bucket in lexical order.
+func (b *Bucket) Keys() []string {
+	if b.check() != nil {
+		return nil
+	}
+	var keys []string
+	for key := range b.db.liveKeys(b.prefix) {
+		keys = append(keys, strings.TrimPrefix(key, b.prefix))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Iterate walks keys of the bucket starting with prefix. Keys are reported
+// without the bucket, deleted and expired ones are skipped as by Db.Iterate.
+func (b *Bucket) Iterate(prefix string) *Iterator {
+	if b.check() != nil {
+		return &Iterator{db: b.db, pos: -1}
+	}
+	it := b.db.iterate(b.prefix + prefix)
+	it.trim = b.prefix
+	return it
+}
+
+// Range walks keys of the bucket within [start, end) as Db.Range does, an
+// empty end leaves the range open up to the last key of the bucket.
+func (b *Bucket) Range(start, end string) *Iterator {
+	if b.check() != nil {
+		return &Iterator{db: b.db, pos: -1}
+	}
+	var it *Iterator
+	if end == "" {
+		it = b.db.iterateRange(b.prefix, b.prefix+start, "")
+	} else {
+		it = b.db.iterateRange(b.prefix+rangePrefix(start, end), b.prefix+start, b.prefix+end)
+	}
+	it.trim = b.prefix
+	return it
+}
+
+// Drop deletes all the keys of the bucket, see Db.DeleteRange.
+func (b *Bucket) Drop() error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.db.deleteRange(b.prefix)
+}
+
+// liveKeys returns the keys starting with prefix whose latest values are not
+// expired.
+func (db *Db) liveKeys(prefix string) map[string]bool {
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+
+	now := time.Now().UnixNano()
+	seen := make(map[string]bool)
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		for key, pos := range db.segments[i].positions(now) {
+			if _, ok := seen[key]; ok || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			seen[key] = pos >= 0
+		}
+	}
+	for key, live := range seen {
+		if !live {
+			delete(seen, key)
+		}
+	}
+	return seen
+}
+
+// isSystemKey reports whether the key belongs to the system bucket.
+func isSystemKey(key string) bool {
+	return strings.HasPrefix(key, bucketMark+systemBucket+bucketMark)
+}
+
+// isBucketKey reports whether the key belongs to a bucket.
+func isBucketKey(key string) bool {
+	return strings.HasPrefix(key, bucketMark)
+}
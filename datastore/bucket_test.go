@@ -0,0 +1,166 @@
+package datastore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDb_Bucket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 10*Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	users, orders := db.Bucket("users"), db.Bucket("orders")
+	_, err = db.PutString("key1", "root")
+	assert.Nil(t, err)
+	_, err = users.PutString("key1", "user")
+	assert.Nil(t, err)
+	_, err = users.PutInt64("key2", 2)
+	assert.Nil(t, err)
+	_, err = orders.PutString("key1", "order")
+	assert.Nil(t, err)
+
+	t.Run("isolation", func(t *testing.T) {
+		val, err := db.GetString("key1")
+		assert.Nil(t, err)
+		assert.Equal(t, "root", val)
+		val, err = users.GetString("key1")
+		assert.Nil(t, err)
+		assert.Equal(t, "user", val)
+		n, err := users.GetInt64("key2")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(2), n)
+		_, err = orders.GetInt64("key2")
+		assert.Equal(t, ErrNotFound, err)
+		assert.True(t, orders.Has("key1"))
+		assert.False(t, orders.Has("key2"))
+		assert.False(t, db.Bucket("").Has("key1"))
+		info, err := users.Describe("key2")
+		assert.Nil(t, err)
+		assert.Equal(t, Int, info.Type)
+		_, err = orders.Describe("key2")
+		assert.Equal(t, ErrNotFound, err)
+
+		assert.Equal(t, []string{"key1"}, db.KeysByType(Str))
+		assert.Empty(t, db.KeysByType(Int))
+		it := db.Iterate("")
+		assert.True(t, it.Next())
+		assert.Equal(t, "key1", it.Key())
+		assert.False(t, it.Next())
+		snap := db.Snapshot()
+		assert.Equal(t, 1, snap.Len())
+		snap.Release()
+
+		_, err = db.PutString(users.prefix+"key3", "value")
+		assert.Equal(t, ErrReservedKey, err)
+		_, err = db.Bucket("").PutString("key1", "value")
+		assert.Equal(t, ErrInvalidBucket, err)
+	})
+
+	t.Run("iteration", func(t *testing.T) {
+		assert.Equal(t, []string{"key1", "key2"}, users.Keys())
+
+		it := users.Iterate("key")
+		it.Seek("key2")
+		assert.True(t, it.Next())
+		assert.Equal(t, "key2", it.Key())
+		val, err := it.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(2), val)
+		assert.False(t, it.Next())
+
+		it = users.Range("key2", "")
+		assert.True(t, it.Next())
+		assert.Equal(t, "key2", it.Key())
+		assert.False(t, it.Next())
+		assert.False(t, users.Range("key0", "key1").Next())
+
+		_, err = users.PutStringWithTTL("key3", "value", time.Millisecond)
+		assert.Nil(t, err)
+		time.Sleep(5 * time.Millisecond)
+		var keys []string
+		for it := users.Iterate("key"); it.Next(); {
+			keys = append(keys, it.Key())
+		}
+		assert.Equal(t, []string{"key1", "key2"}, keys)
+	})
+
+	t.Run("deletion", func(t *testing.T) {
+		assert.Nil(t, users.Delete("key1"))
+		assert.Nil(t, users.Delete("missing"))
+		_, err := users.GetString("key1")
+		assert.Equal(t, ErrNotFound, err)
+		assert.Equal(t, []string{"key2"}, users.Keys())
+
+		_, err = db.Compact(context.Background())
+		assert.Nil(t, err)
+		_, err = users.GetString("key1")
+		assert.Equal(t, ErrNotFound, err)
+
+		assert.Nil(t, orders.Drop())
+		assert.Empty(t, orders.Keys())
+		assert.Equal(t, []string{"key2"}, users.Keys())
+		val, err := db.GetString("key1")
+		assert.Nil(t, err)
+		assert.Equal(t, "root", val)
+	})
+}
+
+func TestDb_DeleteRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*2*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"ten1/k", "ten1/l", "ten2/k"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	_, err = db.Bucket("ten1").PutString("k", "value1")
+	assert.Nil(t, err)
+
+	seq := db.LastSeq()
+	assert.Nil(t, db.DeleteRange("ten1/"))
+	assert.Equal(t, seq+2, db.LastSeq())
+	for _, key := range []string{"ten1/k", "ten1/l"} {
+		_, err := db.GetString(key)
+		assert.Equal(t, ErrNotFound, err)
+	}
+	assert.Equal(t, []string{"ten2/k"}, db.KeysByType(Str))
+	_, err = db.Bucket("ten1").GetString("k")
+	assert.Nil(t, err)
+	assert.Equal(t, ErrReservedKey, db.DeleteRange(bucketMark))
+
+	// Merge drops the deleted values, tombstones included.
+	_, err = db.Compact(context.Background())
+	assert.Nil(t, err)
+	_, err = db.PutString("ten2/l", "value1")
+	assert.Nil(t, err)
+	_, err = db.Compact(context.Background())
+	assert.Nil(t, err)
+	for _, seg := range db.segmentSet() {
+		for _, key := range seg.Keys() {
+			assert.NotContains(t, key, "ten1/")
+		}
+	}
+}
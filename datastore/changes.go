@@ -0,0 +1,284 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrClosed = fmt.Errorf("db is closed")
+
+// changeBufferSize is the number of writes a feed subscriber may lag
+// behind before it is dropped.
+const changeBufferSize = 1024
+
+// Change is a write delivered by the change feed.
+type Change struct {
+	Seq   uint64
+	Key   string
+	Type  ValueType
+	Value interface{}
+	// ExpiresAt is zero for values without TTL.
+	ExpiresAt time.Time
+	// WrittenAt is the time of the write on the Db which took it first,
+	// zero for values written before write times were introduced.
+	WrittenAt time.Time
+	// Principal is who the write is attributed to, see WithPrincipal. It is
+	// empty for writes of no one in particular.
+	Principal string
+}
+
+func changeOf(e *entry, value interface{}) Change {
+	c := Change{Seq: e.seq, Key: e.key, Type: e.valueType, Value: value, Principal: e.principal}
+	if e.expiresAt != 0 {
+		c.ExpiresAt = time.Unix(0, e.expiresAt)
+	}
+	if e.writeTime != 0 {
+		c.WrittenAt = time.Unix(0, e.writeTime)
+	}
+	return c
+}
+
+// changeFeed fans written entries out to subscribers. Publishing never
+// blocks the write loop, a subscriber whose buffer is full is dropped.
+type changeFeed struct {
+	mu   sync.Mutex
+	subs map[chan *entry]struct{}
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{subs: make(map[chan *entry]struct{})}
+}
+
+func (f *changeFeed) subscribe() chan *entry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch := make(chan *entry, changeBufferSize)
+	f.subs[ch] = struct{}{}
+	return ch
+}
+
+func (f *changeFeed) unsubscribe(ch chan *entry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.subs[ch]; ok {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+func (f *changeFeed) publish(e *entry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for ch := range f.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Apply writes the change under its sequence number, as a follower
+// replaying the feed of another Db does. Changes up to LastSeq are already
+// applied and ignored, so a feed may be replayed after a reconnect. Values
+// written before sequence numbers were introduced can not be applied.
+func (db *Db) Apply(c Change) error {
+	if c.Seq == 0 {
+		return fmt.Errorf("change of %s has no sequence number", c.Key)
+	}
+	if len(c.Principal) > maxPrincipalLength {
+		return ErrInvalidPrincipal
+	}
+	e := &entry{key: c.Key, value: c.Value, valueType: c.Type, seq: c.Seq, principal: c.Principal}
+	if !c.WrittenAt.IsZero() {
+		e.writeTime = c.WrittenAt.UnixNano()
+	}
+	if !c.ExpiresAt.IsZero() {
+		e.expiresAt = c.ExpiresAt.UnixNano()
+		// Deletions do not depend on the clock.
+		if e.expiresAt != tombstoneExpiry {
+			if err := db.checkClockSkew(); err != nil {
+				return err
+			}
+		}
+	}
+	switch c.Value.(type) {
+	case string:
+		if c.Type != Str {
+			return fmt.Errorf("change of %s has a string value of type %s", c.Key, c.Type)
+		}
+	case int64:
+		if c.Type != Int {
+			return fmt.Errorf("change of %s has an int64 value of type %s", c.Key, c.Type)
+		}
+	default:
+		return fmt.Errorf("change of %s has a value of unsupported type %T", c.Key, c.Value)
+	}
+	return db.putUnknown(e)
+}
+
+// LastSeq returns the sequence number of the latest write.
+func (db *Db) LastSeq() uint64 {
+	return db.lastSeq.Load()
+}
+
+// Changes returns the feed of writes with sequence numbers greater than
+// sinceSeq, see ChangesContext.
+func (db *Db) Changes(sinceSeq uint64) (<-chan Change, error) {
+	return db.ChangesContext(context.Background(), sinceSeq)
+}
+
+// ChangesContext returns the feed of writes with sequence numbers greater
+// than sinceSeq in sequence order. The feed starts with the latest values
+// of keys written after sinceSeq, overwritten values are not kept by the
+// log, deletes included until merge drops them, and continues with new
+// writes as they happen. Values written before
+// sequence numbers were introduced have sequence 0 and are only part of the
+// feed from 0.
+//
+// The channel is closed once ctx is done, the Db is closed or the reader
+// lags too far behind; the reader may then resume from the last sequence it
+// got.
+func (db *Db) ChangesContext(ctx context.Context, sinceSeq uint64) (<-chan Change, error) {
+	select {
+	case <-db.done:
+		return nil, ErrClosed
+	default:
+	}
+
+	// Subscribing before the backlog is collected leaves no gap between
+	// them; writes found in both are delivered once.
+	live := db.feed.subscribe()
+	backlog := db.changesSince(sinceSeq)
+
+	out := make(chan Change)
+	go func() {
+		defer close(out)
+		defer db.feed.unsubscribe(live)
+
+		send := func(c Change) bool {
+			select {
+			case out <- c:
+				return true
+			case <-ctx.Done():
+			case <-db.done:
+			}
+			return false
+		}
+
+		var last uint64
+		for _, item := range backlog {
+			c, ok, err := db.latestChange(item.key, item.seq)
+			if err != nil {
+				return
+			}
+			if ok && !send(c) {
+				return
+			}
+			last = item.seq
+		}
+
+		for {
+			var e *entry
+			var ok bool
+			select {
+			case e, ok = <-live:
+			case <-ctx.Done():
+				return
+			case <-db.done:
+				return
+			}
+			if !ok {
+				return
+			}
+			if e.seq <= last {
+				continue
+			}
+			var err error
+			val := e.value
+			if e.blob != nil {
+				val, err = db.readBlob(e.blob)
+			}
+			// A missing blob was superseded by a later write and merged
+			// away, the later write follows in the feed.
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			if !send(changeOf(e, val)) {
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+type changeRef struct {
+	key string
+	seq uint64
+}
+
+// changesSince returns keys whose latest entries were written after seq,
+// in sequence order.
+func (db *Db) changesSince(seq uint64) []changeRef {
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+
+	seen := make(map[string]bool)
+	var refs []changeRef
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		for key, s := range db.segments[i].sequences() {
+			if seen[key] || isSystemKey(key) {
+				continue
+			}
+			seen[key] = true
+			if s > seq || seq == 0 {
+				refs = append(refs, changeRef{key: key, seq: s})
+			}
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].seq < refs[j].seq })
+	return refs
+}
+
+// latestChange reads the latest entry of the key. It reports false if the
+// key was overwritten after seq, the newer write is delivered separately,
+// or if the key is gone or expired.
+func (db *Db) latestChange(key string, seq uint64) (Change, bool, error) {
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		e, err := db.segments[i].entry(key)
+		if err != nil {
+			return Change{}, false, err
+		}
+		if e == nil {
+			continue
+		}
+		// Tombstones are sent as deletes, values whose TTL ran out are not
+		// sent at all.
+		if e.seq != seq || e.expiresAt != tombstoneExpiry && e.expired(time.Now().UnixNano()) {
+			return Change{}, false, nil
+		}
+		val := e.value
+		if e.blob != nil {
+			val, err = db.readBlob(e.blob)
+			if err != nil {
+				return Change{}, false, err
+			}
+		}
+		return changeOf(e, val), true, nil
+	}
+	return Change{}, false, nil
+}
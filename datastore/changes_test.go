@@ -0,0 +1,170 @@
+package datastore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// receive returns the next change with its write time, which is checked to
+// be set, cleared.
+func receive(t *testing.T, ch <-chan Change) Change {
+	t.Helper()
+	select {
+	case c, ok := <-ch:
+		assert.True(t, ok, "Feed is closed")
+		if ok {
+			assert.False(t, c.WrittenAt.IsZero())
+		}
+		c.WrittenAt = time.Time{}
+		return c
+	case <-time.After(time.Second):
+		t.Fatal("No change received")
+	}
+	return Change{}
+}
+
+func TestDb_Changes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*2*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.PutString("key1", "value1")
+	assert.Nil(t, err)
+	_, err = db.PutInt64("key2", 2)
+	assert.Nil(t, err)
+	_, err = db.PutString("key1", "value2")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), db.LastSeq())
+
+	t.Run("backlog", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ch, err := db.ChangesContext(ctx, 0)
+		assert.Nil(t, err)
+
+		assert.Equal(t, Change{Seq: 2, Key: "key2", Type: Int, Value: int64(2)}, receive(t, ch))
+		assert.Equal(t, Change{Seq: 3, Key: "key1", Type: Str, Value: "value2"}, receive(t, ch))
+
+		cancel()
+		for range ch {
+		}
+	})
+
+	t.Run("live", func(t *testing.T) {
+		ch, err := db.Changes(2)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(3), receive(t, ch).Seq)
+
+		_, err = db.PutStringWithTTL("key3", "value3", time.Hour)
+		assert.Nil(t, err)
+		c := receive(t, ch)
+		assert.Equal(t, uint64(4), c.Seq)
+		assert.Equal(t, "value3", c.Value)
+		assert.False(t, c.ExpiresAt.IsZero())
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		assert.Nil(t, db.mergeOldSegments())
+		ch, err := db.Changes(0)
+		assert.Nil(t, err)
+		var seqs []uint64
+		for i := 0; i < 3; i++ {
+			seqs = append(seqs, receive(t, ch).Seq)
+		}
+		assert.Equal(t, []uint64{2, 3, 4}, seqs)
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		ch, err := db.Changes(4)
+		assert.Nil(t, err)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		_, ok := <-ch
+		assert.False(t, ok)
+		_, err = db.Changes(0)
+		assert.Equal(t, ErrClosed, err)
+
+		db, err = NewDb(dir, 40*2*Byte)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, uint64(4), db.LastSeq())
+		_, err = db.PutString("key4", "value4")
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(5), db.LastSeq())
+	})
+}
+
+func TestDb_ChangesPrincipal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*2*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	live, err := db.Changes(0)
+	assert.Nil(t, err)
+	ctx := WithPrincipal(context.Background(), "alice")
+	_, err = db.PutStringContext(ctx, "key1", "value1")
+	assert.Nil(t, err)
+	var b Batch
+	b.PutInt64("key2", 2)
+	b.Delete("key1")
+	_, err = db.WriteContext(ctx, &b)
+	assert.Nil(t, err)
+	_, err = db.PutString("key3", "value3")
+	assert.Nil(t, err)
+	for _, principal := range []string{"alice", "alice", "alice", ""} {
+		assert.Equal(t, principal, receive(t, live).Principal)
+	}
+
+	long := WithPrincipal(context.Background(), strings.Repeat("a", maxPrincipalLength+1))
+	_, err = db.PutStringContext(long, "key4", "value4")
+	assert.Equal(t, ErrInvalidPrincipal, err)
+
+	// Principals are stored with the entries.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 40*2*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := db.Changes(0)
+	assert.Nil(t, err)
+	assert.Equal(t, Change{Seq: 2, Key: "key2", Type: Int, Value: int64(2), Principal: "alice"}, receive(t, ch))
+
+	t.Run("Apply", func(t *testing.T) {
+		follower, err := NewDb(t.TempDir(), 40*2*Byte)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer follower.Close()
+
+		assert.Nil(t, follower.Apply(Change{Seq: 1, Key: "key", Type: Str, Value: "value", Principal: "bob"}))
+		ch, err := follower.Changes(0)
+		assert.Nil(t, err)
+		assert.Equal(t, "bob", receive(t, ch).Principal)
+	})
+}
@@ -0,0 +1,51 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+// ErrClockSkew is returned for TTL writes while the clock skew exceeds the
+// bound set by WithMaxClockSkew in the refusing mode.
+var ErrClockSkew = fmt.Errorf("clock skew exceeds the allowed bound")
+
+// WithMaxClockSkew bounds the clock skew tolerated by TTL operations, which
+// rely on wall clocks agreeing across nodes. Beyond the bound TTL writes
+// fail with ErrClockSkew if refuse is set and are counted as warnings
+// otherwise.
+func WithMaxClockSkew(d time.Duration, refuse bool) Option {
+	return func(db *Db) {
+		db.maxClockSkew = d
+		db.refuseSkewed = refuse
+	}
+}
+
+// ReportClockSkew records the offset of the local clock from a peer, such as
+// the one measured by a replication follower against its leader. Positive
+// skew means the local clock is ahead.
+func (db *Db) ReportClockSkew(d time.Duration) {
+	db.clockSkew.Store(int64(d))
+}
+
+func (db *Db) ClockSkew() time.Duration {
+	return time.Duration(db.clockSkew.Load())
+}
+
+// checkClockSkew guards TTL operations.
+func (db *Db) checkClockSkew() error {
+	if db.maxClockSkew <= 0 {
+		return nil
+	}
+	skew := db.ClockSkew()
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew <= db.maxClockSkew {
+		return nil
+	}
+	if db.refuseSkewed {
+		return ErrClockSkew
+	}
+	db.counters.skewWarnings.Add(1)
+	return nil
+}
@@ -0,0 +1,47 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDb_ClockSkew(t *testing.T) {
+	for _, refuse := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "test-db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		db, err := NewDb(dir, 10*Megabyte, WithMaxClockSkew(time.Second, refuse))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		db.ReportClockSkew(-500 * time.Millisecond)
+		_, err = db.PutStringWithTTL("key1", "value1", time.Hour)
+		assert.Nil(t, err)
+
+		db.ReportClockSkew(-2 * time.Second)
+		assert.Equal(t, -2*time.Second, db.Stats().ClockSkew)
+		_, err = db.PutStringWithTTL("key2", "value2", time.Hour)
+		if refuse {
+			assert.Equal(t, ErrClockSkew, err)
+			assert.Equal(t, int64(0), db.Stats().SinceStart.ClockSkewWarnings)
+			_, err = db.GetString("key2")
+			assert.Equal(t, ErrNotFound, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, int64(1), db.Stats().SinceStart.ClockSkewWarnings)
+		}
+
+		// Writes without a TTL do not depend on the clock.
+		_, err = db.PutString("key3", "value3")
+		assert.Nil(t, err)
+	}
+}
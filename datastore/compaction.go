@@ -0,0 +1,87 @@
+package datastore
+
+import "time"
+
+// SegmentInfo describes a sealed segment to a CompactionPolicy.
+type SegmentInfo struct {
+	Id   int
+	Size int64
+	// Garbage is the number of bytes taken by overwritten and expired
+	// entries, Expired counts the latter alone.
+	Garbage int64
+	Expired int64
+	ModTime time.Time
+}
+
+// CompactionPolicy decides which sealed segments get merged. Plan is given
+// the sealed segments oldest first and returns the range [from, to) of them
+// to merge, ok is false when nothing should be merged. Merged segments keep
+// their place in the list, so later values still override them.
+type CompactionPolicy interface {
+	Plan(segments []SegmentInfo, opts Options) (from, to int, ok bool)
+}
+
+// SizeTiered merges all sealed segments once the number of segments exceeds
+// SegmentMergeThreshold or some of them hold expired entries.
+type SizeTiered struct{}
+
+func (SizeTiered) Plan(segments []SegmentInfo, opts Options) (int, int, bool) {
+	if len(segments) == 0 {
+		return 0, 0, false
+	}
+	if len(segments)+1 > opts.SegmentMergeThreshold {
+		return 0, len(segments), true
+	}
+	for _, seg := range segments {
+		if seg.Expired > 0 {
+			return 0, len(segments), true
+		}
+	}
+	return 0, 0, false
+}
+
+// GarbageRatio merges sealed segments up to the newest one whose share of
+// garbage reaches Ratio. It trades more disk usage for less rewriting.
+type GarbageRatio struct {
+	Ratio float64
+}
+
+func (p GarbageRatio) Plan(segments []SegmentInfo, _ Options) (int, int, bool) {
+	for i := len(segments) - 1; i >= 0; i-- {
+		seg := segments[i]
+		if seg.Size > 0 && float64(seg.Garbage)/float64(seg.Size) >= p.Ratio {
+			return 0, i + 1, true
+		}
+	}
+	return 0, 0, false
+}
+
+// TimeWindow groups sealed segments by the Window their last write falls
+// into and merges segments of a window once it is over. Segments of
+// different windows are never merged together, so whole windows age out
+// with WithRetention.
+type TimeWindow struct {
+	Window time.Duration
+}
+
+func (p TimeWindow) Plan(segments []SegmentInfo, opts Options) (int, int, bool) {
+	current := time.Now().Truncate(p.Window)
+	for from := 0; from < len(segments); {
+		window := segments[from].ModTime.Truncate(p.Window)
+		to := from
+		var size, garbage int64
+		for to < len(segments) && segments[to].ModTime.Truncate(p.Window).Equal(window) {
+			size += segments[to].Size
+			garbage += segments[to].Garbage
+			to++
+		}
+		// A merged window fits into a single segment or has no garbage
+		// left, so it is not merged again.
+		fits := size-garbage <= opts.MaxSegmentSize.Bytes()
+		if window.Before(current) && to-from > 1 && (fits || garbage > 0) {
+			return from, to, true
+		}
+		from = to
+	}
+	return 0, 0, false
+}
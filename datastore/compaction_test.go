@@ -0,0 +1,299 @@
+package datastore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactionPolicies(t *testing.T) {
+	opts := Options{MaxSegmentSize: 100 * Byte, SegmentMergeThreshold: 3}
+
+	t.Run("size tiered", func(t *testing.T) {
+		segments := []SegmentInfo{{Size: 100}, {Size: 100}}
+		_, _, ok := SizeTiered{}.Plan(segments, opts)
+		assert.False(t, ok)
+
+		segments = append(segments, SegmentInfo{Size: 100})
+		from, to, ok := SizeTiered{}.Plan(segments, opts)
+		assert.True(t, ok)
+		assert.Equal(t, []int{0, 3}, []int{from, to})
+
+		from, to, ok = SizeTiered{}.Plan([]SegmentInfo{{Size: 100, Garbage: 30, Expired: 30}}, opts)
+		assert.True(t, ok)
+		assert.Equal(t, []int{0, 1}, []int{from, to})
+	})
+
+	t.Run("garbage ratio", func(t *testing.T) {
+		policy := GarbageRatio{Ratio: 0.5}
+		segments := []SegmentInfo{{Size: 100, Garbage: 10}, {Size: 100, Garbage: 60}, {Size: 100, Garbage: 20}}
+		from, to, ok := policy.Plan(segments, opts)
+		assert.True(t, ok)
+		assert.Equal(t, []int{0, 2}, []int{from, to})
+
+		_, _, ok = policy.Plan(segments[2:], opts)
+		assert.False(t, ok)
+	})
+
+	t.Run("time window", func(t *testing.T) {
+		policy := TimeWindow{Window: time.Hour}
+		now := time.Now()
+		old := now.Add(-3 * time.Hour).Truncate(time.Hour)
+		older := old.Add(-time.Hour)
+		segments := []SegmentInfo{
+			{Size: 100, ModTime: older},
+			{Size: 40, ModTime: old},
+			{Size: 40, ModTime: old.Add(time.Minute)},
+			{Size: 40, ModTime: now},
+			{Size: 40, ModTime: now},
+		}
+		from, to, ok := policy.Plan(segments, opts)
+		assert.True(t, ok)
+		assert.Equal(t, []int{1, 3}, []int{from, to})
+
+		// Windows merged into a segment that is full are left alone.
+		segments = []SegmentInfo{{Size: 100, ModTime: old}, {Size: 100, ModTime: old}}
+		_, _, ok = policy.Plan(segments, opts)
+		assert.False(t, ok)
+	})
+}
+
+func TestDb_CompactionPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	policy := TimeWindow{Window: time.Hour}
+	db, err := NewDb(dir, 40*2*Byte, WithCompactionPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"key1", "key2", "key3", "key4", "key5", "key6", "key7"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.compact())
+	assert.Equal(t, 4, len(db.segments))
+
+	_, err = db.PutString("key3", "value2")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(db.segments))
+
+	// Move the two middle segments into a past window. The overwritten
+	// key3 is dropped from them, segments of other windows stay intact.
+	old := time.Now().Add(-2 * time.Hour)
+	for _, seg := range db.segments[1:3] {
+		assert.Nil(t, os.Chtimes(seg.FilePath(), old, old))
+	}
+	before := db.Stats().SinceStart.BytesReclaimed
+	assert.Nil(t, db.compact())
+	assert.Equal(t, before+40, db.Stats().SinceStart.BytesReclaimed)
+	assert.Equal(t, 4, len(db.segments))
+	from, to, ok := policy.Plan(segmentInfos(db.segments), db.Options())
+	assert.False(t, ok, "Planned to merge again [%d, %d)", from, to)
+
+	for key, want := range map[string]string{"key1": "value1", "key3": "value2", "key4": "value1", "key7": "value1"} {
+		val, err := db.GetString(key)
+		assert.Nil(t, err)
+		assert.Equal(t, want, val)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 40*2*Byte, WithCompactionPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 4, len(db.segments))
+	val, err := db.GetString("key3")
+	assert.Nil(t, err)
+	assert.Equal(t, "value2", val)
+}
+
+func TestDb_ArchiveDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "archive")
+	opts := []Option{WithCompactionPolicy(manualOnly{}), WithArchiveDir(archive)}
+	db, err := NewDb(dir, 100*Byte, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	big := strings.Repeat("b", 1<<20)
+	_, err = db.PutString("old", big)
+	assert.Nil(t, err)
+	for _, key := range []string{"key1", "key2", "key3", "key4", "key5"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	_, err = db.PutString("old", "value2")
+	assert.Nil(t, err)
+	var replaced []string
+	for _, seg := range db.segments[:len(db.segments)-1] {
+		replaced = append(replaced, filepath.Base(seg.FilePath()))
+	}
+	_, err = db.Compact(context.Background())
+	assert.Nil(t, err)
+
+	// The merge archives the segments it replaced and the blob of the
+	// overwritten value to a directory of its own.
+	merges, err := os.ReadDir(archive)
+	assert.Nil(t, err)
+	if assert.Len(t, merges, 1) {
+		files, _ := filepath.Glob(filepath.Join(archive, merges[0].Name(), "segment-*"))
+		assert.Len(t, files, len(replaced))
+		blobs, _ := filepath.Glob(filepath.Join(archive, merges[0].Name(), "blob-*"))
+		if assert.Len(t, blobs, 1) {
+			data, err := os.ReadFile(blobs[0])
+			assert.Nil(t, err)
+			assert.Equal(t, big, string(data))
+		}
+	}
+	blobs, _ := filepath.Glob(filepath.Join(dir, "blob-*"))
+	assert.Empty(t, blobs)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 100*Byte, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"old": "value2", "key1": "value1", "key5": "value1"} {
+		val, err := db.GetString(key)
+		assert.Nil(t, err)
+		assert.Equal(t, want, val)
+	}
+}
+
+// benchmarkSegments fills a Db with segments of 4 MB, overwriting the keys
+// in turns.
+func benchmarkSegments(b *testing.B, segments int, value string, keys []string) *Db {
+	db, err := NewInMemoryDb(4 * Megabyte)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; len(db.segments) <= segments; i++ {
+		if _, err := db.PutString(keys[i%len(keys)], value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return db
+}
+
+func BenchmarkEntryIterator(b *testing.B) {
+	db := benchmarkSegments(b, 1, strings.Repeat("v", 256), benchmarkKeys(50000))
+	defer db.Close()
+	seg := db.segments[0]
+
+	b.SetBytes(seg.Size())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := newEntryIterator(context.Background(), seg)
+		for e, err := it.Next(); e != nil || err != nil; e, err = it.Next() {
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDb_Compact(b *testing.B) {
+	benchmarkValues(b, func(b *testing.B, value string, keys []string) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			db := benchmarkSegments(b, 4, value, keys)
+			var size int64
+			for _, seg := range db.segments[:4] {
+				size += seg.Size()
+			}
+			b.SetBytes(size)
+			b.StartTimer()
+			if _, err := db.Compact(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+			b.StopTimer()
+			db.Close()
+		}
+	})
+}
+
+// manualOnly plans no merges, segments are only merged by Compact.
+type manualOnly struct{}
+
+func (manualOnly) Plan([]SegmentInfo, Options) (int, int, bool) {
+	return 0, 0, false
+}
+
+func TestDb_CompactionThrottle(t *testing.T) {
+	db, err := NewInMemoryDb(40*2*Byte, WithCompactionRate(4000*Byte), WithCompactionPolicy(manualOnly{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	assert.Equal(t, 4000*Byte, db.Options().CompactionRate)
+
+	for _, key := range []string{"key1", "key2", "key3", "key4", "key5", "key6", "key7"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+
+	// 240 bytes are read and as many written.
+	start := time.Now()
+	_, err = db.Compact(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) >= 100*time.Millisecond, "Compacted in %s", time.Since(start))
+
+	t.Run("pause", func(t *testing.T) {
+		opts := db.Options()
+		opts.CompactionRate = 0
+		assert.Nil(t, db.SetOptions(opts))
+		_, err = db.PutString("key1", "value2")
+		assert.Nil(t, err)
+
+		db.PauseCompaction()
+		assert.True(t, db.CompactionPaused())
+		done := make(chan error)
+		go func() {
+			_, err := db.Compact(context.Background())
+			done <- err
+		}()
+		select {
+		case <-done:
+			t.Fatal("Compacted while paused")
+		case <-time.After(20 * time.Millisecond):
+		}
+		db.ResumeCompaction()
+		assert.False(t, db.CompactionPaused())
+		assert.Nil(t, <-done)
+
+		// Paused merges are still cancelled.
+		db.PauseCompaction()
+		defer db.ResumeCompaction()
+		_, err = db.PutString("key2", "value2")
+		assert.Nil(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := db.Compact(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
@@ -0,0 +1,51 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+)
+
+// ErrOverflow is returned by Increment when the sum does not fit an int64.
+var ErrOverflow = fmt.Errorf("increment overflows int64")
+
+// Increment adds delta to the int64 value of the key and returns the sum.
+// Keys which do not exist count from zero, and the TTL of an existing value
+// is kept. The value is read and written by the write loop, so concurrent
+// increments of a key are never lost. Keys holding strings fail with
+// ErrNotInt64.
+func (db *Db) Increment(key string, delta int64) (int64, error) {
+	return db.IncrementContext(context.Background(), key, delta)
+}
+
+// IncrementContext is Increment traced as a child of the span of ctx and
+// given up as PutIfRevisionContext is once ctx is done.
+func (db *Db) IncrementContext(ctx context.Context, key string, delta int64) (int64, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, err
+	}
+	e := &entry{key: key, value: delta, valueType: Int}
+	if err := db.put(PutRequest{ctx: ctx, entry: e, increment: true}); err != nil {
+		return 0, err
+	}
+	return e.value.(int64), nil
+}
+
+// applyIncrement turns the entry of an Increment holding the delta into the
+// one of the sum, it is called by the write loop.
+func (db *Db) applyIncrement(e *entry) error {
+	cur, err := db.latest(e.key)
+	if err != nil || cur == nil {
+		return err
+	}
+	if cur.valueType != Int {
+		return ErrNotInt64
+	}
+	v, delta := cur.value.(int64), e.value.(int64)
+	sum := v + delta
+	if delta > 0 && sum < v || delta < 0 && sum > v {
+		return ErrOverflow
+	}
+	e.value = sum
+	e.expiresAt = cur.expiresAt
+	return nil
+}
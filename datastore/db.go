@@ -1,60 +1,206 @@
 package datastore
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var ErrNotFound = fmt.Errorf("record does not exist")
+var (
+	ErrNotFound  = fmt.Errorf("record does not exist")
+	ErrNotOnDisk = fmt.Errorf("values of the db are not in os files")
+	// ErrTooLarge is returned for entries which do not fit into a segment,
+	// such as int64 values of huge keys. String values go to blob files.
+	ErrTooLarge = fmt.Errorf("entry size exceeds segment size")
+	// ErrNegativeSize is returned by PutReader for a negative size.
+	ErrNegativeSize = fmt.Errorf("value size is negative")
+)
 
 type Db struct {
 	maxSegmentSize MemoryUnit
 	outDir         string
+	backend        Backend
 
 	segments              []*Segment
 	lastSegmentId         int
 	segmentMergeThreshold int
-
-	dataChan chan PutRequest
-	open     bool
-
-	mergeWrite sync.RWMutex
-	mergeRead  sync.RWMutex
+	segmentPrefix         string
+
+	types    *typeIndex
+	counters counters
+	// lastBlobId is the id of the latest blob file.
+	lastBlobId atomic.Int64
+	// lastSeq is the sequence number of the latest write.
+	lastSeq atomic.Uint64
+	// compactedSeq is the latest sequence number merged.
+	compactedSeq atomic.Uint64
+	// syncedSeq is the latest sequence number known to be on the storage,
+	// syncMu serializes syncs for WaitForSync.
+	syncedSeq atomic.Uint64
+	syncMu    sync.Mutex
+	feed      *changeFeed
+	// appendMu orders appends to the active segment. The write loop makes
+	// most of them, flushStats the others, from merges and restores run
+	// by the write loop as well as from other goroutines.
+	appendMu sync.Mutex
+
+	dataChan    chan PutRequest
+	optionsChan chan optionsRequest
+	restoreChan chan restoreRequest
+	optionsMu   sync.RWMutex
+	// done is closed by Close, operations fail with ErrClosed from then on.
+	// loopDone is closed once the write loop is over.
+	done     chan struct{}
+	loopDone chan struct{}
+	stopOnce sync.Once
+
+	sweepInterval time.Duration
+	statsInterval time.Duration
+	retention     time.Duration
+	maxDiskUsage  MemoryUnit
+	// archive keeps sealed segments older than archiveAfter in an object
+	// store, it wraps backend when set.
+	archive      *archiveBackend
+	archiveAfter time.Duration
+	// mergeArchiveDir keeps files replaced by merges, see WithArchiveDir.
+	mergeArchiveDir string
+	// quotaCompacted is the unix time in nanoseconds of the latest
+	// compaction forced by maxDiskUsage.
+	quotaCompacted atomic.Int64
+	compaction     CompactionPolicy
+	newIndex       func() Index
+
+	instrumentation Instrumentation
+	tracer          Tracer
+	slowOp          time.Duration
+	logger          *slog.Logger
+	background      background
+	inflight        inflightWrites
+	keyRules        keyRules
+	throttle        compactionThrottle
+	// recoveryProgress is called as segments are recovered, see
+	// WithRecoveryProgress.
+	recoveryProgress func(recovered, total int)
+
+	// clockSkew is the latest reported skew in nanoseconds.
+	clockSkew    atomic.Int64
+	maxClockSkew time.Duration
+	refuseSkewed bool
+
+	// segmentsMu guards the segment list. The list is never modified in
+	// place, a new one is assigned instead, so a slice taken under the lock
+	// stays a consistent view. Segments replaced by merge are released under
+	// the write lock, hence reads of segment files hold the read lock.
+	segmentsMu sync.RWMutex
+	// mergeMu allows a single merge at a time.
+	mergeMu sync.Mutex
 }
 
 type PutRequest struct {
 	entry *entry
-	res   chan error
+	// batch holds the entries of a Batch written in order instead of entry,
+	// written counts the ones written.
+	batch   []*entry
+	written *int
+	res     chan error
+	// ctx holds the span the write is traced under. The write is given up
+	// if ctx is done before the write loop takes it.
+	ctx    context.Context
+	timing *putTiming
+	// checkRevision makes the write fail with ErrConflict unless the key is
+	// at revision.
+	checkRevision bool
+	revision      uint64
+	// increment makes the int64 value of entry a delta added to the value
+	// of the key, see Increment.
+	increment bool
 }
 
-func NewDb(dir string, size MemoryUnit) (*Db, error) {
-	err := os.MkdirAll(dir, 0o755)
-	if err != nil {
-		return nil, err
-	}
+// inMemoryDir is the data directory of in-memory Dbs within their own
+// backends.
+const inMemoryDir = "db"
+
+// NewInMemoryDb returns a Db which keeps its segments and blobs in memory
+// instead of files. It behaves as a Db on disk, except that its data is gone
+// once it is closed and OpenString is not supported.
+func NewInMemoryDb(size MemoryUnit, opts ...Option) (*Db, error) {
+	return NewDb(inMemoryDir, size, append([]Option{WithBackend(newMemBackend())}, opts...)...)
+}
+
+// NewDb opens the Db kept in dir, which is created if missing. Segments of
+// size bytes at most are kept in files of the os unless another Backend is
+// set with WithBackend.
+func NewDb(dir string, size MemoryUnit, opts ...Option) (*Db, error) {
 	db := &Db{
 		outDir:                dir,
+		backend:               OSBackend{},
 		segments:              make([]*Segment, 0),
+		lastSegmentId:         -1,
 		maxSegmentSize:        size,
 		dataChan:              make(chan PutRequest),
-		open:                  true,
+		optionsChan:           make(chan optionsRequest),
+		restoreChan:           make(chan restoreRequest),
 		segmentMergeThreshold: 10,
+		segmentPrefix:         defaultSegmentPrefix,
+		types:                 newTypeIndex(),
+		feed:                  newChangeFeed(),
+		done:                  make(chan struct{}),
+		loopDone:              make(chan struct{}),
+		sweepInterval:         time.Minute,
+		statsInterval:         time.Minute,
+		compaction:            SizeTiered{},
+		newIndex:              NewMapIndex,
+		instrumentation:       noInstrumentation{},
+		tracer:                noTracer{},
+		logger:                slog.New(discardHandler{}),
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	if _, ok := db.backend.(OSBackend); ok {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	if db.archive != nil {
+		if err := db.archive.init(db.backend, dir); err != nil {
+			return nil, err
+		}
+		db.backend = db.archive
+	}
+	if db.segmentPrefix == "" || strings.ContainsRune(db.segmentPrefix, filepath.Separator) {
+		return nil, fmt.Errorf("invalid segment prefix %q", db.segmentPrefix)
+	}
+	if db.segmentMergeThreshold < 2 {
+		return nil, fmt.Errorf("segment merge threshold must be at least 2")
+	}
+
+	if _, err := db.recover(); err != nil {
+		return nil, err
+	}
+	if err := db.loadStats(); err != nil {
+		return nil, err
 	}
 
 	go db.handleWriteLoop()
+	go db.sweepLoop()
 
-	return db.recover()
+	return db, nil
 }
 
 const bufSize = 8192
 
+// curSegment returns the active segment, segmentsMu must be held.
 func (db *Db) curSegment() *Segment {
 	if len(db.segments) == 0 {
 		return nil
@@ -62,254 +208,693 @@ func (db *Db) curSegment() *Segment {
 	return db.segments[len(db.segments)-1]
 }
 
+// segmentSet returns the current list of segments, oldest first.
+func (db *Db) segmentSet() []*Segment {
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+	return db.segments
+}
+
 func (db *Db) recover() (*Db, error) {
-	files, err := filepath.Glob(filepath.Join(db.outDir, "segment-*"))
-	if len(files) == 0 {
-		err = db.initNewSegment()
+	start := time.Now()
+	if err := db.recoverMerge(); err != nil {
+		return nil, err
+	}
+	// An interrupted flush leaves the log in place.
+	if err := removeAll(db.backend, filepath.Join(db.outDir, flushDirName)); err != nil {
+		return nil, err
+	}
+
+	files, err := db.backend.List(db.outDir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(files))
+	for _, file := range files {
+		// The directory may be shared with other files.
+		if id, err := db.getSegmentId(file.Name()); err == nil && !file.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		if err := db.recoverBlobs(nil); err != nil {
+			return nil, err
+		}
+		_, err = db.initNewSegment()
 		if err != nil {
 			return nil, err
 		}
 		return db, nil
 	}
+	sort.Ints(ids)
 
-	sort.Slice(files, func(i, j int) bool {
-		return files[i] < files[j]
-	})
-	for i, file := range files {
-		seg, err := db.recoverSegment(file)
+	progress := func(recovered int) {
+		if db.recoveryProgress != nil {
+			db.recoveryProgress(recovered, len(ids))
+		}
+	}
+	progress(0)
+	blobs := make(map[int64]bool)
+	for i, id := range ids {
+		isLastSegment := i == len(ids)-1
+		seg, err := db.recoverSegment(db.segmentPath(db.outDir, id), id, isLastSegment, blobs)
 		if err != nil && err != io.EOF {
 			return nil, err
 		}
 
 		db.segments = append(db.segments, seg)
 		db.lastSegmentId = seg.id
-
-		if isLastSegment := i == len(files)-1; !isLastSegment {
-			err := db.segments[i].Close()
-			if err != nil {
-				return nil, err
-			}
-		}
+		db.logger.Debug("segment recovered", "segment", seg.id, "keys", seg.index.Len(), "bytes", seg.offset,
+			"progress", fmt.Sprintf("%d/%d", i+1, len(ids)))
+		progress(i + 1)
+	}
+	if err := db.recoverBlobs(blobs); err != nil {
+		return nil, err
 	}
 
+	db.logger.Info("recovery finished", "segments", len(db.segments), "keys", db.types.len(),
+		"last_seq", db.lastSeq.Load(), "duration", time.Since(start))
 	return db, nil
 }
 
-func (db *Db) recoverSegment(path string) (*Segment, error) {
-	id, err := db.getSegmentId(path)
-	if err != nil {
-		return nil, err
+// recoverSegment indexes the segment file and adds ids of blobs referenced
+// by its entries to blobs. The latest sequence number is recovered as well.
+//
+// The active segment gets its memtable back. Sealed segments load their
+// sparse indexes, or are indexed as sorted ones if they have none unless
+// their files turn out to be logs, which happens to segments written before
+// memtables were introduced or left by a failed flush; those get full
+// indexes.
+func (db *Db) recoverSegment(path string, id int, writable bool, blobs map[int64]bool) (*Segment, error) {
+	var index Index = newSortedIndex()
+	if writable {
+		index = newMemtable()
 	}
-
-	input, err := os.Open(path)
+	segment, err := openSegment(db.backend, path, id, writable, index)
 	if err != nil {
 		return nil, err
 	}
-	segment := &Segment{
-		file:  input,
-		index: make(map[string]int64),
-		id:    id,
+	var from int64
+	if writable {
+		// A Db closed cleanly leaves the memtable, only entries written
+		// after it are read.
+		if from, err = db.loadHotIndex(segment, blobs); err != nil {
+			db.logger.Warn("failed to load hot index, reading the segment", "segment", id, "err", err)
+			from = 0
+		}
+	} else if err := segment.loadSparseIndex(); err != nil {
+		segment.release()
+		return nil, err
 	}
 
-	for pair := range segmentValsGenerator(segment) {
-		if pair.err != nil {
-			return nil, pair.err
+	it := newEntryIteratorAt(context.Background(), segment, from)
+	for {
+		e, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		if e.key == sparseIndexKey {
+			segment.offset += e.Size().Bytes()
+			continue
+		}
+		if e.blob != nil {
+			blobs[e.blob.id] = true
+		}
+		if e.seq > db.lastSeq.Load() {
+			db.lastSeq.Store(e.seq)
+		}
+		segment.indexEntry(e, segment.offset)
+		if !isSystemKey(e.key) {
+			db.types.set(e.key, e.valueType)
 		}
-		e := pair.entry
-		segment.SetIndex(e.key, segment.offset)
 		segment.offset += e.Size().Bytes()
 	}
+	if sorted, ok := segment.index.(*sortedIndex); ok && sorted.unordered {
+		segment.index = db.newIndex()
+		var pos int64
+		it := newEntryIterator(context.Background(), segment)
+		for {
+			e, err := it.Next()
+			if err != nil {
+				return nil, err
+			}
+			if e == nil {
+				break
+			}
+			segment.index.Set(e.key, IndexEntry{Offset: pos, Size: e.Size().Bytes(), Seq: e.seq})
+			pos += e.Size().Bytes()
+		}
+	}
 
 	return segment, nil
 }
 
+// Close stops the Db, every operation fails with ErrClosed afterwards,
+// Close itself included. Writes sent to the write loop before are completed
+// first.
 func (db *Db) Close() error {
-	db.open = false
-	return db.curSegment().Close()
+	closing := false
+	db.stopOnce.Do(func() {
+		close(db.done)
+		closing = true
+	})
+	if !closing {
+		return ErrClosed
+	}
+	<-db.loopDone
+	statsErr := db.flushStats()
+
+	db.segmentsMu.Lock()
+	defer db.segmentsMu.Unlock()
+	for _, seg := range db.segments[:len(db.segments)-1] {
+		seg.release()
+	}
+	hotErr := db.persistHotIndex(db.curSegment())
+	if err := db.curSegment().Close(); err != nil {
+		return err
+	}
+	if hotErr != nil {
+		return hotErr
+	}
+	return statsErr
 }
 
-func (db *Db) getUnknown(key string) (val interface{}, err error) {
-	db.mergeRead.RLock()
-	defer db.mergeRead.RUnlock()
+func (db *Db) getUnknown(ctx context.Context, key string) (val interface{}, err error) {
+	start := time.Now()
+	_, span := db.tracer.Start(ctx, SpanGet)
+	// Segments searched, the one found in and when, for the slow log.
+	searched, found := 0, -1
+	var lookup time.Duration
+	defer func() {
+		d := time.Since(start)
+		db.instrumentation.OnGet(err == nil, d)
+		if db.slow(d) {
+			db.logger.WarnContext(ctx, "slow get", "key", key, "segment", found, "segments_searched", searched,
+				"duration", d, "lookup", lookup, "blob_read", d-lookup, "err", err)
+		}
+		span.SetAttributes(Attribute{AttrHit, err == nil})
+		// Misses are no failures.
+		if err == ErrNotFound {
+			span.End()
+		} else {
+			endSpan(span, err)
+		}
+	}()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+	if db.isClosed() {
+		return nil, ErrClosed
+	}
 
 	for i := len(db.segments) - 1; i >= 0; i-- {
 		seg := db.segments[i]
+		searched++
 		val, err := seg.Get(key)
+		if err == errExpired {
+			lookup = time.Since(start)
+			return "", ErrNotFound
+		}
 		if err != nil {
 			continue
 		}
+		found, lookup = seg.id, time.Since(start)
+		span.SetAttributes(Attribute{AttrSegment, int64(seg.id)})
+		val, err = db.resolve(val)
+		if err == nil {
+			span.SetAttributes(Attribute{AttrBytesRead, valueSize(val)})
+		}
 		return val, err
 	}
 
+	lookup = time.Since(start)
 	return "", ErrNotFound
 }
 
 func (db *Db) putUnknown(entry *entry) error {
+	return db.put(PutRequest{entry: entry})
+}
+
+// putEntry writes the entry and returns its sequence number.
+func (db *Db) putEntry(ctx context.Context, e *entry) (uint64, error) {
+	if err := db.put(PutRequest{ctx: ctx, entry: e}); err != nil {
+		return 0, err
+	}
+	return e.seq, nil
+}
+
+// put passes the request to the write loop and waits for the outcome.
+func (db *Db) put(req PutRequest) error {
+	start := time.Now()
+	if req.ctx == nil {
+		req.ctx = context.Background()
+	}
+	entries := req.batch
+	if entries == nil {
+		entries = []*entry{req.entry}
+	}
+	if principal := principalOf(req.ctx); principal != "" {
+		if len(principal) > maxPrincipalLength {
+			return ErrInvalidPrincipal
+		}
+		for _, e := range entries {
+			if e.principal == "" {
+				e.principal = principal
+			}
+		}
+	}
+	_, span := db.tracer.Start(req.ctx, SpanPut)
+	req.timing = &putTiming{queued: start}
+	ticket := db.inflight.begin()
 	res := make(chan error)
-	db.dataChan <- PutRequest{
-		entry: entry,
-		res:   res,
+	req.res = res
+	// Writes not taken by the write loop yet are not applied, so they fail
+	// with the error of ctx. Taken ones are waited for.
+	err := req.ctx.Err()
+	if err == nil {
+		select {
+		case db.dataChan <- req:
+			err = <-res
+		case <-db.done:
+			err = ErrClosed
+		case <-req.ctx.Done():
+			err = req.ctx.Err()
+		}
+	}
+	db.inflight.end(ticket)
+	if err == nil {
+		var size int64
+		for _, e := range entries {
+			size += e.Size().Bytes()
+			if e.blob != nil {
+				size += e.blob.length
+			}
+		}
+		db.instrumentation.OnPut(time.Since(start), size)
+		span.SetAttributes(Attribute{AttrSegment, int64(req.timing.segment)}, Attribute{AttrBytesWritten, size})
+	}
+	span.SetAttributes(Attribute{AttrQueueWait, req.timing.wait})
+	endSpan(span, err)
+	if d := time.Since(start); db.slow(d) {
+		db.logger.WarnContext(req.ctx, "slow put", "key", entries[0].key, "entries", len(entries), "segment", req.timing.segment,
+			"duration", d, "queue_wait", req.timing.wait, "write", req.timing.handle, "err", err)
 	}
-	err := <-res
-	close(res)
 	return err
 }
 
-func (db *Db) PutString(key, value string) error {
-	return db.putUnknown(&entry{key, value, Str})
+// PutString stores the value and returns the sequence number of the write,
+// which is the new revision of the key as well. WaitForSync takes it to
+// confirm the write is on the storage.
+func (db *Db) PutString(key, value string) (uint64, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, err
+	}
+	return db.putEntry(context.Background(), &entry{key: key, value: value, valueType: Str})
 }
 
-func (db *Db) PutInt64(key string, value int64) error {
-	return db.putUnknown(&entry{key, value, Int})
+// PutInt64 is PutString for int64 values.
+func (db *Db) PutInt64(key string, value int64) (uint64, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, err
+	}
+	return db.putEntry(context.Background(), &entry{key: key, value: value, valueType: Int})
+}
+
+// PutStringWithTTL stores the value which is considered deleted once ttl
+// passes.
+func (db *Db) PutStringWithTTL(key, value string, ttl time.Duration) (uint64, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, err
+	}
+	if err := db.checkClockSkew(); err != nil {
+		return 0, err
+	}
+	return db.putEntry(context.Background(), &entry{key: key, value: value, valueType: Str, expiresAt: expiresAt(ttl)})
+}
+
+// PutReader stores size bytes read from r as a string value. Values that do
+// not fit into a segment are streamed into a blob file without buffering.
+func (db *Db) PutReader(key string, r io.Reader, size int64) (uint64, error) {
+	return db.PutReaderContext(context.Background(), key, r, size)
+}
+
+// PutReaderContext is PutReader traced as a child of the span of ctx and
+// given up as PutIfRevisionContext is once ctx is done.
+func (db *Db) PutReaderContext(ctx context.Context, key string, r io.Reader, size int64) (uint64, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, err
+	}
+	if size < 0 {
+		return 0, ErrNegativeSize
+	}
+	e := &entry{key: key, value: "", valueType: Str}
+	if e.Size().Bytes()+size <= db.Options().MaxSegmentSize.Bytes() {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return 0, err
+		}
+		return db.PutStringContext(ctx, key, string(data))
+	}
+
+	ref, err := db.writeBlob(r, size)
+	if err != nil {
+		return 0, err
+	}
+	e.blob = ref
+	return db.putEntry(ctx, e)
+}
+
+func (db *Db) PutInt64WithTTL(key string, value int64, ttl time.Duration) (uint64, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, err
+	}
+	if err := db.checkClockSkew(); err != nil {
+		return 0, err
+	}
+	return db.putEntry(context.Background(), &entry{key: key, value: value, valueType: Int, expiresAt: expiresAt(ttl)})
+}
+
+func expiresAt(ttl time.Duration) int64 {
+	return time.Now().Add(ttl).UnixNano()
 }
 
 func (db *Db) GetString(key string) (string, error) {
-	val, err := db.getUnknown(key)
+	val, err := db.getUnknown(context.Background(), key)
 	if err != nil {
 		return "", err
 	}
 	str, ok := val.(string)
 	if !ok {
-		return "", fmt.Errorf("value is not a string")
+		return "", ErrNotString
 	}
 	return str, nil
 }
 
+// OpenString opens the string value of the key for reading straight from the
+// segment file. It returns the file positioned at the start of the value and
+// the value length; the caller reads at most that many bytes and closes the
+// file. Merge does not affect values being read. Dbs with a Backend other
+// than OSBackend return ErrNotOnDisk, GetReader reads their values.
+func (db *Db) OpenString(key string) (*os.File, int64, error) {
+	if _, ok := db.backend.(OSBackend); !ok {
+		return nil, 0, ErrNotOnDisk
+	}
+	f, offset, size, err := db.openString(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	osFile := f.(*os.File)
+	if _, err := osFile.Seek(offset, io.SeekStart); err != nil {
+		osFile.Close()
+		return nil, 0, err
+	}
+	return osFile, size, nil
+}
+
+// openString opens the file holding the string value of the key and returns
+// the offset and the length of the value within it.
+func (db *Db) openString(key string) (f File, offset, size int64, err error) {
+	start := time.Now()
+	defer func() { db.instrumentation.OnGet(err == nil, time.Since(start)) }()
+
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+	if db.isClosed() {
+		return nil, 0, 0, ErrClosed
+	}
+
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		seg := db.segments[i]
+		offset, length, ref, err := seg.valueRegion(key)
+		if err == errExpired {
+			return nil, 0, 0, ErrNotFound
+		}
+		if err == ErrNotString {
+			return nil, 0, 0, err
+		}
+		if err != nil {
+			continue
+		}
+
+		if ref != nil {
+			f, err := db.openBlob(ref)
+			return f, ref.offset, ref.length, err
+		}
+
+		f, err := db.backend.Open(seg.FilePath())
+		return f, offset, length, err
+	}
+
+	return nil, 0, 0, ErrNotFound
+}
+
+// GetReader returns a reader of the string value of the key. The value is
+// read from disk as the reader is consumed.
+func (db *Db) GetReader(key string) (io.ReadCloser, error) {
+	f, offset, size, err := db.openString(key)
+	if err != nil {
+		return nil, err
+	}
+	return &valueReader{Reader: io.NewSectionReader(f, offset, size), file: f}, nil
+}
+
+type valueReader struct {
+	io.Reader
+	file File
+}
+
+func (r *valueReader) Close() error {
+	return r.file.Close()
+}
+
 func (db *Db) GetInt64(key string) (int64, error) {
-	val, err := db.getUnknown(key)
+	val, err := db.getUnknown(context.Background(), key)
 	if err != nil {
 		return 0, err
 	}
 	i, ok := val.(int64)
 	if !ok {
-		return 0, fmt.Errorf("value is not an int64")
+		return 0, ErrNotInt64
 	}
 	return i, nil
 }
 
-func (db *Db) putHandler(e *entry) error {
-	entrySize := e.Size()
-	if db.maxSegmentSize < entrySize {
-		return fmt.Errorf("entry size exceeds segment size")
+// Has reports whether the key has a value, as Get would find. Only segment
+// indexes are consulted, newest first; no value is read.
+func (db *Db) Has(key string) bool {
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+	if db.isClosed() {
+		return false
 	}
-	if db.curSegment().IsSurpassed(db.maxSegmentSize - entrySize) {
-		err := db.initNewSegment()
-		if err != nil {
-			return err
+
+	now := time.Now().UnixNano()
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		if indexed, live := db.segments[i].contains(key, now); indexed {
+			return live
 		}
 	}
-
-	err := db.curSegment().Write(e)
-	return err
+	return false
 }
 
-func (db *Db) mergeOldSegments() error {
-	db.mergeWrite.Lock()
-	defer db.mergeWrite.Unlock()
-
-	segmentsToMerge := make([]*Segment, 0, len(db.segments))
-	for i := 0; i < len(db.segments)-1; i++ {
-		seg := db.segments[i]
-		segmentsToMerge = append(segmentsToMerge, seg)
+// KeysByType returns keys whose latest value has the given type, in lexical
+// order. The merge keeps the latest value of every key, so the index stays
+// valid across merges.
+func (db *Db) KeysByType(t ValueType) []string {
+	all := db.types.keysOf(t)
+	keys := all[:0]
+	for _, key := range all {
+		if !isBucketKey(key) {
+			keys = append(keys, key)
+		}
 	}
+	return keys
+}
 
-	var err error
-	vals := make(map[string]*entry)
-	for i := 0; i < len(segmentsToMerge); i++ {
-		seg := segmentsToMerge[i]
-		for pair := range segmentValsGenerator(seg) {
-			if pair.err != nil {
-				return pair.err
-			}
-
-			if db.curSegment().Has(pair.entry.key) {
-				continue
-			}
+// fits tells if an entry of the size can be written to a segment, larger
+// string values are moved to blob files.
+func (db *Db) fits(size MemoryUnit) bool {
+	return size <= db.maxSegmentSize && size.Bytes() <= maxEntrySize
+}
 
-			e := pair.entry
-			vals[e.key] = e
+func (db *Db) putHandler(e *entry) error {
+	if err := db.background.writeErr(); err != nil {
+		return err
+	}
+	// Entries applied from a change feed come with their sequence numbers.
+	if last := db.lastSeq.Load(); e.seq == 0 {
+		e.seq = last + 1
+	} else if e.seq <= last {
+		return nil
+	}
+	if e.writeTime == 0 {
+		e.writeTime = time.Now().UnixNano()
+	}
+	entrySize := e.Size()
+	if !db.fits(entrySize) && e.valueType == Str && e.blob == nil {
+		value := e.value.(string)
+		ref, err := db.writeBlob(strings.NewReader(value), int64(len(value)))
+		if err != nil {
+			return err
+		}
+		e = &entry{key: e.key, value: "", valueType: Str, expiresAt: e.expiresAt, blob: ref, seq: e.seq, flags: e.flags, writeTime: e.writeTime, principal: e.principal}
+		entrySize = e.Size()
+	}
+	if !db.fits(entrySize) {
+		return ErrTooLarge
+	}
+	if err := db.checkDiskUsage(entrySize.Bytes()); err != nil {
+		if e.blob != nil {
+			db.removeBlobs(map[int64]bool{e.blob.id: true})
 		}
+		return err
 	}
 
-	shadowDb, err := NewDb(path.Join(db.outDir, "shadow"), db.maxSegmentSize)
+	db.appendMu.Lock()
+	err := db.appendEntry(e, entrySize)
+	db.appendMu.Unlock()
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(shadowDb.outDir)
-	defer shadowDb.Close()
+	if e.expired(time.Now().UnixNano()) {
+		db.types.remove(e.key)
+	} else {
+		db.types.set(e.key, e.valueType)
+	}
+	db.counters.writes.Add(1)
+	db.lastSeq.Store(e.seq)
+	db.feed.publish(e)
+	return nil
+}
 
-	for _, e := range vals {
-		err = shadowDb.putUnknown(e)
+// appendEntry writes the entry of the size to the active segment, which is
+// sealed first if the entry does not fit. appendMu must be held.
+func (db *Db) appendEntry(e *entry, size MemoryUnit) error {
+	db.segmentsMu.RLock()
+	cur := db.curSegment()
+	db.segmentsMu.RUnlock()
+
+	if cur.IsSurpassed(db.maxSegmentSize - size) {
+		var err error
+		cur, err = db.initNewSegment()
 		if err != nil {
 			return err
 		}
 	}
+	return cur.Write(e)
+}
 
-	for _, mergedSegment := range shadowDb.segments {
-		err = os.Rename(mergedSegment.file.Name(), db.getNextSegmentPath())
+func (db *Db) handlePut(req PutRequest) error {
+	start := time.Now()
+	req.timing.wait = start.Sub(req.timing.queued)
+	defer func() { req.timing.handle = time.Since(start) }()
+	if req.checkRevision {
+		rev, err := db.revision(req.entry.key)
 		if err != nil {
 			return err
 		}
-		db.lastSegmentId++
+		if rev != req.revision {
+			return ErrConflict
+		}
 	}
-
-	db.mergeRead.Lock()
-	db.segments = append(shadowDb.segments, db.curSegment())
-	db.mergeRead.Unlock()
-
-	for _, segment := range segmentsToMerge {
-		os.Remove(segment.FilePath())
+	if req.increment {
+		if err := db.applyIncrement(req.entry); err != nil {
+			return err
+		}
 	}
-
+	if req.batch != nil {
+		for _, e := range req.batch {
+			if err := db.putHandler(e); err != nil {
+				return err
+			}
+			*req.written++
+		}
+	} else if err := db.putHandler(req.entry); err != nil {
+		return err
+	}
+	db.segmentsMu.RLock()
+	req.timing.segment = db.curSegment().id
+	db.segmentsMu.RUnlock()
 	return nil
 }
 
-func (db *Db) initNewSegment() error {
-	oldId := -1
-	if db.curSegment() != nil {
-		oldId = db.curSegment().id
-		defer db.curSegment().Close()
+// initNewSegment seals the active segment, flushing its memtable, and
+// appends a new one. Merged segments reuse ids of the segments they
+// replace, so ids of new segments keep growing from lastSegmentId.
+func (db *Db) initNewSegment() (*Segment, error) {
+	var prev *Segment
+	if segments := db.segmentSet(); len(segments) > 0 {
+		prev = segments[len(segments)-1]
+	}
+	if prev != nil {
+		if err := prev.Close(); err != nil {
+			db.logger.Error("failed to seal segment", "segment", prev.id, "err", err)
+		}
+		// The log stays the segment if the flush fails.
+		if err := db.flushSegment(prev); err != nil {
+			db.logger.Error("failed to flush segment", "segment", prev.id, "err", err)
+			db.background.fail(err, false)
+		}
 	}
 
-	newSegmentId := oldId + 1
-	outFile, err := os.OpenFile(filepath.Join(db.outDir, fmt.Sprintf("segment-%d", newSegmentId)), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	newSegmentId := db.lastSegmentId + 1
+	newSegment, err := openSegment(db.backend, db.segmentPath(db.outDir, newSegmentId), newSegmentId, true, newMemtable())
 	if err != nil {
-		return err
+		return nil, err
 	}
+	db.lastSegmentId = newSegmentId
 
-	newSegment := &Segment{
-		offset: 0,
-		file:   outFile,
-		index:  make(map[string]int64),
-		id:     newSegmentId,
-	}
-	db.segments = append(db.segments, newSegment)
+	db.segmentsMu.Lock()
+	segments := make([]*Segment, len(db.segments), len(db.segments)+1)
+	copy(segments, db.segments)
+	db.segments = append(segments, newSegment)
+	count := len(db.segments)
+	db.segmentsMu.Unlock()
 
-	if len(db.segments) > db.segmentMergeThreshold {
-		go db.mergeOldSegments()
+	if prev != nil {
+		db.logger.Info("segment rolled", "sealed", prev.id, "bytes", prev.Size(), "segment", newSegmentId)
+	}
+	if count > 1 {
+		db.compactInBackground()
 	}
 
-	return nil
-}
-
-func (db *Db) getNextSegmentPath() string {
-	id := db.lastSegmentId + 1
-	return filepath.Join(db.outDir, fmt.Sprintf("segment-%d", id))
+	return newSegment, nil
 }
 
 func (db *Db) handleWriteLoop() {
-	for db.open {
-		data := <-db.dataChan
-		db.mergeWrite.RLock()
-		err := db.putHandler(data.entry)
-		db.mergeWrite.RUnlock()
+	defer close(db.loopDone)
+	for {
+		select {
+		case <-db.done:
+			return
+		case data := <-db.dataChan:
+			data.res <- db.handlePut(data)
+		case req := <-db.optionsChan:
+			req.res <- db.applyOptions(req.opts)
+		case req := <-db.restoreChan:
+			req.res <- db.restore(req.seq)
+		}
+	}
+}
 
-		data.res <- err
+// isClosed reports whether Close was called.
+func (db *Db) isClosed() bool {
+	select {
+	case <-db.done:
+		return true
+	default:
+		return false
 	}
 }
 
 func (db *Db) getSegmentId(path string) (int, error) {
-	s := regexp.MustCompile(`segment-(\d+)`).FindStringSubmatch(path)
+	s := regexp.MustCompile(`^` + regexp.QuoteMeta(db.segmentPrefix) + `(\d+)$`).FindStringSubmatch(filepath.Base(path))
 	if len(s) == 0 {
 		return 0, fmt.Errorf("cannot parse segment id")
 	}
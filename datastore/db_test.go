@@ -1,11 +1,20 @@
 package datastore
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestDb_Put(t *testing.T) {
@@ -27,14 +36,14 @@ func TestDb_Put(t *testing.T) {
 		{"key3", "value3"},
 	}
 
-	outFile := db.curSegment().file
+	outPath := db.curSegment().FilePath()
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	t.Run("put/get", func(t *testing.T) {
 		for _, pair := range pairs {
-			err := db.PutString(pair[0], pair[1])
+			_, err := db.PutString(pair[0], pair[1])
 			assert.Nil(t, err)
 			value, err := db.GetString(pair[0])
 			assert.Nil(t, err)
@@ -42,7 +51,7 @@ func TestDb_Put(t *testing.T) {
 		}
 	})
 
-	outInfo, err := outFile.Stat()
+	outInfo, err := os.Stat(outPath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -50,10 +59,10 @@ func TestDb_Put(t *testing.T) {
 
 	t.Run("file growth", func(t *testing.T) {
 		for _, pair := range pairs {
-			err := db.PutString(pair[0], pair[1])
+			_, err := db.PutString(pair[0], pair[1])
 			assert.Nil(t, err)
 		}
-		outInfo, err := outFile.Stat()
+		outInfo, err := os.Stat(outPath)
 		assert.Nil(t, err)
 		assert.Equal(t, size1*2, outInfo.Size())
 	})
@@ -76,7 +85,7 @@ func TestDb_Put(t *testing.T) {
 
 func TestDb_Segments(t *testing.T) {
 	dbDir := filepath.Join(os.TempDir(), "test-db")
-	limit := 23 * 3 * Byte
+	limit := 40 * 3 * Byte
 	db, err := NewDb(dbDir, limit)
 	if err != nil {
 		t.Fatal(err)
@@ -85,20 +94,20 @@ func TestDb_Segments(t *testing.T) {
 	defer os.RemoveAll(dbDir)
 
 	pairs := [][]string{
-		{"key1", "value1"}, //13 + 4 (key1) + 6 (value1) -> 23
+		{"key1", "value1"}, // 30 + 4 (key1) + 6 (value1) -> 40
 		{"key2", "value2"},
 		{"key3", "value3"},
 	}
 
 	newPairs := [][]string{
-		{"key1", "value1new"}, // 13 + 4 (key1) + 9 (value1new) -> 26
-		{"key2", "new"},       // Needs to be 20 in order to fit in the segment after merge (69 - (23 + 26) = 20)
+		{"key1", "value1new"}, // 30 + 4 (key1) + 9 (value1new) -> 43
+		{"key2", "new"},       // Needs to be 37 in order to fit in the segment after merge (120 - (40 + 43) = 37)
 		{"key4", "value4new"},
 	}
 
 	t.Run("segmentation", func(t *testing.T) {
 		for _, pair := range pairs {
-			err := db.PutString(pair[0], pair[1])
+			_, err := db.PutString(pair[0], pair[1])
 			assert.Nil(t, err, "Cannot put %s: %s", pair, err)
 		}
 
@@ -107,7 +116,7 @@ func TestDb_Segments(t *testing.T) {
 
 	t.Run("new segment", func(t *testing.T) {
 		for _, pair := range newPairs {
-			err := db.PutString(pair[0], pair[1])
+			_, err := db.PutString(pair[0], pair[1])
 			assert.Nil(t, err, "Cannot put %s: %s", pair, err)
 		}
 		assert.Equal(t, 3, len(db.segments), "Expected number of segments %d got %d", 3, len(db.segments))
@@ -157,7 +166,8 @@ func TestDb_Segments(t *testing.T) {
 		}
 
 		assert.Equal(t, 2, len(db.segments), "Expected number of segments %d got %d", 2, len(db.segments))
-		assert.Equal(t, 3, db.lastSegmentId)
+		// Merged segments reuse ids of the merged ones.
+		assert.Equal(t, 2, db.lastSegmentId)
 
 		for _, pair := range newPairs {
 			value, err := db.GetString(pair[0])
@@ -171,9 +181,9 @@ func TestDb_Segments(t *testing.T) {
 	})
 
 	t.Run("mix of vals", func(t *testing.T) {
-		err := db.PutInt64("key5", 123)
+		_, err := db.PutInt64("key5", 123)
 		assert.Nil(t, err)
-		err = db.PutString("key6", "123")
+		_, err = db.PutString("key6", "123")
 		assert.Nil(t, err)
 
 		intVal, err := db.GetInt64("key5")
@@ -209,7 +219,1633 @@ func TestDb_Segments(t *testing.T) {
 	})
 
 	t.Run("over limit", func(t *testing.T) {
-		err := db.PutString("key5", string(make([]byte, limit+1)))
+		// Oversized values spill over to blob files, oversized keys do not.
+		value := string(make([]byte, limit+1))
+		_, err = db.PutString("key5", value)
+		assert.Nil(t, err)
+		val, err := db.GetString("key5")
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+
+		_, err = db.PutString(string(make([]byte, limit)), "value")
 		assert.Error(t, err, "Expected error, got nil")
 	})
 }
+
+func TestDb_Blobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	limit := 100 * Byte
+	db, err := NewDb(dir, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	big := strings.Repeat("b", 1<<20)
+	_, err = db.PutString("big", big)
+	assert.Nil(t, err)
+	_, err = db.PutString("old", big)
+	assert.Nil(t, err)
+	_, err = db.PutStringWithTTL("ttl", big, time.Hour)
+	assert.Nil(t, err)
+	_, err = db.PutString("small", "value")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"big", "old", "small", "ttl"}, db.KeysByType(Str))
+
+	blobs := func() []string {
+		files, _ := filepath.Glob(filepath.Join(dir, "blob-*"))
+		return files
+	}
+	assert.Len(t, blobs(), 3)
+
+	f, size, err := db.OpenString("big")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(big)), size)
+	f.Close()
+
+	t.Run("merge removes overwritten blobs", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			_, err = db.PutString("old", "value")
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, db.mergeOldSegments())
+		assert.Len(t, blobs(), 2)
+
+		val, err := db.GetString("big")
+		assert.Nil(t, err)
+		assert.Equal(t, big, val)
+		val, err = db.GetString("old")
+		assert.Nil(t, err)
+		assert.Equal(t, "value", val)
+
+		it := db.Iterate("big")
+		assert.True(t, it.Next())
+		itVal, err := it.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, big, itVal)
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		// An orphan left by a crash is removed on recovery.
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, "blob-100"), []byte("orphan"), 0o600))
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, blobs(), 2)
+
+		val, err := db.GetString("ttl")
+		assert.Nil(t, err)
+		assert.Equal(t, big, val)
+
+		_, err = db.PutString("new", big)
+		assert.Nil(t, err)
+		assert.Len(t, blobs(), 3)
+		val, err = db.GetString("new")
+		assert.Nil(t, err)
+		assert.Equal(t, big, val)
+	})
+}
+
+func TestDb_KeysByType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 10*Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.PutInt64("counter1", 1)
+	assert.Nil(t, err)
+	_, err = db.PutInt64("counter2", 2)
+	assert.Nil(t, err)
+	_, err = db.PutString("name", "gopack")
+	assert.Nil(t, err)
+	_, err = db.PutString("counter2", "overwritten")
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"counter1"}, db.KeysByType(Int))
+	assert.Equal(t, []string{"counter2", "name"}, db.KeysByType(Str))
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, 10*Megabyte)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, []string{"counter1"}, db.KeysByType(Int))
+		assert.Equal(t, []string{"counter2", "name"}, db.KeysByType(Str))
+	})
+}
+
+func TestDb_TTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 110*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.PutString("key1", "persistent")
+	assert.Nil(t, err)
+	_, err = db.PutString("key2", "persistent")
+	assert.Nil(t, err)
+	_, err = db.PutStringWithTTL("key1", "temporary", 20*time.Millisecond)
+	assert.Nil(t, err)
+	_, err = db.PutInt64WithTTL("key3", 1, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(db.segments))
+
+	val, err := db.GetString("key1")
+	assert.Nil(t, err)
+	assert.Equal(t, "temporary", val)
+
+	time.Sleep(30 * time.Millisecond)
+
+	t.Run("expired value", func(t *testing.T) {
+		_, err := db.GetString("key1")
+		assert.Equal(t, ErrNotFound, err)
+
+		intVal, err := db.GetInt64("key3")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), intVal)
+	})
+
+	t.Run("sweep", func(t *testing.T) {
+		assert.Equal(t, int64(0), db.DeadBytes())
+		db.sweepExpired()
+		e := entry{key: "key1", value: "temporary", valueType: Str, expiresAt: 1, seq: 3, writeTime: 1}
+		assert.Equal(t, e.Size().Bytes(), db.DeadBytes())
+		assert.Equal(t, []string{"key2"}, db.KeysByType(Str))
+
+		db.sweepExpired()
+		assert.Equal(t, e.Size().Bytes(), db.DeadBytes())
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, 110*Byte)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := db.GetString("key1")
+		assert.Equal(t, ErrNotFound, err)
+	})
+}
+
+func TestDb_Closed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*2*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.PutString("key1", "value1")
+	assert.Nil(t, err)
+
+	// Writes racing Close either make it or fail, none hangs.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				_, err := db.PutString(fmt.Sprintf("key%d-%d", i, j), "value1")
+				if err == ErrClosed {
+					return
+				}
+				assert.Nil(t, err)
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, db.Close())
+	wg.Wait()
+
+	_, err = db.PutString("key1", "value2")
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, ErrClosed, db.Delete("key1"))
+	_, err = db.GetString("key1")
+	assert.Equal(t, ErrClosed, err)
+	_, _, err = db.GetWithMeta("key1")
+	assert.Equal(t, ErrClosed, err)
+	_, err = db.Describe("key1")
+	assert.Equal(t, ErrClosed, err)
+	_, _, err = db.OpenString("key1")
+	assert.Equal(t, ErrClosed, err)
+	assert.False(t, db.Has("key1"))
+	assert.False(t, db.Iterate("").Next())
+	assert.Equal(t, ErrClosed, db.SetOptions(db.Options()))
+	assert.Equal(t, ErrClosed, db.RestoreTo(db.LastSeq()))
+	assert.Equal(t, ErrClosed, db.WaitForSync(db.LastSeq()))
+	_, err = db.Verify(VerifyCursor{}, 1<<20)
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, ErrClosed, db.Close())
+
+	db, err = NewDb(dir, 40*2*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	val, err := db.GetString("key1")
+	assert.Nil(t, err)
+	assert.Equal(t, "value1", val)
+}
+
+func TestDb_Has(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*2*Byte, WithCompactionPolicy(manualOnly{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.PutString("key1", "value1")
+	assert.Nil(t, err)
+	_, err = db.PutString("key2", "value1")
+	assert.Nil(t, err)
+	_, err = db.PutString("key3", "value1")
+	assert.Nil(t, err)
+	_, err = db.PutStringWithTTL("key2", "value2", time.Millisecond)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Delete("key3"))
+	time.Sleep(5 * time.Millisecond)
+
+	check := func(t *testing.T) {
+		assert.True(t, db.Has("key1"))
+		// Expired and deleted values hide the older ones.
+		assert.False(t, db.Has("key2"))
+		assert.False(t, db.Has("key3"))
+		assert.False(t, db.Has("key4"))
+	}
+	check(t)
+	_, err = db.Compact(context.Background())
+	assert.Nil(t, err)
+	check(t)
+}
+
+func TestDb_SetOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 10*Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	assert.Equal(t, Options{MaxSegmentSize: 10 * Megabyte, SegmentMergeThreshold: 10}, db.Options())
+
+	t.Run("validation", func(t *testing.T) {
+		assert.Error(t, db.SetOptions(Options{MaxSegmentSize: 0, SegmentMergeThreshold: 10}))
+		assert.Error(t, db.SetOptions(Options{MaxSegmentSize: 3 * Bit, SegmentMergeThreshold: 10}))
+		assert.Error(t, db.SetOptions(Options{MaxSegmentSize: Megabyte, SegmentMergeThreshold: 1}))
+		assert.Equal(t, 10*Megabyte, db.Options().MaxSegmentSize)
+	})
+
+	t.Run("segment size", func(t *testing.T) {
+		_, err = db.PutString("key1", "value1")
+		assert.Nil(t, err)
+		_, err = db.PutString("key2", "value2")
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(db.segments))
+
+		opts := Options{MaxSegmentSize: 40 * Byte, SegmentMergeThreshold: 10}
+		assert.Nil(t, db.SetOptions(opts))
+		assert.Equal(t, opts, db.Options())
+
+		_, err = db.PutString("key3", "value3")
+		assert.Nil(t, err)
+		_, err = db.PutString("key4", "value4")
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(db.segments))
+
+		val, err := db.GetString("key1")
+		assert.Nil(t, err)
+		assert.Equal(t, "value1", val)
+	})
+}
+
+func TestDb_Retention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	limit := 40 * 3 * Byte
+	db, err := NewDb(dir, limit, WithRetention(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"old1", "old2", "old3", "new1", "new2", "new3", "cur1"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 3, len(db.segments))
+
+	old := time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, os.Chtimes(db.segments[0].FilePath(), old, old))
+
+	assert.Nil(t, db.mergeOldSegments())
+	assert.Equal(t, 2, len(db.segments))
+	assert.Equal(t, []string{"cur1", "new1", "new2", "new3"}, db.KeysByType(Str))
+
+	_, err = db.GetString("old1")
+	assert.Equal(t, ErrNotFound, err)
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, limit, WithRetention(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.GetString("old2")
+		assert.Equal(t, ErrNotFound, err)
+		val, err := db.GetString("new2")
+		assert.Nil(t, err)
+		assert.Equal(t, "value1", val)
+	})
+}
+
+func TestDb_Stats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*3*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"key1", "key2", "key3", "key1"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	stats := db.Stats()
+	assert.Equal(t, 2, stats.Segments)
+	assert.Equal(t, 3, stats.Keys)
+	assert.Equal(t, int64(4*40), stats.DiskBytes)
+	assert.Equal(t, int64(1), stats.Starts)
+	assert.Equal(t, int64(4), stats.SinceStart.Writes)
+
+	assert.Nil(t, db.mergeOldSegments())
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, 40*3*Byte)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.PutString("key4", "value1")
+		assert.Nil(t, err)
+
+		stats := db.Stats()
+		assert.Equal(t, int64(2), stats.Starts)
+		assert.Equal(t, Counters{Writes: 1, Uptime: stats.SinceStart.Uptime}, stats.SinceStart)
+		assert.Equal(t, int64(5), stats.Lifetime.Writes)
+		assert.Equal(t, int64(1), stats.Lifetime.Compactions)
+		assert.Equal(t, int64(40), stats.Lifetime.BytesReclaimed)
+		assert.Greater(t, stats.Lifetime.Uptime, stats.SinceStart.Uptime)
+	})
+
+	t.Run("system bucket", func(t *testing.T) {
+		e, err := db.latest(statsKey)
+		assert.Nil(t, err)
+		assert.NotNil(t, e)
+		assert.Equal(t, 4, db.Stats().Keys)
+		assert.Nil(t, db.Bucket(systemBucket).Keys())
+		_, err = db.Bucket(systemBucket).PutString("stats", "value1")
+		assert.Equal(t, ErrReservedBucket, err)
+
+		changes, err := db.Changes(0)
+		assert.Nil(t, err)
+		for i := 0; i < 4; i++ {
+			assert.False(t, isSystemKey((<-changes).Key))
+		}
+		_, err = os.Stat(filepath.Join(dir, legacyStatsFileName))
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestDb_LegacyStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	legacy := `{"starts":3,"lifetime":{"writes":7,"compactions":2},"last_seq":7,"compacted_seq":5}`
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, legacyStatsFileName), []byte(legacy), 0o600))
+
+	db, err := NewDb(dir, 10*Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The counters moved to the system bucket.
+	_, err = os.Stat(filepath.Join(dir, legacyStatsFileName))
+	assert.True(t, os.IsNotExist(err))
+	stats := db.Stats()
+	assert.Equal(t, int64(4), stats.Starts)
+	assert.Equal(t, int64(7), stats.Lifetime.Writes)
+	assert.Equal(t, uint64(7), stats.LastSeq)
+	assert.Equal(t, uint64(5), stats.CompactedSeq)
+	assert.Nil(t, db.Close())
+
+	db, err = NewDb(dir, 10*Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stats = db.Stats()
+	assert.Equal(t, int64(5), stats.Starts)
+	assert.Equal(t, int64(2), stats.Lifetime.Compactions)
+	assert.Equal(t, uint64(7), stats.LastSeq)
+}
+
+func TestDb_SegmentStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*3*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"key1", "key2", "key1", "key3"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	segments := db.SegmentStats()
+	if assert.Len(t, segments, 2) {
+		assert.Equal(t, 2, segments[0].Keys)
+		assert.Equal(t, int64(3*40), segments[0].Size)
+		assert.False(t, segments[0].Active)
+		assert.Equal(t, 1, segments[1].Keys)
+		assert.True(t, segments[1].Active)
+		for _, seg := range segments {
+			_, err := os.Stat(filepath.Join(dir, seg.File))
+			assert.Nil(t, err, seg.File)
+		}
+	}
+}
+
+func TestDb_RecoveryProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*3*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key1", "key2", "key3", "key4"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Close())
+
+	var progress [][2]int
+	db, err = NewDb(dir, 40*3*Byte, WithRecoveryProgress(func(recovered, total int) {
+		progress = append(progress, [2]int{recovered, total})
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	assert.Equal(t, [][2]int{{0, 2}, {1, 2}, {2, 2}}, progress)
+}
+
+func TestDb_ConcurrentPutAndMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	limit := 40 * 4 * Byte
+	db, err := NewDb(dir, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const keys, rounds = 20, 50
+	done := make(chan struct{})
+	mergeErr := make(chan error, 1)
+	go func() {
+		defer close(mergeErr)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := db.mergeOldSegments(); err != nil {
+				mergeErr <- err
+				return
+			}
+		}
+	}()
+
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("key%02d", i)
+			_, err = db.PutString(key, fmt.Sprintf("val%03d", round))
+			assert.Nil(t, err)
+		}
+	}
+	close(done)
+	assert.Nil(t, <-mergeErr)
+
+	check := func(t *testing.T) {
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("key%02d", i)
+			val, err := db.GetString(key)
+			assert.Nil(t, err, "Cannot get %s: %s", key, err)
+			assert.Equal(t, fmt.Sprintf("val%03d", rounds-1), val)
+		}
+	}
+	check(t)
+
+	assert.Nil(t, db.mergeOldSegments())
+	check(t)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t)
+}
+
+func TestDb_ConcurrentGetAndMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*2*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"key1", "key2", "key3", "key4", "key5"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	it := db.Iterate("key")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			_, err = db.PutString("key5", "value1")
+			assert.Nil(t, err)
+			assert.Nil(t, db.mergeOldSegments())
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			for it.Next() {
+				val, err := it.Value()
+				assert.Nil(t, err, "Cannot get %s: %s", it.Key(), err)
+				assert.Equal(t, "value1", val)
+			}
+			return
+		default:
+		}
+		val, err := db.GetString("key1")
+		assert.Nil(t, err)
+		assert.Equal(t, "value1", val)
+	}
+}
+
+func TestDb_IteratorIsolation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*2*Byte, WithCompactionPolicy(manualOnly{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	big := strings.Repeat("b", 200)
+	_, err = db.PutString("key1", "value1")
+	assert.Nil(t, err)
+	_, err = db.PutString("key2", "value1")
+	assert.Nil(t, err)
+	_, err = db.PutString("key3", big)
+	assert.Nil(t, err)
+	_, err = db.PutString("key4", "value1")
+	assert.Nil(t, err)
+	it := db.Iterate("key")
+
+	_, err = db.PutString("key1", "value2")
+	assert.Nil(t, err)
+	assert.Nil(t, db.Delete("key2"))
+	_, err = db.PutString("key3", "value2")
+	assert.Nil(t, err)
+	_, err = db.PutString("key5", "value2")
+	assert.Nil(t, err)
+	_, err = db.Compact(context.Background())
+	assert.Nil(t, err)
+	blobs := func() []string {
+		files, _ := filepath.Glob(filepath.Join(dir, "blob-*"))
+		return files
+	}
+	// The blob of key3 is kept for the iterator.
+	assert.Len(t, blobs(), 1)
+
+	values := make(map[string]interface{})
+	for it.Next() {
+		val, err := it.Value()
+		assert.Nil(t, err)
+		values[it.Key()] = val
+	}
+	assert.Equal(t, map[string]interface{}{"key1": "value1", "key2": "value1", "key3": big, "key4": "value1"}, values)
+	assert.Empty(t, blobs())
+
+	t.Run("closed early", func(t *testing.T) {
+		it := db.Iterate("key")
+		assert.True(t, it.Next())
+		_, err = db.PutString("key1", "value3")
+		assert.Nil(t, err)
+		_, err := db.Compact(context.Background())
+		assert.Nil(t, err)
+		val, err := it.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, "value2", val)
+		it.Close()
+		it.Close()
+
+		// Values of a closed iterator are the current ones.
+		val, err = it.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, "value3", val)
+	})
+}
+
+// TestDb_ConcurrentSegmentAccess reads segment state while writes roll and
+// flush segments and merges replace them, for the race detector to check.
+func TestDb_ConcurrentSegmentAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*2*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.PutString("key0", "value1")
+	assert.Nil(t, err)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	run := func(fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				fn()
+			}
+		}()
+	}
+	run(func() {
+		assert.Nil(t, db.mergeOldSegments())
+	})
+	run(func() {
+		val, err := db.GetString("key0")
+		assert.Nil(t, err)
+		assert.Equal(t, "value1", val)
+	})
+	run(func() {
+		for _, seg := range db.segmentSet() {
+			seg.Size()
+			seg.IsSurpassed(db.maxSegmentSize)
+			seg.GetIndex("key0")
+			seg.MemoryUsage()
+			seg.Keys()
+		}
+	})
+	run(func() {
+		snap := db.Snapshot()
+		assert.Nil(t, snap.Each(func(Record) error { return nil }))
+		snap.Release()
+	})
+	run(func() {
+		_, err := db.Verify(VerifyCursor{}, 1<<20)
+		assert.Nil(t, err)
+	})
+
+	for i := 0; i < 100; i++ {
+		_, err = db.PutString(fmt.Sprintf("key%d", i%10), "value1")
+		assert.Nil(t, err)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestDb_Compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*2*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"key1", "key2", "key1", "key2", "key3"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 3, len(db.segments))
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := db.Compact(ctx)
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, 3, len(db.segments))
+		_, err = os.Stat(filepath.Join(dir, shadowDirName))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		stats, err := db.Compact(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, 2, stats.SegmentsMerged)
+		assert.Equal(t, 1, stats.SegmentsWritten)
+		assert.Equal(t, 2, stats.EntriesRewritten)
+		assert.Equal(t, int64(2*40), stats.BytesReclaimed)
+		assert.Equal(t, 2, len(db.segments))
+
+		val, err := db.GetString("key2")
+		assert.Nil(t, err)
+		assert.Equal(t, "value1", val)
+	})
+}
+
+func TestDb_Streaming(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, value := range []string{"small", strings.Repeat("large", 1<<16)} {
+		_, err = db.PutReader("key", strings.NewReader(value), int64(len(value)))
+		assert.Nil(t, err)
+
+		r, err := db.GetReader("key")
+		assert.Nil(t, err)
+		data, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Nil(t, r.Close())
+		assert.Equal(t, value, string(data))
+	}
+
+	_, err = db.PutReader("short", strings.NewReader("abc"), 1<<10)
+	assert.Error(t, err)
+	_, err = db.GetReader("short")
+	assert.Equal(t, ErrNotFound, err)
+
+	_, err = db.PutReader("negative", strings.NewReader("abc"), -1)
+	assert.Equal(t, ErrNegativeSize, err)
+}
+
+func TestDb_UnsupportedEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 10*Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.PutString("key1", "value1")
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	// An entry written by a newer version with a flag unknown here.
+	e := &entry{key: "key2", value: "value2", valueType: Str, seq: 2, flags: 0x80}
+	f, err := os.OpenFile(db.segmentPath(dir, 0), os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(e.Encode())
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	_, err = NewDb(dir, 10*Megabyte)
+	assert.True(t, errors.Is(err, ErrUnsupportedEntry))
+}
+
+func TestDb_SegmentPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files of the embedder sharing the directory are left alone.
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "data-notes"), []byte("notes"), 0o600))
+
+	_, err = NewDb(dir, 40*2*Byte, WithSegmentPrefix("nested/data-"))
+	assert.Error(t, err)
+	_, err = NewDb(dir, 40*2*Byte, WithSegmentMergeThreshold(1))
+	assert.Error(t, err)
+
+	opts := []Option{WithSegmentPrefix("data-"), WithSegmentMergeThreshold(20)}
+	db, err := NewDb(dir, 40*2*Byte, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 20, db.Options().SegmentMergeThreshold)
+	for _, key := range []string{"key1", "key2", "key3"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Close())
+
+	// The active segment leaves its hot index.
+	files, err := filepath.Glob(filepath.Join(dir, "data-*"))
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{
+		filepath.Join(dir, "data-0"), filepath.Join(dir, "data-1"), filepath.Join(dir, "data-1"+hotIndexSuffix),
+		filepath.Join(dir, "data-notes"),
+	}, files)
+
+	db, err = NewDb(dir, 40*2*Byte, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	assert.Equal(t, 2, len(db.segments))
+	val, err := db.GetString("key3")
+	assert.Nil(t, err)
+	assert.Equal(t, "value1", val)
+}
+
+func TestDb_MaxDiskUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Merges append the lifetime counters, the quota leaves room for them.
+	const limit int64 = 40 * 10
+	db, err := NewDb(dir, 40*2*Byte, WithMaxDiskUsage(MemoryUnit(limit)*Byte))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	assert.Nil(t, db.Writable())
+
+	for i := 0; i < 10; i++ {
+		_, err = db.PutString("key1", "value1")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int64(limit), db.diskUsage())
+	assert.Equal(t, ErrDiskQuotaExceeded, db.Writable())
+
+	// Overwritten values are compacted to make room.
+	_, err = db.PutString("key2", "value1")
+	assert.Nil(t, err)
+	assert.True(t, db.diskUsage() <= limit)
+
+	var rejected string
+	for i := 3; i < 20 && rejected == ""; i++ {
+		db.quotaCompacted.Store(0)
+		key := fmt.Sprintf("key%d", i)
+		if _, err := db.PutString(key, "value1"); err != nil {
+			assert.Equal(t, ErrDiskQuotaExceeded, err)
+			rejected = key
+		}
+	}
+	assert.NotEmpty(t, rejected)
+	_, err = db.GetString(rejected)
+	assert.Equal(t, ErrNotFound, err)
+	// The counters flushed by the compaction a rejected write ran may go
+	// over the quota.
+	counters, err := db.statsEntry(db.compactedSeq.Load())
+	assert.Nil(t, err)
+	assert.True(t, db.diskUsage() <= limit+counters.Size().Bytes())
+}
+
+func TestDb_GetWithMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*2*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	before := time.Now()
+	_, err = db.PutString("key1", "value1")
+	assert.Nil(t, err)
+	_, err = db.PutInt64WithTTL("key2", 2, time.Hour)
+	assert.Nil(t, err)
+	_, err = db.PutString("key1", "value2")
+	assert.Nil(t, err)
+
+	val, meta, err := db.GetWithMeta("key1")
+	assert.Nil(t, err)
+	assert.Equal(t, "value2", val)
+	assert.Equal(t, uint64(3), meta.Seq)
+	assert.Equal(t, Str, meta.Type)
+	assert.False(t, meta.UpdatedAt.Before(before))
+	assert.False(t, meta.UpdatedAt.After(time.Now()))
+	assert.True(t, meta.ExpiresAt.IsZero())
+
+	val, meta, err = db.GetWithMeta("key2")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), val)
+	assert.Equal(t, Int, meta.Type)
+	assert.True(t, meta.ExpiresAt.After(meta.UpdatedAt))
+
+	assert.Nil(t, db.Delete("key1"))
+	_, _, err = db.GetWithMeta("key1")
+	assert.Equal(t, ErrNotFound, err)
+	_, _, err = db.GetWithMeta("missing")
+	assert.Equal(t, ErrNotFound, err)
+
+	t.Run("new db process", func(t *testing.T) {
+		_, meta, err := db.GetWithMeta("key2")
+		assert.Nil(t, err)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, 40*2*Byte)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, reopened, err := db.GetWithMeta("key2")
+		assert.Nil(t, err)
+		assert.Equal(t, meta.UpdatedAt.UnixNano(), reopened.UpdatedAt.UnixNano())
+	})
+}
+
+func TestDb_Describe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*2*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	big := strings.Repeat("b", 200)
+	_, err = db.PutString("key1", "value1")
+	assert.Nil(t, err)
+	_, err = db.PutInt64WithTTL("key2", 2, time.Hour)
+	assert.Nil(t, err)
+	_, err = db.PutString("big", big)
+	assert.Nil(t, err)
+	_, err = db.PutString("key3", "value1")
+	assert.Nil(t, err)
+
+	check := func(t *testing.T) {
+		info, err := db.Describe("key1")
+		assert.Nil(t, err)
+		assert.Equal(t, Str, info.Type)
+		assert.Equal(t, int64(6), info.Size)
+		assert.Equal(t, int64(40), info.EntrySize)
+		assert.Equal(t, uint64(1), info.Seq)
+		assert.False(t, info.Blob)
+		assert.False(t, info.UpdatedAt.IsZero())
+		assert.True(t, info.ExpiresAt.IsZero())
+		_, meta, err := db.GetWithMeta("key1")
+		assert.Nil(t, err)
+		assert.Equal(t, meta.UpdatedAt, info.UpdatedAt)
+
+		info, err = db.Describe("key2")
+		assert.Nil(t, err)
+		assert.Equal(t, Int, info.Type)
+		assert.Equal(t, int64(8), info.Size)
+		assert.False(t, info.ExpiresAt.IsZero())
+
+		info, err = db.Describe("big")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(big)), info.Size)
+		assert.True(t, info.Blob)
+
+		info, err = db.Describe("key3")
+		assert.Nil(t, err)
+		assert.Equal(t, db.curSegment().id, info.Segment)
+
+		_, err = db.Describe("missing")
+		assert.Equal(t, ErrNotFound, err)
+	}
+	check(t)
+
+	assert.Nil(t, db.Delete("key3"))
+	_, err = db.Describe("key3")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = db.PutString("key3", "value1")
+	assert.Nil(t, err)
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, 40*2*Byte)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+}
+
+func TestInMemoryDb(t *testing.T) {
+	db, err := NewInMemoryDb(40 * 2 * Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"key1", "key2", "key3", "key4", "key5"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 3, len(db.segments))
+	it := db.Iterate("key")
+
+	big := strings.Repeat("b", 1<<10)
+	_, err = db.PutString("big", big)
+	assert.Nil(t, err)
+	r, err := db.GetReader("big")
+	assert.Nil(t, err)
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, big, string(data))
+	r.Close()
+	_, _, err = db.OpenString("big")
+	assert.Equal(t, ErrNotOnDisk, err)
+
+	for i := 0; i < 5; i++ {
+		_, err = db.PutString("key5", "value2")
+		assert.Nil(t, err)
+	}
+	_, err = db.PutString("big", "small")
+	assert.Nil(t, err)
+	assert.Nil(t, db.mergeOldSegments())
+
+	// Readers of merged segments keep their data.
+	for it.Next() {
+		_, err := it.Value()
+		assert.Nil(t, err)
+	}
+	val, err := db.GetString("key5")
+	assert.Nil(t, err)
+	assert.Equal(t, "value2", val)
+	val, err = db.GetString("big")
+	assert.Nil(t, err)
+	assert.Equal(t, "small", val)
+	files, err := db.backend.List(db.outDir)
+	assert.Nil(t, err)
+	for _, file := range files {
+		assert.False(t, strings.HasPrefix(file.Name(), "blob-"), file.Name())
+	}
+
+	assert.Nil(t, db.RestoreTo(db.CompactedSeq()))
+	report, err := db.Verify(VerifyCursor{}, 1<<20)
+	assert.Nil(t, err)
+	assert.True(t, report.Done)
+	assert.Empty(t, report.Findings)
+}
+
+func TestDb_Range(t *testing.T) {
+	db, err := NewInMemoryDb(40 * 2 * Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	keys := []string{"2024-05-01T09:59", "2024-05-01T10:00", "2024-05-01T10:30", "2024-05-01T11:00", "2024-05-02T10:00"}
+	for _, key := range keys {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	_, err = db.PutString("2024-05-01T10:30", "value2")
+	assert.Nil(t, err)
+	_, err = db.Bucket("logs").PutString("2024-05-01T10:15", "value1")
+	assert.Nil(t, err)
+
+	collect := func(it *Iterator) []string {
+		var res []string
+		for it.Next() {
+			res = append(res, it.Key())
+		}
+		return res
+	}
+	assert.Equal(t, keys[1:3], collect(db.Range("2024-05-01T10", "2024-05-01T11")))
+	assert.Equal(t, keys[3:], collect(db.Range("2024-05-01T11:00", "")))
+	assert.Equal(t, keys, collect(db.Range("", "")))
+	assert.Empty(t, collect(db.Range("2024-05-01T11", "2024-05-01T10")))
+
+	// Deleted keys are not walked, nor brought back by older segments.
+	assert.Nil(t, db.Delete(keys[0]))
+	assert.Equal(t, keys[1:], collect(db.Range("", "")))
+	_, err = db.PutString(keys[0], "value1")
+	assert.Nil(t, err)
+
+	it := db.Range("2024-05-01T10", "2024-05-01T11")
+	it.Seek("2024-05-01T10:01")
+	assert.True(t, it.Next())
+	val, err := it.Value()
+	assert.Nil(t, err)
+	assert.Equal(t, "value2", val)
+	assert.False(t, it.Next())
+
+	t.Run("reverse", func(t *testing.T) {
+		assert.Equal(t, []string{keys[2], keys[1]}, collect(db.Range("2024-05-01T10", "2024-05-01T11").Reverse()))
+		assert.Equal(t, []string{keys[3], keys[2], keys[1]}, collect(db.IterateReverse("2024-05-01T1")))
+
+		it := db.IterateReverse("2024")
+		it.Seek("2024-05-01T10:15")
+		assert.True(t, it.Next())
+		assert.Equal(t, keys[1], it.Key())
+		it.Seek("2024-05-02T10:00")
+		assert.True(t, it.Next())
+		assert.Equal(t, keys[4], it.Key())
+
+		it = db.Bucket("logs").Iterate("").Reverse()
+		it.Seek("2024-05-01T10:15")
+		assert.True(t, it.Next())
+		assert.Equal(t, "2024-05-01T10:15", it.Key())
+		assert.False(t, it.Next())
+		assert.Equal(t, keys, collect(db.Iterate("2024").Reverse().Reverse()))
+	})
+}
+
+func TestDb_PutIfRevision(t *testing.T) {
+	db, err := NewInMemoryDb(40 * 2 * Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rev, err := db.PutIfRevision("key1", "value1", 0)
+	assert.Nil(t, err)
+	_, err = db.PutIfRevision("key1", "value2", 0)
+	assert.Equal(t, ErrConflict, err)
+
+	_, meta, err := db.GetWithMeta("key1")
+	assert.Nil(t, err)
+	assert.Equal(t, rev, meta.Seq)
+
+	_, err = db.PutString("key2", "value1")
+	assert.Nil(t, err)
+	next, err := db.PutIfRevision("key1", "value2", rev)
+	assert.Nil(t, err)
+	assert.Greater(t, next, rev)
+	_, err = db.PutIfRevision("key1", "value3", rev)
+	assert.Equal(t, ErrConflict, err)
+	val, err := db.GetString("key1")
+	assert.Nil(t, err)
+	assert.Equal(t, "value2", val)
+
+	// Deleted keys are created again from revision 0.
+	assert.Nil(t, db.Delete("key1"))
+	_, err = db.PutInt64IfRevision("key1", 5, next)
+	assert.Equal(t, ErrConflict, err)
+	rev, err = db.PutInt64IfRevision("key1", 5, 0)
+	assert.Nil(t, err)
+	forced, err := db.PutIfRevision("key1", "value4", AnyRevision)
+	assert.Nil(t, err)
+	assert.Equal(t, rev+1, forced)
+
+	_, err = db.PutIfRevision("\x00users\x00key1", "value1", 0)
+	assert.Equal(t, ErrReservedKey, err)
+
+	// Expired keys are at revision 0 again.
+	rev, err = db.PutInt64IfRevisionWithTTL("key3", 1, 0, time.Millisecond)
+	assert.Nil(t, err)
+	_, meta, err = db.GetWithMeta("key3")
+	assert.Nil(t, err)
+	assert.False(t, meta.ExpiresAt.IsZero())
+	time.Sleep(2 * time.Millisecond)
+	_, err = db.PutIfRevisionWithTTL("key3", "value1", rev, time.Hour)
+	assert.Equal(t, ErrConflict, err)
+	rev, err = db.PutIfRevisionWithTTL("key3", "value1", 0, time.Hour)
+	assert.Nil(t, err)
+
+	assert.Equal(t, ErrConflict, db.DeleteIfRevision("key3", rev-1))
+	assert.True(t, db.Has("key3"))
+	assert.Nil(t, db.DeleteIfRevision("key3", rev))
+	assert.False(t, db.Has("key3"))
+	assert.Equal(t, ErrReservedKey, db.DeleteIfRevision("\x00users\x00key1", AnyRevision))
+}
+
+// syncCountingBackend counts syncs of the files it creates.
+type syncCountingBackend struct {
+	Backend
+	syncs atomic.Int64
+}
+
+type syncCountingFile struct {
+	File
+	syncs *atomic.Int64
+}
+
+func (b *syncCountingBackend) Create(path string) (File, error) {
+	f, err := b.Backend.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return syncCountingFile{File: f, syncs: &b.syncs}, nil
+}
+
+func (f syncCountingFile) Sync() error {
+	f.syncs.Add(1)
+	return f.File.Sync()
+}
+
+func TestDb_WaitForSync(t *testing.T) {
+	backend := &syncCountingBackend{Backend: newMemBackend()}
+	db, err := NewDb(inMemoryDir, 10*Megabyte, WithBackend(backend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Writes do not wait for syncs.
+	syncs := backend.syncs.Load()
+	for i := 0; i < 10; i++ {
+		seq, err := db.PutString(fmt.Sprintf("key%d", i), "value1")
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(i+1), seq)
+	}
+	assert.Equal(t, syncs, backend.syncs.Load())
+
+	seq, err := db.PutString("key", "value1")
+	assert.Nil(t, err)
+	// The sequence number of a write is the revision of its key.
+	info, err := db.Describe("key")
+	assert.Nil(t, err)
+	assert.Equal(t, info.Seq, seq)
+	assert.Nil(t, db.WaitForSync(seq))
+	assert.Equal(t, syncs+1, backend.syncs.Load())
+	// Earlier writes are synced along.
+	assert.Nil(t, db.WaitForSync(seq-5))
+	assert.Equal(t, syncs+1, backend.syncs.Load())
+
+	assert.NotNil(t, db.WaitForSync(db.LastSeq()+1))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			seq, err := db.PutInt64(fmt.Sprintf("key%d", i), 2)
+			assert.Nil(t, err)
+			assert.Nil(t, db.WaitForSync(seq))
+		}(i)
+	}
+	wg.Wait()
+	assert.True(t, backend.syncs.Load() <= syncs+11)
+}
+
+func TestDb_Barrier(t *testing.T) {
+	db, err := NewInMemoryDb(10 * Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Barrier()
+
+	// Hold the write loop while a write is in flight.
+	db.segmentsMu.Lock()
+	go db.PutString("key1", "value1")
+	assert.Eventually(t, func() bool {
+		db.inflight.mu.Lock()
+		defer db.inflight.mu.Unlock()
+		return len(db.inflight.writes) == 1
+	}, time.Second, time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		db.Barrier()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Barrier returned before the write was taken")
+	case <-time.After(10 * time.Millisecond):
+	}
+	db.segmentsMu.Unlock()
+
+	<-done
+	val, err := db.GetString("key1")
+	assert.Nil(t, err)
+	assert.Equal(t, "value1", val)
+}
+
+func TestDb_Context(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 10*Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.PutString("key1", "value1")
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Writes given up are not applied.
+	_, err = db.PutIfRevisionContext(ctx, "key2", "value2", AnyRevision)
+	assert.Equal(t, context.Canceled, err)
+	_, err = db.PutInt64IfRevisionWithTTLContext(ctx, "key2", 2, AnyRevision, time.Hour)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, db.DeleteIfRevisionContext(ctx, "key1", AnyRevision))
+	var b Batch
+	b.PutString("key2", "value2")
+	n, err := db.WriteContext(ctx, &b)
+	assert.Equal(t, context.Canceled, err)
+	assert.Zero(t, n)
+	assert.False(t, db.Has("key2"))
+	assert.True(t, db.Has("key1"))
+
+	_, _, err = db.GetWithMetaContext(ctx, "key1")
+	assert.Equal(t, context.Canceled, err)
+	_, err = db.GetStringContext(ctx, "key1")
+	assert.Equal(t, context.Canceled, err)
+
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelTimeout()
+	rev, err := db.PutIfRevisionContext(timeout, "key2", "value2", 0)
+	assert.Nil(t, err)
+	_, meta, err := db.GetWithMetaContext(timeout, "key2")
+	assert.Nil(t, err)
+	assert.Equal(t, rev, meta.Seq)
+}
+
+func TestDb_KeyRules(t *testing.T) {
+	errUpper := errors.New("upper case")
+	db, err := NewInMemoryDb(10*Megabyte,
+		WithMaxKeyLength(8),
+		WithDisallowedKeyBytes(" \n"),
+		WithKeyValidator(func(key string) error {
+			if strings.ToLower(key) != key {
+				return errUpper
+			}
+			return nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.PutString("key1", "value1")
+	assert.Nil(t, err)
+	for _, key := range []string{"verylongkey", "key 1", "key\n", "Key1"} {
+		_, err := db.PutString(key, "value1")
+		assert.ErrorIs(t, err, ErrInvalidKey, key)
+		_, err = db.PutIfRevision(key, "value1", AnyRevision)
+		assert.ErrorIs(t, err, ErrInvalidKey, key)
+		_, err = db.Bucket("b").PutInt64(key, 1)
+		assert.ErrorIs(t, err, ErrInvalidKey, key)
+		_, err = db.GetString(key)
+		assert.Equal(t, ErrNotFound, err)
+	}
+	_, err = db.PutInt64WithTTL("Key1", 1, time.Hour)
+	assert.ErrorIs(t, err, errUpper)
+	_, err = db.PutString("\x00key", "value1")
+	assert.Equal(t, ErrReservedKey, err)
+
+	// Bucket keys are checked without the bucket name.
+	_, err = db.Bucket("bucket").PutString("key1", "value1")
+	assert.Nil(t, err)
+}
+
+func TestDb_CorruptedSizeField(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 10*Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.PutString("key1", "value1")
+	assert.Nil(t, err)
+	path := db.segments[0].FilePath()
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.Remove(path+hotIndexSuffix))
+
+	// An entry claiming 4 GB is refused, not allocated.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xff, 3, 0, 0, 0, 'k', 'e', 'y', 0, 0, 0, 0, 0})
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	_, err = NewDb(dir, 10*Megabyte)
+	assert.True(t, errors.Is(err, ErrCorrupted), "%v", err)
+}
+
+func TestDb_Batch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*2*Byte, WithCompactionPolicy(manualOnly{}), WithMaxKeyLength(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.PutString("key0", "value0")
+	assert.Nil(t, err)
+
+	var b Batch
+	b.PutString("key1", "value1")
+	b.PutString("key2", "value2")
+	b.PutInt64("key3", 3)
+	b.PutString("key4", "value4")
+	b.Delete("key0")
+	n, err := db.Write(&b)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	// The batch rolls over segments as single writes do.
+	assert.True(t, len(db.segments) > 1, "%d segments", len(db.segments))
+
+	values, err := db.GetMany([]string{"key0", "key1", "key3", "key4", "missing"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"key1": "value1", "key3": int64(3), "key4": "value4"}, values)
+
+	t.Run("Invalid key", func(t *testing.T) {
+		var b Batch
+		b.PutString("key5", "value5")
+		b.PutString("too-long-key", "value")
+		n, err := db.Write(&b)
+		assert.True(t, errors.Is(err, ErrInvalidKey), "%v", err)
+		assert.Equal(t, 0, n)
+		assert.False(t, db.Has("key5"))
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		n, err := db.Write(&Batch{})
+		assert.Nil(t, err)
+		assert.Equal(t, 0, n)
+	})
+}
+
+func TestDb_Increment(t *testing.T) {
+	db, err := NewInMemoryDb(Kilobyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	n, err := db.Increment("counter", 5)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), n)
+
+	// Increments racing each other are all applied, across segments too.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := db.Increment("counter", 1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	n, err = db.GetInt64("counter")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5+8*50), n)
+	assert.True(t, len(db.segments) > 1, "%d segments", len(db.segments))
+
+	n, err = db.Increment("counter", -405)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	_, err = db.PutInt64WithTTL("expiring", math.MaxInt64, time.Hour)
+	assert.Nil(t, err)
+	_, err = db.Increment("expiring", 1)
+	assert.Equal(t, ErrOverflow, err)
+	_, err = db.Increment("expiring", -1)
+	assert.Nil(t, err)
+	_, meta, err := db.GetWithMeta("expiring")
+	assert.Nil(t, err)
+	assert.False(t, meta.ExpiresAt.IsZero())
+
+	_, err = db.PutString("name", "value1")
+	assert.Nil(t, err)
+	_, err = db.Increment("name", 1)
+	assert.Equal(t, ErrNotInt64, err)
+	_, err = db.Increment("\x00users\x00key1", 1)
+	assert.Equal(t, ErrReservedKey, err)
+}
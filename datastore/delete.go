@@ -0,0 +1,55 @@
+package datastore
+
+import "sort"
+
+// tombstoneExpiry is the expiration time of entries written by Delete. Such
+// entries are expired from the start, so they hide older values until merge
+// drops them all.
+const tombstoneExpiry = 1
+
+// Delete removes the key. Deleting a key which does not exist is not an
+// error.
+func (db *Db) Delete(key string) error {
+	if isBucketKey(key) {
+		return ErrReservedKey
+	}
+	return db.delete(key)
+}
+
+// DeleteRange deletes all the keys starting with prefix, keys of buckets
+// aside. The keys are deleted in a single batch written as Write writes
+// one, keys written after they are listed survive. The space is reclaimed
+// by merges, as with other overwritten values.
+func (db *Db) DeleteRange(prefix string) error {
+	if isBucketKey(prefix) {
+		return ErrReservedKey
+	}
+	return db.deleteRange(prefix)
+}
+
+func (db *Db) delete(key string) error {
+	return db.putUnknown(&entry{key: key, value: "", valueType: Str, expiresAt: tombstoneExpiry})
+}
+
+func (db *Db) deleteRange(prefix string) error {
+	var keys []string
+	for key := range db.liveKeys(prefix) {
+		if prefix == "" && isBucketKey(key) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b Batch
+	for _, key := range keys {
+		b.Delete(key)
+	}
+	if b.Len() > 0 {
+		var written int
+		if err := db.put(PutRequest{batch: b.entries, written: &written}); err != nil {
+			return err
+		}
+	}
+	db.compactInBackground()
+	return nil
+}
@@ -4,41 +4,222 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
 )
 
+type ValueType int
+
 const (
-	Str = iota
+	Str ValueType = iota
 	Int
 )
 
+func (t ValueType) String() string {
+	switch t {
+	case Str:
+		return "string"
+	case Int:
+		return "int64"
+	}
+	return fmt.Sprintf("ValueType(%d)", int(t))
+}
+
+const (
+	// ttlFlag is set in the type byte of entries followed by an expiration
+	// time.
+	ttlFlag = 0x80
+	// seqFlag is set in the type byte of entries followed by a sequence
+	// number, it comes after the expiration time.
+	seqFlag = 0x20
+	// flagsFlag is set in the type byte of entries followed by a flags byte,
+	// it comes last.
+	flagsFlag = 0x10
+
+	flagBits = ttlFlag | blobFlag | seqFlag | flagsFlag
+)
+
+// ErrUnsupportedEntry is returned for entries using features unknown to this
+// version, which are written by a newer one.
+var ErrUnsupportedEntry = fmt.Errorf("unsupported entry")
+
+// ErrCorrupted is returned for entries whose size fields do not add up, as
+// damaged files hold. Decoding never trusts them for more than a bounds
+// check.
+var ErrCorrupted = fmt.Errorf("corrupted entry")
+
+// maxEntrySize bounds the size of an entry, larger string values go to blob
+// files. Entries claiming more are corrupted, nothing allocates that much
+// for them.
+const maxEntrySize = 1 << 30
+
+// checkEntrySize fails with ErrCorrupted if no entry can be size bytes.
+func checkEntrySize(size int64) error {
+	if size < 13 || size > maxEntrySize {
+		return fmt.Errorf("%w: size %d out of bounds", ErrCorrupted, size)
+	}
+	return nil
+}
+
+// checkEntryEnd fails with ErrCorrupted if r ends before the entry of size
+// bytes at pos does, so no large buffer is allocated for what is not there.
+// Small entries are not checked, reading them tells as cheaply.
+func checkEntryEnd(r io.ReaderAt, pos, size int64) error {
+	if size <= bufSize {
+		return nil
+	}
+	var last [1]byte
+	n, err := r.ReadAt(last[:], pos+size-1)
+	if n == 1 {
+		return nil
+	}
+	if err == io.EOF {
+		return fmt.Errorf("%w: truncated at %d", ErrCorrupted, pos)
+	}
+	return err
+}
+
+// entryFlags are the bits of the flags byte. Features changing how an entry
+// is read get a flag there instead of changing the format once more.
+type entryFlags uint8
+
+const (
+	// writeTimeFlag is set for entries followed by the write time, it comes
+	// after the flags byte.
+	writeTimeFlag entryFlags = 0x01
+	// principalFlag is set for entries followed by the principal of the
+	// write, a length byte and as many bytes. It comes after the write time.
+	principalFlag entryFlags = 0x02
+
+	// knownFlags are the flags this version understands. Entries with other
+	// flags are rejected rather than misread.
+	knownFlags = writeTimeFlag | principalFlag
+)
+
+func (f entryFlags) has(flag entryFlags) bool {
+	return f&flag == flag
+}
+
+func (f entryFlags) validate() error {
+	if unknown := f &^ knownFlags; unknown != 0 {
+		return fmt.Errorf("%w: flags %#x", ErrUnsupportedEntry, uint8(unknown))
+	}
+	return nil
+}
+
 type entry struct {
 	key       string
 	value     interface{}
-	valueType int
+	valueType ValueType
+	// expiresAt is a unix time in nanoseconds, zero for entries without TTL.
+	expiresAt int64
+	// blob is set for string values stored in a blob file.
+	blob *blobRef
+	// seq is the sequence number of the write, zero for entries written
+	// before sequence numbers were introduced.
+	seq uint64
+	// flags are stored only if any is set. Flags telling which fields are
+	// stored, such as writeTimeFlag and principalFlag, are not kept here.
+	flags entryFlags
+	// writeTime is a unix time in nanoseconds, zero for entries written
+	// before write times were introduced.
+	writeTime int64
+	// principal is who the write is attributed to, see WithPrincipal. It is
+	// empty for writes of no one in particular.
+	principal string
+}
+
+// storedFlags returns the flags byte of the encoded entry.
+func (e *entry) storedFlags() entryFlags {
+	flags := e.flags
+	if e.writeTime != 0 {
+		flags |= writeTimeFlag
+	}
+	if e.principal != "" {
+		flags |= principalFlag
+	}
+	return flags
+}
+
+func (e *entry) hasFlag(flag entryFlags) bool {
+	return e.flags.has(flag)
+}
+
+func (e *entry) setFlag(flag entryFlags) {
+	e.flags |= flag
+}
+
+func (e *entry) expired(now int64) bool {
+	return e.expiresAt != 0 && e.expiresAt <= now
 }
 
 func (e *entry) Encode() []byte {
 	kl := len(e.key)
 	var vl int
-	if e.valueType == Int {
+	if e.blob != nil {
+		vl = blobRefSize
+	} else if e.valueType == Int {
 		vl = 8
 	} else {
 		vl = len(e.value.(string))
 	}
 	size := kl + vl + 13
+	trailer := kl + 13 + vl
+	if e.expiresAt != 0 {
+		size += 8
+	}
+	if e.seq != 0 {
+		size += 8
+	}
+	flags := e.storedFlags()
+	if flags != 0 {
+		size++
+	}
+	if flags.has(writeTimeFlag) {
+		size += 8
+	}
+	if flags.has(principalFlag) {
+		size += 1 + len(e.principal)
+	}
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
 	copy(res[8:], e.key)
 
 	if _, ok := e.value.(int64); ok {
-		res[kl+8] = Int
+		res[kl+8] = byte(Int)
 	} else {
-		res[kl+8] = Str
+		res[kl+8] = byte(Str)
+	}
+
+	if e.expiresAt != 0 {
+		res[kl+8] |= ttlFlag
+		binary.LittleEndian.PutUint64(res[trailer:], uint64(e.expiresAt))
+		trailer += 8
+	}
+	if e.seq != 0 {
+		res[kl+8] |= seqFlag
+		binary.LittleEndian.PutUint64(res[trailer:], e.seq)
+		trailer += 8
+	}
+	if flags != 0 {
+		res[kl+8] |= flagsFlag
+		res[trailer] = byte(flags)
+		trailer++
+	}
+	if flags.has(writeTimeFlag) {
+		binary.LittleEndian.PutUint64(res[trailer:], uint64(e.writeTime))
+		trailer += 8
+	}
+	if flags.has(principalFlag) {
+		res[trailer] = byte(len(e.principal))
+		copy(res[trailer+1:], e.principal)
 	}
 
 	binary.LittleEndian.PutUint32(res[kl+9:], uint32(vl))
-	if e.valueType == Int {
+	if e.blob != nil {
+		res[kl+8] |= blobFlag
+		e.blob.encode(res[kl+13:])
+	} else if e.valueType == Int {
 		binary.LittleEndian.PutUint64(res[kl+13:], uint64(e.value.(int64)))
 	} else {
 		v := e.value.(string)
@@ -49,36 +230,221 @@ func (e *entry) Encode() []byte {
 }
 
 func (e *entry) Size() MemoryUnit {
-	if e.valueType == Int {
-		return MemoryUnit((len(e.key) + 13 + 8) * 8)
+	bytes := len(e.key) + 13
+	if e.blob != nil {
+		bytes += blobRefSize
+	} else if e.valueType == Int {
+		bytes += 8
+	} else {
+		bytes += len(e.value.(string))
+	}
+	if e.expiresAt != 0 {
+		bytes += 8
+	}
+	if e.seq != 0 {
+		bytes += 8
+	}
+	flags := e.storedFlags()
+	if flags != 0 {
+		bytes++
 	}
-	bytes := len(e.key) + len(e.value.(string)) + 13
-	return MemoryUnit(bytes * 8)
+	if flags.has(writeTimeFlag) {
+		bytes += 8
+	}
+	if flags.has(principalFlag) {
+		bytes += 1 + len(e.principal)
+	}
+	return FromBytes(int64(bytes))
 }
 
-func (e *entry) Decode(input []byte) {
-	typeBuf := make([]byte, 4)
-	copy(typeBuf, input[:4])
-
-	kl := binary.LittleEndian.Uint32(input[4:])
-	keyBuf := make([]byte, kl)
-	copy(keyBuf, input[8:kl+8])
-	e.key = string(keyBuf)
+// Decode fails with ErrUnsupportedEntry for unknown value types and flags,
+// and with ErrCorrupted if the lengths of the input do not match.
+func (e *entry) Decode(input []byte) error {
+	if len(input) < 13 {
+		return fmt.Errorf("%w: %d bytes", ErrCorrupted, len(input))
+	}
+	// Conversions to strings copy, input may be reused once decoded.
+	kl := int64(binary.LittleEndian.Uint32(input[4:]))
+	if kl+13 > int64(len(input)) {
+		return fmt.Errorf("%w: key length %d", ErrCorrupted, kl)
+	}
+	e.key = string(input[8 : kl+8])
 
-	typeFlag := input[kl+8]
+	typeByte := input[kl+8]
+	typeFlag := ValueType(typeByte &^ flagBits)
+	if typeFlag != Str && typeFlag != Int {
+		return fmt.Errorf("%w: %s", ErrUnsupportedEntry, typeFlag)
+	}
 
-	vl := binary.LittleEndian.Uint32(input[kl+9:])
+	vl := int64(binary.LittleEndian.Uint32(input[kl+9:]))
+	if err := checkValueLength(typeByte, vl, int64(len(input))-kl-13); err != nil {
+		return err
+	}
+	if err := e.decodeTrailer(input[kl+8], input[kl+13+vl:]); err != nil {
+		return err
+	}
 
-	if typeFlag == Int {
+	e.blob = nil
+	if input[kl+8]&blobFlag != 0 {
+		e.valueType = Str
+		e.value = ""
+		e.blob = decodeBlobRef(input[kl+13:])
+	} else if typeFlag == Int {
 		e.valueType = Int
 		val := binary.LittleEndian.Uint64(input[kl+13 : kl+13+vl])
 		e.value = int64(val)
 	} else {
 		e.valueType = Str
-		valBuf := make([]byte, vl)
-		copy(valBuf, input[kl+13:kl+13+vl])
-		e.value = string(valBuf)
+		e.value = string(input[kl+13 : kl+13+vl])
+	}
+	return nil
+}
+
+// checkValueLength fails with ErrCorrupted if the value length vl of an
+// entry with the type byte does not fit the room left for it, or its type.
+func checkValueLength(typeByte byte, vl, room int64) error {
+	switch {
+	case vl > room:
+	case typeByte&blobFlag != 0:
+		if vl == blobRefSize {
+			return nil
+		}
+	case ValueType(typeByte&^flagBits) == Int:
+		if vl == 8 {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w: value length %d", ErrCorrupted, vl)
+}
+
+// decodeTrailer decodes the fields following the value, which the type byte
+// tells are there.
+func (e *entry) decodeTrailer(typeByte byte, trailer []byte) error {
+	truncated := fmt.Errorf("%w: truncated trailer", ErrCorrupted)
+	e.expiresAt = 0
+	if typeByte&ttlFlag != 0 {
+		if len(trailer) < 8 {
+			return truncated
+		}
+		e.expiresAt = int64(binary.LittleEndian.Uint64(trailer))
+		trailer = trailer[8:]
+	}
+	e.seq = 0
+	if typeByte&seqFlag != 0 {
+		if len(trailer) < 8 {
+			return truncated
+		}
+		e.seq = binary.LittleEndian.Uint64(trailer)
+		trailer = trailer[8:]
+	}
+	e.flags = 0
+	e.writeTime = 0
+	e.principal = ""
+	if typeByte&flagsFlag != 0 {
+		if len(trailer) < 1 {
+			return truncated
+		}
+		flags := entryFlags(trailer[0])
+		if err := flags.validate(); err != nil {
+			return err
+		}
+		trailer = trailer[1:]
+		if flags.has(writeTimeFlag) {
+			if len(trailer) < 8 {
+				return truncated
+			}
+			e.writeTime = int64(binary.LittleEndian.Uint64(trailer))
+			trailer = trailer[8:]
+		}
+		if flags.has(principalFlag) {
+			if len(trailer) < 1 || len(trailer) < 1+int(trailer[0]) {
+				return truncated
+			}
+			e.principal = string(trailer[1 : 1+int(trailer[0])])
+		}
+		e.flags = flags &^ (writeTimeFlag | principalFlag)
+	}
+	return nil
+}
+
+// readEntryHeaderAt decodes the entry at pos but its value, only the blob
+// reference of values in blob files is read. It returns the length of the
+// value in the segment file as well.
+func readEntryHeaderAt(r io.ReaderAt, pos int64) (*entry, int64, error) {
+	var header [8]byte
+	if _, err := r.ReadAt(header[:], pos); err != nil {
+		return nil, 0, err
+	}
+	size := int64(binary.LittleEndian.Uint32(header[:]))
+	kl := int64(binary.LittleEndian.Uint32(header[4:]))
+	if err := checkEntrySize(size); err != nil {
+		return nil, 0, err
+	}
+	if err := checkEntryEnd(r, pos, size); err != nil {
+		return nil, 0, err
+	}
+	if kl+13 > size {
+		return nil, 0, fmt.Errorf("%w: key length %d at %d", ErrCorrupted, kl, pos)
+	}
+	head := make([]byte, kl+5)
+	if _, err := r.ReadAt(head, pos+8); err != nil {
+		return nil, 0, err
+	}
+	e := &entry{key: string(head[:kl])}
+	typeByte := head[kl]
+	vl := int64(binary.LittleEndian.Uint32(head[kl+1:]))
+	if err := checkValueLength(typeByte, vl, size-kl-13); err != nil {
+		return nil, 0, err
+	}
+
+	switch typeFlag := ValueType(typeByte &^ flagBits); {
+	case typeByte&blobFlag != 0:
+		var ref [blobRefSize]byte
+		if _, err := r.ReadAt(ref[:], pos+kl+13); err != nil {
+			return nil, 0, err
+		}
+		e.valueType = Str
+		e.blob = decodeBlobRef(ref[:])
+	case typeFlag == Str || typeFlag == Int:
+		e.valueType = typeFlag
+	default:
+		return nil, 0, fmt.Errorf("%w: %s", ErrUnsupportedEntry, typeFlag)
+	}
+
+	trailer := make([]byte, size-kl-13-vl)
+	if _, err := r.ReadAt(trailer, pos+kl+13+vl); err != nil {
+		return nil, 0, err
+	}
+	if err := e.decodeTrailer(typeByte, trailer); err != nil {
+		return nil, 0, err
+	}
+	return e, vl, nil
+}
+
+// readEntryAt reads and decodes the whole entry at pos.
+func readEntryAt(r io.ReaderAt, pos int64) (*entry, error) {
+	var header [4]byte
+	if _, err := r.ReadAt(header[:], pos); err != nil {
+		return nil, err
+	}
+	size := int64(binary.LittleEndian.Uint32(header[:]))
+	if err := checkEntrySize(size); err != nil {
+		return nil, err
+	}
+	if err := checkEntryEnd(r, pos, size); err != nil {
+		return nil, err
 	}
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, pos); err != nil {
+		return nil, err
+	}
+	e := new(entry)
+	if err := e.Decode(data); err != nil {
+		return nil, err
+	}
+	return e, nil
 }
 
 func readValue(in *bufio.Reader) (interface{}, error) {
@@ -86,7 +452,14 @@ func readValue(in *bufio.Reader) (interface{}, error) {
 	if err != nil {
 		return "", err
 	}
+	size := int64(binary.LittleEndian.Uint32(header))
+	if err := checkEntrySize(size); err != nil {
+		return "", err
+	}
 	keySize := int(binary.LittleEndian.Uint32(header[4:]))
+	if int64(keySize)+13 > size {
+		return "", fmt.Errorf("%w: key length %d", ErrCorrupted, keySize)
+	}
 	_, err = in.Discard(keySize + 8)
 	if err != nil {
 		return "", err
@@ -102,26 +475,36 @@ func readValue(in *bufio.Reader) (interface{}, error) {
 		return "", err
 	}
 	valSize := int(binary.LittleEndian.Uint32(header))
+	if err := checkValueLength(typeFlag, int64(valSize), size-int64(keySize)-13); err != nil {
+		return "", err
+	}
 	_, err = in.Discard(4)
 	if err != nil {
 		return "", err
 	}
 
-	if typeFlag == Int {
+	if typeFlag&blobFlag != 0 {
+		header, err = in.Peek(blobRefSize)
+		if err != nil {
+			return "", err
+		}
+		return decodeBlobRef(header), nil
+	} else if ValueType(typeFlag&^flagBits) == Int {
 		header, err = in.Peek(8)
 		if err != nil {
 			return 0, err
 		}
 		return int64(binary.LittleEndian.Uint64(header)), nil
 	} else {
+		// Values may be larger than the buffer of the reader.
 		data := make([]byte, valSize)
-		n, err := in.Read(data)
+		n, err := io.ReadFull(in, data)
+		if err == io.ErrUnexpectedEOF {
+			return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+		}
 		if err != nil {
 			return "", err
 		}
-		if n != valSize {
-			return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
-		}
 		return string(data), nil
 	}
 }
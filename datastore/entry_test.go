@@ -3,13 +3,17 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
 func Test_EntryString(t *testing.T) {
 	t.Run("Encode", func(t *testing.T) {
-		e := entry{"key", "value", Str}
+		e := entry{key: "key", value: "value", valueType: Str}
 		e.Decode(e.Encode())
 		assert.Equal(t, Str, e.valueType)
 		assert.Equal(t, "key", e.key)
@@ -17,7 +21,7 @@ func Test_EntryString(t *testing.T) {
 	})
 
 	t.Run("Decode", func(t *testing.T) {
-		e := entry{"key", "test-value", Str}
+		e := entry{key: "key", value: "test-value", valueType: Str}
 		data := e.Encode()
 		v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
 		s, ok := v.(string)
@@ -26,12 +30,94 @@ func Test_EntryString(t *testing.T) {
 		assert.Equal(t, "test-value", s)
 		assert.Equal(t, e.Size(), MemoryUnit((13+len("test-value")+len("key"))*8))
 	})
+
+	t.Run("Decode larger than the buffer", func(t *testing.T) {
+		value := strings.Repeat("v", 3*4096)
+		e := entry{key: "key", value: value, valueType: Str}
+		v, err := readValue(bufio.NewReader(bytes.NewReader(e.Encode())))
+		assert.Nil(t, err)
+		assert.Equal(t, value, v)
+	})
+}
+
+func Test_EntryTTL(t *testing.T) {
+	e := entry{key: "key", value: "value", valueType: Str, expiresAt: 1700000000000000000}
+	data := e.Encode()
+	assert.Equal(t, e.Size().Bytes(), int64(len(data)))
+
+	var decoded entry
+	decoded.Decode(data)
+	assert.Equal(t, e, decoded)
+
+	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", v)
+}
+
+func Test_EntryBlob(t *testing.T) {
+	ref := &blobRef{id: 7, offset: 0, length: 1 << 30}
+	e := entry{key: "key", value: "", valueType: Str, expiresAt: 1700000000000000000, blob: ref}
+	data := e.Encode()
+	assert.Equal(t, e.Size().Bytes(), int64(len(data)))
+
+	var decoded entry
+	decoded.Decode(data)
+	assert.Equal(t, e, decoded)
+
+	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	assert.Nil(t, err)
+	assert.Equal(t, ref, v)
+}
+
+func Test_EntrySeq(t *testing.T) {
+	e := entry{key: "key", value: int64(1), valueType: Int, expiresAt: 1700000000000000000, seq: 42}
+	data := e.Encode()
+	assert.Equal(t, e.Size().Bytes(), int64(len(data)))
+
+	var decoded entry
+	decoded.Decode(data)
+	assert.Equal(t, e, decoded)
+
+	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), v)
+}
+
+func Test_EntryWriteTime(t *testing.T) {
+	e := entry{key: "key", value: "value", valueType: Str, seq: 1, writeTime: 1700000000000000000}
+	data := e.Encode()
+	assert.Equal(t, int64(38), e.Size().Bytes())
+	assert.Equal(t, e.Size().Bytes(), int64(len(data)))
+
+	var decoded entry
+	assert.Nil(t, decoded.Decode(data))
+	assert.Equal(t, e, decoded)
+	assert.False(t, decoded.hasFlag(writeTimeFlag))
+}
+
+func Test_EntryPrincipal(t *testing.T) {
+	e := entry{key: "key", value: "value", valueType: Str, seq: 1, writeTime: 1700000000000000000, principal: "alice"}
+	data := e.Encode()
+	assert.Equal(t, int64(44), e.Size().Bytes())
+	assert.Equal(t, e.Size().Bytes(), int64(len(data)))
+
+	var decoded entry
+	assert.Nil(t, decoded.Decode(data))
+	assert.Equal(t, e, decoded)
+	assert.False(t, decoded.hasFlag(principalFlag))
+	assert.Equal(t, int64(len(data)), encodedSize(data, int64(len(e.key))))
+
+	// The principal goes without the write time as well.
+	e = entry{key: "key", value: int64(1), valueType: Int, principal: "bob"}
+	decoded = entry{}
+	assert.Nil(t, decoded.Decode(e.Encode()))
+	assert.Equal(t, e, decoded)
 }
 
 func Test_EntryInt64(t *testing.T) {
 	t.Run("Encode", func(t *testing.T) {
 		val := int64(123)
-		e := entry{"key", val, Int}
+		e := entry{key: "key", value: val, valueType: Int}
 		e.Decode(e.Encode())
 		assert.Equal(t, Int, e.valueType)
 		assert.Equal(t, "key", e.key)
@@ -40,7 +126,7 @@ func Test_EntryInt64(t *testing.T) {
 
 	t.Run("Encode negative", func(t *testing.T) {
 		val := int64(-123)
-		e := entry{"key", val, Int}
+		e := entry{key: "key", value: val, valueType: Int}
 		e.Decode(e.Encode())
 		assert.Equal(t, Int, e.valueType)
 		assert.Equal(t, "key", e.key)
@@ -48,7 +134,7 @@ func Test_EntryInt64(t *testing.T) {
 	})
 
 	t.Run("Decode", func(t *testing.T) {
-		e := entry{"key", int64(123), Int}
+		e := entry{key: "key", value: int64(123), valueType: Int}
 		data := e.Encode()
 		v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
 		s, ok := v.(int64)
@@ -57,3 +143,136 @@ func Test_EntryInt64(t *testing.T) {
 		assert.Equal(t, int64(123), s)
 	})
 }
+
+func Test_EntryFlags(t *testing.T) {
+	e := entry{key: "key", value: "value", valueType: Str, seq: 1}
+	assert.Equal(t, int64(29), e.Size().Bytes())
+	assert.False(t, e.hasFlag(0x80))
+
+	e.setFlag(0x80)
+	assert.True(t, e.hasFlag(0x80))
+	data := e.Encode()
+	assert.Equal(t, int64(30), e.Size().Bytes())
+	assert.Equal(t, e.Size().Bytes(), int64(len(data)))
+
+	var decoded entry
+	err := decoded.Decode(data)
+	assert.True(t, errors.Is(err, ErrUnsupportedEntry))
+
+	// Readers of the value do not need to know about flags.
+	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", v)
+
+	data = (&entry{key: "key", value: "value", valueType: Str}).Encode()
+	data[len("key")+8] |= 0x0f
+	assert.True(t, errors.Is(decoded.Decode(data), ErrUnsupportedEntry))
+}
+
+func Test_EntryCorrupted(t *testing.T) {
+	entries := []entry{
+		{key: "key", value: "value", valueType: Str, expiresAt: 1, seq: 2, writeTime: 3, principal: "alice"},
+		{key: "key", value: int64(1), valueType: Int, seq: 2},
+		{key: "key", valueType: Str, blob: &blobRef{id: 1, length: 5}, seq: 2},
+	}
+	for _, e := range entries {
+		data := e.Encode()
+		// Every truncation of the entry with its size field fixed up is
+		// rejected, not read past.
+		for n := 0; n < len(data); n++ {
+			input := append([]byte(nil), data[:n]...)
+			if n >= 4 {
+				binary.LittleEndian.PutUint32(input, uint32(n))
+			}
+			var decoded entry
+			assert.True(t, errors.Is(decoded.Decode(input), ErrCorrupted), "%d of %d bytes", n, len(data))
+		}
+	}
+
+	// Size fields claiming more than an entry can be are not allocated.
+	data := entries[0].Encode()
+	binary.LittleEndian.PutUint32(data, 0xffffffff)
+	_, err := readEntryAt(bytes.NewReader(data), 0)
+	assert.True(t, errors.Is(err, ErrCorrupted))
+	_, err = readValue(bufio.NewReader(bytes.NewReader(data)))
+	assert.True(t, errors.Is(err, ErrCorrupted))
+	_, _, err = readEntryHeaderAt(bytes.NewReader(data), 0)
+	assert.True(t, errors.Is(err, ErrCorrupted))
+
+	data = entries[0].Encode()
+	binary.LittleEndian.PutUint32(data[4:], 0xffffffff)
+	_, err = readValue(bufio.NewReader(bytes.NewReader(data)))
+	assert.True(t, errors.Is(err, ErrCorrupted))
+	data = entries[0].Encode()
+	binary.LittleEndian.PutUint32(data[4+4+3+1:], 0xffffffff)
+	_, err = readValue(bufio.NewReader(bytes.NewReader(data)))
+	assert.True(t, errors.Is(err, ErrCorrupted))
+	_, _, err = readEntryHeaderAt(bytes.NewReader(data), 0)
+	assert.True(t, errors.Is(err, ErrCorrupted))
+}
+
+func FuzzEntry_Decode(f *testing.F) {
+	for _, e := range []entry{
+		{key: "key", value: "value", valueType: Str},
+		{key: "key", value: int64(1), valueType: Int, expiresAt: 1, seq: 2, writeTime: 3, principal: "alice"},
+		{key: "key", valueType: Str, blob: &blobRef{id: 1, length: 5}},
+	} {
+		f.Add(e.Encode())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var e entry
+		if e.Decode(data) == nil {
+			readValue(bufio.NewReader(bytes.NewReader(data)))
+		}
+		readEntryAt(bytes.NewReader(data), 0)
+		readEntryHeaderAt(bytes.NewReader(data), 0)
+	})
+}
+
+func TestEntryIterator(t *testing.T) {
+	db, err := NewInMemoryDb(10 * Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"key1", "key2", "key3"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	seg := db.segments[0]
+
+	it := newEntryIterator(context.Background(), seg)
+	var keys []string
+	for e, err := it.Next(); e != nil || err != nil; e, err = it.Next() {
+		assert.Nil(t, err)
+		keys = append(keys, e.key)
+	}
+	assert.Equal(t, []string{"key1", "key2", "key3"}, keys)
+	e, err := it.Next()
+	assert.Nil(t, e)
+	assert.Nil(t, err)
+
+	t.Run("stop early", func(t *testing.T) {
+		it := newEntryIterator(context.Background(), seg)
+		e, err := it.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, "key1", e.key)
+		it.Close()
+		it.Close()
+		e, err = it.Next()
+		assert.Nil(t, e)
+		assert.Nil(t, err)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		it := newEntryIterator(ctx, seg)
+		_, err := it.Next()
+		assert.Nil(t, err)
+		cancel()
+		_, err = it.Next()
+		assert.ErrorIs(t, err, context.Canceled)
+		_, err = it.Next()
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
@@ -0,0 +1,122 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Report is the outcome of Verify.
+type Report struct {
+	Segments []SegmentReport `json:"segments"`
+	// Problems are those of the directory rather than of a segment.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// SegmentReport describes a segment file checked by Verify.
+type SegmentReport struct {
+	Id       int             `json:"id"`
+	Path     string          `json:"path"`
+	Entries  int             `json:"entries"`
+	Bytes    int64           `json:"bytes"`
+	Findings []VerifyFinding `json:"findings,omitempty"`
+}
+
+// OK reports whether no problem was found.
+func (r Report) OK() bool {
+	if len(r.Problems) > 0 {
+		return false
+	}
+	for _, seg := range r.Segments {
+		if len(seg.Findings) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Verify checks the data directory of a Db which is not open. It validates
+// framing of every entry of every segment and blob references, and looks for
+// segment files sharing an id and leftovers of merges. Nothing is written,
+// an interrupted merge is reported rather than finished. Options other than
+// WithSegmentPrefix have no effect.
+func Verify(dir string, opts ...Option) (Report, error) {
+	db := &Db{outDir: dir, segmentPrefix: defaultSegmentPrefix}
+	for _, opt := range opts {
+		opt(db)
+	}
+
+	var report Report
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return report, err
+	}
+	paths := make(map[int][]string)
+	for _, file := range files {
+		if id, err := db.getSegmentId(file.Name()); err == nil && !file.IsDir() {
+			paths[id] = append(paths[id], filepath.Join(dir, file.Name()))
+		}
+	}
+	ids := make([]int, 0, len(paths))
+	for id := range paths {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		if len(paths[id]) > 1 {
+			report.Problems = append(report.Problems, fmt.Sprintf("segment id %d is used by %d files", id, len(paths[id])))
+		}
+		for _, path := range paths[id] {
+			seg, err := verifySegmentFile(path, id, dir)
+			if err != nil {
+				return report, err
+			}
+			report.Segments = append(report.Segments, seg)
+		}
+	}
+
+	shadowDir := filepath.Join(dir, shadowDirName)
+	if _, err := os.Stat(shadowDir); err == nil {
+		if _, err := os.Stat(filepath.Join(shadowDir, mergeManifestName)); err == nil {
+			report.Problems = append(report.Problems, "merge was interrupted, it is finished when the Db is opened")
+		} else {
+			report.Problems = append(report.Problems, "orphaned merge directory "+shadowDirName)
+		}
+	} else if !os.IsNotExist(err) {
+		return report, err
+	}
+	return report, nil
+}
+
+func verifySegmentFile(path string, id int, dir string) (SegmentReport, error) {
+	report := SegmentReport{Id: id, Path: path}
+	f, err := os.Open(path)
+	if err != nil {
+		return report, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return report, err
+	}
+	report.Bytes = info.Size()
+
+	for pos := int64(0); pos < report.Bytes; {
+		e, size, problem, err := checkEntry(OSBackend{}, f, pos, report.Bytes, dir)
+		if err != nil {
+			return report, err
+		}
+		if finding := newFinding(id, pos, e, problem); finding != nil {
+			report.Findings = append(report.Findings, *finding)
+		}
+		if size == 0 {
+			// The rest of the file can not be parsed.
+			break
+		}
+		report.Entries++
+		pos += size
+	}
+	return report, nil
+}
@@ -0,0 +1,108 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*2*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key1", "key2", "key3"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Close())
+
+	report, err := Verify(dir)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	if assert.Len(t, report.Segments, 2) {
+		assert.Equal(t, SegmentReport{Id: 0, Path: filepath.Join(dir, "segment-0"), Entries: 2, Bytes: 80}, report.Segments[0])
+		// key3 and the lifetime counters flushed on Close.
+		assert.Equal(t, 2, report.Segments[1].Entries)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "segment-1"))
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "segment-01"), data[:20], 0o600))
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, shadowDirName), 0o755))
+
+	report, err = Verify(dir)
+	assert.Nil(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, []string{"segment id 1 is used by 2 files", "orphaned merge directory shadow"}, report.Problems)
+	if assert.Len(t, report.Segments, 3) {
+		var truncated SegmentReport
+		for _, seg := range report.Segments {
+			if seg.Path == filepath.Join(dir, "segment-01") {
+				truncated = seg
+			}
+		}
+		assert.Equal(t, []VerifyFinding{{Segment: 1, Offset: 0, Problem: "entry size 40 out of bounds"}}, truncated.Findings)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*3*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key1", "key2", "key3", "key4"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Close())
+
+	// Garbage in the middle of the first segment and a stray copy of the
+	// second one.
+	path := filepath.Join(dir, "segment-0")
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	damaged := append(append(append([]byte{}, data[:40]...), 0xde, 0xad, 0xbe, 0xef, 0x01), data[40:]...)
+	assert.Nil(t, os.WriteFile(path, damaged, 0o600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "segment-001"), data, 0o600))
+
+	report, err := Repair(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{path}, report.Repaired)
+	assert.ElementsMatch(t, []string{
+		filepath.Join(dir, quarantineDirName, "segment-0"),
+		filepath.Join(dir, quarantineDirName, "segment-001"),
+	}, report.Quarantined)
+	assert.Equal(t, 3, report.Salvaged)
+	assert.Equal(t, 1, report.Dropped)
+
+	verified, err := Verify(dir)
+	assert.Nil(t, err)
+	assert.True(t, verified.OK())
+
+	db, err = NewDb(dir, 40*3*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"key1", "key2", "key3", "key4"} {
+		val, err := db.GetString(key)
+		assert.Nil(t, err)
+		assert.Equal(t, "value1", val)
+	}
+}
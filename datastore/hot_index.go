@@ -0,0 +1,180 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+const (
+	// hotIndexSuffix is appended to the path of the active segment to name
+	// the file its memtable is persisted to on Close.
+	hotIndexSuffix = ".index"
+	hotIndexMagic  = 0x7865646e49746f68
+	// hotIndexHeader is the size of the magic number, the offset covered
+	// and the number of records.
+	hotIndexHeader = 8 + 8 + 8
+	// hotIndexRecord is the size of a record without its key: key length,
+	// offset, size, sequence number, value type, expiration time and blob
+	// id.
+	hotIndexRecord = 4 + 8 + 8 + 8 + 1 + 8 + 8
+)
+
+// hotVersion is a version of a key read from a hot index.
+type hotVersion struct {
+	key       string
+	ie        IndexEntry
+	valueType ValueType
+	expiresAt int64
+	// blob is the id of the blob file of the value, -1 for none.
+	blob int64
+}
+
+// persistHotIndex writes every version of the memtable of the active segment
+// next to its file, so the next NewDb loads them instead of reading the
+// whole segment. The segment must not be written to anymore.
+func (db *Db) persistHotIndex(seg *Segment) error {
+	seg.mu.RLock()
+	defer seg.mu.RUnlock()
+	if seg.mem == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	var header [hotIndexHeader]byte
+	binary.LittleEndian.PutUint64(header[:], hotIndexMagic)
+	binary.LittleEndian.PutUint64(header[8:], uint64(seg.offset))
+	buf.Write(header[:])
+	var n uint64
+	err := seg.mem.each(func(key string, v memVersion) error {
+		e := v.e
+		if e == nil {
+			// The version was loaded from a hot index itself.
+			var err error
+			if e, err = readEntryAt(seg.reader, v.ie.Offset); err != nil {
+				return err
+			}
+		}
+		blob := int64(-1)
+		if e.blob != nil {
+			blob = e.blob.id
+		}
+		var rec [hotIndexRecord]byte
+		binary.LittleEndian.PutUint32(rec[:], uint32(len(key)))
+		binary.LittleEndian.PutUint64(rec[4:], uint64(v.ie.Offset))
+		binary.LittleEndian.PutUint64(rec[12:], uint64(v.ie.Size))
+		binary.LittleEndian.PutUint64(rec[20:], v.ie.Seq)
+		rec[28] = byte(e.valueType)
+		binary.LittleEndian.PutUint64(rec[29:], uint64(e.expiresAt))
+		binary.LittleEndian.PutUint64(rec[37:], uint64(blob))
+		buf.Write(rec[:])
+		buf.WriteString(key)
+		n++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint64(data[16:], n)
+	return writeFile(db.backend, seg.path+hotIndexSuffix, data)
+}
+
+// readHotIndex reads the hot index of the segment and removes it, a Db which
+// writes to the segment leaves it stale. It returns the offset the index
+// covers the segment file up to, and no versions if there is no index.
+func (db *Db) readHotIndex(seg *Segment) ([]hotVersion, int64, error) {
+	path := seg.path + hotIndexSuffix
+	data, err := readFile(db.backend, path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := db.backend.Remove(path); err != nil {
+		return nil, 0, err
+	}
+
+	corrupted := fmt.Errorf("corrupted hot index of segment %d", seg.id)
+	if len(data) < hotIndexHeader || binary.LittleEndian.Uint64(data) != hotIndexMagic {
+		return nil, 0, corrupted
+	}
+	offset := int64(binary.LittleEndian.Uint64(data[8:]))
+	n := binary.LittleEndian.Uint64(data[16:])
+	data = data[hotIndexHeader:]
+	versions := make([]hotVersion, 0, n)
+	for i := uint64(0); i < n; i++ {
+		if len(data) < hotIndexRecord {
+			return nil, 0, corrupted
+		}
+		kl := int(binary.LittleEndian.Uint32(data))
+		if len(data) < hotIndexRecord+kl {
+			return nil, 0, corrupted
+		}
+		versions = append(versions, hotVersion{
+			key: string(data[hotIndexRecord : hotIndexRecord+kl]),
+			ie: IndexEntry{
+				Offset: int64(binary.LittleEndian.Uint64(data[4:])),
+				Size:   int64(binary.LittleEndian.Uint64(data[12:])),
+				Seq:    binary.LittleEndian.Uint64(data[20:]),
+			},
+			valueType: ValueType(data[28]),
+			expiresAt: int64(binary.LittleEndian.Uint64(data[29:])),
+			blob:      int64(binary.LittleEndian.Uint64(data[37:])),
+		})
+		data = data[hotIndexRecord+kl:]
+	}
+	return versions, offset, nil
+}
+
+// loadHotIndex indexes the active segment from its hot index, if there is
+// one which matches the segment file. It returns the offset entries are to
+// be read from to index the rest of the file, zero if there is no index.
+func (db *Db) loadHotIndex(seg *Segment, blobs map[int64]bool) (int64, error) {
+	versions, offset, err := db.readHotIndex(seg)
+	if err != nil || len(versions) == 0 {
+		return 0, err
+	}
+	info, err := stat(db.backend, seg.path)
+	if err != nil {
+		return 0, err
+	}
+	// The latest entry of the index must be where it says, the file has
+	// changed since otherwise.
+	last := versions[0]
+	for _, v := range versions {
+		if v.ie.Offset > last.ie.Offset {
+			last = v
+		}
+	}
+	if offset > info.Size() || last.ie.Offset+last.ie.Size > offset {
+		return 0, nil
+	}
+	if e, err := readEntryAt(seg.reader, last.ie.Offset); err != nil || e.key != last.key || e.seq != last.ie.Seq {
+		return 0, nil
+	}
+
+	for i, v := range versions {
+		seg.mem.put(v.key, memVersion{ie: v.ie})
+		if v.blob >= 0 {
+			blobs[v.blob] = true
+		}
+		if v.ie.Seq > db.lastSeq.Load() {
+			db.lastSeq.Store(v.ie.Seq)
+		}
+		// Versions of a key are in write order, the latest one decides.
+		if i+1 < len(versions) && versions[i+1].key == v.key {
+			continue
+		}
+		if v.expiresAt != 0 {
+			seg.expiring[v.key] = &expiry{at: v.expiresAt, size: v.ie.Size}
+		}
+		if !isSystemKey(v.key) {
+			db.types.set(v.key, v.valueType)
+		}
+	}
+	seg.offset = offset
+	return offset, nil
+}
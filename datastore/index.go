@@ -0,0 +1,150 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// IndexEntry locates an entry within a segment file.
+type IndexEntry struct {
+	Offset int64
+	// Size is the encoded size of the entry in bytes.
+	Size int64
+	Seq  uint64
+}
+
+// Index maps keys of a segment to their latest entries. Segments guard
+// their indexes, so implementations need not be safe for concurrent use.
+type Index interface {
+	Get(key string) (IndexEntry, bool)
+	Set(key string, e IndexEntry)
+	// Iterate calls fn for keys with the prefix until it returns false. The
+	// order of keys is up to the implementation.
+	Iterate(prefix string, fn func(key string, e IndexEntry) bool)
+	Len() int
+	// MemoryUsage estimates the memory taken by the index in bytes.
+	MemoryUsage() int64
+	// Persist writes the index in a form Load reads back, any index can load
+	// what another one persisted.
+	Persist(w io.Writer) error
+	Load(r io.Reader) error
+}
+
+// WithIndex makes segments use indexes created by newIndex, such as
+// NewTrieIndex for keyspaces with long common prefixes. Only segments kept
+// as logs are fully indexed: the active segment is indexed by its memtable
+// and sorted segments keep sparse indexes.
+func WithIndex(newIndex func() Index) Option {
+	return func(db *Db) {
+		db.newIndex = newIndex
+	}
+}
+
+// mapIndex is the default Index backed by a map.
+type mapIndex map[string]IndexEntry
+
+func NewMapIndex() Index {
+	return make(mapIndex)
+}
+
+func (m mapIndex) Get(key string) (IndexEntry, bool) {
+	e, ok := m[key]
+	return e, ok
+}
+
+func (m mapIndex) Set(key string, e IndexEntry) {
+	m[key] = e
+}
+
+func (m mapIndex) Iterate(prefix string, fn func(string, IndexEntry) bool) {
+	for key, e := range m {
+		if len(key) >= len(prefix) && key[:len(prefix)] == prefix && !fn(key, e) {
+			return
+		}
+	}
+}
+
+func (m mapIndex) Len() int {
+	return len(m)
+}
+
+// mapSlotSize approximates the per key cost of a map: a string header, the
+// entry, a tophash byte and the load factor slack.
+const mapSlotSize = (16 + 24 + 1) * 8 / 6
+
+func (m mapIndex) MemoryUsage() int64 {
+	var total int64
+	for key := range m {
+		total += mapSlotSize + int64(len(key))
+	}
+	return total
+}
+
+func (m mapIndex) Persist(w io.Writer) error {
+	return persistIndex(w, m)
+}
+
+func (m mapIndex) Load(r io.Reader) error {
+	return loadIndex(r, m)
+}
+
+// indexRecordHeader is the size of a persisted index record without the
+// key: key length, offset, size and sequence number.
+const indexRecordHeader = 4 + 8 + 8 + 8
+
+// persistIndex writes the number of keys followed by a record per key.
+func persistIndex(w io.Writer, idx Index) error {
+	bw := bufio.NewWriter(w)
+	var buf [indexRecordHeader]byte
+	binary.LittleEndian.PutUint64(buf[:8], uint64(idx.Len()))
+	if _, err := bw.Write(buf[:8]); err != nil {
+		return err
+	}
+
+	var err error
+	idx.Iterate("", func(key string, e IndexEntry) bool {
+		binary.LittleEndian.PutUint32(buf[:], uint32(len(key)))
+		binary.LittleEndian.PutUint64(buf[4:], uint64(e.Offset))
+		binary.LittleEndian.PutUint64(buf[12:], uint64(e.Size))
+		binary.LittleEndian.PutUint64(buf[20:], e.Seq)
+		if _, err = bw.Write(buf[:]); err != nil {
+			return false
+		}
+		_, err = bw.WriteString(key)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func loadIndex(r io.Reader, idx Index) error {
+	br := bufio.NewReader(r)
+	var buf [indexRecordHeader]byte
+	if _, err := io.ReadFull(br, buf[:8]); err != nil {
+		return err
+	}
+	n := binary.LittleEndian.Uint64(buf[:8])
+	for i := uint64(0); i < n; i++ {
+		if _, err := io.ReadFull(br, buf[:]); err != nil {
+			return fmt.Errorf("corrupted index: %w", err)
+		}
+		kl := binary.LittleEndian.Uint32(buf[:])
+		if kl > maxEntrySize {
+			return fmt.Errorf("corrupted index: key length %d", kl)
+		}
+		key := make([]byte, kl)
+		if _, err := io.ReadFull(br, key); err != nil {
+			return fmt.Errorf("corrupted index: %w", err)
+		}
+		idx.Set(string(key), IndexEntry{
+			Offset: int64(binary.LittleEndian.Uint64(buf[4:])),
+			Size:   int64(binary.LittleEndian.Uint64(buf[12:])),
+			Seq:    binary.LittleEndian.Uint64(buf[20:]),
+		})
+	}
+	return nil
+}
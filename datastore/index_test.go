@@ -0,0 +1,459 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var indexes = map[string]func() Index{
+	"map":      NewMapIndex,
+	"trie":     NewTrieIndex,
+	"memtable": func() Index { return newMemtable() },
+}
+
+func TestIndex(t *testing.T) {
+	keys := []string{"user/1", "user/10", "user/2", "users", "u", "order/1", ""}
+	for name, newIndex := range indexes {
+		t.Run(name, func(t *testing.T) {
+			idx := newIndex()
+			for i, key := range keys {
+				idx.Set(key, IndexEntry{Offset: int64(i), Size: 10, Seq: uint64(i + 1)})
+			}
+			idx.Set("user/1", IndexEntry{Offset: 100, Size: 20, Seq: 8})
+			assert.Equal(t, len(keys), idx.Len())
+
+			e, ok := idx.Get("user/1")
+			assert.True(t, ok)
+			assert.Equal(t, IndexEntry{Offset: 100, Size: 20, Seq: 8}, e)
+			e, ok = idx.Get("user/2")
+			assert.True(t, ok)
+			assert.Equal(t, int64(2), e.Offset)
+			for _, missing := range []string{"user", "user/", "user/100", "x"} {
+				_, ok := idx.Get(missing)
+				assert.False(t, ok, "Found %q", missing)
+			}
+
+			var prefixed []string
+			idx.Iterate("user", func(key string, _ IndexEntry) bool {
+				prefixed = append(prefixed, key)
+				return true
+			})
+			sort.Strings(prefixed)
+			assert.Equal(t, []string{"user/1", "user/10", "user/2", "users"}, prefixed)
+
+			count := 0
+			idx.Iterate("", func(string, IndexEntry) bool {
+				count++
+				return count < 2
+			})
+			assert.Equal(t, 2, count)
+			assert.Greater(t, idx.MemoryUsage(), int64(0))
+
+			var buf bytes.Buffer
+			assert.Nil(t, idx.Persist(&buf))
+			for _, other := range indexes {
+				loaded := other()
+				assert.Nil(t, loaded.Load(bytes.NewReader(buf.Bytes())))
+				assert.Equal(t, idx.Len(), loaded.Len())
+				idx.Iterate("", func(key string, e IndexEntry) bool {
+					got, ok := loaded.Get(key)
+					assert.True(t, ok)
+					assert.Equal(t, e, got)
+					return true
+				})
+			}
+			assert.Error(t, newIndex().Load(bytes.NewReader(buf.Bytes()[:buf.Len()-1])))
+		})
+	}
+}
+
+func TestTrieIndex_Order(t *testing.T) {
+	idx := NewTrieIndex()
+	keys := []string{"b", "abc", "a", "ab", "abd", "ba"}
+	for _, key := range keys {
+		idx.Set(key, IndexEntry{})
+	}
+	var iterated []string
+	idx.Iterate("", func(key string, _ IndexEntry) bool {
+		iterated = append(iterated, key)
+		return true
+	})
+	sort.Strings(keys)
+	assert.Equal(t, keys, iterated)
+}
+
+func TestMemtable(t *testing.T) {
+	m := newMemtable()
+	keys := []string{"b", "abc", "a", "ab", "abd", "ba"}
+	for i, key := range keys {
+		m.put(key, memVersion{ie: IndexEntry{Offset: int64(i)}, e: &entry{key: key, value: "v1", seq: uint64(i + 1)}})
+	}
+	m.put("ab", memVersion{ie: IndexEntry{Offset: 10}, e: &entry{key: "ab", value: "v2", seq: 11}})
+	assert.Equal(t, len(keys), m.Len())
+
+	v, ok := m.latest("ab")
+	assert.True(t, ok)
+	assert.Equal(t, "v2", v.e.value)
+	var iterated []string
+	m.Iterate("ab", func(key string, _ IndexEntry) bool {
+		iterated = append(iterated, key)
+		return true
+	})
+	assert.Equal(t, []string{"ab", "abc", "abd"}, iterated)
+
+	// Flushes write every version in key order.
+	var versions []string
+	assert.Nil(t, m.each(func(key string, v memVersion) error {
+		versions = append(versions, key+"="+v.e.value.(string))
+		return nil
+	}))
+	assert.Equal(t, []string{"a=v1", "ab=v1", "ab=v2", "abc=v1", "abd=v1", "b=v1", "ba=v1"}, versions)
+}
+
+func TestSortedIndex(t *testing.T) {
+	backend := newMemBackend()
+	seg, err := openSegment(backend, "segment-0", 0, true, newSortedIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for i := 0; i < 3*sparseInterval; i++ {
+		keys = append(keys, fmt.Sprintf("key%03d", i))
+	}
+	for seq, key := range keys {
+		assert.Nil(t, seg.Write(&entry{key: key, value: "v1", valueType: Str, seq: uint64(seq + 1)}))
+	}
+	assert.Nil(t, seg.Write(&entry{key: keys[len(keys)-1], value: "v2", valueType: Str, seq: 100}))
+	assert.Equal(t, len(keys), seg.index.Len())
+	assert.False(t, seg.index.(*sortedIndex).unordered)
+
+	check := func() {
+		for _, key := range []string{keys[0], keys[sparseInterval-1], keys[sparseInterval], keys[len(keys)-2]} {
+			val, err := seg.Get(key)
+			assert.Nil(t, err)
+			assert.Equal(t, "v1", val)
+		}
+		val, err := seg.Get(keys[len(keys)-1])
+		assert.Nil(t, err)
+		assert.Equal(t, "v2", val)
+		for _, missing := range []string{"a", "key", "key0005", "key1000", sparseIndexKey} {
+			assert.False(t, seg.Has(missing), "Found %q", missing)
+		}
+
+		assert.Equal(t, keys, seg.Keys())
+		assert.Equal(t, []string{"key010", "key011", "key012", "key013", "key014", "key015", "key016", "key017", "key018", "key019"},
+			seg.keys("key01"))
+		assert.Empty(t, seg.keys("x"))
+		seqs := seg.sequences()
+		assert.Equal(t, uint64(100), seqs[keys[len(keys)-1]])
+		assert.Less(t, seg.MemoryUsage(), int64(len(keys)*len(keys[0])))
+	}
+	check()
+
+	// The sparse index ends the file and is read back from there.
+	built := seg.index.(*sortedIndex)
+	assert.Nil(t, seg.writeSparseIndex())
+	loaded, err := readSortedIndex(seg.reader, seg.offset)
+	assert.Nil(t, err)
+	if assert.NotNil(t, loaded) {
+		assert.Equal(t, built.sparse, loaded.sparse)
+		assert.Equal(t, built.len, loaded.len)
+		assert.Equal(t, built.end, loaded.end)
+		loaded.seg = seg
+		seg.index = loaded
+		check()
+	}
+	missing, err := readSortedIndex(seg.reader, built.end)
+	assert.Nil(t, err)
+	assert.Nil(t, missing)
+
+	// Complete indexes ignore entries, others tell logs apart.
+	loaded.Set("a", IndexEntry{})
+	assert.False(t, loaded.unordered)
+	unordered := newSortedIndex()
+	unordered.Set("b", IndexEntry{})
+	unordered.Set("a", IndexEntry{})
+	assert.True(t, unordered.unordered)
+	assert.Nil(t, seg.release())
+}
+
+func TestDb_SortedSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*3*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"key3", "key1", "key3", "key2", "key5", "key4"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 2, len(db.segments))
+	snap := db.Snapshot()
+	_, err = db.PutString("key0", "value1")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(db.segments))
+
+	// Sealed segments are flushed in key order, every version kept.
+	var order []string
+	entries := newEntryIterator(context.Background(), db.segments[1])
+	for e, err := entries.Next(); e != nil || err != nil; e, err = entries.Next() {
+		assert.Nil(t, err)
+		order = append(order, e.key)
+	}
+	assert.Equal(t, []string{"key2", "key4", "key5"}, order)
+	_, ok := db.segments[0].index.(*sortedIndex)
+	assert.True(t, ok)
+	assert.NotNil(t, db.segments[2].mem)
+	assert.Equal(t, int64(40*3), db.segments[0].Size())
+
+	// Snapshots go on reading the logs.
+	var snapped []string
+	assert.Nil(t, snap.Each(func(r Record) error {
+		snapped = append(snapped, r.Key)
+		return nil
+	}))
+	snap.Release()
+	assert.Equal(t, []string{"key1", "key2", "key3", "key4", "key5"}, snapped)
+
+	it := db.Iterate("key")
+	it.Seek("key2")
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	assert.Equal(t, []string{"key2", "key3", "key4", "key5"}, keys)
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, 40*3*Byte)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ok := db.segments[1].index.(*sortedIndex)
+		assert.True(t, ok)
+		assert.NotNil(t, db.segments[2].mem)
+		for _, key := range []string{"key0", "key1", "key3", "key5"} {
+			val, err := db.GetString(key)
+			assert.Nil(t, err)
+			assert.Equal(t, "value1", val)
+		}
+		assert.Nil(t, db.RestoreTo(2))
+		assert.Equal(t, []string{"key1", "key3"}, db.KeysByType(Str))
+	})
+}
+
+func TestDb_SparseIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 2 * sparseInterval
+	db, err := NewDb(dir, MemoryUnit(40*n)*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := n; i >= 0; i-- {
+		_, err = db.PutString(fmt.Sprintf("k%03d", i), "value1")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 2, len(db.segments))
+	index := db.segments[0].index.(*sortedIndex)
+	assert.Len(t, index.sparse, 2)
+	assert.Equal(t, int64(40*n), index.end)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, MemoryUnit(40*n)*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := db.segments[0].index.(*sortedIndex)
+	assert.Equal(t, index.sparse, loaded.sparse)
+	assert.Equal(t, n, loaded.Len())
+	for _, key := range []string{"k000", "k001", "k016", "k031", fmt.Sprintf("k%03d", n)} {
+		val, err := db.GetString(key)
+		assert.Nil(t, err)
+		assert.Equal(t, "value1", val)
+	}
+	assert.Equal(t, n+1, len(db.KeysByType(Str)))
+}
+
+func TestDb_TrieIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 31*2*Byte, WithIndex(NewTrieIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"key1", "key2", "key1", "key3"} {
+		_, err = db.PutString(key, "value-"+key)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.mergeOldSegments())
+
+	it := db.Iterate("key")
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	assert.Equal(t, []string{"key1", "key2", "key3"}, keys)
+	val, err := db.GetString("key1")
+	assert.Nil(t, err)
+	assert.Equal(t, "value-key1", val)
+	assert.Greater(t, db.Stats().IndexBytes, int64(0))
+}
+
+// prefixedKeys imitates a keyspace with long shared prefixes.
+func prefixedKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("region/eu-west-1/tenant/%03d/bucket/profiles/user/%08d", i%100, i)
+	}
+	return keys
+}
+
+func BenchmarkIndex_Set(b *testing.B) {
+	keys := prefixedKeys(100000)
+	for name, newIndex := range indexes {
+		b.Run(name, func(b *testing.B) {
+			var idx Index
+			for i := 0; i < b.N; i++ {
+				if i%len(keys) == 0 {
+					idx = newIndex()
+				}
+				idx.Set(keys[i%len(keys)], IndexEntry{Offset: int64(i)})
+			}
+		})
+	}
+}
+
+func BenchmarkIndex_Get(b *testing.B) {
+	keys := prefixedKeys(100000)
+	for name, newIndex := range indexes {
+		b.Run(name, func(b *testing.B) {
+			idx := newIndex()
+			for i, key := range keys {
+				idx.Set(key, IndexEntry{Offset: int64(i)})
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				idx.Get(keys[i%len(keys)])
+			}
+			b.ReportMetric(float64(idx.MemoryUsage())/float64(len(keys)), "index-bytes/key")
+		})
+	}
+}
+
+func TestDb_HotIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 10*Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.PutString("key1", "value1")
+	assert.Nil(t, err)
+	_, err = db.PutInt64("key2", 2)
+	assert.Nil(t, err)
+	_, err = db.PutString("key1", "value2")
+	assert.Nil(t, err)
+	_, err = db.PutStringWithTTL("key3", "value1", time.Millisecond)
+	assert.Nil(t, err)
+	lastSeq := db.LastSeq()
+	assert.Nil(t, db.Close())
+	// Reopening may take less than the TTL.
+	time.Sleep(2 * time.Millisecond)
+
+	hotPath := db.segmentPath(dir, 0) + hotIndexSuffix
+	hot, err := os.ReadFile(hotPath)
+	assert.Nil(t, err)
+
+	check := func(t *testing.T, db *Db) {
+		val, err := db.GetString("key1")
+		assert.Nil(t, err)
+		assert.Equal(t, "value2", val)
+		n, err := db.GetInt64("key2")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(2), n)
+		_, err = db.GetString("key3")
+		assert.Equal(t, ErrNotFound, err)
+		assert.Equal(t, []string{"key2"}, db.KeysByType(Int))
+	}
+
+	db, err = NewDb(dir, 10*Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, db)
+	assert.Equal(t, lastSeq, db.LastSeq())
+	// Versions come from the index, the segment was not read.
+	v, ok := db.segments[0].mem.latest("key1")
+	assert.True(t, ok)
+	assert.Nil(t, v.e)
+	// The lifetime counters flushed on Close are indexed too.
+	assert.Equal(t, 4, db.segments[0].mem.Len())
+	_, err = os.Stat(hotPath)
+	assert.True(t, os.IsNotExist(err))
+
+	t.Run("tail", func(t *testing.T) {
+		_, err = db.PutString("key4", "value1")
+		assert.Nil(t, err)
+		assert.Nil(t, db.Close())
+
+		// An older index covers a part of the segment, the rest is read.
+		assert.Nil(t, os.WriteFile(hotPath, hot, 0o600))
+		db, err = NewDb(dir, 10*Megabyte)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+		val, err := db.GetString("key4")
+		assert.Nil(t, err)
+		assert.Equal(t, "value1", val)
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		assert.Nil(t, db.Close())
+		assert.Nil(t, os.WriteFile(hotPath, hot[:len(hot)-3], 0o600))
+		db, err = NewDb(dir, 10*Megabyte)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		check(t, db)
+		v, _ := db.segments[0].mem.latest("key4")
+		assert.NotNil(t, v.e)
+	})
+}
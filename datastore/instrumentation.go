@@ -0,0 +1,107 @@
+package datastore
+
+import (
+	"expvar"
+	"time"
+)
+
+// Instrumentation observes the operations of a Db. The hooks are called
+// synchronously, so they must be cheap and safe for concurrent use.
+type Instrumentation interface {
+	// OnPut is called after a successful write of size bytes of key and
+	// value.
+	OnPut(d time.Duration, size int64)
+	// OnGet is called after a read, hit is false if the key was not found.
+	OnGet(hit bool, d time.Duration)
+	OnCompaction(stats CompactStats)
+}
+
+// ErrorInstrumentation is implemented by Instrumentations also observing the
+// errors of background work, compaction is true for failed compactions.
+type ErrorInstrumentation interface {
+	OnBackgroundError(err error, compaction bool)
+}
+
+// WithInstrumentation reports the operations of the Db to i, the errors of
+// background work too if i is an ErrorInstrumentation. Given several times,
+// operations are reported to every Instrumentation in turn.
+func WithInstrumentation(i Instrumentation) Option {
+	return func(db *Db) {
+		switch prev := db.instrumentation.(type) {
+		case noInstrumentation:
+			db.instrumentation = i
+		case multiInstrumentation:
+			db.instrumentation = append(prev, i)
+		default:
+			db.instrumentation = multiInstrumentation{prev, i}
+		}
+		if o, ok := i.(ErrorInstrumentation); ok {
+			db.background.observers = append(db.background.observers, o)
+		}
+	}
+}
+
+type noInstrumentation struct{}
+
+func (noInstrumentation) OnPut(time.Duration, int64) {}
+func (noInstrumentation) OnGet(bool, time.Duration)  {}
+func (noInstrumentation) OnCompaction(CompactStats)  {}
+
+type multiInstrumentation []Instrumentation
+
+func (m multiInstrumentation) OnPut(d time.Duration, size int64) {
+	for _, i := range m {
+		i.OnPut(d, size)
+	}
+}
+
+func (m multiInstrumentation) OnGet(hit bool, d time.Duration) {
+	for _, i := range m {
+		i.OnGet(hit, d)
+	}
+}
+
+func (m multiInstrumentation) OnCompaction(stats CompactStats) {
+	for _, i := range m {
+		i.OnCompaction(stats)
+	}
+}
+
+// ExpvarInstrumentation publishes counters of the Db operations as an
+// expvar map.
+type ExpvarInstrumentation struct {
+	vars *expvar.Map
+}
+
+// NewExpvarInstrumentation publishes the counters under name. A map already
+// published under the name is reused, so counters of several Dbs add up.
+func NewExpvarInstrumentation(name string) *ExpvarInstrumentation {
+	vars, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		vars = expvar.NewMap(name)
+	}
+	return &ExpvarInstrumentation{vars: vars}
+}
+
+func (e *ExpvarInstrumentation) OnPut(d time.Duration, size int64) {
+	e.vars.Add("puts", 1)
+	e.vars.Add("put_bytes", size)
+	e.vars.Add("put_ns", int64(d))
+}
+
+func (e *ExpvarInstrumentation) OnGet(hit bool, d time.Duration) {
+	e.vars.Add("gets", 1)
+	if hit {
+		e.vars.Add("get_hits", 1)
+	} else {
+		e.vars.Add("get_misses", 1)
+	}
+	e.vars.Add("get_ns", int64(d))
+}
+
+func (e *ExpvarInstrumentation) OnCompaction(stats CompactStats) {
+	e.vars.Add("compactions", 1)
+	e.vars.Add("compaction_segments_merged", int64(stats.SegmentsMerged))
+	e.vars.Add("compaction_bytes_reclaimed", stats.BytesReclaimed)
+	e.vars.Add("compaction_ns", int64(stats.Duration))
+}
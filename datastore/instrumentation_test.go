@@ -0,0 +1,204 @@
+package datastore
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingInstrumentation struct {
+	mu           sync.Mutex
+	puts         []int64
+	hits, misses int
+	compactions  []CompactStats
+	errors       []error
+}
+
+func (r *recordingInstrumentation) OnPut(_ time.Duration, size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.puts = append(r.puts, size)
+}
+
+func (r *recordingInstrumentation) OnGet(hit bool, _ time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if hit {
+		r.hits++
+	} else {
+		r.misses++
+	}
+}
+
+func (r *recordingInstrumentation) OnCompaction(stats CompactStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.compactions = append(r.compactions, stats)
+}
+
+func (r *recordingInstrumentation) OnBackgroundError(err error, compaction bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors = append(r.errors, err)
+}
+
+func TestDb_Instrumentation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec := &recordingInstrumentation{}
+	db, err := NewDb(dir, 40*2*Byte, WithInstrumentation(rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"key1", "key2", "key1"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	_, err = db.GetString("key1")
+	assert.Nil(t, err)
+	_, err = db.GetString("missing")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Nil(t, db.mergeOldSegments())
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	assert.Equal(t, []int64{40, 40, 40}, rec.puts)
+	assert.Equal(t, 1, rec.hits)
+	assert.Equal(t, 1, rec.misses)
+	assert.Equal(t, 1, len(rec.compactions))
+	assert.Equal(t, 1, rec.compactions[0].SegmentsMerged)
+}
+
+func TestDb_SeveralInstrumentations(t *testing.T) {
+	first, second := &recordingInstrumentation{}, &recordingInstrumentation{}
+	db, err := NewInMemoryDb(10*Megabyte, WithInstrumentation(first), WithInstrumentation(second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.PutString("key1", "value1")
+	assert.Nil(t, err)
+	_, err = db.GetString("key1")
+	assert.Nil(t, err)
+	failure := fmt.Errorf("disk full")
+	db.background.fail(failure, true)
+
+	for _, rec := range []*recordingInstrumentation{first, second} {
+		rec.mu.Lock()
+		assert.Equal(t, []int64{40}, rec.puts)
+		assert.Equal(t, 1, rec.hits)
+		assert.Equal(t, []error{failure}, rec.errors)
+		rec.mu.Unlock()
+	}
+}
+
+func TestExpvarInstrumentation(t *testing.T) {
+	i := NewExpvarInstrumentation("test_datastore")
+	i.OnPut(time.Millisecond, 10)
+	i.OnGet(true, time.Millisecond)
+	i.OnGet(false, time.Millisecond)
+	NewExpvarInstrumentation("test_datastore").OnCompaction(CompactStats{SegmentsMerged: 2, BytesReclaimed: 5})
+
+	vars := expvar.Get("test_datastore").(*expvar.Map)
+	assert.Equal(t, "10", vars.Get("put_bytes").String())
+	assert.Equal(t, "1", vars.Get("get_hits").String())
+	assert.Equal(t, "1", vars.Get("get_misses").String())
+	assert.Equal(t, "2", vars.Get("compaction_segments_merged").String())
+}
+
+// recordingTracer keeps the spans ended along with their parents.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	name   string
+	parent string
+	attrs  map[string]any
+	err    error
+}
+
+type spanKey struct{}
+
+func (r *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &recordedSpan{name: name, attrs: make(map[string]any)}
+	span.parent, _ = ctx.Value(spanKey{}).(string)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+	return context.WithValue(ctx, spanKey{}, name), span
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...Attribute) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordedSpan) RecordError(err error) {
+	s.err = err
+}
+
+func (s *recordedSpan) End() {}
+
+func TestDb_Tracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	db, err := NewInMemoryDb(40*2*Byte, WithTracer(tracer), WithCompactionPolicy(manualOnly{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.WithValue(context.Background(), spanKey{}, "request")
+	for _, key := range []string{"key1", "key2", "key3"} {
+		_, err = db.PutStringContext(ctx, key, "value1")
+		assert.Nil(t, err)
+	}
+	val, err := db.GetStringContext(ctx, "key1")
+	assert.Nil(t, err)
+	assert.Equal(t, "value1", val)
+	_, err = db.GetInt64Context(ctx, "missing")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = db.Compact(context.Background())
+	assert.Nil(t, err)
+
+	spans := tracer.spans
+	assert.Len(t, spans, 6)
+	for _, span := range spans[:5] {
+		assert.Equal(t, "request", span.parent)
+	}
+	put := spans[2]
+	assert.Equal(t, SpanPut, put.name)
+	assert.Equal(t, int64(40), put.attrs[AttrBytesWritten])
+	assert.Equal(t, int64(1), put.attrs[AttrSegment])
+	assert.IsType(t, time.Duration(0), put.attrs[AttrQueueWait])
+
+	get := spans[3]
+	assert.Equal(t, SpanGet, get.name)
+	assert.Equal(t, true, get.attrs[AttrHit])
+	assert.Equal(t, int64(0), get.attrs[AttrSegment])
+	assert.Equal(t, int64(len("value1")), get.attrs[AttrBytesRead])
+	assert.Equal(t, false, spans[4].attrs[AttrHit])
+	assert.Nil(t, spans[4].err)
+
+	compact := spans[5]
+	assert.Equal(t, SpanCompact, compact.name)
+	assert.Equal(t, int64(80), compact.attrs[AttrBytesRead])
+	assert.Equal(t, int64(80), compact.attrs[AttrBytesWritten])
+	assert.Nil(t, compact.err)
+}
@@ -0,0 +1,197 @@
+package datastore
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Iterator walks live keys of the Db in lexical order, or in reverse. It is
+// a frozen view of the Db at the time it is created: the keys and the
+// positions of their latest values are captured then, and values are read
+// lazily from there, so neither writes nor merges going on meanwhile make
+// it report a key twice, skip one or report a newer value.
+//
+// The segments of the view are kept until the iterator is done: merges go
+// on, but the files of the segments they replace stay open. The iterator is
+// done once Next returns false; consumers stopping before that must Close
+// it. Values of a closed iterator are read from the current state.
+type Iterator struct {
+	db   *Db
+	keys []string
+	refs map[string]iteratorRef
+	// pinned are the segments of the view, nil once closed.
+	pinned []*Segment
+	pos    int
+	// trim is the prefix removed from keys reported, the one of the bucket
+	// iterated.
+	trim string
+	// reverse is set if keys are walked in reverse lexical order.
+	reverse bool
+}
+
+// iteratorRef locates the latest entry of a key at the time the iterator
+// was created, pos is -1 for keys expired or deleted by then, which are not
+// walked.
+type iteratorRef struct {
+	reader File
+	pos    int64
+}
+
+// Iterate walks keys starting with prefix. Keys of buckets are not included.
+func (db *Db) Iterate(prefix string) *Iterator {
+	if isBucketKey(prefix) {
+		return &Iterator{db: db, pos: -1}
+	}
+	it := db.iterate(prefix)
+	keys := it.keys[:0]
+	for _, key := range it.keys {
+		if !isBucketKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	it.keys = keys
+	return it
+}
+
+// Range walks keys from start up to but not including end in lexical
+// order, an empty end leaves the range open. Indexes are only searched for
+// keys sharing the prefix common to start and end, so a range of keys
+// prefixed with times, such as the last hour, does not read the rest of the
+// keyspace. Keys of buckets are not included.
+func (db *Db) Range(start, end string) *Iterator {
+	it := db.iterateRange(rangePrefix(start, end), start, end)
+	keys := it.keys[:0]
+	for _, key := range it.keys {
+		if !isBucketKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	it.keys = keys
+	return it
+}
+
+// rangePrefix returns the prefix of every key within [start, end).
+func rangePrefix(start, end string) string {
+	if end == "" {
+		return ""
+	}
+	return start[:commonPrefix(start, end)]
+}
+
+func (db *Db) iterate(prefix string) *Iterator {
+	return db.iterateRange(prefix, "", "")
+}
+
+// iterateRange walks keys with the prefix within [start, end), end is not
+// checked if empty.
+func (db *Db) iterateRange(prefix, start, end string) *Iterator {
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+	if db.isClosed() {
+		return &Iterator{db: db, pos: -1}
+	}
+
+	it := &Iterator{
+		db:   db,
+		refs: make(map[string]iteratorRef),
+		pos:  -1,
+	}
+	now := time.Now().UnixNano()
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		seg := db.segments[i]
+		seg.capture(prefix, now, func(reader File, key string, pos int64) {
+			if key < start || end != "" && key >= end {
+				return
+			}
+			if _, ok := it.refs[key]; ok {
+				return
+			}
+			// Dead refs stay, so older segments do not bring the key back,
+			// but the key is not walked.
+			it.refs[key] = iteratorRef{reader: reader, pos: pos}
+			if pos >= 0 {
+				it.keys = append(it.keys, key)
+			}
+		})
+		it.pinned = append(it.pinned, seg)
+	}
+	sort.Strings(it.keys)
+
+	return it
+}
+
+// IterateReverse walks keys starting with prefix in reverse lexical order,
+// see Iterator.Reverse.
+func (db *Db) IterateReverse(prefix string) *Iterator {
+	return db.Iterate(prefix).Reverse()
+}
+
+// Reverse makes the iterator walk its keys in reverse lexical order from
+// the last one, so the latest N keys of a range are read without walking
+// the others. It returns the iterator.
+func (it *Iterator) Reverse() *Iterator {
+	for i, j := 0, len(it.keys)-1; i < j; i, j = i+1, j-1 {
+		it.keys[i], it.keys[j] = it.keys[j], it.keys[i]
+	}
+	it.reverse = !it.reverse
+	it.pos = -1
+	return it
+}
+
+// Seek positions the iterator so that the following Next call moves to the
+// first key greater than or equal to the given one, or less than or equal
+// to it for reverse iterators.
+func (it *Iterator) Seek(key string) {
+	key = it.trim + key
+	if it.reverse {
+		it.pos = sort.Search(len(it.keys), func(i int) bool { return it.keys[i] <= key }) - 1
+		return
+	}
+	it.pos = sort.SearchStrings(it.keys, key) - 1
+}
+
+func (it *Iterator) Next() bool {
+	if it.pos < len(it.keys) {
+		it.pos++
+	}
+	if it.pos < len(it.keys) {
+		return true
+	}
+	it.Close()
+	return false
+}
+
+// Close lets the segments of the view go, it is safe to call more than
+// once.
+func (it *Iterator) Close() {
+	for _, seg := range it.pinned {
+		seg.unpin()
+	}
+	it.pinned = nil
+}
+
+func (it *Iterator) Key() string {
+	return strings.TrimPrefix(it.keys[it.pos], it.trim)
+}
+
+// Value reads the value the current key had when the iterator was created.
+func (it *Iterator) Value() (interface{}, error) {
+	key := it.keys[it.pos]
+	if it.pinned == nil {
+		return it.db.getUnknown(context.Background(), key)
+	}
+	ref := it.refs[key]
+	if ref.pos < 0 {
+		return "", errExpired
+	}
+	e, err := readEntryAt(ref.reader, ref.pos)
+	if err != nil {
+		return nil, err
+	}
+	if e.blob != nil {
+		return it.db.resolve(e.blob)
+	}
+	return e.value, nil
+}
@@ -0,0 +1,66 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidKey is wrapped by errors of writes whose keys break the rules set
+// with WithMaxKeyLength, WithDisallowedKeyBytes or WithKeyValidator.
+var ErrInvalidKey = fmt.Errorf("invalid key")
+
+// WithMaxKeyLength makes writes of keys longer than n bytes fail with
+// ErrInvalidKey. Zero, the default, puts no limit.
+func WithMaxKeyLength(n int) Option {
+	return func(db *Db) {
+		db.keyRules.maxLength = n
+	}
+}
+
+// WithDisallowedKeyBytes makes writes of keys containing any of the bytes
+// fail with ErrInvalidKey.
+func WithDisallowedKeyBytes(bytes string) Option {
+	return func(db *Db) {
+		db.keyRules.disallowed = bytes
+	}
+}
+
+// WithKeyValidator makes fn be called with the key of every write, writes of
+// keys it returns an error for fail with the error wrapped in ErrInvalidKey.
+// Keys of buckets are checked without the bucket name. Writes applied from a
+// change feed are not checked, the Db which took them did.
+func WithKeyValidator(fn func(key string) error) Option {
+	return func(db *Db) {
+		db.keyRules.validator = fn
+	}
+}
+
+// keyRules are the constraints on keys written.
+type keyRules struct {
+	maxLength  int
+	disallowed string
+	validator  func(string) error
+}
+
+func (r keyRules) check(key string) error {
+	if r.maxLength > 0 && len(key) > r.maxLength {
+		return fmt.Errorf("%w: key is %d bytes long, at most %d are allowed", ErrInvalidKey, len(key), r.maxLength)
+	}
+	if i := strings.IndexAny(key, r.disallowed); r.disallowed != "" && i >= 0 {
+		return fmt.Errorf("%w: key has disallowed byte %q at %d", ErrInvalidKey, key[i], i)
+	}
+	if r.validator != nil {
+		if err := r.validator(key); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidKey, err)
+		}
+	}
+	return nil
+}
+
+// checkKey returns the error of writing the key to the Db itself.
+func (db *Db) checkKey(key string) error {
+	if isBucketKey(key) {
+		return ErrReservedKey
+	}
+	return db.keyRules.check(key)
+}
@@ -0,0 +1,23 @@
+package datastore
+
+import (
+	"context"
+	"log/slog"
+)
+
+// WithLogger makes the Db log compaction, recovery, segment rolls and errors
+// of background work, which are not reported to any caller. Nothing is
+// logged by default.
+func WithLogger(l *slog.Logger) Option {
+	return func(db *Db) {
+		db.logger = l
+	}
+}
+
+// discardHandler is the handler of the default logger.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
@@ -0,0 +1,111 @@
+package datastore
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingHandler keeps messages of the records it handles.
+type recordingHandler struct {
+	mu       *sync.Mutex
+	messages *[]string
+}
+
+func (h recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h recordingHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h recordingHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	*h.messages = append(*h.messages, r.Message)
+	return nil
+}
+
+func (h recordingHandler) logged() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), *h.messages...)
+}
+
+func TestDb_Logger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := recordingHandler{mu: new(sync.Mutex), messages: new([]string)}
+	db, err := NewDb(dir, 31*2*Byte, WithLogger(slog.New(h)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"key1", "key2", "key1"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	assert.Contains(t, h.logged(), "segment rolled")
+
+	_, err = db.Compact(context.Background())
+	assert.Nil(t, err)
+	assert.Contains(t, h.logged(), "compaction started")
+	assert.Contains(t, h.logged(), "compaction finished")
+	assert.Nil(t, db.Close())
+
+	db, err = NewDb(dir, 31*2*Byte, WithLogger(slog.New(h)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	assert.Contains(t, h.logged(), "segment recovered")
+	assert.Contains(t, h.logged(), "recovery finished")
+}
+
+func TestDb_SlowOpThreshold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := recordingHandler{mu: new(sync.Mutex), messages: new([]string)}
+	db, err := NewDb(dir, 40*2*Byte, WithLogger(slog.New(h)), WithSlowOpThreshold(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.PutString("key1", "value1")
+	assert.Nil(t, err)
+	_, err = db.GetString("key1")
+	assert.Nil(t, err)
+	assert.NotContains(t, h.logged(), "slow put")
+	assert.NotContains(t, h.logged(), "slow get")
+	assert.Nil(t, db.Close())
+
+	// Every operation takes longer than a nanosecond.
+	db, err = NewDb(dir, 40*2*Byte, WithLogger(slog.New(h)), WithSlowOpThreshold(time.Nanosecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"key1", "key2", "key1", "key3"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	assert.Contains(t, h.logged(), "slow put")
+	_, err = db.GetString("key2")
+	assert.Nil(t, err)
+	_, err = db.GetString("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Contains(t, h.logged(), "slow get")
+	_, err = db.Compact(context.Background())
+	assert.Nil(t, err)
+	assert.Contains(t, h.logged(), "slow compaction")
+}
@@ -1,5 +1,14 @@
 package datastore
 
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// MemoryUnit is an amount of memory in bits. FromBytes and the constants
+// below build one from bytes, which is what most sizes are given in.
 type MemoryUnit int64
 
 func (m MemoryUnit) Bytes() int64 {
@@ -12,4 +21,94 @@ const (
 	Kilobyte            = 1024 * Byte
 	Megabyte            = 1024 * Kilobyte
 	Gigabyte            = 1024 * Megabyte
+	Terabyte            = 1024 * Gigabyte
 )
+
+// FromBytes returns the memory unit of n bytes.
+func FromBytes(n int64) MemoryUnit {
+	return MemoryUnit(n) * Byte
+}
+
+// memoryUnitSuffixes are the suffixes used by String, from the largest unit
+// down. Units are powers of 1024.
+var memoryUnitSuffixes = []struct {
+	suffix string
+	unit   MemoryUnit
+}{
+	{"TB", Terabyte},
+	{"GB", Gigabyte},
+	{"MB", Megabyte},
+	{"KB", Kilobyte},
+	{"B", Byte},
+}
+
+// parseSuffixes are the upper case suffixes accepted by ParseMemoryUnit,
+// ordered so that no suffix comes after one it ends with.
+var parseSuffixes = []struct {
+	suffix string
+	unit   MemoryUnit
+}{
+	{"BIT", Bit},
+	{"TIB", Terabyte}, {"TB", Terabyte}, {"T", Terabyte},
+	{"GIB", Gigabyte}, {"GB", Gigabyte}, {"G", Gigabyte},
+	{"MIB", Megabyte}, {"MB", Megabyte}, {"M", Megabyte},
+	{"KIB", Kilobyte}, {"KB", Kilobyte}, {"K", Kilobyte},
+	{"B", Byte},
+}
+
+// ParseMemoryUnit parses a size such as "256MB", "1.5GB" or "4096". Sizes
+// without a suffix are in bytes. Suffixes are case insensitive, "K", "KB"
+// and "KiB" all mean 1024 bytes, and so on for M, G and T. "bit" may be used
+// for sizes which are not whole bytes.
+func ParseMemoryUnit(s string) (MemoryUnit, error) {
+	num := strings.TrimSpace(s)
+	unit := Byte
+	upper := strings.ToUpper(num)
+	for _, u := range parseSuffixes {
+		if strings.HasSuffix(upper, u.suffix) {
+			num, unit = num[:len(num)-len(u.suffix)], u.unit
+			break
+		}
+	}
+
+	num = strings.TrimSpace(num)
+	if n, err := strconv.ParseInt(num, 10, 64); err == nil {
+		if n < 0 || n > math.MaxInt64/int64(unit) {
+			return 0, fmt.Errorf("memory size %q out of range", s)
+		}
+		return MemoryUnit(n) * unit, nil
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+	if f < 0 || f*float64(unit) >= math.MaxInt64 {
+		return 0, fmt.Errorf("memory size %q out of range", s)
+	}
+	return MemoryUnit(math.Round(f * float64(unit))), nil
+}
+
+// String formats the size in the largest unit that represents it exactly,
+// e.g. "256MB". ParseMemoryUnit parses the result back.
+func (m MemoryUnit) String() string {
+	if m%Byte != 0 {
+		return strconv.FormatInt(int64(m), 10) + "bit"
+	}
+	for _, u := range memoryUnitSuffixes {
+		if m%u.unit == 0 && m != 0 {
+			return strconv.FormatInt(int64(m/u.unit), 10) + u.suffix
+		}
+	}
+	return "0B"
+}
+
+// Set parses the size for the flag package, so a MemoryUnit can be used with
+// flag.Var.
+func (m *MemoryUnit) Set(s string) error {
+	v, err := ParseMemoryUnit(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
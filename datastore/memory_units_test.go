@@ -0,0 +1,48 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMemoryUnit(t *testing.T) {
+	for s, expected := range map[string]MemoryUnit{
+		"4096":    FromBytes(4096),
+		"0":       0,
+		"12B":     12 * Byte,
+		"256MB":   256 * Megabyte,
+		"256mb":   256 * Megabyte,
+		"256 MiB": 256 * Megabyte,
+		"64k":     64 * Kilobyte,
+		"1.5GB":   3 * Gigabyte / 2,
+		"2T":      2 * Terabyte,
+		"12bit":   12 * Bit,
+	} {
+		v, err := ParseMemoryUnit(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, expected, v, s)
+	}
+
+	for _, s := range []string{"", "MB", "ten", "-1KB", "1XB", "9999999999TB"} {
+		_, err := ParseMemoryUnit(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestMemoryUnit_String(t *testing.T) {
+	for expected, m := range map[string]MemoryUnit{
+		"0B":     0,
+		"10MB":   10 * Megabyte,
+		"1536KB": 3 * Megabyte / 2,
+		"1025B":  FromBytes(1025),
+		"4TB":    4 * Terabyte,
+		"3bit":   3 * Bit,
+	} {
+		assert.Equal(t, expected, m.String())
+		parsed, err := ParseMemoryUnit(m.String())
+		assert.Nil(t, err)
+		assert.Equal(t, m, parsed)
+	}
+	assert.Equal(t, int64(1025), FromBytes(1025).Bytes())
+}
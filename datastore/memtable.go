@@ -0,0 +1,258 @@
+package datastore
+
+import (
+	"bufio"
+	"io"
+	"math/bits"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// memtableMaxLevel bounds the height of memtable towers, enough for
+// millions of keys.
+const memtableMaxLevel = 20
+
+// memtable buffers the entries of the active segment in a skip list sorted
+// by key, every version of a key is kept in write order. The segment file
+// serves as its write ahead log; once the segment is sealed the memtable is
+// flushed into a sorted segment replacing the log, see Db.flushSegment.
+//
+// A memtable is an Index of the log, so the active segment uses it as one.
+type memtable struct {
+	head  memNode
+	level int
+	len   int
+	bytes int64
+	// rnd is the state of the xorshift generator of tower heights.
+	rnd uint64
+}
+
+type memNode struct {
+	key string
+	// versions are the entries of the key, the latest last.
+	versions []memVersion
+	next     []*memNode
+}
+
+type memVersion struct {
+	ie IndexEntry
+	// e is the buffered entry, nil for versions only known by position as
+	// those set through the Index interface.
+	e *entry
+}
+
+func newMemtable() *memtable {
+	return &memtable{head: memNode{next: make([]*memNode, memtableMaxLevel)}, level: 1, rnd: 0x9e3779b97f4a7c15}
+}
+
+// randomLevel picks the height of a new tower, every level is half as
+// likely as the previous one.
+func (m *memtable) randomLevel() int {
+	m.rnd ^= m.rnd << 13
+	m.rnd ^= m.rnd >> 7
+	m.rnd ^= m.rnd << 17
+	level := bits.TrailingZeros64(m.rnd) + 1
+	if level > memtableMaxLevel {
+		level = memtableMaxLevel
+	}
+	return level
+}
+
+// seek returns the first node with a key not less than key. If update is
+// given, it is filled with the last node before that one on every level.
+func (m *memtable) seek(key string, update []*memNode) *memNode {
+	n := &m.head
+	for level := m.level - 1; level >= 0; level-- {
+		for n.next[level] != nil && n.next[level].key < key {
+			n = n.next[level]
+		}
+		if update != nil {
+			update[level] = n
+		}
+	}
+	return n.next[0]
+}
+
+// put buffers the entry written at ie.
+func (m *memtable) put(key string, v memVersion) {
+	var update [memtableMaxLevel]*memNode
+	n := m.seek(key, update[:])
+	if n != nil && n.key == key {
+		n.versions = append(n.versions, v)
+		m.bytes += memVersionSize(v)
+		return
+	}
+
+	level := m.randomLevel()
+	for ; m.level < level; m.level++ {
+		update[m.level] = &m.head
+	}
+	n = &memNode{key: key, versions: []memVersion{v}, next: make([]*memNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	m.len++
+	m.bytes += int64(len(key)) + 8*int64(level) + 48 + memVersionSize(v)
+}
+
+// memVersionSize approximates the memory taken by a version, the buffered
+// entry included.
+func memVersionSize(v memVersion) int64 {
+	size := int64(32)
+	if v.e != nil {
+		size += 64 + v.ie.Size
+	}
+	return size
+}
+
+// latest returns the latest version of the key.
+func (m *memtable) latest(key string) (memVersion, bool) {
+	n := m.seek(key, nil)
+	if n == nil || n.key != key {
+		return memVersion{}, false
+	}
+	return n.versions[len(n.versions)-1], true
+}
+
+func (m *memtable) Get(key string) (IndexEntry, bool) {
+	v, ok := m.latest(key)
+	return v.ie, ok
+}
+
+func (m *memtable) Set(key string, e IndexEntry) {
+	m.put(key, memVersion{ie: e})
+}
+
+// Iterate walks keys in lexical order.
+func (m *memtable) Iterate(prefix string, fn func(string, IndexEntry) bool) {
+	for n := m.seek(prefix, nil); n != nil && strings.HasPrefix(n.key, prefix); n = n.next[0] {
+		if !fn(n.key, n.versions[len(n.versions)-1].ie) {
+			return
+		}
+	}
+}
+
+// each walks every version of every key in lexical order of keys.
+func (m *memtable) each(fn func(key string, v memVersion) error) error {
+	for n := m.head.next[0]; n != nil; n = n.next[0] {
+		for _, v := range n.versions {
+			if err := fn(n.key, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memtable) Len() int {
+	return m.len
+}
+
+func (m *memtable) MemoryUsage() int64 {
+	return m.bytes
+}
+
+func (m *memtable) Persist(w io.Writer) error {
+	return persistIndex(w, m)
+}
+
+func (m *memtable) Load(r io.Reader) error {
+	return loadIndex(r, m)
+}
+
+// flushDirName is the directory sorted segments are written to before they
+// replace logs.
+const flushDirName = "flush"
+
+// flushSegment replaces the log of the segment just sealed by the write
+// loop with a sorted segment written from its memtable, its sparse index
+// last. The file keeps its modification time, and every version is kept so
+// history remains for RestoreTo. Readers of the log, such as snapshots, keep it
+// until the segment is released.
+func (db *Db) flushSegment(seg *Segment) error {
+	if seg.mem == nil {
+		return nil
+	}
+	start := time.Now()
+	modTime, err := seg.ModTime()
+	if err != nil {
+		return err
+	}
+	path := db.segmentPath(filepath.Join(db.outDir, flushDirName), seg.id)
+	if err := removeAll(db.backend, path); err != nil {
+		return err
+	}
+	f, err := db.backend.Create(path)
+	if err != nil {
+		return err
+	}
+
+	// The memtable of a sealed segment no longer changes, reads of the log
+	// go through the segment as archiving may switch its reader.
+	log := seg.fileReader()
+	index := newSortedIndex()
+	out := bufio.NewWriterSize(f, bufSize)
+	var offset int64
+	err = seg.mem.each(func(key string, v memVersion) error {
+		e := v.e
+		if e == nil {
+			var err error
+			if e, err = readEntryAt(log, v.ie.Offset); err != nil {
+				return err
+			}
+		}
+		data := e.Encode()
+		index.Set(key, IndexEntry{Offset: offset, Size: int64(len(data)), Seq: e.seq})
+		offset += int64(len(data))
+		_, err := out.Write(data)
+		return err
+	})
+	if e := index.complete(offset); e != nil && err == nil {
+		data := e.Encode()
+		offset += int64(len(data))
+		_, err = out.Write(data)
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if c, ok := db.backend.(chtimesBackend); ok && err == nil {
+		err = c.Chtimes(path, modTime, modTime)
+	}
+	var reader File
+	if err == nil {
+		reader, err = db.backend.Open(path)
+	}
+	if err != nil {
+		removeAll(db.backend, path)
+		return err
+	}
+
+	db.segmentsMu.Lock()
+	seg.mu.Lock()
+	err = db.backend.Rename(path, seg.path)
+	if err == nil {
+		seg.retired = append(seg.retired, seg.reader)
+		seg.reader = reader
+		seg.offset = offset
+		seg.index = index
+		index.seg = seg
+		seg.mem = nil
+	}
+	seg.mu.Unlock()
+	db.segmentsMu.Unlock()
+	if err != nil {
+		reader.Close()
+		removeAll(db.backend, path)
+		return err
+	}
+	db.logger.Debug("segment flushed", "segment", seg.id, "keys", index.Len(), "duration", time.Since(start))
+	return nil
+}
@@ -0,0 +1,419 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	shadowDirName     = "shadow"
+	mergeManifestName = "merge.json"
+)
+
+// mergeManifest is written to the shadow directory once all merged segments
+// are there. Segments are moved over the segments with the same ids and
+// Remove lists ids of merged segments that got no replacement. A manifest
+// found on recovery means the merge has to be finished.
+//
+// Archive is the directory the replaced segments are moved to, if the Db
+// archives them.
+type mergeManifest struct {
+	Segments []int  `json:"segments"`
+	Remove   []int  `json:"remove"`
+	Archive  string `json:"archive,omitempty"`
+}
+
+// compact merges the sealed segments picked by the compaction policy.
+func (db *Db) compact() error {
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+
+	segments := db.segmentSet()
+	sealed := segments[:len(segments)-1]
+	from, to, ok := db.compaction.Plan(segmentInfos(segments), db.Options())
+	if !ok || from < 0 || to > len(sealed) || to-from < 1 {
+		return nil
+	}
+	_, err := db.traceMerge(context.Background(), segments, from, to)
+	return err
+}
+
+// CompactStats reports the outcome of a merge.
+type CompactStats struct {
+	SegmentsMerged   int           `json:"segments_merged"`
+	SegmentsWritten  int           `json:"segments_written"`
+	EntriesRewritten int           `json:"entries_rewritten"`
+	BytesReclaimed   int64         `json:"bytes_reclaimed"`
+	Duration         time.Duration `json:"duration_ns"`
+}
+
+// Compact merges all the sealed segments regardless of the compaction
+// policy. Cancelling ctx aborts the merge unless it is already being
+// applied, the segments are left intact then.
+func (db *Db) Compact(ctx context.Context) (CompactStats, error) {
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+
+	segments := db.segmentSet()
+	if len(segments) < 2 {
+		return CompactStats{}, nil
+	}
+	stats, err := db.traceMerge(ctx, segments, 0, len(segments)-1)
+	if err == nil {
+		db.background.compacted()
+	}
+	return stats, err
+}
+
+func (db *Db) mergeOldSegments() error {
+	_, err := db.Compact(context.Background())
+	return err
+}
+
+// segmentInfos describes the sealed segments. Garbage of a segment includes
+// entries overwritten in any newer one, the active segment included.
+func segmentInfos(segments []*Segment) []SegmentInfo {
+	infos := make([]SegmentInfo, len(segments)-1)
+	shadowed := make(map[string]bool)
+	segments[len(segments)-1].garbage(shadowed)
+	for i := len(infos) - 1; i >= 0; i-- {
+		seg := segments[i]
+		modTime, _ := seg.ModTime()
+		infos[i] = SegmentInfo{
+			Id:      seg.id,
+			Size:    seg.Size(),
+			Garbage: seg.garbage(shadowed),
+			Expired: seg.DeadBytes(),
+			ModTime: modTime,
+		}
+	}
+	return infos
+}
+
+// mergeRange compacts segments[from:to] of a snapshot of the segment list,
+// mergeMu must be held. Segments sealed while the merge runs are not part of
+// the snapshot and stay in place after the merged ones, so writes never wait
+// for the merge.
+func (db *Db) mergeRange(ctx context.Context, segments []*Segment, from, to int) (CompactStats, error) {
+	if db.isClosed() {
+		return CompactStats{}, ErrClosed
+	}
+	start := time.Now()
+	snapshot := segments[from:to]
+	older := segments[:from]
+	newer := segments[to:]
+	db.logger.Info("compaction started", "segments", len(snapshot),
+		"first", snapshot[0].id, "last", snapshot[len(snapshot)-1].id)
+
+	now := time.Now().UnixNano()
+	vals := make(map[string]*entry)
+	retired := make(map[string]bool)
+	// blobs collects blobs referenced from the snapshot, those not carried
+	// over to merged segments are removed with the merged ones.
+	blobs := make(map[int64]bool)
+	var newest time.Time
+	var maxSeq uint64
+	for _, seg := range snapshot {
+		modTime, err := seg.ModTime()
+		if err != nil {
+			return CompactStats{}, err
+		}
+		isRetired := db.retention > 0 && time.Since(modTime) > db.retention
+		if isRetired {
+			for _, key := range seg.Keys() {
+				retired[key] = true
+			}
+		} else if modTime.After(newest) {
+			newest = modTime
+		}
+
+		it := newEntryIterator(ctx, seg)
+		for {
+			e, err := it.Next()
+			if err != nil {
+				return CompactStats{}, err
+			}
+			if e == nil {
+				break
+			}
+			if err := db.throttle.wait(ctx, db.done, e.Size().Bytes()); err != nil {
+				it.Close()
+				return CompactStats{}, err
+			}
+			if e.key == sparseIndexKey {
+				continue
+			}
+			if e.blob != nil {
+				blobs[e.blob.id] = true
+			}
+			if e.seq > maxSeq {
+				maxSeq = e.seq
+			}
+			if isRetired {
+				continue
+			}
+			if hasKey(newer, e.key) {
+				continue
+			}
+			// An expired entry still hides older values that are not
+			// merged.
+			if e.expired(now) && !hasKey(older, e.key) {
+				delete(vals, e.key)
+				continue
+			}
+			vals[e.key] = e
+		}
+		if err := ctx.Err(); err != nil {
+			return CompactStats{}, err
+		}
+	}
+
+	read := time.Since(start)
+	for _, e := range vals {
+		if e.blob != nil {
+			delete(blobs, e.blob.id)
+		}
+	}
+
+	// Merge may drop the latest entry, its sequence number must survive.
+	// Older values are dropped too, states before maxSeq are gone.
+	if maxSeq > db.compactedSeq.Load() {
+		db.compactedSeq.Store(maxSeq)
+	}
+	if err := db.flushStatsIfMoved(); err != nil {
+		return CompactStats{}, err
+	}
+
+	shadowDir := filepath.Join(db.outDir, shadowDirName)
+	if err := removeAll(db.backend, shadowDir); err != nil {
+		return CompactStats{}, err
+	}
+
+	merged, manifest, err := db.prepareMerge(ctx, shadowDir, snapshot, vals, newest)
+	if err != nil {
+		for _, seg := range merged {
+			seg.release()
+		}
+		removeAll(db.backend, shadowDir)
+		return CompactStats{}, err
+	}
+
+	written := time.Since(start)
+	db.segmentsMu.Lock()
+	if db.isClosed() {
+		// Close released the segments meanwhile, the merge is dropped
+		// and the data stays in the segments merged.
+		err = ErrClosed
+		for _, seg := range merged {
+			seg.release()
+		}
+		removeAll(db.backend, shadowDir)
+	} else {
+		err = db.applyMerge(db.outDir, manifest)
+	}
+	if err == nil {
+		for _, seg := range merged {
+			seg.path = db.segmentPath(db.outDir, seg.id)
+		}
+		spliced := make([]*Segment, 0, len(db.segments)-len(snapshot)+len(merged))
+		spliced = append(spliced, db.segments[:from]...)
+		spliced = append(spliced, merged...)
+		db.segments = append(spliced, db.segments[to:]...)
+	}
+	db.segmentsMu.Unlock()
+	if err != nil {
+		return CompactStats{}, err
+	}
+
+	db.segmentsMu.RLock()
+	for key := range retired {
+		if _, ok := vals[key]; !ok && !hasKey(db.segments, key) {
+			db.types.remove(key)
+		}
+	}
+	db.segmentsMu.RUnlock()
+
+	stats := CompactStats{
+		SegmentsMerged:   len(snapshot),
+		SegmentsWritten:  len(merged),
+		EntriesRewritten: len(vals),
+	}
+	for _, seg := range snapshot {
+		stats.BytesReclaimed += seg.Size()
+	}
+	db.dropSegments(snapshot, blobs, manifest.Archive)
+	for _, seg := range merged {
+		stats.BytesReclaimed -= seg.Size()
+	}
+	stats.Duration = time.Since(start)
+	db.counters.compactions.Add(1)
+	db.counters.bytesReclaimed.Add(stats.BytesReclaimed)
+	db.instrumentation.OnCompaction(stats)
+	db.logger.Info("compaction finished", "segments_merged", stats.SegmentsMerged,
+		"segments_written", stats.SegmentsWritten, "entries_rewritten", stats.EntriesRewritten,
+		"bytes_reclaimed", stats.BytesReclaimed, "duration", stats.Duration)
+	if db.slow(stats.Duration) {
+		db.logger.Warn("slow compaction", "first", snapshot[0].id, "last", snapshot[len(snapshot)-1].id,
+			"segments_merged", stats.SegmentsMerged, "duration", stats.Duration,
+			"read", read, "write", written-read, "apply", stats.Duration-written)
+	}
+	return stats, nil
+}
+
+// prepareMerge writes merged segments and the manifest into the shadow
+// directory. Once it succeeds the merge is not cancelled anymore.
+func (db *Db) prepareMerge(ctx context.Context, dir string, snapshot []*Segment, vals map[string]*entry, newest time.Time) ([]*Segment, *mergeManifest, error) {
+	merged, err := db.writeMerged(ctx, dir, snapshot, vals)
+	if err != nil {
+		return merged, nil, err
+	}
+
+	manifest := &mergeManifest{Archive: db.mergeArchive()}
+	for _, seg := range merged {
+		manifest.Segments = append(manifest.Segments, seg.id)
+		// Merged segments inherit the age of the newest merged entry, so
+		// retention keeps working on them.
+		if c, ok := db.backend.(chtimesBackend); ok && !newest.IsZero() {
+			if err := c.Chtimes(seg.path, newest, newest); err != nil {
+				return merged, nil, err
+			}
+		}
+	}
+	for _, seg := range snapshot[len(merged):] {
+		manifest.Remove = append(manifest.Remove, seg.id)
+	}
+	if err := ctx.Err(); err != nil {
+		return merged, nil, err
+	}
+	return merged, manifest, db.writeMergeManifest(dir, manifest)
+}
+
+// writeMerged writes vals into sealed segments in dir. The segments take ids
+// of the snapshot in order; once those run out the last segment may exceed
+// the size limit.
+func (db *Db) writeMerged(ctx context.Context, dir string, snapshot []*Segment, vals map[string]*entry) ([]*Segment, error) {
+	keys := make([]string, 0, len(vals))
+	for key := range vals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	maxSize := db.Options().MaxSegmentSize
+	var merged []*Segment
+	var cur *Segment
+	seal := func() error {
+		err := cur.writeSparseIndex()
+		if closeErr := cur.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			if cur != nil {
+				cur.Close()
+			}
+			return merged, err
+		}
+		e := vals[key]
+		if cur == nil || (cur.IsSurpassed(maxSize-e.Size()) && len(merged) < len(snapshot)) {
+			if cur != nil {
+				if err := seal(); err != nil {
+					return merged, err
+				}
+			}
+			id := snapshot[len(merged)].id
+			seg, err := openSegment(db.backend, db.segmentPath(dir, id), id, true, newSortedIndex())
+			if err != nil {
+				return merged, err
+			}
+			merged = append(merged, seg)
+			cur = seg
+		}
+		if err := cur.Write(e); err != nil {
+			return merged, err
+		}
+		if err := db.throttle.wait(ctx, db.done, e.Size().Bytes()); err != nil {
+			cur.Close()
+			return merged, err
+		}
+	}
+	if cur != nil {
+		if err := seal(); err != nil {
+			return merged, err
+		}
+	}
+	return merged, nil
+}
+
+func hasKey(segments []*Segment, key string) bool {
+	for _, seg := range segments {
+		if seg.Has(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *Db) writeMergeManifest(dir string, m *mergeManifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, mergeManifestName+".tmp")
+	if err := writeFile(db.backend, tmp, data); err != nil {
+		return err
+	}
+	return db.backend.Rename(tmp, filepath.Join(dir, mergeManifestName))
+}
+
+// applyMerge moves merged segments from the shadow directory into dir. It
+// can be repeated after a crash in the middle.
+func (db *Db) applyMerge(dir string, m *mergeManifest) error {
+	shadowDir := filepath.Join(dir, shadowDirName)
+	for _, id := range m.Segments {
+		shadow := db.segmentPath(shadowDir, id)
+		if m.Archive != "" {
+			// Segments replaced before an interruption are merged ones.
+			if _, err := stat(db.backend, shadow); err == nil {
+				if err := db.archiveFile(db.segmentPath(dir, id), m.Archive); err != nil {
+					return err
+				}
+			}
+		}
+		err := db.backend.Rename(shadow, db.segmentPath(dir, id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, id := range m.Remove {
+		if err := db.archiveFile(db.segmentPath(dir, id), m.Archive); err != nil {
+			return err
+		}
+	}
+	return removeAll(db.backend, shadowDir)
+}
+
+// recoverMerge finishes a merge interrupted after its manifest was written
+// and drops leftovers of any other one.
+func (db *Db) recoverMerge() error {
+	shadowDir := filepath.Join(db.outDir, shadowDirName)
+	data, err := readFile(db.backend, filepath.Join(shadowDir, mergeManifestName))
+	if os.IsNotExist(err) {
+		return removeAll(db.backend, shadowDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	var manifest mergeManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return err
+	}
+	db.logger.Warn("finishing interrupted merge")
+	return db.applyMerge(db.outDir, &manifest)
+}
@@ -0,0 +1,127 @@
+package datastore
+
+import (
+	"context"
+	"time"
+)
+
+// Meta describes the latest write of a key.
+type Meta struct {
+	// Seq is the sequence number of the write, the revision of the key
+	// checked by PutIfRevision.
+	Seq  uint64
+	Type ValueType
+	// UpdatedAt is the time of the write, zero for values written before
+	// write times were introduced. Values applied from a change feed keep
+	// the time of the Db which took the write first.
+	UpdatedAt time.Time
+	// ExpiresAt is zero for values without TTL.
+	ExpiresAt time.Time
+}
+
+// GetWithMeta returns the value of the key along with the metadata of its
+// latest write.
+func (db *Db) GetWithMeta(key string) (interface{}, Meta, error) {
+	return db.GetWithMetaContext(context.Background(), key)
+}
+
+// GetWithMetaContext is GetWithMeta failing with the error of ctx if it is
+// done before the read starts.
+func (db *Db) GetWithMetaContext(ctx context.Context, key string) (interface{}, Meta, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, Meta{}, err
+	}
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+	if db.isClosed() {
+		return nil, Meta{}, ErrClosed
+	}
+
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		e, err := db.segments[i].entry(key)
+		if err != nil {
+			return nil, Meta{}, err
+		}
+		if e == nil {
+			continue
+		}
+		if e.expired(time.Now().UnixNano()) {
+			return nil, Meta{}, ErrNotFound
+		}
+
+		meta := Meta{Seq: e.seq, Type: e.valueType}
+		if e.writeTime != 0 {
+			meta.UpdatedAt = time.Unix(0, e.writeTime)
+		}
+		if e.expiresAt != 0 {
+			meta.ExpiresAt = time.Unix(0, e.expiresAt)
+		}
+		var val interface{} = e.value
+		if e.blob != nil {
+			val = e.blob
+		}
+		val, err = db.resolve(val)
+		if err != nil {
+			return nil, Meta{}, err
+		}
+		return val, meta, nil
+	}
+	return nil, Meta{}, ErrNotFound
+}
+
+// ValueInfo describes the latest value of a key.
+type ValueInfo struct {
+	Type ValueType
+	// Size is the length of the value: the bytes of a string, 8 for an
+	// int64.
+	Size int64
+	// EntrySize is the encoded size of the entry in its segment file, which
+	// holds a reference in place of a value stored in a blob file.
+	EntrySize int64
+	// Blob is set for values stored in blob files.
+	Blob bool
+	// Segment is the id of the segment holding the entry.
+	Segment int
+	Seq     uint64
+	// UpdatedAt and ExpiresAt are as in Meta.
+	UpdatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Describe returns what is known of the latest value of the key without
+// reading the value, so blob files are not opened either.
+func (db *Db) Describe(key string) (ValueInfo, error) {
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+	if db.isClosed() {
+		return ValueInfo{}, ErrClosed
+	}
+
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		seg := db.segments[i]
+		e, vl, size, err := seg.entryHeader(key)
+		if err != nil {
+			return ValueInfo{}, err
+		}
+		if e == nil {
+			continue
+		}
+		if e.expired(time.Now().UnixNano()) {
+			return ValueInfo{}, ErrNotFound
+		}
+
+		info := ValueInfo{Type: e.valueType, Size: vl, EntrySize: size, Segment: seg.id, Seq: e.seq}
+		if e.blob != nil {
+			info.Size = e.blob.length
+			info.Blob = true
+		}
+		if e.writeTime != 0 {
+			info.UpdatedAt = time.Unix(0, e.writeTime)
+		}
+		if e.expiresAt != 0 {
+			info.ExpiresAt = time.Unix(0, e.expiresAt)
+		}
+		return info, nil
+	}
+	return ValueInfo{}, ErrNotFound
+}
@@ -0,0 +1,181 @@
+// Package metrics exports the state and operations of a datastore.Db as
+// Prometheus metrics.
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector of a Db. It observes operations as
+// the Instrumentation of the Db and reads gauges from Db.Stats when
+// collected:
+//
+//	c := metrics.NewCollector("datastore")
+//	db, err := datastore.NewDb(dir, size, datastore.WithInstrumentation(c))
+//	...
+//	c.Watch(db)
+//	prometheus.MustRegister(c)
+type Collector struct {
+	putDuration        prometheus.Histogram
+	putBytes           prometheus.Counter
+	getDuration        *prometheus.HistogramVec
+	compactions        prometheus.Counter
+	compactionDuration prometheus.Histogram
+	segmentsMerged     prometheus.Counter
+	bytesReclaimed     prometheus.Counter
+	errors             *prometheus.CounterVec
+
+	segments   *prometheus.Desc
+	keys       *prometheus.Desc
+	diskBytes  *prometheus.Desc
+	deadBytes  *prometheus.Desc
+	indexBytes *prometheus.Desc
+	archived   *prometheus.Desc
+	lastSeq    *prometheus.Desc
+
+	mu sync.RWMutex
+	db *datastore.Db
+}
+
+var (
+	_ prometheus.Collector           = (*Collector)(nil)
+	_ datastore.ErrorInstrumentation = (*Collector)(nil)
+)
+
+// NewCollector names the metrics within namespace.
+func NewCollector(namespace string) *Collector {
+	gauge := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, nil, nil)
+	}
+	return &Collector{
+		putDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "put_duration_seconds",
+			Help:      "Latency of successful writes.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}),
+		putBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "put_bytes_total",
+			Help:      "Bytes of keys and values written.",
+		}),
+		getDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "get_duration_seconds",
+			Help:      "Latency of reads by result, hit or miss.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 8),
+		}, []string{"result"}),
+		compactions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "compactions_total",
+			Help:      "Compactions run.",
+		}),
+		compactionDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "compaction_duration_seconds",
+			Help:      "Duration of compactions.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 8),
+		}),
+		segmentsMerged: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "compaction_segments_merged_total",
+			Help:      "Segments merged by compactions.",
+		}),
+		bytesReclaimed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "compaction_reclaimed_bytes_total",
+			Help:      "Disk bytes reclaimed by compactions.",
+		}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "background_errors_total",
+			Help:      "Errors of background work by kind, compaction or other.",
+		}, []string{"kind"}),
+
+		segments:   gauge("segments", "Segments, archived ones included."),
+		keys:       gauge("keys", "Keys stored."),
+		diskBytes:  gauge("disk_bytes", "Bytes of segment files on disk."),
+		deadBytes:  gauge("dead_bytes", "Bytes of overwritten, deleted or expired entries."),
+		indexBytes: gauge("index_bytes", "Estimated memory of segment indexes."),
+		archived:   gauge("archived_segments", "Segments moved to the object store."),
+		lastSeq:    gauge("last_seq", "Sequence number of the latest write."),
+	}
+}
+
+// Watch makes the collector report the gauges of db, nothing is reported
+// for them before.
+func (c *Collector) Watch(db *datastore.Db) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.db = db
+}
+
+func (c *Collector) OnPut(d time.Duration, size int64) {
+	c.putDuration.Observe(d.Seconds())
+	c.putBytes.Add(float64(size))
+}
+
+func (c *Collector) OnGet(hit bool, d time.Duration) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	c.getDuration.WithLabelValues(result).Observe(d.Seconds())
+}
+
+func (c *Collector) OnCompaction(stats datastore.CompactStats) {
+	c.compactions.Inc()
+	c.compactionDuration.Observe(stats.Duration.Seconds())
+	c.segmentsMerged.Add(float64(stats.SegmentsMerged))
+	c.bytesReclaimed.Add(float64(stats.BytesReclaimed))
+}
+
+func (c *Collector) OnBackgroundError(err error, compaction bool) {
+	kind := "other"
+	if compaction {
+		kind = "compaction"
+	}
+	c.errors.WithLabelValues(kind).Inc()
+}
+
+func (c *Collector) metrics() []prometheus.Collector {
+	return []prometheus.Collector{c.putDuration, c.putBytes, c.getDuration, c.compactions,
+		c.compactionDuration, c.segmentsMerged, c.bytesReclaimed, c.errors}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range c.metrics() {
+		m.Describe(ch)
+	}
+	for _, d := range []*prometheus.Desc{c.segments, c.keys, c.diskBytes, c.deadBytes, c.indexBytes, c.archived, c.lastSeq} {
+		ch <- d
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c.metrics() {
+		m.Collect(ch)
+	}
+	c.mu.RLock()
+	db := c.db
+	c.mu.RUnlock()
+	if db == nil {
+		return
+	}
+	stats := db.Stats()
+	for d, v := range map[*prometheus.Desc]float64{
+		c.segments:   float64(stats.Segments),
+		c.keys:       float64(stats.Keys),
+		c.diskBytes:  float64(stats.DiskBytes),
+		c.deadBytes:  float64(stats.DeadBytes),
+		c.indexBytes: float64(stats.IndexBytes),
+		c.archived:   float64(stats.ArchivedSegments),
+		c.lastSeq:    float64(stats.LastSeq),
+	} {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v)
+	}
+}
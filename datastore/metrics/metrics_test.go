@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector("datastore")
+	db, err := datastore.NewInMemoryDb(40*2*datastore.Byte, datastore.WithInstrumentation(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	reg := prometheus.NewPedanticRegistry()
+	assert.Nil(t, reg.Register(c))
+
+	// Gauges are reported once the Db is watched.
+	assert.Nil(t, testutil.GatherAndCompare(reg, strings.NewReader(""), "datastore_segments"))
+	c.Watch(db)
+
+	for _, key := range []string{"key1", "key2", "key3"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	_, err = db.PutString("key1", "value2")
+	assert.Nil(t, err)
+	_, err = db.GetString("key1")
+	assert.Nil(t, err)
+	_, err = db.GetString("missing")
+	assert.Equal(t, datastore.ErrNotFound, err)
+	_, err = db.Compact(context.Background())
+	assert.Nil(t, err)
+	c.OnBackgroundError(errors.New("disk full"), true)
+
+	expected := fmt.Sprintf(`
+# HELP datastore_keys Keys stored.
+# TYPE datastore_keys gauge
+datastore_keys 3
+# HELP datastore_disk_bytes Bytes of segment files on disk.
+# TYPE datastore_disk_bytes gauge
+datastore_disk_bytes %d
+# HELP datastore_compactions_total Compactions run.
+# TYPE datastore_compactions_total counter
+datastore_compactions_total 1
+# HELP datastore_background_errors_total Errors of background work by kind, compaction or other.
+# TYPE datastore_background_errors_total counter
+datastore_background_errors_total{kind="compaction"} 1
+`, db.Stats().DiskBytes)
+	assert.Nil(t, testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"datastore_keys", "datastore_disk_bytes", "datastore_compactions_total", "datastore_background_errors_total"))
+	assert.Equal(t, 2, testutil.CollectAndCount(c.getDuration))
+	assert.Equal(t, float64(4*40), testutil.ToFloat64(c.putBytes))
+}
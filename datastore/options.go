@@ -0,0 +1,126 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+// Option configures a Db on creation.
+type Option func(*Db)
+
+// WithRetention makes merge drop sealed segments which were last written
+// more than d ago.
+func WithRetention(d time.Duration) Option {
+	return func(db *Db) {
+		db.retention = d
+	}
+}
+
+// WithCompactionPolicy replaces the default SizeTiered compaction.
+func WithCompactionPolicy(p CompactionPolicy) Option {
+	return func(db *Db) {
+		db.compaction = p
+	}
+}
+
+// WithSegmentMergeThreshold sets the initial SegmentMergeThreshold, 10 by
+// default.
+func WithSegmentMergeThreshold(n int) Option {
+	return func(db *Db) {
+		db.segmentMergeThreshold = n
+	}
+}
+
+// WithSegmentPrefix changes the prefix of segment file names, "segment-" by
+// default, so the Db can share the directory with files of the embedder.
+// Segments with a different prefix are not recovered.
+func WithSegmentPrefix(prefix string) Option {
+	return func(db *Db) {
+		db.segmentPrefix = prefix
+	}
+}
+
+// WithRecoveryProgress makes NewDb call fn with the number of segments
+// recovered so far and the number to recover, once before the first and
+// after each, so an embedder can report the progress of a long recovery.
+func WithRecoveryProgress(fn func(recovered, total int)) Option {
+	return func(db *Db) {
+		db.recoveryProgress = fn
+	}
+}
+
+// WithBackend keeps the files of the Db in the backend instead of the os
+// file system, see Backend.
+func WithBackend(b Backend) Option {
+	return func(db *Db) {
+		db.backend = b
+	}
+}
+
+// Options are the tunables of a Db that can be changed at runtime.
+type Options struct {
+	// MaxSegmentSize applies to segments rolled after the change. The active
+	// segment is sealed on the next write if it already exceeds the new size.
+	MaxSegmentSize MemoryUnit
+	// SegmentMergeThreshold is checked whenever a new segment is created.
+	SegmentMergeThreshold int
+	// CompactionRate limits the bytes merges read and write per second,
+	// zero for no limit. Merges in progress slow down or speed up at once.
+	CompactionRate MemoryUnit
+}
+
+type optionsRequest struct {
+	opts Options
+	res  chan error
+}
+
+func (o Options) validate() error {
+	if o.MaxSegmentSize < Byte || o.MaxSegmentSize%Byte != 0 {
+		return fmt.Errorf("max segment size must be a positive number of bytes")
+	}
+	if o.SegmentMergeThreshold < 2 {
+		return fmt.Errorf("segment merge threshold must be at least 2")
+	}
+	if o.CompactionRate < 0 {
+		return fmt.Errorf("compaction rate must not be negative")
+	}
+	return nil
+}
+
+func (db *Db) Options() Options {
+	db.optionsMu.RLock()
+	defer db.optionsMu.RUnlock()
+
+	return Options{
+		MaxSegmentSize:        db.maxSegmentSize,
+		SegmentMergeThreshold: db.segmentMergeThreshold,
+		CompactionRate:        FromBytes(db.throttle.getRate()),
+	}
+}
+
+// SetOptions changes the options of the running Db. The change is applied by
+// the write loop, so writes queued before the call complete with the old
+// options and every later write observes the new ones.
+func (db *Db) SetOptions(opts Options) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	res := make(chan error)
+	select {
+	case db.optionsChan <- optionsRequest{opts: opts, res: res}:
+		return <-res
+	case <-db.done:
+		return ErrClosed
+	}
+}
+
+func (db *Db) applyOptions(opts Options) error {
+	db.optionsMu.Lock()
+	defer db.optionsMu.Unlock()
+
+	db.maxSegmentSize = opts.MaxSegmentSize
+	db.segmentMergeThreshold = opts.SegmentMergeThreshold
+	db.throttle.setRate(opts.CompactionRate.Bytes())
+	return nil
+}
@@ -0,0 +1,29 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+)
+
+// maxPrincipalLength bounds principals, whose length is stored in a byte.
+const maxPrincipalLength = 255
+
+// ErrInvalidPrincipal is returned by writes attributed to a principal longer
+// than maxPrincipalLength bytes.
+var ErrInvalidPrincipal = fmt.Errorf("principals must be at most %d bytes long", maxPrincipalLength)
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx attributing the writes made with it,
+// such as those of PutStringContext or WriteContext, to principal. The
+// principal is stored with the entries written and reported by the Change
+// of each, so replicas and consumers of Changes learn who made it.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// principalOf returns the principal ctx attributes writes to, empty if none.
+func principalOf(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey{}).(string)
+	return principal
+}
@@ -0,0 +1,87 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ErrDiskQuotaExceeded is returned for writes which would take the segments
+// over the limit set by WithMaxDiskUsage.
+var ErrDiskQuotaExceeded = fmt.Errorf("disk quota exceeded")
+
+// quotaCompactInterval bounds how often writes over the quota compact, as
+// merging the same segments over again reclaims nothing.
+const quotaCompactInterval = time.Second
+
+// WithMaxDiskUsage limits the total size of segment files. A write that
+// would exceed the limit compacts all the sealed segments first and fails
+// with ErrDiskQuotaExceeded if that does not free enough space. Blob files
+// do not count, only the references to them kept in segments.
+func WithMaxDiskUsage(limit MemoryUnit) Option {
+	return func(db *Db) {
+		db.maxDiskUsage = limit
+	}
+}
+
+func (db *Db) diskUsage() int64 {
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+
+	var total int64
+	for _, seg := range db.segments {
+		if db.archive == nil || !db.archive.archived(seg.path) {
+			total += seg.Size()
+		}
+	}
+	return total
+}
+
+// checkDiskUsage is called by the write loop before writing size bytes.
+func (db *Db) checkDiskUsage(size int64) error {
+	if db.maxDiskUsage <= 0 {
+		return nil
+	}
+	limit := db.maxDiskUsage.Bytes()
+	if db.diskUsage()+size <= limit {
+		return nil
+	}
+
+	// RestoreTo waits for the write loop with mergeMu held, so the write
+	// loop does not wait for mergeMu. A merge in progress frees space on
+	// its own anyway.
+	last := time.Unix(0, db.quotaCompacted.Load())
+	if time.Since(last) >= quotaCompactInterval && db.mergeMu.TryLock() {
+		db.quotaCompacted.Store(time.Now().UnixNano())
+		segments := db.segmentSet()
+		if len(segments) > 1 {
+			if _, err := db.traceMerge(context.Background(), segments, 0, len(segments)-1); err != nil {
+				db.logger.Error("compaction over disk quota failed", "err", err)
+			} else {
+				db.background.compacted()
+			}
+		}
+		db.mergeMu.Unlock()
+	}
+	if db.diskUsage()+size <= limit {
+		return nil
+	}
+	return ErrDiskQuotaExceeded
+}
+
+// Writable returns the error writes fail with whatever they write: ErrClosed
+// once closed, ErrCompactionFailing after too many failed compactions and
+// ErrDiskQuotaExceeded while the segments take all the space WithMaxDiskUsage
+// allows. Unlike writes, it does not compact to free space.
+func (db *Db) Writable() error {
+	if db.isClosed() {
+		return ErrClosed
+	}
+	if err := db.background.writeErr(); err != nil {
+		return err
+	}
+	if db.maxDiskUsage > 0 && db.diskUsage() >= db.maxDiskUsage.Bytes() {
+		return ErrDiskQuotaExceeded
+	}
+	return nil
+}
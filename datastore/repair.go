@@ -0,0 +1,162 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// quarantineDirName is the directory Repair moves damaged files to.
+const quarantineDirName = "quarantine"
+
+// RepairReport describes what Repair did.
+type RepairReport struct {
+	// Repaired are segment files rewritten with the entries salvaged.
+	Repaired []string `json:"repaired,omitempty"`
+	// Quarantined are the original damaged files, moved to the quarantine
+	// directory.
+	Quarantined []string `json:"quarantined,omitempty"`
+	// Salvaged is the number of entries copied from damaged segments.
+	Salvaged int `json:"salvaged"`
+	// Dropped is the number of corrupt regions and entries left behind.
+	Dropped int `json:"dropped"`
+}
+
+// Repair fixes the problems Verify finds in the data directory of a Db which
+// is not open. Decodable entries of a damaged segment are copied into a
+// fresh file taking its place, the damaged one is quarantined. Entries
+// referring to missing blobs are dropped. Segment files sharing an id with
+// the one the Db loads and leftovers of merges are quarantined as well, an
+// interrupted merge is left for the Db to finish.
+func Repair(dir string, opts ...Option) (RepairReport, error) {
+	var report RepairReport
+	verified, err := Verify(dir, opts...)
+	if err != nil {
+		return report, err
+	}
+	db := &Db{outDir: dir, segmentPrefix: defaultSegmentPrefix}
+	for _, opt := range opts {
+		opt(db)
+	}
+
+	for _, seg := range verified.Segments {
+		if seg.Path != db.segmentPath(dir, seg.Id) {
+			if err := report.quarantine(dir, seg.Path); err != nil {
+				return report, err
+			}
+			continue
+		}
+		if len(seg.Findings) == 0 {
+			continue
+		}
+		if err := report.repairSegment(dir, seg); err != nil {
+			return report, err
+		}
+	}
+
+	shadowDir := filepath.Join(dir, shadowDirName)
+	if _, err := os.Stat(shadowDir); err == nil {
+		if _, err := os.Stat(filepath.Join(shadowDir, mergeManifestName)); os.IsNotExist(err) {
+			if err := report.quarantine(dir, shadowDir); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// repairSegment copies entries of the segment which check out into a new
+// file and swaps it with the damaged one. Entries are looked for at every
+// offset after a corrupt region, since its length is not known.
+func (r *RepairReport) repairSegment(dir string, seg SegmentReport) error {
+	in, err := os.Open(seg.Path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := seg.Path + ".repair"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	corrupt := false
+	for pos := int64(0); pos < seg.Bytes; {
+		e, size, problem, err := checkEntry(OSBackend{}, in, pos, seg.Bytes, dir)
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			// A corrupt region counts once.
+			if !corrupt {
+				r.Dropped++
+			}
+			corrupt = true
+			pos++
+			continue
+		}
+		corrupt = false
+		if problem != "" {
+			r.Dropped++
+			pos += size
+			continue
+		}
+		// Offsets of the sparse index do not hold once entries are
+		// dropped, the Db rebuilds it on recovery.
+		if e.key == sparseIndexKey {
+			pos += size
+			continue
+		}
+
+		data := make([]byte, size)
+		if _, err := in.ReadAt(data, pos); err != nil {
+			return err
+		}
+		if _, err := out.Write(data); err != nil {
+			return err
+		}
+		r.Salvaged++
+		pos += size
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if err := r.quarantine(dir, seg.Path); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, seg.Path); err != nil {
+		return err
+	}
+	r.Repaired = append(r.Repaired, seg.Path)
+	return nil
+}
+
+// quarantine moves the file to the quarantine directory under a name not
+// taken yet.
+func (r *RepairReport) quarantine(dir, path string) error {
+	qdir := filepath.Join(dir, quarantineDirName)
+	if err := os.MkdirAll(qdir, 0o755); err != nil {
+		return err
+	}
+	dst := filepath.Join(qdir, filepath.Base(path))
+	for i := 1; ; i++ {
+		if _, err := os.Stat(dst); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+		dst = filepath.Join(qdir, fmt.Sprintf("%s.%d", filepath.Base(path), i))
+	}
+	if err := os.Rename(path, dst); err != nil {
+		return err
+	}
+	r.Quarantined = append(r.Quarantined, dst)
+	return nil
+}
@@ -0,0 +1,45 @@
+package replication
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+)
+
+// skewSamples is the number of recent heartbeats the skew is estimated from.
+const skewSamples = 8
+
+// SkewMonitor estimates the offset of the local clock from the leader clock
+// carried by heartbeats and reports it to the Db. A heartbeat arrives later
+// than it was sent, so the smallest offset of recent heartbeats is the
+// closest to the true one.
+type SkewMonitor struct {
+	db  *datastore.Db
+	now func() time.Time
+
+	mu      sync.Mutex
+	samples []time.Duration
+}
+
+func NewSkewMonitor(db *datastore.Db) *SkewMonitor {
+	return &SkewMonitor{db: db, now: time.Now}
+}
+
+// Observe accounts a heartbeat, suitable as HTTPTransport.Heartbeat.
+func (m *SkewMonitor) Observe(leaderTime time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.samples = append(m.samples, m.now().Sub(leaderTime))
+	if len(m.samples) > skewSamples {
+		m.samples = m.samples[1:]
+	}
+	skew := m.samples[0]
+	for _, s := range m.samples[1:] {
+		if s < skew {
+			skew = s
+		}
+	}
+	m.db.ReportClockSkew(skew)
+}
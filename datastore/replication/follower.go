@@ -0,0 +1,111 @@
+package replication
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+)
+
+const (
+	minRetryInterval = 100 * time.Millisecond
+	maxRetryInterval = 5 * time.Second
+)
+
+// Follower applies the change feed of a leader to a local Db in sequence
+// order. It resumes from the latest applied sequence number after the feed
+// breaks, so the local Db must not be written to while following.
+type Follower struct {
+	db        *datastore.Db
+	transport Transport
+
+	following atomic.Bool
+	mu        sync.Mutex
+	cancel    context.CancelFunc
+	stopped   chan struct{}
+}
+
+func NewFollower(db *datastore.Db, transport Transport) *Follower {
+	return &Follower{db: db, transport: transport}
+}
+
+// Start starts following the leader in the background.
+func (f *Follower) Start() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.following.Load() {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	f.stopped = make(chan struct{})
+	f.following.Store(true)
+	go func() {
+		defer close(f.stopped)
+		f.run(ctx)
+	}()
+}
+
+// Following reports whether the follower still tails the leader.
+func (f *Follower) Following() bool {
+	return f.following.Load()
+}
+
+// Promote stops following, the local Db may accept writes once it returns.
+// It reports false if the follower was not following.
+func (f *Follower) Promote() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.following.Load() {
+		return false
+	}
+	f.cancel()
+	<-f.stopped
+	f.following.Store(false)
+	return true
+}
+
+func (f *Follower) run(ctx context.Context) {
+	retry := minRetryInterval
+	for ctx.Err() == nil {
+		if f.tail(ctx) {
+			retry = minRetryInterval
+		}
+
+		select {
+		case <-time.After(retry):
+		case <-ctx.Done():
+			return
+		}
+		if retry *= 2; retry > maxRetryInterval {
+			retry = maxRetryInterval
+		}
+	}
+}
+
+// tail applies the feed until it breaks and reports whether any change was
+// applied.
+func (f *Follower) tail(ctx context.Context) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	changes, err := f.transport.Changes(ctx, f.db.LastSeq())
+	if err != nil {
+		log.Printf("Failed to follow the leader: %s", err)
+		return false
+	}
+	applied := false
+	for c := range changes {
+		if err := f.db.Apply(c); err != nil {
+			log.Printf("Failed to apply change %d of %s: %s", c.Seq, c.Key, err)
+			return applied
+		}
+		applied = true
+	}
+	return applied
+}
@@ -0,0 +1,221 @@
+package replication
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func newDb(t *testing.T) *datastore.Db {
+	db, err := datastore.NewInMemoryDb(10 * datastore.Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func waitSeq(t *testing.T, db *datastore.Db, seq uint64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for db.LastSeq() < seq {
+		if time.Now().After(deadline) {
+			t.Fatalf("Follower is at %d, expected %d", db.LastSeq(), seq)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func testFollower(t *testing.T, leader *datastore.Db, transport Transport) {
+	_, err := leader.PutString("key1", "value1")
+	assert.Nil(t, err)
+	_, err = leader.PutInt64("key2", 2)
+	assert.Nil(t, err)
+
+	follower := newDb(t)
+	f := NewFollower(follower, transport)
+	f.Start()
+	waitSeq(t, follower, 2)
+
+	_, err = leader.PutStringWithTTL("key1", "value2", time.Hour)
+	assert.Nil(t, err)
+	waitSeq(t, follower, 3)
+
+	val, err := follower.GetString("key1")
+	assert.Nil(t, err)
+	assert.Equal(t, "value2", val)
+	_, leaderMeta, err := leader.GetWithMeta("key1")
+	assert.Nil(t, err)
+	_, followerMeta, err := follower.GetWithMeta("key1")
+	assert.Nil(t, err)
+	assert.Equal(t, leaderMeta.UpdatedAt.UnixNano(), followerMeta.UpdatedAt.UnixNano())
+	intVal, err := follower.GetInt64("key2")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), intVal)
+
+	assert.True(t, f.Promote())
+	assert.False(t, f.Following())
+	assert.False(t, f.Promote())
+
+	_, err = leader.PutString("key3", "value3")
+	assert.Nil(t, err)
+	_, err = follower.PutString("key4", "value4")
+	assert.Nil(t, err)
+	_, err = follower.GetString("key3")
+	assert.Equal(t, datastore.ErrNotFound, err)
+	assert.Equal(t, uint64(4), follower.LastSeq())
+}
+
+func TestFollower_Local(t *testing.T) {
+	leader := newDb(t)
+	testFollower(t, leader, Local{Db: leader})
+}
+
+func TestFollower_HTTP(t *testing.T) {
+	leader := newDb(t)
+	server := httptest.NewServer(Handler(leader))
+	defer server.Close()
+	testFollower(t, leader, &HTTPTransport{URL: server.URL})
+}
+
+func TestFollower_CatchUpDeletes(t *testing.T) {
+	leader := newDb(t)
+	_, err := leader.PutString("key1", "value1")
+	assert.Nil(t, err)
+	_, err = leader.PutString("key2", "value1")
+	assert.Nil(t, err)
+
+	follower := newDb(t)
+	f := NewFollower(follower, Local{Db: leader})
+	f.Start()
+	waitSeq(t, follower, 2)
+	assert.True(t, f.Promote())
+
+	// The delete is sent from the backlog of the leader.
+	assert.Nil(t, leader.Delete("key1"))
+	f = NewFollower(follower, Local{Db: leader})
+	f.Start()
+	defer f.Promote()
+	waitSeq(t, follower, 3)
+	_, err = follower.GetString("key1")
+	assert.Equal(t, datastore.ErrNotFound, err)
+	_, err = follower.GetString("key2")
+	assert.Nil(t, err)
+}
+
+func TestWireChange(t *testing.T) {
+	for _, c := range []datastore.Change{
+		{Seq: 1, Key: "s", Type: datastore.Str, Value: "value", WrittenAt: time.Unix(0, 1600000000000000000), Principal: "alice"},
+		{Seq: 2, Key: "i", Type: datastore.Int, Value: int64(-7), ExpiresAt: time.Unix(0, 1700000000000000000)},
+	} {
+		decoded, err := decodeChange(encodeChange(c))
+		assert.Nil(t, err)
+		assert.Equal(t, c, decoded)
+	}
+
+	_, err := decodeChange(wireChange{Seq: 1, Key: "k", Type: "float"})
+	assert.Error(t, err)
+}
+
+func TestSkewMonitor(t *testing.T) {
+	db := newDb(t)
+	now := time.Unix(1000, 0)
+	m := NewSkewMonitor(db)
+	m.now = func() time.Time { return now }
+
+	// The local clock is a second ahead, heartbeats take 10-50ms to arrive.
+	m.Observe(now.Add(-time.Second - 50*time.Millisecond))
+	assert.Equal(t, time.Second+50*time.Millisecond, db.ClockSkew())
+	m.Observe(now.Add(-time.Second - 10*time.Millisecond))
+	m.Observe(now.Add(-time.Second - 30*time.Millisecond))
+	assert.Equal(t, time.Second+10*time.Millisecond, db.ClockSkew())
+}
+
+func TestHTTPTransport_Heartbeat(t *testing.T) {
+	leader := newDb(t)
+	server := httptest.NewServer(Handler(leader))
+	defer server.Close()
+
+	beats := make(chan time.Time, 1)
+	transport := &HTTPTransport{URL: server.URL, Heartbeat: func(leaderTime time.Time) {
+		select {
+		case beats <- leaderTime:
+		default:
+		}
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := transport.Changes(ctx, 0)
+	assert.Nil(t, err)
+
+	select {
+	case beat := <-beats:
+		assert.WithinDuration(t, time.Now(), beat, time.Second)
+	case <-time.After(2 * time.Second):
+		t.Fatal("No heartbeat received")
+	}
+}
+
+func TestHTTPTransport_Header(t *testing.T) {
+	leader := newDb(t)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-API-Key") != "follower" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		Handler(leader).ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := (&HTTPTransport{URL: server.URL}).Changes(ctx, 0)
+	assert.Error(t, err)
+	header := http.Header{}
+	header.Set("X-API-Key", "follower")
+	_, err = (&HTTPTransport{URL: server.URL, Header: header}).Changes(ctx, 0)
+	assert.Nil(t, err)
+}
+
+func TestHandler_WriteTimeout(t *testing.T) {
+	leader := newDb(t)
+	_, err := leader.PutString("key1", "value1")
+	assert.Nil(t, err)
+	server := httptest.NewUnstartedServer(Handler(leader))
+	server.Config.WriteTimeout = 50 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, err := (&HTTPTransport{URL: server.URL}).Changes(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := <-changes
+	assert.Equal(t, "key1", c.Key)
+
+	// Writes past the write timeout still reach the follower.
+	time.Sleep(150 * time.Millisecond)
+	_, err = leader.PutString("key2", "value2")
+	assert.Nil(t, err)
+	select {
+	case c, ok := <-changes:
+		assert.True(t, ok)
+		assert.Equal(t, "key2", c.Key)
+	case <-time.After(2 * time.Second):
+		t.Fatal("No change received")
+	}
+
+	resp, err := http.Get(server.URL + "?since=one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
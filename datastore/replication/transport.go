@@ -0,0 +1,241 @@
+// Package replication keeps follower Dbs in sync with a leader by tailing
+// its change feed.
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+)
+
+// heartbeatInterval is how often the feed handler writes a heartbeat to an
+// idle connection. HTTPTransport drops connections idle for several
+// intervals.
+const heartbeatInterval = 10 * time.Second
+
+// Transport delivers the change feed of a leader.
+type Transport interface {
+	// Changes returns writes after sinceSeq in sequence order. The channel
+	// is closed when the feed breaks or ctx is done.
+	Changes(ctx context.Context, sinceSeq uint64) (<-chan datastore.Change, error)
+}
+
+// Local is the transport of a leader in the same process.
+type Local struct {
+	Db *datastore.Db
+}
+
+func (l Local) Changes(ctx context.Context, sinceSeq uint64) (<-chan datastore.Change, error) {
+	return l.Db.ChangesContext(ctx, sinceSeq)
+}
+
+// wireHeartbeat is a line of the feed carrying the leader clock, told from
+// changes by the heartbeat field.
+type wireHeartbeat struct {
+	Heartbeat bool `json:"heartbeat"`
+	// Time is a unix time in nanoseconds.
+	Time int64 `json:"time"`
+}
+
+// wireChange is the JSON form of a change, one per line of the feed.
+type wireChange struct {
+	Heartbeat bool `json:"heartbeat,omitempty"`
+
+	Seq   uint64 `json:"seq"`
+	Key   string `json:"key"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	// ExpiresAt is a unix time in nanoseconds, zero for values without TTL.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// WrittenAt is a unix time in nanoseconds, zero if unknown.
+	WrittenAt int64 `json:"written_at,omitempty"`
+	// Principal is who the write is attributed to, empty if no one.
+	Principal string `json:"principal,omitempty"`
+}
+
+func encodeChange(c datastore.Change) wireChange {
+	w := wireChange{Seq: c.Seq, Key: c.Key, Type: c.Type.String(), Principal: c.Principal}
+	switch v := c.Value.(type) {
+	case string:
+		w.Value = v
+	case int64:
+		w.Value = strconv.FormatInt(v, 10)
+	}
+	if !c.ExpiresAt.IsZero() {
+		w.ExpiresAt = c.ExpiresAt.UnixNano()
+	}
+	if !c.WrittenAt.IsZero() {
+		w.WrittenAt = c.WrittenAt.UnixNano()
+	}
+	return w
+}
+
+func decodeChange(w wireChange) (datastore.Change, error) {
+	c := datastore.Change{Seq: w.Seq, Key: w.Key, Principal: w.Principal}
+	switch w.Type {
+	case datastore.Str.String():
+		c.Type, c.Value = datastore.Str, w.Value
+	case datastore.Int.String():
+		v, err := strconv.ParseInt(w.Value, 10, 64)
+		if err != nil {
+			return c, err
+		}
+		c.Type, c.Value = datastore.Int, v
+	default:
+		return c, fmt.Errorf("unknown value type %q", w.Type)
+	}
+	if w.ExpiresAt != 0 {
+		c.ExpiresAt = time.Unix(0, w.ExpiresAt)
+	}
+	if w.WrittenAt != 0 {
+		c.WrittenAt = time.Unix(0, w.WrittenAt)
+	}
+	return c, nil
+}
+
+// Handler serves the change feed of db as newline delimited JSON. The
+// since query parameter sets the sequence number to start after, the feed
+// starts from the first write without one. The feed outlives write timeouts
+// of the server, followers stay connected for as long as they follow.
+func Handler(db *datastore.Db) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var since uint64
+		if s := req.URL.Query().Get("since"); s != "" {
+			var err error
+			if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		changes, err := db.ChangesContext(req.Context(), since)
+		if err != nil {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = http.NewResponseController(rw).SetWriteDeadline(time.Time{})
+		flusher, _ := rw.(http.Flusher)
+		flush := func() {
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		rw.Header().Set("content-type", "application/x-ndjson")
+		rw.WriteHeader(http.StatusOK)
+
+		enc := json.NewEncoder(rw)
+		beat := func() error {
+			return enc.Encode(wireHeartbeat{Heartbeat: true, Time: time.Now().UnixNano()})
+		}
+		if beat() != nil {
+			return
+		}
+		flush()
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case c, ok := <-changes:
+				if !ok {
+					return
+				}
+				if err := enc.Encode(encodeChange(c)); err != nil {
+					return
+				}
+			case <-heartbeat.C:
+				if beat() != nil {
+					return
+				}
+			}
+			flush()
+		}
+	})
+}
+
+// HTTPTransport reads the change feed served by Handler at URL.
+type HTTPTransport struct {
+	URL    string
+	Client *http.Client
+	// Header is sent along the requests of the feed, an API key of the
+	// leader for one.
+	Header http.Header
+	// Heartbeat, if set, is called with the leader clock of every heartbeat
+	// as soon as it is received.
+	Heartbeat func(leaderTime time.Time)
+}
+
+func (t *HTTPTransport) Changes(ctx context.Context, sinceSeq uint64) (<-chan datastore.Change, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s?since=%d", t.URL, sinceSeq), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for name, values := range t.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("change feed responded with %s", resp.Status)
+	}
+
+	// A connection without even heartbeats is considered broken.
+	idle := time.AfterFunc(3*heartbeatInterval, cancel)
+	out := make(chan datastore.Change)
+	go func() {
+		defer close(out)
+		defer cancel()
+		defer resp.Body.Close()
+		defer idle.Stop()
+
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(nil, 1<<30)
+		for scanner.Scan() {
+			idle.Reset(3 * heartbeatInterval)
+			line := scanner.Bytes()
+			var w wireChange
+			if err := json.Unmarshal(line, &w); err != nil {
+				return
+			}
+			if w.Heartbeat {
+				var hb wireHeartbeat
+				if err := json.Unmarshal(line, &hb); err != nil {
+					return
+				}
+				if t.Heartbeat != nil {
+					t.Heartbeat(time.Unix(0, hb.Time))
+				}
+				continue
+			}
+			c, err := decodeChange(w)
+			if err != nil {
+				return
+			}
+			select {
+			case out <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,144 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// ErrHistoryCompacted is returned by RestoreTo when the merge has
+	// already dropped values needed to rebuild the requested state.
+	ErrHistoryCompacted = fmt.Errorf("history of the sequence is compacted")
+	ErrSeqAhead         = fmt.Errorf("sequence is ahead of the latest write")
+)
+
+type restoreRequest struct {
+	seq uint64
+	res chan error
+}
+
+// CompactedSeq returns the latest sequence number merged so far. States
+// before it can not be restored since merge keeps only the latest values.
+func (db *Db) CompactedSeq() uint64 {
+	return db.compactedSeq.Load()
+}
+
+// RestoreTo rebuilds the Db as it was right after the write with sequence
+// number seq: keys keep their latest values not newer than seq and keys
+// first written later are gone. Writes wait until the restore completes,
+// the original segments are replaced the same crash safe way merge does.
+//
+// Sequence numbers keep growing from LastSeq. The restore is not part of
+// the change feed, so followers have to be synced from scratch.
+func (db *Db) RestoreTo(seq uint64) error {
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+
+	res := make(chan error)
+	select {
+	case db.restoreChan <- restoreRequest{seq: seq, res: res}:
+		return <-res
+	case <-db.done:
+		return ErrClosed
+	}
+}
+
+// restore is run by the write loop with mergeMu held.
+func (db *Db) restore(seq uint64) error {
+	// The active segment is replaced too, flushStats waits.
+	db.appendMu.Lock()
+	defer db.appendMu.Unlock()
+
+	if seq > db.lastSeq.Load() {
+		return ErrSeqAhead
+	}
+	if seq < db.compactedSeq.Load() {
+		return ErrHistoryCompacted
+	}
+
+	segments := db.segmentSet()
+	now := time.Now().UnixNano()
+	vals := make(map[string]*entry)
+	blobs := make(map[int64]bool)
+	for _, seg := range segments {
+		it := newEntryIterator(context.Background(), seg)
+		for {
+			e, err := it.Next()
+			if err != nil {
+				return err
+			}
+			if e == nil {
+				break
+			}
+			if e.key == sparseIndexKey || e.key == statsKey {
+				continue
+			}
+			if e.blob != nil {
+				blobs[e.blob.id] = true
+			}
+			if e.seq > seq {
+				continue
+			}
+			// Merged segments are ordered by keys, so the latest value is
+			// told by its sequence number.
+			if cur, ok := vals[e.key]; !ok || cur.seq <= e.seq {
+				vals[e.key] = e
+			}
+		}
+	}
+	types := make(map[string]ValueType, len(vals))
+	for key, e := range vals {
+		if e.expired(now) {
+			delete(vals, key)
+			continue
+		}
+		types[key] = e.valueType
+		if e.blob != nil {
+			delete(blobs, e.blob.id)
+		}
+	}
+
+	// Every entry up to now is rewritten, older states are gone once the
+	// restore is applied. The lifetime counters saying so are rewritten
+	// along.
+	compactedSeq := db.lastSeq.Load()
+	stats, err := db.statsEntry(compactedSeq)
+	if err != nil {
+		return err
+	}
+	vals[statsKey] = stats
+
+	shadowDir := filepath.Join(db.outDir, shadowDirName)
+	if err := removeAll(db.backend, shadowDir); err != nil {
+		return err
+	}
+	merged, manifest, err := db.prepareMerge(context.Background(), shadowDir, segments, vals, time.Time{})
+	if err != nil {
+		for _, seg := range merged {
+			seg.release()
+		}
+		removeAll(db.backend, shadowDir)
+		return err
+	}
+
+	db.segmentsMu.Lock()
+	err = db.applyMerge(db.outDir, manifest)
+	if err == nil {
+		for _, seg := range merged {
+			seg.path = db.segmentPath(db.outDir, seg.id)
+		}
+		db.dropSegments(db.segments, blobs, manifest.Archive)
+		db.segments = merged
+	}
+	db.segmentsMu.Unlock()
+	if err != nil {
+		return err
+	}
+	db.compactedSeq.Store(compactedSeq)
+
+	db.types.reset(types)
+	_, err = db.initNewSegment()
+	return err
+}
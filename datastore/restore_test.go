@@ -0,0 +1,111 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDb_RestoreTo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*2*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.PutString("key1", "value1")
+	assert.Nil(t, err)
+	_, err = db.PutString("key2", "value1")
+	assert.Nil(t, err)
+	_, err = db.PutString("key1", "value2")
+	assert.Nil(t, err)
+	_, err = db.PutInt64("key3", 3)
+	assert.Nil(t, err)
+	_, err = db.PutString("key2", "value2")
+	assert.Nil(t, err)
+
+	assertState := func(t *testing.T, db *Db) {
+		val, err := db.GetString("key1")
+		assert.Nil(t, err)
+		assert.Equal(t, "value1", val)
+		val, err = db.GetString("key2")
+		assert.Nil(t, err)
+		assert.Equal(t, "value1", val)
+		_, err = db.GetInt64("key3")
+		assert.Equal(t, ErrNotFound, err)
+		assert.Empty(t, db.KeysByType(Int))
+	}
+
+	t.Run("ahead of the log", func(t *testing.T) {
+		assert.Equal(t, ErrSeqAhead, db.RestoreTo(6))
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		assert.Nil(t, db.RestoreTo(2))
+		assertState(t, db)
+		assert.Equal(t, []string{"key1", "key2"}, db.KeysByType(Str))
+		assert.Equal(t, uint64(5), db.LastSeq())
+		assert.Equal(t, uint64(5), db.CompactedSeq())
+
+		_, err = db.PutString("key4", "value1")
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(6), db.LastSeq())
+	})
+
+	t.Run("compacted history", func(t *testing.T) {
+		assert.Equal(t, ErrHistoryCompacted, db.RestoreTo(1))
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, 40*2*Byte)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertState(t, db)
+		val, err := db.GetString("key4")
+		assert.Nil(t, err)
+		assert.Equal(t, "value1", val)
+		assert.Equal(t, uint64(5), db.CompactedSeq())
+	})
+}
+
+func TestDb_RestoreFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := &failingBackend{Backend: OSBackend{}}
+	db, err := NewDb(dir, 40*2*Byte, WithBackend(backend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, value := range []string{"value1", "value2", "value3"} {
+		_, err = db.PutString("key1", value)
+		assert.Nil(t, err)
+	}
+
+	// Nothing was replaced, the history is still there.
+	backend.failing.Store(true)
+	assert.Error(t, db.RestoreTo(1))
+	backend.failing.Store(false)
+	assert.Equal(t, uint64(0), db.CompactedSeq())
+	changes, err := db.Changes(0)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), (<-changes).Seq)
+	assert.Nil(t, db.RestoreTo(1))
+}
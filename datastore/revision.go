@@ -0,0 +1,137 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ErrConflict is returned by conditional writes when the key is not at the
+// expected revision.
+var ErrConflict = fmt.Errorf("key was changed")
+
+// AnyRevision makes PutIfRevision write whatever the revision of the key is,
+// as PutString does.
+const AnyRevision uint64 = math.MaxUint64
+
+// PutIfRevision stores the value unless the key has changed since rev,
+// failing with ErrConflict then, and returns the new revision of the key.
+//
+// The revision of a key is the sequence number of its latest write, Seq of
+// GetWithMeta, which PutString and the other Put methods return as well.
+// Keys which do not exist, expired or deleted ones included, are at
+// revision 0, as are keys written before sequence numbers were introduced;
+// rev 0 thus only creates the key.
+func (db *Db) PutIfRevision(key, value string, rev uint64) (uint64, error) {
+	return db.PutIfRevisionContext(context.Background(), key, value, rev)
+}
+
+// PutIfRevisionContext is PutIfRevision traced as a child of the span of
+// ctx. Unless the write loop takes the write before ctx is done, nothing is
+// written and the error of ctx is returned.
+func (db *Db) PutIfRevisionContext(ctx context.Context, key, value string, rev uint64) (uint64, error) {
+	return db.putIfRevision(ctx, &entry{key: key, value: value, valueType: Str}, rev)
+}
+
+// PutInt64IfRevision is PutIfRevision for int64 values.
+func (db *Db) PutInt64IfRevision(key string, value int64, rev uint64) (uint64, error) {
+	return db.PutInt64IfRevisionContext(context.Background(), key, value, rev)
+}
+
+// PutInt64IfRevisionContext is PutIfRevisionContext for int64 values.
+func (db *Db) PutInt64IfRevisionContext(ctx context.Context, key string, value int64, rev uint64) (uint64, error) {
+	return db.putIfRevision(ctx, &entry{key: key, value: value, valueType: Int}, rev)
+}
+
+// PutIfRevisionWithTTL is PutIfRevision for values considered deleted once
+// ttl passes, as with PutStringWithTTL.
+func (db *Db) PutIfRevisionWithTTL(key, value string, rev uint64, ttl time.Duration) (uint64, error) {
+	return db.PutIfRevisionWithTTLContext(context.Background(), key, value, rev, ttl)
+}
+
+// PutIfRevisionWithTTLContext is PutIfRevisionContext with a TTL.
+func (db *Db) PutIfRevisionWithTTLContext(ctx context.Context, key, value string, rev uint64, ttl time.Duration) (uint64, error) {
+	if err := db.checkClockSkew(); err != nil {
+		return 0, err
+	}
+	return db.putIfRevision(ctx, &entry{key: key, value: value, valueType: Str, expiresAt: expiresAt(ttl)}, rev)
+}
+
+// PutInt64IfRevisionWithTTL is PutIfRevisionWithTTL for int64 values.
+func (db *Db) PutInt64IfRevisionWithTTL(key string, value int64, rev uint64, ttl time.Duration) (uint64, error) {
+	return db.PutInt64IfRevisionWithTTLContext(context.Background(), key, value, rev, ttl)
+}
+
+// PutInt64IfRevisionWithTTLContext is PutIfRevisionWithTTLContext for int64
+// values.
+func (db *Db) PutInt64IfRevisionWithTTLContext(ctx context.Context, key string, value int64, rev uint64, ttl time.Duration) (uint64, error) {
+	if err := db.checkClockSkew(); err != nil {
+		return 0, err
+	}
+	return db.putIfRevision(ctx, &entry{key: key, value: value, valueType: Int, expiresAt: expiresAt(ttl)}, rev)
+}
+
+// DeleteIfRevision deletes the key unless it has changed since rev, failing
+// with ErrConflict then. AnyRevision deletes it whatever the revision is, as
+// Delete does.
+func (db *Db) DeleteIfRevision(key string, rev uint64) error {
+	return db.DeleteIfRevisionContext(context.Background(), key, rev)
+}
+
+// DeleteIfRevisionContext is DeleteIfRevision given up as
+// PutIfRevisionContext is once ctx is done.
+func (db *Db) DeleteIfRevisionContext(ctx context.Context, key string, rev uint64) error {
+	if isBucketKey(key) {
+		return ErrReservedKey
+	}
+	return db.put(PutRequest{
+		ctx:           ctx,
+		entry:         &entry{key: key, value: "", valueType: Str, expiresAt: tombstoneExpiry},
+		checkRevision: rev != AnyRevision,
+		revision:      rev,
+	})
+}
+
+func (db *Db) putIfRevision(ctx context.Context, e *entry, rev uint64) (uint64, error) {
+	if err := db.checkKey(e.key); err != nil {
+		return 0, err
+	}
+	err := db.put(PutRequest{ctx: ctx, entry: e, checkRevision: rev != AnyRevision, revision: rev})
+	if err != nil {
+		return 0, err
+	}
+	return e.seq, nil
+}
+
+// revision returns the revision of the key, read by the write loop before
+// conditional writes.
+func (db *Db) revision(key string) (uint64, error) {
+	e, err := db.latest(key)
+	if err != nil || e == nil {
+		return 0, err
+	}
+	return e.seq, nil
+}
+
+// latest returns the latest entry of the key, nil if the key does not exist
+// or has expired.
+func (db *Db) latest(key string) (*entry, error) {
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		e, err := db.segments[i].entry(key)
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			continue
+		}
+		if e.expired(time.Now().UnixNano()) {
+			return nil, nil
+		}
+		return e, nil
+	}
+	return nil, nil
+}
@@ -2,23 +2,232 @@ package datastore
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var (
+	errExpired = fmt.Errorf("record has expired")
+	// ErrNotString is returned by GetString for keys holding int64s.
+	ErrNotString = fmt.Errorf("value is not a string")
+	// ErrNotInt64 is returned by GetInt64 and Increment for keys holding
+	// strings.
+	ErrNotInt64 = fmt.Errorf("value is not an int64")
+)
+
+// maxSectionSize bounds section readers over segment files which may still
+// grow.
+const maxSectionSize = 1 << 62
+
+// Segment is a segment file along with its index. The mutex guards every
+// field which changes once the segment is in the segment list of the Db:
+// the offset, the reader, the index and the memtable, as well as expiring
+// entries and dead bytes. Segments still being recovered or written by a
+// merge are private and not locked.
 type Segment struct {
 	offset int64
-	file   *os.File
-	index  map[string]int64
-	mu     sync.RWMutex
-	id     int
+	path   string
+	// backend keeps the segment file.
+	backend Backend
+	// file is the append handle of the active segment.
+	file File
+	// reader serves all reads of the segment. It stays valid when merge
+	// renames or removes the segment file.
+	reader File
+	// retired are readers replaced by the flush of the memtable, they are
+	// closed with the segment since snapshots may still read them.
+	retired []File
+	index   Index
+	// mem buffers the entries of the active segment, it is the index of the
+	// segment until flushed.
+	mem *memtable
+	mu  sync.RWMutex
+	id  int
+
+	// expiring holds the latest entries of keys written with a TTL.
+	expiring  map[string]*expiry
+	deadBytes int64
+
+	// pins counts iterators reading the segment. A segment dropped by a
+	// merge is released once the last one is done, afterDrop runs then.
+	pins      int
+	dropped   bool
+	afterDrop func()
+}
+
+type expiry struct {
+	at   int64
+	size int64
+	// swept is set once the entry bytes are accounted as dead.
+	swept bool
+}
+
+// defaultSegmentPrefix is the prefix of segment file names unless changed
+// with WithSegmentPrefix.
+const defaultSegmentPrefix = "segment-"
+
+func (db *Db) segmentPath(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%d", db.segmentPrefix, id))
+}
+
+// openSegment opens the segment file for reading and, if writable, for
+// appending. A writable segment file is created when missing.
+func openSegment(backend Backend, path string, id int, writable bool, index Index) (*Segment, error) {
+	s := &Segment{
+		path:     path,
+		backend:  backend,
+		index:    index,
+		expiring: make(map[string]*expiry),
+		id:       id,
+	}
+	switch index := index.(type) {
+	case *memtable:
+		s.mem = index
+	case *sortedIndex:
+		index.seg = s
+	}
+
+	var err error
+	if writable {
+		s.file, err = backend.Create(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.reader, err = backend.Open(path)
+	if err != nil {
+		if s.file != nil {
+			s.file.Close()
+		}
+		return nil, err
+	}
+	return s, nil
 }
 
+// Close seals the segment, it remains readable until released. The file is
+// synced first, entries of sealed segments are durable.
 func (s *Segment) Close() error {
-	return s.file.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	return err
+}
+
+// Sync commits the entries written to the segment to the storage.
+func (s *Segment) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Sync()
+}
+
+// loadSparseIndex makes the sparse index ending the segment file, if any,
+// the index of the segment.
+func (s *Segment) loadSparseIndex() error {
+	info, err := stat(s.backend, s.path)
+	if err != nil {
+		return err
+	}
+	index, err := readSortedIndex(s.reader, info.Size())
+	if err != nil || index == nil {
+		return err
+	}
+	index.seg = s
+	s.index = index
+	return nil
+}
+
+// writeSparseIndex completes the sorted segment written by merge with its
+// sparse index.
+func (s *Segment) writeSparseIndex() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index, ok := s.index.(*sortedIndex)
+	if !ok {
+		return nil
+	}
+	e := index.complete(s.offset)
+	if e == nil {
+		return nil
+	}
+	n, err := s.file.Write(e.Encode())
+	s.offset += int64(n)
+	return err
+}
+
+// unpin lets the segment pinned by capture go. Pinned segments stay
+// readable even once a merge drops them.
+func (s *Segment) unpin() {
+	s.mu.Lock()
+	s.pins--
+	release := s.pins == 0 && s.dropped
+	s.mu.Unlock()
+	if release {
+		s.releaseDropped()
+	}
+}
+
+// drop releases the segment removed from the segment list once no iterator
+// pins it, then runs after if given.
+func (s *Segment) drop(after func()) {
+	s.mu.Lock()
+	s.dropped = true
+	s.afterDrop = after
+	release := s.pins == 0
+	s.mu.Unlock()
+	if release {
+		s.releaseDropped()
+	}
+}
+
+func (s *Segment) releaseDropped() {
+	s.release()
+	if s.afterDrop != nil {
+		s.afterDrop()
+	}
+}
+
+// dropSegments drops the segments a merge replaced. Blob files referenced by
+// them only are removed, or moved to the archive directory of the merge,
+// once they are all released; iterators may still read them until then.
+func (db *Db) dropSegments(segments []*Segment, blobs map[int64]bool, archive string) {
+	if len(segments) == 0 {
+		db.archiveBlobs(blobs, archive)
+		return
+	}
+	var left atomic.Int32
+	left.Store(int32(len(segments)))
+	for _, seg := range segments {
+		seg.drop(func() {
+			if left.Add(-1) == 0 {
+				db.archiveBlobs(blobs, archive)
+			}
+		})
+	}
+}
+
+func (s *Segment) release() error {
+	s.Close()
+	for _, r := range s.retired {
+		r.Close()
+	}
+	return s.reader.Close()
 }
 
 func (s *Segment) Write(p *entry) error {
@@ -32,32 +241,46 @@ func (s *Segment) Write(p *entry) error {
 	pos := s.offset
 	s.offset += int64(n)
 
-	s.SetIndex(p.key, pos)
+	s.indexEntry(p, pos)
 
 	return nil
 }
 
+func (s *Segment) indexEntry(e *entry, pos int64) {
+	ie := IndexEntry{Offset: pos, Size: e.Size().Bytes(), Seq: e.seq}
+	if s.mem != nil {
+		s.mem.put(e.key, memVersion{ie: ie, e: e})
+	} else {
+		s.index.Set(e.key, ie)
+	}
+	if e.expiresAt != 0 {
+		s.expiring[e.key] = &expiry{at: e.expiresAt, size: e.Size().Bytes()}
+	} else {
+		delete(s.expiring, e.key)
+	}
+}
+
 func (s *Segment) Get(key string) (interface{}, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	file, err := os.Open(s.file.Name())
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	pos, ok := s.GetIndex(key)
+	pos, ok := s.indexOffset(key)
 	if !ok {
 		return "", fmt.Errorf("can not get an element")
 	}
-
-	_, err = file.Seek(pos, 0)
-	if err != nil {
-		return "", err
+	if exp, ok := s.expiring[key]; ok && exp.at <= time.Now().UnixNano() {
+		return "", errExpired
+	}
+	if s.mem != nil {
+		if v, _ := s.mem.latest(key); v.e != nil {
+			if v.e.blob != nil {
+				return v.e.blob, nil
+			}
+			return v.e.value, nil
+		}
 	}
 
-	reader := bufio.NewReader(file)
+	reader := bufio.NewReader(io.NewSectionReader(s.reader, pos, maxSectionSize))
 	value, err := readValue(reader)
 	if err != nil {
 		return "", err
@@ -66,90 +289,377 @@ func (s *Segment) Get(key string) (interface{}, error) {
 	return value, nil
 }
 
+// entry reads the whole indexed entry of the key, expired or not. It returns
+// nil if the key is not in the segment.
+func (s *Segment) entry(key string) (*entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.mem != nil {
+		v, ok := s.mem.latest(key)
+		if !ok {
+			return nil, nil
+		}
+		if v.e != nil {
+			e := *v.e
+			return &e, nil
+		}
+	}
+	ie, ok := s.index.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	data := make([]byte, ie.Size)
+	if _, err := s.reader.ReadAt(data, ie.Offset); err != nil {
+		return nil, err
+	}
+	var e entry
+	if err := e.Decode(data); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// entryHeader reads the indexed entry of the key but its value, along with
+// the length of the value and the encoded size of the entry. It returns nil
+// if the key is not in the segment.
+func (s *Segment) entryHeader(key string) (*entry, int64, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.mem != nil {
+		v, ok := s.mem.latest(key)
+		if !ok {
+			return nil, 0, 0, nil
+		}
+		if v.e != nil {
+			e := *v.e
+			var vl int64 = blobRefSize
+			if e.blob == nil {
+				vl = valueSize(e.value)
+			}
+			return &e, vl, v.ie.Size, nil
+		}
+	}
+	ie, ok := s.index.Get(key)
+	if !ok {
+		return nil, 0, 0, nil
+	}
+	e, vl, err := readEntryHeaderAt(s.reader, ie.Offset)
+	return e, vl, ie.Size, err
+}
+
+// valueRegion returns the offset and the length of the string value of the
+// key within the segment file, or the reference of the value spilled over to
+// a blob file.
+func (s *Segment) valueRegion(key string) (int64, int64, *blobRef, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pos, ok := s.indexOffset(key)
+	if !ok {
+		return 0, 0, nil, fmt.Errorf("can not get an element")
+	}
+	if exp, ok := s.expiring[key]; ok && exp.at <= time.Now().UnixNano() {
+		return 0, 0, nil, errExpired
+	}
+
+	var header [8]byte
+	if _, err := s.reader.ReadAt(header[:], pos); err != nil {
+		return 0, 0, nil, err
+	}
+	keySize := int64(binary.LittleEndian.Uint32(header[4:]))
+
+	var value [5 + blobRefSize]byte
+	if _, err := s.reader.ReadAt(value[:5], pos+8+keySize); err != nil {
+		return 0, 0, nil, err
+	}
+	offset := pos + 8 + keySize + 5
+	if value[0]&blobFlag != 0 {
+		if _, err := s.reader.ReadAt(value[5:], offset); err != nil {
+			return 0, 0, nil, err
+		}
+		return 0, 0, decodeBlobRef(value[5:]), nil
+	}
+	if ValueType(value[0]&^flagBits) != Str {
+		return 0, 0, nil, ErrNotString
+	}
+	return offset, int64(binary.LittleEndian.Uint32(value[1:])), nil, nil
+}
+
+// Has reports whether the segment holds a value of the key which has not
+// expired, without reading it.
 func (s *Segment) Has(key string) bool {
-	_, err := s.Get(key)
-	return err == nil
+	_, live := s.contains(key, time.Now().UnixNano())
+	return live
+}
+
+// contains reports whether the key is indexed by the segment, and whether
+// its entry is still live by now.
+func (s *Segment) contains(key string, now int64) (indexed, live bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.indexOffset(key); !ok {
+		return false, false
+	}
+	if exp, ok := s.expiring[key]; ok && exp.at <= now {
+		return true, false
+	}
+	return true, true
 }
 
 func (s *Segment) IsSurpassed(maxSize MemoryUnit) bool {
-	return s.offset > maxSize.Bytes()
+	return s.Size() > maxSize.Bytes()
 }
 
 func (s *Segment) FilePath() string {
-	return s.file.Name()
+	return s.path
+}
+
+func (s *Segment) ModTime() (time.Time, error) {
+	info, err := stat(s.backend, s.FilePath())
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
 }
 
 func (s *Segment) GetIndex(key string) (int64, bool) {
-	offset, ok := s.index[key]
-	return offset, ok
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.indexOffset(key)
 }
 
-func (s *Segment) SetIndex(key string, val int64) {
-	s.index[key] = val
+// indexOffset returns the offset of the entry of the key, the segment lock
+// must be held.
+func (s *Segment) indexOffset(key string) (int64, bool) {
+	e, ok := s.index.Get(key)
+	return e.Offset, ok
 }
 
-type generatorPair struct {
-	entry *entry
-	err   error
+// fileReader returns the reader of the segment file. Flushes and archiving
+// replace it, the returned one stays readable until the segment is
+// released.
+func (s *Segment) fileReader() File {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.reader
 }
 
-/**
- * segmentValsGenerator returns a channel that generates entries from a segment file.
- * It is similar to the iterator pattern, but implemented with goroutines.
- */
-func segmentValsGenerator(seg *Segment) <-chan *generatorPair {
-	ch := make(chan *generatorPair)
+// MemoryUsage estimates the memory taken by the segment index.
+func (s *Segment) MemoryUsage() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index.MemoryUsage()
+}
 
-	go func() {
-		offset := 0
-		var buf [bufSize]byte
-		reopen, err := os.Open(seg.file.Name())
-		if err != nil {
-			ch <- &generatorPair{err: err}
-			close(ch)
-			return
+// positions returns offsets of the indexed entries, -1 for entries expired
+// by now.
+func (s *Segment) positions(now int64) map[string]int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make(map[string]int64, s.index.Len())
+	s.index.Iterate("", func(key string, e IndexEntry) bool {
+		pos := e.Offset
+		if exp, ok := s.expiring[key]; ok && exp.at <= now {
+			pos = -1
 		}
-		in := bufio.NewReaderSize(reopen, bufSize)
-
-		for err == nil {
-			var (
-				header, data []byte
-				n            int
-			)
-			header, err = in.Peek(bufSize)
-			if err == io.EOF {
-				if len(header) == 0 {
-					close(ch)
-					return
-				}
-			} else if err != nil {
-				ch <- &generatorPair{err: err}
-				close(ch)
-				return
-			}
-			size := binary.LittleEndian.Uint32(header)
+		res[key] = pos
+		return true
+	})
+	return res
+}
 
-			if size < bufSize {
-				data = buf[:size]
-			} else {
-				data = make([]byte, size)
-			}
-			n, err = in.Read(data)
+// capture pins the segment, see unpin, and calls fn with the keys starting
+// with prefix, the positions of their entries, -1 for entries expired by
+// now, and the reader the positions are in.
+func (s *Segment) capture(prefix string, now int64, fn func(r File, key string, pos int64)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-			if err == nil {
-				if n != int(size) {
-					ch <- &generatorPair{err: fmt.Errorf("corrupted file")}
-					close(ch)
-					return
-				}
+	s.pins++
+	s.index.Iterate(prefix, func(key string, e IndexEntry) bool {
+		pos := e.Offset
+		if exp, ok := s.expiring[key]; ok && exp.at <= now {
+			pos = -1
+		}
+		fn(s.reader, key, pos)
+		return true
+	})
+}
 
-				var e entry
-				e.Decode(data)
+// sequences returns sequence numbers of the indexed entries.
+func (s *Segment) sequences() map[string]uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-				ch <- &generatorPair{entry: &e}
-				offset += n
-			}
+	res := make(map[string]uint64, s.index.Len())
+	s.index.Iterate("", func(key string, e IndexEntry) bool {
+		res[key] = e.Seq
+		return true
+	})
+	return res
+}
+
+func (s *Segment) Keys() []string {
+	return s.keys("")
+}
+
+// keys returns keys of the segment starting with prefix.
+func (s *Segment) keys(prefix string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var keys []string
+	s.index.Iterate(prefix, func(key string, _ IndexEntry) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// sweep accounts entries expired by now as dead bytes and returns their keys.
+// Every expired entry is reported once.
+func (s *Segment) sweep(now int64) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []string
+	for key, exp := range s.expiring {
+		if exp.swept || exp.at > now {
+			continue
+		}
+		exp.swept = true
+		s.deadBytes += exp.size
+		expired = append(expired, key)
+	}
+	return expired
+}
+
+// garbage returns the number of bytes taken by entries of keys in shadowed
+// and by swept expired entries. Keys of the segment are added to shadowed.
+func (s *Segment) garbage(shadowed map[string]bool) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var total int64
+	s.index.Iterate("", func(key string, e IndexEntry) bool {
+		if shadowed[key] {
+			total += e.Size
+		} else if exp, ok := s.expiring[key]; ok && exp.swept {
+			total += exp.size
 		}
-	}()
-	return ch
+		shadowed[key] = true
+		return true
+	})
+	return total
+}
+
+func (s *Segment) Size() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.offset
+}
+
+// keyCount returns the number of indexed keys.
+func (s *Segment) keyCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index.Len()
+}
+
+func (s *Segment) DeadBytes() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.deadBytes
+}
+
+// readAheadSize is the buffer of sequential segment reads, large reads keep
+// the disk streaming while entries are decoded.
+const readAheadSize = 256 << 10
+
+// entryBufPool holds the buffers iterators read encoded entries into. The
+// decoded entries copy what they keep, so the buffers are reused by the next
+// iterator, merges read many segments in a row.
+var entryBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, bufSize)
+		return &buf
+	},
+}
+
+// EntryIterator reads the entries of a segment file in order. Next returns a
+// nil entry once the file ends, and the context error once its context is
+// done. The iterator releases its buffers as soon as Next returns nil or an
+// error; consumers stopping before that must Close it.
+type EntryIterator struct {
+	ctx  context.Context
+	in   *bufio.Reader
+	bufp *[]byte
+	err  error
+}
+
+func newEntryIterator(ctx context.Context, seg *Segment) *EntryIterator {
+	return newEntryIteratorAt(ctx, seg, 0)
+}
+
+// newEntryIteratorAt reads the entries from offset on.
+func newEntryIteratorAt(ctx context.Context, seg *Segment, offset int64) *EntryIterator {
+	return &EntryIterator{
+		ctx:  ctx,
+		in:   bufio.NewReaderSize(io.NewSectionReader(seg.fileReader(), offset, maxSectionSize), readAheadSize),
+		bufp: entryBufPool.Get().(*[]byte),
+	}
+}
+
+func (it *EntryIterator) Next() (*entry, error) {
+	if it.err != nil || it.bufp == nil {
+		return nil, it.err
+	}
+	e, err := it.next()
+	if err != nil || e == nil {
+		it.err = err
+		it.Close()
+	}
+	return e, err
+}
+
+func (it *EntryIterator) next() (*entry, error) {
+	if err := it.ctx.Err(); err != nil {
+		return nil, err
+	}
+	header, err := it.in.Peek(4)
+	if err == io.EOF && len(header) == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	size := int(binary.LittleEndian.Uint32(header))
+	if err := checkEntrySize(int64(size)); err != nil {
+		return nil, fmt.Errorf("corrupted file: %w", err)
+	}
+	if cap(*it.bufp) < size {
+		*it.bufp = make([]byte, size)
+	}
+	data := (*it.bufp)[:size]
+	if _, err := io.ReadFull(it.in, data); err != nil {
+		return nil, fmt.Errorf("corrupted file: %w", err)
+	}
+
+	e := new(entry)
+	if err := e.Decode(data); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Close releases the read buffers of the iterator.
+func (it *EntryIterator) Close() {
+	if it.bufp != nil {
+		entryBufPool.Put(it.bufp)
+		it.bufp = nil
+		it.in = nil
+	}
 }
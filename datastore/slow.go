@@ -0,0 +1,31 @@
+package datastore
+
+import "time"
+
+// WithSlowOpThreshold makes the Db log puts, gets and merges taking d or
+// longer as warnings, along with the key or the segments and the time spent
+// in each step, so latency spikes can be told apart: a put waiting for the
+// write loop from one writing a blob, a get missing the active segment from
+// one reading a blob. Zero, the default, logs none. Gets are the ones of
+// GetString, GetInt64 and their Context variants.
+func WithSlowOpThreshold(d time.Duration) Option {
+	return func(db *Db) {
+		db.slowOp = d
+	}
+}
+
+func (db *Db) slow(d time.Duration) bool {
+	return db.slowOp > 0 && d >= db.slowOp
+}
+
+// putTiming is filled by the write loop for the writer waiting for the
+// outcome, which reads it once the outcome is in.
+type putTiming struct {
+	queued time.Time
+	// wait is the time the write waited for the write loop, handle the
+	// time the loop took writing it.
+	wait   time.Duration
+	handle time.Duration
+	// segment is the id of the segment written.
+	segment int
+}
@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"sort"
+	"time"
+)
+
+// Record is the latest value of a key captured by a Snapshot.
+type Record struct {
+	Key   string
+	Type  ValueType
+	Value interface{}
+	// UpdatedAt is the write time of the value. Values written before write
+	// times were introduced report the last write time of the segment
+	// holding the value, they were written no later than that.
+	UpdatedAt time.Time
+	// Sequence is the sequence number of the write, see Db.Changes.
+	Sequence uint64
+}
+
+type snapshotRef struct {
+	key string
+	// reader is the one of the segment at the time of the snapshot, a
+	// memtable flush replaces it.
+	reader  File
+	pos     int64
+	seq     uint64
+	modTime time.Time
+}
+
+// Snapshot is a read-only view of the latest values of all live keys at the
+// moment it was taken. Merges wait until the snapshot is released, writes
+// go on as usual.
+type Snapshot struct {
+	db   *Db
+	refs []snapshotRef
+}
+
+func (db *Db) Snapshot() *Snapshot {
+	db.mergeMu.Lock()
+
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+
+	now := time.Now().UnixNano()
+	snap := &Snapshot{db: db}
+	seen := make(map[string]bool)
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		seg := db.segments[i]
+		modTime, _ := seg.ModTime()
+		seqs := seg.sequences()
+		for key, pos := range seg.positions(now) {
+			if seen[key] || isBucketKey(key) {
+				continue
+			}
+			seen[key] = true
+			if pos < 0 {
+				continue
+			}
+			snap.refs = append(snap.refs, snapshotRef{
+				key:     key,
+				reader:  seg.fileReader(),
+				pos:     pos,
+				seq:     seqs[key],
+				modTime: modTime,
+			})
+		}
+	}
+	sort.Slice(snap.refs, func(i, j int) bool { return snap.refs[i].key < snap.refs[j].key })
+	return snap
+}
+
+// Len returns the number of records in the snapshot.
+func (s *Snapshot) Len() int {
+	return len(s.refs)
+}
+
+// Each calls fn with every record of the snapshot in lexical order of keys
+// and stops at the first error.
+func (s *Snapshot) Each(fn func(Record) error) error {
+	for _, ref := range s.refs {
+		e, err := readEntryAt(ref.reader, ref.pos)
+		if err != nil {
+			return err
+		}
+		var val interface{} = e.value
+		if e.blob != nil {
+			val = e.blob
+		}
+		val, err = s.db.resolve(val)
+		if err != nil {
+			return err
+		}
+
+		rec := Record{Key: ref.key, Type: e.valueType, Value: val, UpdatedAt: ref.modTime, Sequence: ref.seq}
+		if e.writeTime != 0 {
+			rec.UpdatedAt = time.Unix(0, e.writeTime)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release lets merges run again. The snapshot must not be used afterwards.
+func (s *Snapshot) Release() {
+	if s.db == nil {
+		return
+	}
+	s.db.mergeMu.Unlock()
+	s.db = nil
+	s.refs = nil
+}
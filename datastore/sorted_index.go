@@ -0,0 +1,258 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// sparseInterval is the number of keys of a sorted segment per key kept in
+// memory, a lookup reads that many entries at most.
+const sparseInterval = 16
+
+const (
+	// sparseIndexKey is the reserved key of the entry holding the sparse
+	// index of a sorted segment, the last entry of the file. It is a string
+	// entry to any reader of segment files, the index skips it.
+	sparseIndexKey = bucketMark + bucketMark + "sparse-index"
+	// sparseIndexMagic ends the value of the sparse index entry, following
+	// the offset of the entry.
+	sparseIndexMagic = 0x78646e4970737273
+	// sparseIndexTrailer is the size of the offset and the magic number.
+	sparseIndexTrailer = 16
+)
+
+// sortedIndex is the index of a sorted segment, whose entries are ordered
+// by key with versions of a key in write order, as merge and memtable
+// flushes write them. Only every sparseInterval-th key is kept in memory;
+// lookups binary search those and scan the entries that follow in the
+// segment file. Keys are iterated in lexical order.
+//
+// Read errors end lookups as if the keys were missing. The index reads the
+// file of its segment, so the segment lock guards it as any other index.
+type sortedIndex struct {
+	seg    *Segment
+	sparse []sparseKey
+	len    int
+	last   string
+	// end is the offset of the sparse index entry once it is written or
+	// read, entries are complete then. Zero for segments written without
+	// one, their entries end with the segment.
+	end int64
+	// unordered is set once a key is set out of order, the segment is not
+	// sorted then.
+	unordered bool
+}
+
+type sparseKey struct {
+	key    string
+	offset int64
+}
+
+func newSortedIndex() *sortedIndex {
+	return &sortedIndex{}
+}
+
+// Set records the entry appended to the segment, keys must not decrease.
+// Entries of a complete index are known already and ignored.
+func (s *sortedIndex) Set(key string, e IndexEntry) {
+	if s.end > 0 {
+		return
+	}
+	if s.len > 0 && key <= s.last {
+		if key < s.last {
+			s.unordered = true
+		}
+		return
+	}
+	if s.len%sparseInterval == 0 {
+		s.sparse = append(s.sparse, sparseKey{key: key, offset: e.Offset})
+	}
+	s.len++
+	s.last = key
+}
+
+// scan reads entries of the segment from the offset on, along with their
+// positions and sizes, until fn returns false.
+func (s *sortedIndex) scan(offset int64, fn func(pos, size int64, e *entry) bool) error {
+	end := s.end
+	if end == 0 {
+		end = s.seg.offset
+	}
+	in := bufio.NewReaderSize(io.NewSectionReader(s.seg.reader, offset, end-offset), bufSize)
+	for pos := offset; pos < end; {
+		header, err := in.Peek(4)
+		if err != nil {
+			return err
+		}
+		size := int64(binary.LittleEndian.Uint32(header))
+		if err := checkEntrySize(size); err != nil {
+			return err
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(in, data); err != nil {
+			return err
+		}
+		var e entry
+		if err := e.Decode(data); err != nil {
+			return err
+		}
+		if !fn(pos, int64(len(data)), &e) {
+			return nil
+		}
+		pos += int64(len(data))
+	}
+	return nil
+}
+
+// block returns the position of the sparse key the scan for key starts at.
+func (s *sortedIndex) block(key string) int {
+	return sort.Search(len(s.sparse), func(i int) bool { return s.sparse[i].key > key }) - 1
+}
+
+func (s *sortedIndex) Get(key string) (IndexEntry, bool) {
+	i := s.block(key)
+	if i < 0 {
+		return IndexEntry{}, false
+	}
+	var found IndexEntry
+	ok := false
+	s.scan(s.sparse[i].offset, func(pos, size int64, e *entry) bool {
+		if e.key > key {
+			return false
+		}
+		if e.key == key {
+			found = IndexEntry{Offset: pos, Size: size, Seq: e.seq}
+			ok = true
+		}
+		return true
+	})
+	return found, ok
+}
+
+func (s *sortedIndex) Iterate(prefix string, fn func(string, IndexEntry) bool) {
+	if len(s.sparse) == 0 {
+		return
+	}
+	i := s.block(prefix)
+	if i < 0 {
+		i = 0
+	}
+
+	// The latest version of a key is reported once the next key shows up.
+	var key string
+	var latest IndexEntry
+	pending, more := false, true
+	s.scan(s.sparse[i].offset, func(pos, size int64, e *entry) bool {
+		if pending && e.key != key {
+			if more = fn(key, latest); !more {
+				return false
+			}
+			pending = false
+		}
+		if !strings.HasPrefix(e.key, prefix) {
+			return e.key < prefix
+		}
+		key = e.key
+		latest = IndexEntry{Offset: pos, Size: size, Seq: e.seq}
+		pending = true
+		return true
+	})
+	if pending && more {
+		fn(key, latest)
+	}
+}
+
+func (s *sortedIndex) Len() int {
+	return s.len
+}
+
+func (s *sortedIndex) MemoryUsage() int64 {
+	var total int64
+	for _, k := range s.sparse {
+		total += int64(len(k.key)) + 24
+	}
+	return total + int64(len(s.last))
+}
+
+func (s *sortedIndex) Persist(w io.Writer) error {
+	return persistIndex(w, s)
+}
+
+// Load fails, sorted indexes are built as their segments are written or
+// recovered.
+func (s *sortedIndex) Load(io.Reader) error {
+	return fmt.Errorf("sorted indexes are not loaded")
+}
+
+// complete returns the sparse index entry to write at offset, where entries
+// of the segment end. Entries set later are ignored. Segments the index has
+// a single key of get no entry, their lookups scan them from the start and
+// recovery rebuilds the index while reading them anyway.
+func (s *sortedIndex) complete(offset int64) *entry {
+	if len(s.sparse) < 2 {
+		return nil
+	}
+	size := 4 + 8
+	for _, k := range s.sparse {
+		size += 4 + len(k.key) + 8
+	}
+	buf := make([]byte, 0, size+sparseIndexTrailer)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(s.sparse)))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(s.len))
+	for _, k := range s.sparse {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(k.key)))
+		buf = append(buf, k.key...)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(k.offset))
+	}
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(offset))
+	buf = binary.LittleEndian.AppendUint64(buf, sparseIndexMagic)
+	s.end = offset
+	return &entry{key: sparseIndexKey, value: string(buf), valueType: Str}
+}
+
+// readSortedIndex reads the sparse index entry ending the segment file of
+// size bytes. It returns nil if there is none.
+func readSortedIndex(r io.ReaderAt, size int64) (*sortedIndex, error) {
+	if size < sparseIndexTrailer {
+		return nil, nil
+	}
+	var trailer [sparseIndexTrailer]byte
+	if _, err := r.ReadAt(trailer[:], size-sparseIndexTrailer); err != nil {
+		return nil, err
+	}
+	offset := int64(binary.LittleEndian.Uint64(trailer[:]))
+	if binary.LittleEndian.Uint64(trailer[8:]) != sparseIndexMagic || offset < 0 || offset >= size {
+		return nil, nil
+	}
+	e, err := readEntryAt(r, offset)
+	if err != nil || e.key != sparseIndexKey || offset+e.Size().Bytes() != size {
+		// The magic number ends a value which is not the index.
+		return nil, nil
+	}
+
+	corrupted := fmt.Errorf("corrupted sparse index at %d", offset)
+	data := []byte(e.value.(string))
+	if len(data) < 12 {
+		return nil, corrupted
+	}
+	s := &sortedIndex{end: offset, len: int(binary.LittleEndian.Uint64(data[4:]))}
+	n := binary.LittleEndian.Uint32(data)
+	data = data[12:]
+	for i := uint32(0); i < n; i++ {
+		if len(data) < 4 {
+			return nil, corrupted
+		}
+		kl := int(binary.LittleEndian.Uint32(data))
+		if len(data) < 4+kl+8 {
+			return nil, corrupted
+		}
+		key := string(data[4 : 4+kl])
+		s.sparse = append(s.sparse, sparseKey{key: key, offset: int64(binary.LittleEndian.Uint64(data[4+kl:]))})
+		data = data[4+kl+8:]
+	}
+	return s, nil
+}
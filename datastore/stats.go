@@ -0,0 +1,261 @@
+package datastore
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// statsKey is the key of the lifetime counters in the system bucket.
+const statsKey = bucketMark + systemBucket + bucketMark + "stats"
+
+// legacyStatsFileName is the file the lifetime counters were kept in before
+// they moved to the system bucket. It is read once and removed.
+const legacyStatsFileName = "stats.json"
+
+type Stats struct {
+	Segments  int   `json:"segments"`
+	Keys      int   `json:"keys"`
+	DiskBytes int64 `json:"disk_bytes"`
+	DeadBytes int64 `json:"dead_bytes"`
+	// ArchivedSegments are kept in the object store set with WithArchive,
+	// they do not count in DiskBytes.
+	ArchivedSegments int `json:"archived_segments"`
+	// IndexBytes estimates the memory taken by segment indexes, the
+	// memtable buffering the active segment included.
+	IndexBytes int64 `json:"index_bytes"`
+	// ClockSkew is the latest reported offset of the local clock.
+	ClockSkew time.Duration `json:"clock_skew_ns"`
+	// LastSeq is the sequence number of the latest write.
+	LastSeq uint64 `json:"last_seq"`
+	// CompactedSeq is the oldest sequence number RestoreTo can go back to.
+	CompactedSeq uint64 `json:"compacted_seq"`
+
+	// Starts is the number of times the Db was opened.
+	Starts     int64    `json:"starts"`
+	SinceStart Counters `json:"since_start"`
+	Lifetime   Counters `json:"lifetime"`
+}
+
+// Counters are cumulative activity counters of a Db.
+type Counters struct {
+	Writes         int64         `json:"writes"`
+	Compactions    int64         `json:"compactions"`
+	BytesReclaimed int64         `json:"bytes_reclaimed"`
+	Uptime         time.Duration `json:"uptime_ns"`
+	// ClockSkewWarnings counts TTL operations let through despite the clock
+	// skew exceeding the bound.
+	ClockSkewWarnings int64 `json:"clock_skew_warnings"`
+}
+
+func (c Counters) add(o Counters) Counters {
+	return Counters{
+		Writes:         c.Writes + o.Writes,
+		Compactions:    c.Compactions + o.Compactions,
+		BytesReclaimed: c.BytesReclaimed + o.BytesReclaimed,
+		Uptime:         c.Uptime + o.Uptime,
+
+		ClockSkewWarnings: c.ClockSkewWarnings + o.ClockSkewWarnings,
+	}
+}
+
+// counters tracks activity since the Db was opened on top of the lifetime
+// counters loaded from the system bucket.
+type counters struct {
+	started                             time.Time
+	writes, compactions, bytesReclaimed atomic.Int64
+	skewWarnings                        atomic.Int64
+
+	starts   int64
+	lifetime Counters
+
+	// flushedSeq and flushedCompactedSeq are the sequence numbers of the
+	// latest counters flushed, guarded by the appendMu of the Db.
+	flushedSeq, flushedCompactedSeq uint64
+}
+
+// statsRecord is the persisted form of the lifetime counters, the value of
+// statsKey. It keeps the latest sequence number too, as merge may drop the
+// entry carrying it.
+type statsRecord struct {
+	Starts   int64    `json:"starts"`
+	Lifetime Counters `json:"lifetime"`
+	LastSeq  uint64   `json:"last_seq"`
+	// CompactedSeq is persisted so RestoreTo does not go past a merge.
+	CompactedSeq uint64 `json:"compacted_seq"`
+}
+
+func (c *counters) sinceStart() Counters {
+	return Counters{
+		Writes:         c.writes.Load(),
+		Compactions:    c.compactions.Load(),
+		BytesReclaimed: c.bytesReclaimed.Load(),
+		Uptime:         time.Since(c.started),
+
+		ClockSkewWarnings: c.skewWarnings.Load(),
+	}
+}
+
+func (db *Db) loadStats() error {
+	db.counters.started = time.Now()
+
+	e, err := db.latest(statsKey)
+	if err != nil {
+		return err
+	}
+	legacyPath := filepath.Join(db.outDir, legacyStatsFileName)
+	legacy := false
+	var data []byte
+	if e != nil {
+		data = []byte(e.value.(string))
+	} else if data, err = readFile(db.backend, legacyPath); err == nil {
+		legacy = true
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	var record statsRecord
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+	}
+	db.counters.starts = record.Starts + 1
+	db.counters.lifetime = record.Lifetime
+	if record.LastSeq > db.lastSeq.Load() {
+		db.lastSeq.Store(record.LastSeq)
+	}
+	db.compactedSeq.Store(record.CompactedSeq)
+	db.counters.flushedSeq = record.LastSeq
+	db.counters.flushedCompactedSeq = record.CompactedSeq
+	if !legacy {
+		return nil
+	}
+	// The counters move to the system bucket before the file is removed.
+	if err := db.flushStats(); err != nil {
+		return err
+	}
+	return db.backend.Remove(legacyPath)
+}
+
+// statsEntry returns the entry of the lifetime counters as of now, merges
+// having dropped the states up to compactedSeq.
+func (db *Db) statsEntry(compactedSeq uint64) (*entry, error) {
+	data, err := json.Marshal(statsRecord{
+		Starts:       db.counters.starts,
+		Lifetime:     db.counters.lifetime.add(db.counters.sinceStart()),
+		LastSeq:      db.lastSeq.Load(),
+		CompactedSeq: compactedSeq,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &entry{key: statsKey, value: string(data), valueType: Str}, nil
+}
+
+// flushStats persists the lifetime counters under statsKey. The entry is
+// appended to the active segment directly rather than by the write loop:
+// it takes no sequence number, is no write of Stats and is left out of
+// Changes, so followers keep counters of their own.
+func (db *Db) flushStats() error {
+	db.appendMu.Lock()
+	defer db.appendMu.Unlock()
+	return db.appendStats()
+}
+
+// flushStatsIfMoved persists the lifetime counters if the sequence numbers
+// they keep moved since the latest flush. Periodic flushes and merges of
+// an idle Db this way do not grow the active segment, the other counters
+// are flushed along the next time or by Close.
+func (db *Db) flushStatsIfMoved() error {
+	db.appendMu.Lock()
+	defer db.appendMu.Unlock()
+	if db.lastSeq.Load() == db.counters.flushedSeq &&
+		db.compactedSeq.Load() == db.counters.flushedCompactedSeq {
+		return nil
+	}
+	return db.appendStats()
+}
+
+// appendStats appends the lifetime counters, appendMu must be held.
+func (db *Db) appendStats() error {
+	e, err := db.statsEntry(db.compactedSeq.Load())
+	if err != nil {
+		return err
+	}
+	// The entry is small and written seldom, it never starts a segment.
+	db.segmentsMu.RLock()
+	cur := db.curSegment()
+	db.segmentsMu.RUnlock()
+	if err := cur.Write(e); err != nil {
+		return err
+	}
+	db.counters.flushedSeq = db.lastSeq.Load()
+	db.counters.flushedCompactedSeq = db.compactedSeq.Load()
+	return nil
+}
+func (db *Db) Stats() Stats {
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+
+	sinceStart := db.counters.sinceStart()
+	stats := Stats{
+		Segments:     len(db.segments),
+		Keys:         db.types.len(),
+		LastSeq:      db.lastSeq.Load(),
+		CompactedSeq: db.compactedSeq.Load(),
+		ClockSkew:    db.ClockSkew(),
+		Starts:       db.counters.starts,
+		SinceStart:   sinceStart,
+		Lifetime:     db.counters.lifetime.add(sinceStart),
+	}
+	for _, seg := range db.segments {
+		if db.archive != nil && db.archive.archived(seg.path) {
+			stats.ArchivedSegments++
+		} else {
+			stats.DiskBytes += seg.Size()
+		}
+		stats.DeadBytes += seg.DeadBytes()
+		stats.IndexBytes += seg.MemoryUsage()
+	}
+	return stats
+}
+
+// SegmentStats describes a segment file.
+type SegmentStats struct {
+	Id   int    `json:"id"`
+	File string `json:"file"`
+	Size int64  `json:"size"`
+	// Keys counts the keys the segment has entries of, including those
+	// overwritten in newer segments.
+	Keys      int       `json:"keys"`
+	DeadBytes int64     `json:"dead_bytes"`
+	ModTime   time.Time `json:"mod_time"`
+	// Active is set for the segment taking writes, Archived for those kept
+	// in the object store set with WithArchive.
+	Active   bool `json:"active"`
+	Archived bool `json:"archived"`
+}
+
+// SegmentStats describes the segments oldest first.
+func (db *Db) SegmentStats() []SegmentStats {
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+
+	res := make([]SegmentStats, len(db.segments))
+	for i, seg := range db.segments {
+		modTime, _ := seg.ModTime()
+		res[i] = SegmentStats{
+			Id:        seg.id,
+			File:      filepath.Base(seg.path),
+			Size:      seg.Size(),
+			Keys:      seg.keyCount(),
+			DeadBytes: seg.DeadBytes(),
+			ModTime:   modTime,
+			Active:    i == len(db.segments)-1,
+			Archived:  db.archive != nil && db.archive.archived(seg.path),
+		}
+	}
+	return res
+}
@@ -0,0 +1,69 @@
+package datastore
+
+import "time"
+
+// sweepLoop runs the periodic housekeeping: the expiration sweep and
+// persisting of the lifetime counters.
+func (db *Db) sweepLoop() {
+	ticker := time.NewTicker(db.sweepInterval)
+	defer ticker.Stop()
+	statsTicker := time.NewTicker(db.statsInterval)
+	defer statsTicker.Stop()
+
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-ticker.C:
+			db.sweepExpired()
+			db.archiveSegments()
+		case <-statsTicker.C:
+			if err := db.flushStatsIfMoved(); err != nil {
+				db.logger.Error("failed to flush stats", "err", err)
+				db.background.fail(err, false)
+			}
+		}
+	}
+}
+
+// sweepExpired scans segment indexes for expired entries and accounts them
+// as dead bytes. Expired entries of sealed segments are reclaimed by merge,
+// so the compaction policy is consulted as soon as any of them is found.
+func (db *Db) sweepExpired() {
+	segments := db.segmentSet()
+
+	now := time.Now().UnixNano()
+	shadowed := make(map[string]bool)
+	sealedExpired := false
+	for i := len(segments) - 1; i >= 0; i-- {
+		seg := segments[i]
+		for _, key := range seg.sweep(now) {
+			if i < len(segments)-1 {
+				sealedExpired = true
+			}
+			if !shadowed[key] {
+				db.types.remove(key)
+			}
+		}
+		for _, key := range seg.Keys() {
+			shadowed[key] = true
+		}
+	}
+
+	if sealedExpired {
+		db.compactInBackground()
+	}
+}
+
+// DeadBytes returns the number of bytes occupied by expired entries which
+// are not reclaimed by merge yet.
+func (db *Db) DeadBytes() int64 {
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+
+	var total int64
+	for _, seg := range db.segments {
+		total += seg.DeadBytes()
+	}
+	return total
+}
@@ -0,0 +1,42 @@
+package datastore
+
+import "fmt"
+
+// WaitForSync returns once the write of sequence number seq, along with all
+// writes before it, is on the storage. Writes are not synced as they are
+// taken, so throughput is not bound by the storage; callers needing the
+// durability of a write wait for its sequence number, as returned by
+// PutString and the other Put methods, or for LastSeq after their writes.
+//
+// Concurrent calls share syncs, a single sync serves every write taken
+// before it started.
+func (db *Db) WaitForSync(seq uint64) error {
+	if db.isClosed() {
+		return ErrClosed
+	}
+	if seq <= db.syncedSeq.Load() {
+		return nil
+	}
+	if seq > db.lastSeq.Load() {
+		return fmt.Errorf("sequence number %d is not written", seq)
+	}
+
+	db.syncMu.Lock()
+	defer db.syncMu.Unlock()
+	if seq <= db.syncedSeq.Load() {
+		return nil
+	}
+	// Writes up to target are in the active segment or in segments sealed
+	// before it, which are synced as they are sealed.
+	target := db.lastSeq.Load()
+	db.segmentsMu.RLock()
+	cur := db.curSegment()
+	db.segmentsMu.RUnlock()
+	if err := cur.Sync(); err != nil {
+		return err
+	}
+	if target > db.syncedSeq.Load() {
+		db.syncedSeq.Store(target)
+	}
+	return nil
+}
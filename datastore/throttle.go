@@ -0,0 +1,125 @@
+package datastore
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// WithCompactionRate sets the initial CompactionRate, unlimited by default.
+func WithCompactionRate(rate MemoryUnit) Option {
+	return func(db *Db) {
+		db.throttle.rate = rate.Bytes()
+	}
+}
+
+// PauseCompaction holds merges at their next read or write until
+// ResumeCompaction, merges started while paused wait as well. Writes go on,
+// segments sealed meanwhile are merged on resume.
+func (db *Db) PauseCompaction() {
+	db.throttle.pause()
+}
+
+// ResumeCompaction lets merges held by PauseCompaction go on.
+func (db *Db) ResumeCompaction() {
+	db.throttle.resume()
+}
+
+// CompactionPaused reports whether merges are paused.
+func (db *Db) CompactionPaused() bool {
+	db.throttle.mu.Lock()
+	defer db.throttle.mu.Unlock()
+	return db.throttle.paused
+}
+
+// minThrottleDelay is the shortest pause of a merge, smaller delays add up
+// until they reach it rather than putting the merge to sleep for every
+// entry.
+const minThrottleDelay = time.Millisecond
+
+// compactionThrottle paces the IO of merges to rate bytes per second and
+// holds them while paused.
+type compactionThrottle struct {
+	mu sync.Mutex
+	// rate is zero for no limit.
+	rate int64
+	// next is the time merge IO is due to go on at the rate.
+	next   time.Time
+	paused bool
+	// resumed is closed on resume.
+	resumed chan struct{}
+}
+
+func (t *compactionThrottle) setRate(rate int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rate = rate
+	t.next = time.Time{}
+}
+
+func (t *compactionThrottle) getRate() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rate
+}
+
+func (t *compactionThrottle) pause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.paused {
+		t.paused = true
+		t.resumed = make(chan struct{})
+	}
+}
+
+func (t *compactionThrottle) resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.paused {
+		t.paused = false
+		close(t.resumed)
+	}
+}
+
+// wait accounts n bytes of merge IO and returns once the merge may go on.
+// It fails once ctx is done or the Db is closed.
+func (t *compactionThrottle) wait(ctx context.Context, closed <-chan struct{}, n int64) error {
+	t.mu.Lock()
+	for t.paused {
+		resumed := t.resumed
+		t.mu.Unlock()
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-closed:
+			return ErrClosed
+		}
+		t.mu.Lock()
+	}
+	if t.rate == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(n) * time.Second / time.Duration(t.rate))
+	delay := t.next.Sub(now)
+	t.mu.Unlock()
+	if delay < minThrottleDelay {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-closed:
+		return ErrClosed
+	}
+}
@@ -0,0 +1,145 @@
+package datastore
+
+import "context"
+
+// Tracer starts spans of Db operations. It keeps tracing libraries out of
+// the dependencies of the Db: an adapter of OpenTelemetry starts spans with
+// its tracer and maps attributes to its own. Spans are children of the span
+// of the context passed to the operation, such as PutStringContext.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is an operation in progress. Its methods are called by the
+// goroutine doing the operation and the write loop, never concurrently.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	// RecordError marks the span failed.
+	RecordError(err error)
+	End()
+}
+
+// Attribute describes a span, Value is a string, an int64, a bool or a
+// time.Duration.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Names of spans and of their attributes.
+const (
+	SpanPut     = "datastore.put"
+	SpanGet     = "datastore.get"
+	SpanCompact = "datastore.compact"
+
+	// AttrSegment is the id of the segment written or read.
+	AttrSegment = "datastore.segment"
+	// AttrFirstSegment and AttrLastSegment are the ids of the segments a
+	// merge starts and ends with.
+	AttrFirstSegment = "datastore.first_segment"
+	AttrLastSegment  = "datastore.last_segment"
+	AttrBytesRead    = "datastore.bytes_read"
+	AttrBytesWritten = "datastore.bytes_written"
+	// AttrQueueWait is the time a write waited for the write loop.
+	AttrQueueWait = "datastore.queue_wait"
+	AttrHit       = "datastore.hit"
+)
+
+// WithTracer traces puts, gets and merges with t.
+func WithTracer(t Tracer) Option {
+	return func(db *Db) {
+		db.tracer = t
+	}
+}
+
+type noTracer struct{}
+
+func (noTracer) Start(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, noSpan{}
+}
+
+type noSpan struct{}
+
+func (noSpan) SetAttributes(...Attribute) {}
+func (noSpan) RecordError(error)          {}
+func (noSpan) End()                       {}
+
+// endSpan records err, if any, and ends the span.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// PutStringContext is PutString traced as a child of the span of ctx and
+// given up as PutIfRevisionContext is once ctx is done.
+func (db *Db) PutStringContext(ctx context.Context, key, value string) (uint64, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, err
+	}
+	return db.putEntry(ctx, &entry{key: key, value: value, valueType: Str})
+}
+
+// PutInt64Context is PutStringContext for int64 values.
+func (db *Db) PutInt64Context(ctx context.Context, key string, value int64) (uint64, error) {
+	if err := db.checkKey(key); err != nil {
+		return 0, err
+	}
+	return db.putEntry(ctx, &entry{key: key, value: value, valueType: Int})
+}
+
+// GetStringContext is GetString traced as a child of the span of ctx. It
+// fails with the error of ctx if it is done before the read starts.
+func (db *Db) GetStringContext(ctx context.Context, key string) (string, error) {
+	val, err := db.getUnknown(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	str, ok := val.(string)
+	if !ok {
+		return "", ErrNotString
+	}
+	return str, nil
+}
+
+// GetInt64Context is GetStringContext for int64 values.
+func (db *Db) GetInt64Context(ctx context.Context, key string) (int64, error) {
+	val, err := db.getUnknown(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	i, ok := val.(int64)
+	if !ok {
+		return 0, ErrNotInt64
+	}
+	return i, nil
+}
+
+// traceMerge runs mergeRange in a span.
+func (db *Db) traceMerge(ctx context.Context, segments []*Segment, from, to int) (CompactStats, error) {
+	ctx, span := db.tracer.Start(ctx, SpanCompact)
+	var read int64
+	for _, seg := range segments[from:to] {
+		read += seg.Size()
+	}
+	span.SetAttributes(
+		Attribute{AttrFirstSegment, int64(segments[from].id)},
+		Attribute{AttrLastSegment, int64(segments[to-1].id)},
+		Attribute{AttrBytesRead, read},
+	)
+	stats, err := db.mergeRange(ctx, segments, from, to)
+	if err == nil {
+		span.SetAttributes(Attribute{AttrBytesWritten, read - stats.BytesReclaimed})
+	}
+	endSpan(span, err)
+	return stats, err
+}
+
+// valueSize is the size of a value read in bytes.
+func valueSize(val interface{}) int64 {
+	if s, ok := val.(string); ok {
+		return int64(len(s))
+	}
+	return 8
+}
@@ -0,0 +1,150 @@
+package datastore
+
+import (
+	"io"
+	"sort"
+	"unsafe"
+)
+
+// trieIndex is a compressed trie: every node holds the part of key shared
+// by all keys below it, so keys with long common prefixes are stored once.
+// Keys are iterated in lexical order.
+type trieIndex struct {
+	root trieNode
+	len  int
+}
+
+type trieNode struct {
+	prefix string
+	// children are ordered by the first byte of their prefixes.
+	children []*trieNode
+	entry    IndexEntry
+	leaf     bool
+}
+
+func NewTrieIndex() Index {
+	return &trieIndex{}
+}
+
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// child returns the position of the child starting with c and whether
+// there is one.
+func (n *trieNode) child(c byte) (int, bool) {
+	i := sort.Search(len(n.children), func(i int) bool { return n.children[i].prefix[0] >= c })
+	return i, i < len(n.children) && n.children[i].prefix[0] == c
+}
+
+func (t *trieIndex) Get(key string) (IndexEntry, bool) {
+	n := &t.root
+	for {
+		if key == "" {
+			return n.entry, n.leaf
+		}
+		i, ok := n.child(key[0])
+		if !ok {
+			return IndexEntry{}, false
+		}
+		next := n.children[i]
+		if len(key) < len(next.prefix) || key[:len(next.prefix)] != next.prefix {
+			return IndexEntry{}, false
+		}
+		key = key[len(next.prefix):]
+		n = next
+	}
+}
+
+func (t *trieIndex) Set(key string, e IndexEntry) {
+	n := &t.root
+	for key != "" {
+		i, ok := n.child(key[0])
+		if !ok {
+			leaf := &trieNode{prefix: key, entry: e, leaf: true}
+			n.children = append(n.children, nil)
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = leaf
+			t.len++
+			return
+		}
+
+		next := n.children[i]
+		common := commonPrefix(key, next.prefix)
+		if common < len(next.prefix) {
+			// Split the child at the end of the common part.
+			split := &trieNode{prefix: next.prefix[:common], children: []*trieNode{next}}
+			next.prefix = next.prefix[common:]
+			n.children[i] = split
+			next = split
+		}
+		key = key[common:]
+		n = next
+	}
+	if !n.leaf {
+		t.len++
+	}
+	n.entry = e
+	n.leaf = true
+}
+
+func (t *trieIndex) Iterate(prefix string, fn func(string, IndexEntry) bool) {
+	n := &t.root
+	path := ""
+	for prefix != "" {
+		i, ok := n.child(prefix[0])
+		if !ok {
+			return
+		}
+		next := n.children[i]
+		common := commonPrefix(prefix, next.prefix)
+		if common < len(prefix) && common < len(next.prefix) {
+			return
+		}
+		path += next.prefix
+		prefix = prefix[common:]
+		n = next
+	}
+	n.walk(path, fn)
+}
+
+func (n *trieNode) walk(path string, fn func(string, IndexEntry) bool) bool {
+	if n.leaf && !fn(path, n.entry) {
+		return false
+	}
+	for _, c := range n.children {
+		if !c.walk(path+c.prefix, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *trieIndex) Len() int {
+	return t.len
+}
+
+func (t *trieIndex) MemoryUsage() int64 {
+	total := int64(unsafe.Sizeof(*t))
+	var count func(n *trieNode)
+	count = func(n *trieNode) {
+		for _, c := range n.children {
+			total += int64(unsafe.Sizeof(*c)) + int64(len(c.prefix)) + 8
+			count(c)
+		}
+	}
+	count(&t.root)
+	return total
+}
+
+func (t *trieIndex) Persist(w io.Writer) error {
+	return persistIndex(w, t)
+}
+
+func (t *trieIndex) Load(r io.Reader) error {
+	return loadIndex(r, t)
+}
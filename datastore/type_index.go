@@ -0,0 +1,81 @@
+package datastore
+
+import (
+	"sort"
+	"sync"
+)
+
+// typeIndex keeps track of the type of the latest value stored for every key.
+type typeIndex struct {
+	mu    sync.RWMutex
+	types map[string]ValueType
+	keys  map[ValueType]map[string]struct{}
+}
+
+func newTypeIndex() *typeIndex {
+	return &typeIndex{
+		types: make(map[string]ValueType),
+		keys:  make(map[ValueType]map[string]struct{}),
+	}
+}
+
+func (ti *typeIndex) set(key string, t ValueType) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	if old, ok := ti.types[key]; ok {
+		if old == t {
+			return
+		}
+		delete(ti.keys[old], key)
+	}
+	ti.types[key] = t
+	if ti.keys[t] == nil {
+		ti.keys[t] = make(map[string]struct{})
+	}
+	ti.keys[t][key] = struct{}{}
+}
+
+func (ti *typeIndex) remove(key string) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	if t, ok := ti.types[key]; ok {
+		delete(ti.keys[t], key)
+		delete(ti.types, key)
+	}
+}
+
+func (ti *typeIndex) keysOf(t ValueType) []string {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	keys := make([]string, 0, len(ti.keys[t]))
+	for key := range ti.keys[t] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (ti *typeIndex) len() int {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+	return len(ti.types)
+}
+
+// reset replaces the index with the given types of keys.
+func (ti *typeIndex) reset(types map[string]ValueType) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	ti.types = make(map[string]ValueType, len(types))
+	ti.keys = make(map[ValueType]map[string]struct{})
+	for key, t := range types {
+		ti.types[key] = t
+		if ti.keys[t] == nil {
+			ti.keys[t] = make(map[string]struct{})
+		}
+		ti.keys[t][key] = struct{}{}
+	}
+}
@@ -0,0 +1,190 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// VerifyCursor is the position Verify continues from. Merge reuses ids of
+// the segments it replaces, so a cursor kept across merges may skip or
+// repeat a part of the data, which is fine for a scan that runs continuously.
+type VerifyCursor struct {
+	Segment int   `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+// VerifyFinding is a problem found in a segment file.
+type VerifyFinding struct {
+	Segment int    `json:"segment"`
+	Offset  int64  `json:"offset"`
+	Key     string `json:"key,omitempty"`
+	Problem string `json:"problem"`
+}
+
+// VerifyPage is the outcome of a single Verify call.
+type VerifyPage struct {
+	Next     VerifyCursor    `json:"next"`
+	Bytes    int64           `json:"bytes"`
+	Findings []VerifyFinding `json:"findings,omitempty"`
+	// Done is set once the last segment is verified.
+	Done bool `json:"done"`
+}
+
+// Verify decodes entries from the cursor on and checks them against segment
+// indexes and blob files. It reads about limit bytes, so a full verification
+// is a sequence of calls each passing the Next cursor of the previous page.
+func (db *Db) Verify(from VerifyCursor, limit int64) (VerifyPage, error) {
+	db.segmentsMu.RLock()
+	defer db.segmentsMu.RUnlock()
+	if db.isClosed() {
+		return VerifyPage{}, ErrClosed
+	}
+
+	page := VerifyPage{Next: from}
+	for _, seg := range db.segments {
+		if seg.id < page.Next.Segment {
+			continue
+		}
+		if seg.id > page.Next.Segment {
+			page.Next = VerifyCursor{Segment: seg.id}
+		}
+		if page.Bytes >= limit {
+			return page, nil
+		}
+
+		size := seg.Size()
+		for page.Next.Offset < size && page.Bytes < limit {
+			n, finding, err := db.verifyEntry(seg, page.Next.Offset, size)
+			if err != nil {
+				return page, err
+			}
+			if finding != nil {
+				page.Findings = append(page.Findings, *finding)
+			}
+			if n == 0 {
+				// The rest of the segment can not be parsed.
+				n = size - page.Next.Offset
+			}
+			page.Next.Offset += n
+			page.Bytes += n
+		}
+		if page.Next.Offset < size {
+			return page, nil
+		}
+		page.Next = VerifyCursor{Segment: seg.id + 1}
+	}
+	page.Done = true
+	return page, nil
+}
+
+// verifyEntry checks the entry at pos and returns its size. Zero size is
+// returned if the entry header is broken. Only IO errors are returned as
+// errors, problems of the data are findings.
+func (db *Db) verifyEntry(seg *Segment, pos, segSize int64) (int64, *VerifyFinding, error) {
+	e, size, problem, err := checkEntry(db.backend, seg.fileReader(), pos, segSize, db.outDir)
+	if err != nil || problem != "" {
+		return size, newFinding(seg.id, pos, e, problem), err
+	}
+
+	seg.mu.RLock()
+	ie, ok := seg.index.Get(e.key)
+	seg.mu.RUnlock()
+	if ok && ie.Offset == pos && ie.Size != size {
+		problem = fmt.Sprintf("index size %d does not match entry size %d", ie.Size, size)
+		return size, newFinding(seg.id, pos, e, problem), nil
+	}
+	return size, nil, nil
+}
+
+func newFinding(id int, pos int64, e *entry, problem string) *VerifyFinding {
+	if problem == "" {
+		return nil
+	}
+	f := &VerifyFinding{Segment: id, Offset: pos, Problem: problem}
+	if e != nil {
+		f.Key = e.key
+	}
+	return f
+}
+
+// checkEntry reads the entry at pos of a segment file of fileSize bytes and
+// checks its framing and the blob it refers to, kept in blobDir of the
+// backend. It returns the entry if it can be decoded and its size, which is
+// zero if the header is broken. Problems of the data are described by
+// problem, only IO errors are errors.
+func checkEntry(backend Backend, r io.ReaderAt, pos, fileSize int64, blobDir string) (e *entry, size int64, problem string, err error) {
+	var header [8]byte
+	if _, err := r.ReadAt(header[:], pos); errors.Is(err, io.EOF) {
+		return nil, 0, "truncated entry header", nil
+	} else if err != nil {
+		return nil, 0, "", err
+	}
+	size = int64(binary.LittleEndian.Uint32(header[:]))
+	keySize := int64(binary.LittleEndian.Uint32(header[4:]))
+	if size < 13+keySize || pos+size > fileSize {
+		return nil, 0, fmt.Sprintf("entry size %d out of bounds", size), nil
+	}
+
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, pos); err != nil {
+		return nil, 0, "", err
+	}
+	if expected := encodedSize(data, keySize); expected != size {
+		return nil, size, fmt.Sprintf("entry size %d does not match its content of %d bytes", size, expected), nil
+	}
+	e = new(entry)
+	if err := e.Decode(data); err != nil {
+		return nil, size, err.Error(), nil
+	}
+
+	if e.blob != nil {
+		info, err := stat(backend, blobPath(blobDir, e.blob.id))
+		if os.IsNotExist(err) {
+			return e, size, fmt.Sprintf("blob %d is missing", e.blob.id), nil
+		} else if err != nil {
+			return e, 0, "", err
+		}
+		if e.blob.offset+e.blob.length > info.Size() {
+			return e, size, fmt.Sprintf("blob %d is truncated", e.blob.id), nil
+		}
+	}
+	return e, size, "", nil
+}
+
+// encodedSize computes the size of the entry from its header, -1 if the
+// value length does not suit the value type. Decode is safe to call on
+// entries of the size they declare.
+func encodedSize(data []byte, keySize int64) int64 {
+	typ := data[keySize+8]
+	valSize := int64(binary.LittleEndian.Uint32(data[keySize+9:]))
+	if typ&blobFlag != 0 && valSize != blobRefSize || typ&blobFlag == 0 && ValueType(typ&^flagBits) == Int && valSize != 8 {
+		return -1
+	}
+	size := 13 + keySize + valSize
+	if typ&ttlFlag != 0 {
+		size += 8
+	}
+	if typ&seqFlag != 0 {
+		size += 8
+	}
+	if typ&flagsFlag != 0 {
+		if size >= int64(len(data)) {
+			return -1
+		}
+		flags := entryFlags(data[size])
+		size++
+		if flags.has(writeTimeFlag) {
+			size += 8
+		}
+		if flags.has(principalFlag) {
+			if size >= int64(len(data)) {
+				return -1
+			}
+			size += 1 + int64(data[size])
+		}
+	}
+	return size
+}
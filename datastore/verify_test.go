@@ -0,0 +1,86 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// verifyAll runs Verify page by page.
+func verifyAll(t *testing.T, db *Db, limit int64) (int, []VerifyFinding) {
+	var pages int
+	var findings []VerifyFinding
+	var cursor VerifyCursor
+	for {
+		page, err := db.Verify(cursor, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		findings = append(findings, page.Findings...)
+		if page.Done {
+			return pages, findings
+		}
+		cursor = page.Next
+	}
+}
+
+func TestDb_Verify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40*2*Byte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"key1", "key2", "key3", "key4"} {
+		_, err = db.PutString(key, "value1")
+		assert.Nil(t, err)
+	}
+	_, err = db.PutString("key5", strings.Repeat("v", 100))
+	assert.Nil(t, err)
+
+	t.Run("healthy", func(t *testing.T) {
+		pages, findings := verifyAll(t, db, 1<<20)
+		assert.Equal(t, 1, pages)
+		assert.Empty(t, findings)
+
+		// A page ends with the entry reaching the limit.
+		pages, findings = verifyAll(t, db, 1)
+		assert.Equal(t, 5, pages)
+		assert.Empty(t, findings)
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		blobs, _ := filepath.Glob(filepath.Join(dir, "blob-*"))
+		assert.Len(t, blobs, 1)
+		assert.Nil(t, os.Remove(blobs[0]))
+
+		f, err := os.OpenFile(db.segmentPath(dir, 0), os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Write([]byte{0xff, 0xff})
+		assert.Nil(t, err)
+		assert.Nil(t, f.Close())
+		db.segments[0].mu.Lock()
+		db.segments[0].offset += 2
+		db.segments[0].mu.Unlock()
+
+		_, findings := verifyAll(t, db, 1<<20)
+		if assert.Len(t, findings, 2) {
+			assert.Equal(t, VerifyFinding{Segment: 0, Offset: 80, Problem: "truncated entry header"}, findings[0])
+			assert.Equal(t, "key5", findings[1].Key)
+			assert.Contains(t, findings[1].Problem, "is missing")
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package datastore
+
+import (
+	"context"
+	"strings"
+)
+
+// Deleted reports whether the change deletes the key.
+func (c Change) Deleted() bool {
+	return c.ExpiresAt.UnixNano() == tombstoneExpiry
+}
+
+// Watch is ChangesContext for the keys starting with prefix. As with
+// Iterate, keys of buckets are not included.
+func (db *Db) Watch(ctx context.Context, prefix string, sinceSeq uint64) (<-chan Change, error) {
+	changes, err := db.ChangesContext(ctx, sinceSeq)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Change)
+	go func() {
+		defer close(out)
+		for c := range changes {
+			if !strings.HasPrefix(c.Key, prefix) || isBucketKey(c.Key) {
+				continue
+			}
+			select {
+			case out <- c:
+			case <-ctx.Done():
+				// The feed is closed once ctx is done.
+			}
+		}
+	}()
+	return out, nil
+}
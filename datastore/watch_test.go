@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDb_Watch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 10*Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.PutString("user:a", "alice")
+	assert.Nil(t, err)
+	_, err = db.PutString("other", "value")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := db.Watch(ctx, "user:", 0)
+	assert.Nil(t, err)
+	c := receive(t, ch)
+	assert.Equal(t, "user:a", c.Key)
+	assert.False(t, c.Deleted())
+
+	_, err = db.PutString("other", "value2")
+	assert.Nil(t, err)
+	_, err = db.Bucket("user:").PutString("b", "bob")
+	assert.Nil(t, err)
+	_, err = db.PutInt64("user:c", 3)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Delete("user:a"))
+
+	c = receive(t, ch)
+	assert.Equal(t, Change{Seq: 5, Key: "user:c", Type: Int, Value: int64(3)}, c)
+	c = receive(t, ch)
+	assert.Equal(t, "user:a", c.Key)
+	assert.True(t, c.Deleted())
+
+	cancel()
+	for range ch {
+	}
+}
@@ -0,0 +1,157 @@
+// Package export writes datastore snapshots in formats of analytics tools,
+// and as NDJSON for the bulk import of cmd/db.
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/parquet-go/parquet-go"
+)
+
+const (
+	CSV     = "csv"
+	Parquet = "parquet"
+	NDJSON  = "ndjson"
+)
+
+// ContentType returns the media type of the format.
+func ContentType(format string) string {
+	switch format {
+	case Parquet:
+		return "application/vnd.apache.parquet"
+	case NDJSON:
+		return "application/x-ndjson"
+	}
+	return "text/csv"
+}
+
+// Write writes all the records of the snapshot in the given format.
+func Write(w io.Writer, format string, snap *datastore.Snapshot) error {
+	switch format {
+	case CSV:
+		return WriteCSV(w, snap)
+	case Parquet:
+		return WriteParquet(w, snap)
+	case NDJSON:
+		return WriteNDJSON(w, snap)
+	}
+	return fmt.Errorf("unknown export format %q", format)
+}
+
+// WriteCSV writes a header row followed by a row per record. Times are in
+// RFC 3339 format.
+func WriteCSV(w io.Writer, snap *datastore.Snapshot) error {
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{"key", "type", "value", "updated_at", "sequence"}); err != nil {
+		return err
+	}
+	err := snap.Each(func(rec datastore.Record) error {
+		var value string
+		switch v := rec.Value.(type) {
+		case int64:
+			value = strconv.FormatInt(v, 10)
+		case string:
+			value = v
+		}
+		return out.Write([]string{
+			rec.Key,
+			rec.Type.String(),
+			value,
+			rec.UpdatedAt.UTC().Format(time.RFC3339Nano),
+			strconv.FormatUint(rec.Sequence, 10),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// Line is a record in the NDJSON export, in the form /db/_import loads.
+// Values are strings of their type as in the CSV export, so int64 values
+// keep their precision.
+type Line struct {
+	Key       string    `json:"key"`
+	Type      string    `json:"type"`
+	Value     string    `json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Sequence  uint64    `json:"sequence"`
+}
+
+// WriteNDJSON writes a Line per record.
+func WriteNDJSON(w io.Writer, snap *datastore.Snapshot) error {
+	out := bufio.NewWriter(w)
+	enc := json.NewEncoder(out)
+	err := snap.Each(func(rec datastore.Record) error {
+		line := Line{Key: rec.Key, Type: rec.Type.String(), UpdatedAt: rec.UpdatedAt.UTC(), Sequence: rec.Sequence}
+		switch v := rec.Value.(type) {
+		case int64:
+			line.Value = strconv.FormatInt(v, 10)
+		case string:
+			line.Value = v
+		}
+		return enc.Encode(line)
+	})
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// Row is a record in the Parquet export. Values are kept in a column of
+// their type, the other one is null.
+type Row struct {
+	Key         string    `parquet:"key"`
+	Type        string    `parquet:"type,dict"`
+	StringValue *string   `parquet:"string_value,optional"`
+	IntValue    *int64    `parquet:"int_value,optional"`
+	UpdatedAt   time.Time `parquet:"updated_at,timestamp(millisecond)"`
+	Sequence    int64     `parquet:"sequence"`
+}
+
+const parquetBatch = 1024
+
+func WriteParquet(w io.Writer, snap *datastore.Snapshot) error {
+	out := parquet.NewGenericWriter[Row](w)
+	rows := make([]Row, 0, parquetBatch)
+	flush := func() error {
+		_, err := out.Write(rows)
+		rows = rows[:0]
+		return err
+	}
+
+	err := snap.Each(func(rec datastore.Record) error {
+		row := Row{
+			Key:       rec.Key,
+			Type:      rec.Type.String(),
+			UpdatedAt: rec.UpdatedAt,
+			Sequence:  int64(rec.Sequence),
+		}
+		switch v := rec.Value.(type) {
+		case int64:
+			row.IntValue = &v
+		case string:
+			row.StringValue = &v
+		}
+		rows = append(rows, row)
+		if len(rows) == parquetBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return out.Close()
+}
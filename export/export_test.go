@@ -0,0 +1,99 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/Gopack-go-labs/labs4-5/datastore"
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func testDb(t *testing.T) *datastore.Db {
+	dir, err := os.MkdirTemp("", "test-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := datastore.NewDb(dir, 10*datastore.Megabyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.PutString("name", "old")
+	assert.Nil(t, err)
+	_, err = db.PutInt64("counter", 5)
+	assert.Nil(t, err)
+	_, err = db.PutString("name", "gopack, \"labs\"")
+	assert.Nil(t, err)
+	return db
+}
+
+func TestWriteCSV(t *testing.T) {
+	db := testDb(t)
+	snap := db.Snapshot()
+	defer snap.Release()
+
+	// Writes after the snapshot do not make it into the export.
+	_, err := db.PutString("late", "value")
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	assert.Nil(t, WriteCSV(&buf, snap))
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	assert.Len(t, lines, 3)
+	assert.Equal(t, "key,type,value,updated_at,sequence", string(lines[0]))
+	assert.Contains(t, string(lines[1]), "counter,int64,5,")
+	assert.Contains(t, string(lines[2]), `name,string,"gopack, ""labs""",`)
+}
+
+func TestWriteNDJSON(t *testing.T) {
+	db := testDb(t)
+	snap := db.Snapshot()
+	defer snap.Release()
+
+	var buf bytes.Buffer
+	assert.Nil(t, WriteNDJSON(&buf, snap))
+
+	var lines []Line
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var line Line
+		assert.Nil(t, dec.Decode(&line))
+		lines = append(lines, line)
+	}
+	assert.Len(t, lines, 2)
+	assert.Equal(t, "counter", lines[0].Key)
+	assert.Equal(t, "int64", lines[0].Type)
+	assert.Equal(t, "5", lines[0].Value)
+	assert.Equal(t, "gopack, \"labs\"", lines[1].Value)
+	assert.False(t, lines[1].UpdatedAt.IsZero())
+}
+
+func TestWriteParquet(t *testing.T) {
+	db := testDb(t)
+	snap := db.Snapshot()
+	defer snap.Release()
+
+	var buf bytes.Buffer
+	assert.Nil(t, WriteParquet(&buf, snap))
+
+	rows, err := parquet.Read[Row](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+	assert.Len(t, rows, 2)
+
+	assert.Equal(t, "counter", rows[0].Key)
+	assert.Equal(t, "int64", rows[0].Type)
+	assert.Equal(t, int64(5), *rows[0].IntValue)
+	assert.Nil(t, rows[0].StringValue)
+
+	assert.Equal(t, "name", rows[1].Key)
+	assert.Equal(t, `gopack, "labs"`, *rows[1].StringValue)
+	assert.Greater(t, rows[1].Sequence, rows[0].Sequence)
+	assert.False(t, rows[1].UpdatedAt.IsZero())
+}
@@ -1,6 +1,8 @@
 package httptools
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,6 +11,9 @@ import (
 
 type Server interface {
 	Start()
+	// Shutdown stops accepting connections and waits for the requests in
+	// flight until ctx is done.
+	Shutdown(ctx context.Context) error
 }
 
 type server struct {
@@ -18,19 +23,46 @@ type server struct {
 func (s server) Start() {
 	go func() {
 		log.Println("Staring the HTTP server...")
-		err := s.httpServer.ListenAndServe()
+		var err error
+		if s.httpServer.TLSConfig != nil {
+			err = s.httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = s.httpServer.ListenAndServe()
+		}
+		if err == http.ErrServerClosed {
+			return
+		}
 		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
 	}()
 }
 
+func (s server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
 func CreateServer(port int, handler http.Handler) Server {
+	return CreateTLSServer(port, handler, nil)
+}
+
+// CreateTLSServer is CreateServer serving HTTPS with the certificates of
+// cfg, HTTP if cfg is nil.
+func CreateTLSServer(port int, handler http.Handler, cfg *tls.Config) Server {
 	return server{
 		httpServer: &http.Server{
 			Addr:           fmt.Sprintf(":%d", port),
 			Handler:        handler,
+			TLSConfig:      cfg,
 			ReadTimeout:    10 * time.Second,
 			WriteTimeout:   10 * time.Second,
 			MaxHeaderBytes: 1 << 20,
 		},
 	}
 }
+
+// CreateServerWithWriteTimeout is CreateServer whose responses may take up
+// to writeTimeout, for handlers that wait longer than the default allows.
+func CreateServerWithWriteTimeout(port int, handler http.Handler, writeTimeout time.Duration) Server {
+	s := CreateServer(port, handler).(server)
+	s.httpServer.WriteTimeout = writeTimeout
+	return s
+}
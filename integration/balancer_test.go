@@ -91,31 +91,3 @@ func TestBalancer(t *testing.T) {
 
   resp.Body.Close()
 }
-
-func BenchmarkBalancer(b *testing.B) {
-  var wg sync.WaitGroup
-  if _, exists := os.LookupEnv("INTEGRATION_TEST"); !exists {
-    b.Skip("Integration benchmark is not enabled")
-  }
-
-  reqCount := 1000
-  start := time.Now()
-
-  for n := 0; n < reqCount; n++ {
-    wg.Add(1)
-    go func() {
-      defer wg.Done()
-      resp, err := client.Get(fmt.Sprintf("%s/api/v1/some-data", baseAddress))
-      if err != nil {
-        b.Error(err)
-        return
-      }
-      resp.Body.Close()
-    }()
-  }
-  wg.Wait()
-
-  t := time.Now()
-  elapsed := t.Sub(start)
-  b.Logf("Processed %d requests in %v", reqCount, elapsed)
-}